@@ -0,0 +1,159 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+// BackupEntry is a file, directory or link inside a backup.
+type BackupEntry struct {
+	Path    string
+	Type    string
+	Size    int64
+	ModTime int64
+	Link    string
+}
+
+// BrowseBackup lists the entries of an archive or snapshot below dir, the
+// top level when empty. Without recursive only direct children are
+// returned. Archives are listed from their sidecar manifest when there is
+// one, so browsing does not read the whole archive.
+func (s Service) BrowseBackup(backupPath, dir string, recursive bool) ([]BackupEntry, error) {
+	entries, err := s.backupEntries(backupPath)
+	if err != nil {
+		return nil, err
+	}
+	return browseEntries(entries, entryPath(dir), recursive), nil
+}
+
+func (s Service) backupEntries(backupPath string) ([]BackupEntry, error) {
+	var entries []BackupEntry
+
+	if id, ok := snapshotID(backupPath); ok {
+		repository, err := s.snapshotRepository()
+		if err != nil {
+			return nil, err
+		}
+		snapshot, err := repository.loadSnapshot(id)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range snapshot.Files {
+			entries = append(entries, BackupEntry{
+				Path:    entryPath(file.Path),
+				Type:    file.Type,
+				Size:    file.Size,
+				ModTime: file.ModTime.Unix(),
+				Link:    file.Link,
+			})
+		}
+		return entries, nil
+	}
+
+	archive, sidecar, err := s.openArchive(backupPath)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+
+	if sidecar != nil {
+		for _, file := range sidecar.Files {
+			entries = append(entries, BackupEntry{
+				Path:    entryPath(file.Path),
+				Type:    file.Type,
+				Size:    file.Size,
+				ModTime: file.ModTime,
+				Link:    file.Link,
+			})
+		}
+		return entries, nil
+	}
+
+	plaintext, err := s.encryption.open(archive)
+	if err != nil {
+		return nil, err
+	}
+	gzipReader, err := gzip.NewReader(plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gzip reader: %v", err)
+	}
+	defer gzipReader.Close()
+
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tar header: %v", err)
+		}
+		if header.Name == manifestEntryName {
+			continue
+		}
+		entries = append(entries, BackupEntry{
+			Path:    entryPath(header.Name),
+			Type:    manifestFileType(header.Typeflag),
+			Size:    header.Size,
+			ModTime: header.ModTime.Unix(),
+			Link:    header.Linkname,
+		})
+	}
+	return entries, nil
+}
+
+// browseEntries selects the entries below dir. Directories that only appear
+// as parents of deeper entries are added, so partial archives still browse
+// as a tree.
+func browseEntries(entries []BackupEntry, dir string, recursive bool) []BackupEntry {
+	prefix := ""
+	if dir != "" {
+		prefix = dir + "/"
+	}
+
+	selected := make(map[string]BackupEntry)
+	for _, entry := range entries {
+		if entry.Path == "" || !strings.HasPrefix(entry.Path, prefix) {
+			continue
+		}
+		if recursive {
+			selected[entry.Path] = entry
+			continue
+		}
+
+		rest := strings.TrimPrefix(entry.Path, prefix)
+		if i := strings.Index(rest, "/"); i >= 0 {
+			child := prefix + rest[:i]
+			if _, ok := selected[child]; !ok {
+				selected[child] = BackupEntry{Path: child, Type: "dir"}
+			}
+			continue
+		}
+		selected[entry.Path] = entry
+	}
+
+	if recursive {
+		// Fill in parents missing from the archive
+		for name := range selected {
+			for parent := path.Dir(name); parent != "." && parent != dir; parent = path.Dir(parent) {
+				if _, ok := selected[parent]; !ok {
+					selected[parent] = BackupEntry{Path: parent, Type: "dir"}
+				}
+			}
+		}
+	}
+
+	result := make([]BackupEntry, 0, len(selected))
+	for _, entry := range selected {
+		result = append(result, entry)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Path < result[j].Path
+	})
+	return result
+}
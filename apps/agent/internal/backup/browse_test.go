@@ -0,0 +1,93 @@
+package backup
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBrowseEntries(t *testing.T) {
+	entries := []BackupEntry{
+		{Path: "", Type: "dir"},
+		{Path: "index.php", Type: "file", Size: 10},
+		{Path: "public", Type: "dir"},
+		{Path: "public/style.css", Type: "file", Size: 20},
+		{Path: "public/img/logo.png", Type: "file", Size: 30},
+		// Partial archives can lack the directories above an entry
+		{Path: "wp-content/uploads/a.jpg", Type: "file", Size: 40},
+		{Path: "link", Type: "symlink", Link: "public"},
+	}
+
+	tests := []struct {
+		name      string
+		dir       string
+		recursive bool
+		want      []string
+	}{
+		{
+			name: "top level",
+			want: []string{"index.php", "link", "public", "wp-content"},
+		},
+		{
+			name: "subdirectory",
+			dir:  "public",
+			want: []string{"public/img", "public/style.css"},
+		},
+		{
+			name: "missing directory",
+			dir:  "wp-content",
+			want: []string{"wp-content/uploads"},
+		},
+		{
+			name:      "recursive",
+			recursive: true,
+			want: []string{
+				"index.php", "link", "public", "public/img", "public/img/logo.png",
+				"public/style.css", "wp-content", "wp-content/uploads", "wp-content/uploads/a.jpg",
+			},
+		},
+		{
+			name:      "recursive subdirectory",
+			dir:       "wp-content",
+			recursive: true,
+			want:      []string{"wp-content/uploads", "wp-content/uploads/a.jpg"},
+		},
+		{
+			// Not a prefix match on the name
+			name: "sibling with a common prefix",
+			dir:  "pub",
+			want: []string{},
+		},
+		{
+			name: "file",
+			dir:  "index.php",
+			want: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := browseEntries(entries, entryPath(tt.dir), tt.recursive)
+			paths := make([]string, 0, len(got))
+			for _, entry := range got {
+				paths = append(paths, entry.Path)
+			}
+			if !reflect.DeepEqual(paths, tt.want) {
+				t.Errorf("got %q, want %q", paths, tt.want)
+			}
+		})
+	}
+
+	// Listed entries keep their details; added parents are directories
+	got := browseEntries(entries, "", false)
+	want := []BackupEntry{
+		{Path: "index.php", Type: "file", Size: 10},
+		{Path: "link", Type: "symlink", Link: "public"},
+		{Path: "public", Type: "dir"},
+		{Path: "wp-content", Type: "dir"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if got := browseEntries(entries, "public", false); got[0] != (BackupEntry{Path: "public/img", Type: "dir"}) {
+		t.Errorf("implied directory %+v", got[0])
+	}
+}
@@ -0,0 +1,125 @@
+package backup
+
+import "io"
+
+// Chunk size bounds for content-defined chunking. Cut points depend only on
+// the bytes around them, so an insertion early in a file only changes the
+// chunks next to it and everything else still deduplicates.
+const (
+	minChunkSize = 512 * 1024
+	avgChunkSize = 1024 * 1024
+	maxChunkSize = 8 * 1024 * 1024
+)
+
+// Normalized chunking: a stricter mask below the average size and a looser
+// one above it keeps chunk sizes close to avgChunkSize. The gear hash
+// shifts left, so the high bits carry the most history.
+const (
+	chunkMaskSmall uint64 = ((1 << 22) - 1) << (64 - 22)
+	chunkMaskLarge uint64 = ((1 << 18) - 1) << (64 - 18)
+)
+
+// gearTable must never change: existing repositories depend on the cut
+// points it produces.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	seed := uint64(0x6a09e667f3bcc908)
+	for i := range table {
+		// splitmix64
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// chunker splits a stream into content-defined chunks. Its buffer is reused
+// across files with reset.
+type chunker struct {
+	reader io.Reader
+	buf    []byte
+	start  int
+	end    int
+	eof    bool
+}
+
+func newChunker() *chunker {
+	return &chunker{buf: make([]byte, maxChunkSize)}
+}
+
+func (c *chunker) reset(r io.Reader) {
+	c.reader = r
+	c.start = 0
+	c.end = 0
+	c.eof = false
+}
+
+// Next returns the next chunk, or io.EOF at the end of the stream. The
+// returned slice is only valid until the following call.
+func (c *chunker) Next() ([]byte, error) {
+	if c.end-c.start < maxChunkSize && !c.eof {
+		if err := c.fill(); err != nil {
+			return nil, err
+		}
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	n := cutPoint(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
+
+func (c *chunker) fill() error {
+	copy(c.buf, c.buf[c.start:c.end])
+	c.end -= c.start
+	c.start = 0
+
+	for c.end < len(c.buf) {
+		n, err := c.reader.Read(c.buf[c.end:])
+		c.end += n
+		if err == io.EOF {
+			c.eof = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cutPoint returns the length of the first chunk in data.
+func cutPoint(data []byte) int {
+	n := len(data)
+	if n <= minChunkSize {
+		return n
+	}
+	if n > maxChunkSize {
+		n = maxChunkSize
+	}
+	normal := avgChunkSize
+	if normal > n {
+		normal = n
+	}
+
+	var fingerprint uint64
+	i := minChunkSize
+	for ; i < normal; i++ {
+		fingerprint = (fingerprint << 1) + gearTable[data[i]]
+		if fingerprint&chunkMaskSmall == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fingerprint = (fingerprint << 1) + gearTable[data[i]]
+		if fingerprint&chunkMaskLarge == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
@@ -0,0 +1,122 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/iotest"
+)
+
+func randomData(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// chunkAll returns the chunks of r as copies.
+func chunkAll(t *testing.T, r io.Reader) [][]byte {
+	t.Helper()
+	c := newChunker()
+	c.reset(r)
+	var chunks [][]byte
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, append([]byte(nil), chunk...))
+	}
+}
+
+func chunkLengths(chunks [][]byte) []int {
+	lengths := make([]int, len(chunks))
+	for i, chunk := range chunks {
+		lengths[i] = len(chunk)
+	}
+	return lengths
+}
+
+func checkChunkSizes(t *testing.T, chunks [][]byte) {
+	t.Helper()
+	for i, chunk := range chunks {
+		last := i == len(chunks)-1
+		if len(chunk) > maxChunkSize || len(chunk) == 0 || (!last && len(chunk) < minChunkSize) {
+			t.Errorf("chunk %d of %d is %d bytes", i, len(chunks), len(chunk))
+		}
+	}
+}
+
+func TestChunkerBoundaries(t *testing.T) {
+	data := randomData(1, 24*1024*1024)
+
+	chunks := chunkAll(t, bytes.NewReader(data))
+	checkChunkSizes(t, chunks)
+	if got := bytes.Join(chunks, nil); !bytes.Equal(got, data) {
+		t.Fatal("chunks do not add up to the input")
+	}
+	if len(chunks) < 10 {
+		t.Errorf("only %d chunks for %d bytes", len(chunks), len(data))
+	}
+
+	// Boundaries depend on the content, not on how it is read
+	again := chunkAll(t, iotest.HalfReader(bytes.NewReader(data)))
+	if a, b := chunkLengths(chunks), chunkLengths(again); !reflect.DeepEqual(a, b) {
+		t.Errorf("chunked again as %v, was %v", b, a)
+	}
+}
+
+func TestChunkerResync(t *testing.T) {
+	data := randomData(2, 24*1024*1024)
+	chunks := chunkAll(t, bytes.NewReader(data))
+
+	stored := make(map[[32]byte]bool)
+	for _, chunk := range chunks {
+		stored[sha256.Sum256(chunk)] = true
+	}
+
+	// Bytes inserted in the middle only change the chunks around them
+	offset := 5*1024*1024 + 123
+	edited := append(append(append([]byte(nil), data[:offset]...), []byte("inserted bytes")...), data[offset:]...)
+	changed := 0
+	for _, chunk := range chunkAll(t, bytes.NewReader(edited)) {
+		if !stored[sha256.Sum256(chunk)] {
+			changed++
+		}
+	}
+	if changed == 0 || changed > 2 {
+		t.Errorf("%d of %d chunks changed after an insertion", changed, len(chunks))
+	}
+}
+
+func TestChunkerSizeLimits(t *testing.T) {
+	// Content without cut points is split at the maximum size
+	zeros := make([]byte, 2*maxChunkSize+100)
+	lengths := chunkLengths(chunkAll(t, bytes.NewReader(zeros)))
+	if want := []int{maxChunkSize, maxChunkSize, 100}; !reflect.DeepEqual(lengths, want) {
+		t.Errorf("zeros chunked as %v, want %v", lengths, want)
+	}
+
+	// Short content is a single chunk
+	small := randomData(3, minChunkSize)
+	if lengths := chunkLengths(chunkAll(t, bytes.NewReader(small))); !reflect.DeepEqual(lengths, []int{minChunkSize}) {
+		t.Errorf("%d bytes chunked as %v", minChunkSize, lengths)
+	}
+	if chunks := chunkAll(t, bytes.NewReader(nil)); len(chunks) != 0 {
+		t.Errorf("empty input gave %d chunks", len(chunks))
+	}
+
+	// No cut before the minimum size
+	data := randomData(4, 4*maxChunkSize)
+	for start := 0; start < len(data)-minChunkSize; start += 3 * minChunkSize / 2 {
+		n := cutPoint(data[start:])
+		if n < minChunkSize || n > maxChunkSize {
+			t.Errorf("cut at %d bytes from offset %d", n, start)
+		}
+	}
+}
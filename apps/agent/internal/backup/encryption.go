@@ -0,0 +1,123 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+// encryptedSuffix is appended to archive names written with encryption on.
+const encryptedSuffix = ".age"
+
+var ageHeader = []byte("age-encryption.org/v1\n")
+
+// chunkKeyLabel separates the chunk ID key from any other use of the
+// identity.
+const chunkKeyLabel = "hosting-panel-agent backup chunk id"
+
+type EncryptionConfig struct {
+	Enabled bool
+	// Recipients are age public keys (age1...) that can decrypt backups,
+	// such as the control plane's recovery key.
+	Recipients []string
+	// IdentityFile holds this server's age private key. Its public key is
+	// always added as a recipient so the agent can restore its own backups.
+	IdentityFile string
+}
+
+// encryption holds the parsed keys used to seal and open archives.
+type encryption struct {
+	enabled    bool
+	recipients []age.Recipient
+	identities []age.Identity
+	// chunkKey keys repository chunk IDs so that they do not reveal the
+	// hash of the plaintext. It is derived from the first identity.
+	chunkKey []byte
+}
+
+func newEncryption(config EncryptionConfig) (*encryption, error) {
+	e := &encryption{enabled: config.Enabled}
+
+	if config.IdentityFile != "" {
+		data, err := os.ReadFile(config.IdentityFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read backup identity: %v", err)
+		}
+		identities, err := age.ParseIdentities(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse backup identity: %v", err)
+		}
+		e.identities = identities
+
+		for _, identity := range identities {
+			if x25519, ok := identity.(*age.X25519Identity); ok {
+				e.recipients = append(e.recipients, x25519.Recipient())
+				if e.chunkKey == nil {
+					mac := hmac.New(sha256.New, []byte(x25519.String()))
+					mac.Write([]byte(chunkKeyLabel))
+					e.chunkKey = mac.Sum(nil)
+				}
+			}
+		}
+	}
+
+	for _, key := range config.Recipients {
+		recipient, err := age.ParseX25519Recipient(strings.TrimSpace(key))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse backup recipient %q: %v", key, err)
+		}
+		e.recipients = append(e.recipients, recipient)
+	}
+
+	if e.enabled && len(e.recipients) == 0 {
+		return nil, fmt.Errorf("backup encryption is enabled but no recipients are configured")
+	}
+
+	return e, nil
+}
+
+// seal wraps w so that everything written is encrypted to all recipients.
+// The returned writer must be closed to flush the final chunk.
+func (e *encryption) seal(w io.Writer) (io.WriteCloser, error) {
+	encrypted, err := age.Encrypt(w, e.recipients...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start encryption: %v", err)
+	}
+	return encrypted, nil
+}
+
+// open returns a reader over the plaintext of r, decrypting transparently
+// when r starts with an age header, binary or armored.
+func (e *encryption) open(r io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(r)
+
+	peek, _ := buffered.Peek(len(armor.Header))
+	switch {
+	case bytes.HasPrefix(peek, ageHeader):
+		return e.decrypt(buffered)
+	case bytes.HasPrefix(peek, []byte(armor.Header)):
+		return e.decrypt(armor.NewReader(buffered))
+	}
+
+	return buffered, nil
+}
+
+func (e *encryption) decrypt(r io.Reader) (io.Reader, error) {
+	if len(e.identities) == 0 {
+		return nil, fmt.Errorf("backup is encrypted but no identity file is configured")
+	}
+
+	plaintext, err := age.Decrypt(r, e.identities...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt backup: %v", err)
+	}
+	return plaintext, nil
+}
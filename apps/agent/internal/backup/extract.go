@@ -0,0 +1,474 @@
+package backup
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// extractor unpacks a tar stream under root. Every entry is confined to
+// root: names that escape it, symlinks pointing outside it and writes
+// through symlinked directories are rejected.
+type extractor struct {
+	root          string
+	preserveOwner bool
+	dirTimes      []dirTime
+	options       RestoreOptions
+	startedAt     time.Time
+	// written maps restored archive names to where they were written, so
+	// hard links follow renamed files and skip unrestored ones.
+	written map[string]string
+	result  RestoreResult
+}
+
+type dirTime struct {
+	path    string
+	modTime time.Time
+}
+
+func newExtractor(targetPath string, options RestoreOptions) (*extractor, error) {
+	if err := os.MkdirAll(targetPath, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create target directory: %v", err)
+	}
+
+	root, err := filepath.Abs(targetPath)
+	if err != nil {
+		return nil, err
+	}
+	// The target itself may legitimately be a symlink, e.g. /var/www -> /srv/www
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+
+	return &extractor{
+		root:          root,
+		preserveOwner: os.Geteuid() == 0,
+		options:       options,
+		startedAt:     time.Now(),
+		written:       make(map[string]string),
+		result:        RestoreResult{Path: root},
+	}, nil
+}
+
+// extractAll reads every entry from tarReader and restores it.
+func (x *extractor) extractAll(tarReader *tar.Reader) error {
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tar header: %v", err)
+		}
+
+		if header.Name == manifestEntryName {
+			continue
+		}
+
+		if err := x.extract(header, tarReader); err != nil {
+			return fmt.Errorf("%s: %v", header.Name, err)
+		}
+	}
+
+	return x.finish()
+}
+
+// resolve maps an archive name onto a path inside root.
+func (x *extractor) resolve(name string) (string, error) {
+	name = filepath.FromSlash(name)
+	if filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", fmt.Errorf("illegal absolute path in archive")
+	}
+
+	path := filepath.Join(x.root, name)
+	if !x.within(path) {
+		return "", fmt.Errorf("illegal path escapes restore target")
+	}
+	return path, nil
+}
+
+func (x *extractor) within(path string) bool {
+	rel, err := filepath.Rel(x.root, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// maxLinkDepth bounds the symlinks followed to resolve one target, as the
+// kernel does.
+const maxLinkDepth = 40
+
+// followLink resolves a symlink target from dir against what is on disk,
+// following the symlinks already there, and fails if it leaves root. It
+// returns where the target points. Once the walk has passed through a
+// symlink or a name that does not exist yet, later entries may replace what
+// it passes through, so ".." is refused from there on.
+func (x *extractor) followLink(dir, target string, depth int) (string, error) {
+	if depth > maxLinkDepth {
+		return "", fmt.Errorf("too many levels of symlinks")
+	}
+
+	current := dir
+	target = filepath.FromSlash(target)
+	if filepath.IsAbs(target) {
+		target = filepath.Clean(target)
+		if !x.within(target) {
+			return "", fmt.Errorf("escapes restore target")
+		}
+		// root has no symlinks left in it, see newExtractor
+		rel, err := filepath.Rel(x.root, target)
+		if err != nil {
+			return "", err
+		}
+		current, target = x.root, rel
+	}
+
+	unstable := false
+	for _, part := range strings.Split(target, string(filepath.Separator)) {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if unstable {
+				return "", fmt.Errorf("refusing .. after a symlink or missing directory")
+			}
+			current = filepath.Dir(current)
+			if !x.within(current) {
+				return "", fmt.Errorf("escapes restore target")
+			}
+			continue
+		}
+
+		next := filepath.Join(current, part)
+		if unstable {
+			current = next
+			continue
+		}
+
+		info, err := os.Lstat(next)
+		if os.IsNotExist(err) {
+			current, unstable = next, true
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+
+		link, err := os.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		current, err = x.followLink(current, link, depth+1)
+		if err != nil {
+			return "", err
+		}
+		unstable = true
+	}
+
+	return current, nil
+}
+
+// prepareParent creates the parent directories of path, refusing to descend
+// through any component that is a symlink.
+func (x *extractor) prepareParent(path string) error {
+	rel, err := filepath.Rel(x.root, filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	if rel == "." {
+		return nil
+	}
+
+	current := x.root
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		current = filepath.Join(current, part)
+
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			if err := os.Mkdir(current, 0755); err != nil {
+				return fmt.Errorf("failed to create parent directory: %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("refusing to write through symlink %s", current)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("parent %s is not a directory", current)
+		}
+	}
+
+	return nil
+}
+
+// checkParents verifies that no existing directory between root and path
+// is a symlink.
+func (x *extractor) checkParents(path string) error {
+	rel, err := filepath.Rel(x.root, filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	if rel == "." {
+		return nil
+	}
+
+	current := x.root
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		current = filepath.Join(current, part)
+
+		info, err := os.Lstat(current)
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("refusing to follow symlink %s", current)
+		}
+	}
+
+	return nil
+}
+
+// place applies the conflict policy to a non-directory entry at path. It
+// returns where to write the entry, or "" to skip it.
+func (x *extractor) place(path string) (string, error) {
+	if x.options.Conflict != conflictSkip && x.options.Conflict != conflictRename {
+		return path, nil
+	}
+
+	_, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return path, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if x.options.Conflict == conflictSkip {
+		return "", nil
+	}
+
+	x.result.Renamed++
+	return renamedPath(path, x.startedAt), nil
+}
+
+// clear removes whatever non-directory currently occupies path, so that
+// new files never write through an existing symlink.
+func (x *extractor) clear(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("a directory already exists at %s", path)
+	}
+	return os.Remove(path)
+}
+
+func (x *extractor) extract(header *tar.Header, r io.Reader) error {
+	// Entries that are not written still count towards progress
+	copied := false
+	defer func() {
+		if !copied && header.Typeflag == tar.TypeReg {
+			x.options.job.addBytes(header.Size)
+		}
+		x.options.job.addFile()
+	}()
+
+	if !x.options.selects(header.Name, header.Typeflag == tar.TypeDir) {
+		x.result.Skipped++
+		return nil
+	}
+
+	path, err := x.resolve(header.Name)
+	if err != nil {
+		return err
+	}
+	if path == x.root && header.Typeflag != tar.TypeDir {
+		return fmt.Errorf("illegal entry for restore target root")
+	}
+
+	if err := x.prepareParent(path); err != nil {
+		return err
+	}
+
+	if header.Typeflag == tar.TypeLink && x.options.partial() {
+		if _, ok := x.written[entryPath(header.Linkname)]; !ok {
+			// The file it links to was not restored
+			x.result.Skipped++
+			return nil
+		}
+	}
+
+	if header.Typeflag != tar.TypeDir {
+		path, err = x.place(path)
+		if err != nil {
+			return err
+		}
+		if path == "" {
+			x.result.Skipped++
+			return nil
+		}
+		x.written[entryPath(header.Name)] = path
+		x.result.Restored++
+	}
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		info, err := os.Lstat(path)
+		switch {
+		case os.IsNotExist(err):
+			if err := os.Mkdir(path, 0755); err != nil {
+				return fmt.Errorf("failed to create directory: %v", err)
+			}
+		case err != nil:
+			return err
+		case !info.IsDir():
+			return fmt.Errorf("a non-directory already exists at %s", path)
+		case x.options.Conflict == conflictSkip:
+			// Existing directories keep their ownership and permissions
+			return nil
+		}
+
+		if err := x.setOwnerAndMode(path, header); err != nil {
+			return err
+		}
+		// Directory times are set last; extracting children changes them
+		x.dirTimes = append(x.dirTimes, dirTime{path: path, modTime: header.ModTime})
+
+	case tar.TypeReg, tar.TypeRegA:
+		if err := x.clear(path); err != nil {
+			return err
+		}
+
+		// O_EXCL guarantees we create a fresh file rather than follow a
+		// symlink that appeared since clear
+		outFile, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to create file: %v", err)
+		}
+
+		copied = true
+		_, err = io.Copy(outFile, progressReader{reader: r, job: x.options.job})
+		closeErr := outFile.Close()
+		if err != nil {
+			return fmt.Errorf("failed to copy file content: %v", err)
+		}
+		if closeErr != nil {
+			return fmt.Errorf("failed to write file: %v", closeErr)
+		}
+
+		if err := x.setOwnerAndMode(path, header); err != nil {
+			return err
+		}
+		if err := os.Chtimes(path, header.ModTime, header.ModTime); err != nil {
+			return fmt.Errorf("failed to set file times: %v", err)
+		}
+
+	case tar.TypeSymlink:
+		target := header.Linkname
+		if _, err := x.followLink(filepath.Dir(path), target, 0); err != nil {
+			return fmt.Errorf("symlink target %s: %v", target, err)
+		}
+
+		if err := x.clear(path); err != nil {
+			return err
+		}
+		if err := os.Symlink(target, path); err != nil {
+			return fmt.Errorf("failed to create symlink: %v", err)
+		}
+		if x.preserveOwner {
+			if err := os.Lchown(path, header.Uid, header.Gid); err != nil {
+				return fmt.Errorf("failed to set ownership: %v", err)
+			}
+		}
+
+	case tar.TypeLink:
+		source, ok := x.written[entryPath(header.Linkname)]
+		if !ok {
+			source, err = x.resolve(header.Linkname)
+			if err != nil {
+				return err
+			}
+		}
+		if err := x.checkParents(source); err != nil {
+			return err
+		}
+		info, err := os.Lstat(source)
+		if err != nil {
+			return fmt.Errorf("hard link source missing: %v", err)
+		}
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("hard link source %s is not a regular file", header.Linkname)
+		}
+
+		if err := x.clear(path); err != nil {
+			return err
+		}
+		if err := os.Link(source, path); err != nil {
+			return fmt.Errorf("failed to create hard link: %v", err)
+		}
+
+	default:
+		// Devices, FIFOs and sockets have no place in a site backup
+	}
+
+	return nil
+}
+
+// setOwnerAndMode applies ownership before permissions, since chown clears
+// setuid and setgid bits.
+func (x *extractor) setOwnerAndMode(path string, header *tar.Header) error {
+	if x.preserveOwner {
+		if err := os.Lchown(path, header.Uid, header.Gid); err != nil {
+			return fmt.Errorf("failed to set ownership: %v", err)
+		}
+	}
+	if err := os.Chmod(path, x.mode(header)); err != nil {
+		return fmt.Errorf("failed to set permissions: %v", err)
+	}
+	return nil
+}
+
+// mode returns the permissions to apply. setuid, setgid and sticky bits are
+// only kept when restoring as root.
+func (x *extractor) mode(header *tar.Header) os.FileMode {
+	mode := os.FileMode(header.Mode) & os.ModePerm
+	if x.preserveOwner {
+		if header.Mode&04000 != 0 {
+			mode |= os.ModeSetuid
+		}
+		if header.Mode&02000 != 0 {
+			mode |= os.ModeSetgid
+		}
+		if header.Mode&01000 != 0 {
+			mode |= os.ModeSticky
+		}
+	}
+	return mode
+}
+
+// finish applies directory modification times, deepest first.
+func (x *extractor) finish() error {
+	for i := len(x.dirTimes) - 1; i >= 0; i-- {
+		dir := x.dirTimes[i]
+		if err := os.Chtimes(dir.path, dir.modTime, dir.modTime); err != nil {
+			return fmt.Errorf("failed to set directory times: %v", err)
+		}
+	}
+	return nil
+}
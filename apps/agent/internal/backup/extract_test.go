@@ -0,0 +1,245 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const secretContent = "secret"
+
+func buildTar(t testing.TB, headers []tar.Header) *tar.Reader {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, header := range headers {
+		header := header
+		if header.Mode == 0 {
+			header.Mode = 0644
+		}
+		if header.Typeflag == tar.TypeReg {
+			header.Size = int64(len("data"))
+		}
+		if err := tw.WriteHeader(&header); err != nil {
+			t.Fatalf("failed to write header %s: %v", header.Name, err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			tw.Write([]byte("data"))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return tar.NewReader(&buf)
+}
+
+// extractInto restores headers under <dir>/root next to <dir>/secret and
+// returns the restore root.
+func extractInto(t testing.TB, dir string, headers []tar.Header) (string, error) {
+	if err := os.WriteFile(filepath.Join(dir, "secret"), []byte(secretContent), 0600); err != nil {
+		t.Fatal(err)
+	}
+	x, err := newExtractor(filepath.Join(dir, "root"), RestoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return x.root, x.extractAll(buildTar(t, headers))
+}
+
+// checkConfined fails if anything outside root was created or changed, or
+// if a path under root resolves outside it.
+func checkConfined(t testing.TB, dir, root string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.Name() != "root" && entry.Name() != "secret" {
+			t.Errorf("%s was created outside the restore target", entry.Name())
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "secret")); err != nil || string(data) != secretContent {
+		t.Errorf("file outside the restore target changed: %q, %v", data, err)
+	}
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		resolved, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			// Dangling or looping symlinks point nowhere
+			return nil
+		}
+		if resolved != realRoot && !strings.HasPrefix(resolved, realRoot+string(filepath.Separator)) {
+			t.Errorf("%s resolves outside the restore target to %s", path, resolved)
+		}
+		if info.Mode()&(os.ModeDevice|os.ModeCharDevice|os.ModeNamedPipe|os.ModeSocket) != 0 {
+			t.Errorf("special file %s was created", path)
+		}
+		return nil
+	})
+}
+
+func TestExtractRejectsMaliciousArchives(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []tar.Header
+	}{
+		{"zip slip", []tar.Header{
+			{Name: "../secret", Typeflag: tar.TypeReg},
+		}},
+		{"nested zip slip", []tar.Header{
+			{Name: "a/b/../../../x", Typeflag: tar.TypeReg},
+		}},
+		{"absolute path", []tar.Header{
+			{Name: "/tmp/x", Typeflag: tar.TypeReg},
+		}},
+		{"absolute symlink outside", []tar.Header{
+			{Name: "l", Typeflag: tar.TypeSymlink, Linkname: "/etc"},
+		}},
+		{"relative symlink outside", []tar.Header{
+			{Name: "a/", Typeflag: tar.TypeDir},
+			{Name: "a/l", Typeflag: tar.TypeSymlink, Linkname: "../../secret"},
+		}},
+		{"write through symlinked directory", []tar.Header{
+			{Name: "l", Typeflag: tar.TypeSymlink, Linkname: "."},
+			{Name: "l/x", Typeflag: tar.TypeReg},
+		}},
+		{"symlink through earlier symlink", []tar.Header{
+			{Name: "s", Typeflag: tar.TypeSymlink, Linkname: "."},
+			{Name: "l", Typeflag: tar.TypeSymlink, Linkname: "s/../secret"},
+		}},
+		{"symlink through later symlink", []tar.Header{
+			{Name: "l", Typeflag: tar.TypeSymlink, Linkname: "s/../secret"},
+			{Name: "s", Typeflag: tar.TypeSymlink, Linkname: "."},
+		}},
+		{"symlink chain", []tar.Header{
+			{Name: "a/", Typeflag: tar.TypeDir},
+			{Name: "a/b/", Typeflag: tar.TypeDir},
+			{Name: "a/b/up", Typeflag: tar.TypeSymlink, Linkname: ".."},
+			{Name: "a/l", Typeflag: tar.TypeSymlink, Linkname: "b/up/../../secret"},
+		}},
+		{"replaced symlink", []tar.Header{
+			{Name: "sub/", Typeflag: tar.TypeDir},
+			{Name: "sub/deep/", Typeflag: tar.TypeDir},
+			{Name: "s", Typeflag: tar.TypeSymlink, Linkname: "sub/deep"},
+			{Name: "l", Typeflag: tar.TypeSymlink, Linkname: "s/../../secret"},
+			{Name: "s", Typeflag: tar.TypeSymlink, Linkname: "."},
+		}},
+		{"symlink loop", []tar.Header{
+			{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "b"},
+			{Name: "b", Typeflag: tar.TypeSymlink, Linkname: "a"},
+			{Name: "l", Typeflag: tar.TypeSymlink, Linkname: "a/x"},
+		}},
+		{"hard link outside", []tar.Header{
+			{Name: "h", Typeflag: tar.TypeLink, Linkname: "../secret"},
+		}},
+		{"hard link absolute", []tar.Header{
+			{Name: "h", Typeflag: tar.TypeLink, Linkname: "/etc/passwd"},
+		}},
+		{"hard link through symlink", []tar.Header{
+			{Name: "s", Typeflag: tar.TypeSymlink, Linkname: "."},
+			{Name: "h", Typeflag: tar.TypeLink, Linkname: "s/../secret"},
+		}},
+		{"hard link to symlink", []tar.Header{
+			{Name: "s", Typeflag: tar.TypeSymlink, Linkname: "missing"},
+			{Name: "h", Typeflag: tar.TypeLink, Linkname: "s"},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			root, err := extractInto(t, dir, tt.headers)
+			if err == nil {
+				t.Error("expected the archive to be rejected")
+			}
+			checkConfined(t, dir, root)
+		})
+	}
+}
+
+func TestExtractSkipsDeviceNodes(t *testing.T) {
+	dir := t.TempDir()
+	root, err := extractInto(t, dir, []tar.Header{
+		{Name: "null", Typeflag: tar.TypeChar, Devmajor: 1, Devminor: 3},
+		{Name: "sda", Typeflag: tar.TypeBlock, Devmajor: 8},
+		{Name: "fifo", Typeflag: tar.TypeFifo},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"null", "sda", "fifo"} {
+		if _, err := os.Lstat(filepath.Join(root, name)); !os.IsNotExist(err) {
+			t.Errorf("%s was created", name)
+		}
+	}
+	checkConfined(t, dir, root)
+}
+
+func TestExtractKeepsLinksWithinTarget(t *testing.T) {
+	dir := t.TempDir()
+	root, err := extractInto(t, dir, []tar.Header{
+		{Name: "releases/", Typeflag: tar.TypeDir},
+		{Name: "releases/1/", Typeflag: tar.TypeDir},
+		{Name: "shared/", Typeflag: tar.TypeDir},
+		{Name: "shared/config", Typeflag: tar.TypeReg},
+		{Name: "releases/1/config", Typeflag: tar.TypeSymlink, Linkname: "../../shared/config"},
+		{Name: "current", Typeflag: tar.TypeSymlink, Linkname: "releases/1"},
+		{Name: "config", Typeflag: tar.TypeSymlink, Linkname: "current/config"},
+		{Name: "absolute", Typeflag: tar.TypeSymlink, Linkname: filepath.Join(dir, "root", "shared")},
+		{Name: "hard", Typeflag: tar.TypeLink, Linkname: "shared/config"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"config", "absolute/config", "hard"} {
+		if data, err := os.ReadFile(filepath.Join(root, name)); err != nil || string(data) != "data" {
+			t.Errorf("%s: %q, %v", name, data, err)
+		}
+	}
+	checkConfined(t, dir, root)
+}
+
+var fuzzTypes = []byte{tar.TypeReg, tar.TypeDir, tar.TypeSymlink, tar.TypeLink, tar.TypeChar, tar.TypeFifo}
+
+func FuzzExtract(f *testing.F) {
+	f.Add("s", ".", byte(2), "l", "s/../secret", byte(2), "l/x", "", byte(0))
+	f.Add("l", "s/../secret", byte(2), "s", ".", byte(2), "l", "", byte(0))
+	f.Add("a/", "", byte(1), "a/l", "../../secret", byte(2), "h", "../secret", byte(3))
+	f.Add("../x", "", byte(0), "/x", "", byte(0), "d", "", byte(4))
+
+	f.Fuzz(func(t *testing.T, name1, link1 string, type1 byte, name2, link2 string, type2 byte, name3, link3 string, type3 byte) {
+		var headers []tar.Header
+		for _, entry := range []struct {
+			name, link string
+			typ        byte
+		}{{name1, link1, type1}, {name2, link2, type2}, {name3, link3, type3}} {
+			if entry.name == "" || strings.ContainsRune(entry.name, 0) || strings.ContainsRune(entry.link, 0) {
+				continue
+			}
+			header := tar.Header{
+				Name:     entry.name,
+				Linkname: entry.link,
+				Typeflag: fuzzTypes[int(entry.typ)%len(fuzzTypes)],
+			}
+			// Leave out names archive/tar cannot encode
+			if err := tar.NewWriter(io.Discard).WriteHeader(&header); err != nil {
+				continue
+			}
+			headers = append(headers, header)
+		}
+
+		dir := t.TempDir()
+		root, _ := extractInto(t, dir, headers)
+		checkConfined(t, dir, root)
+	})
+}
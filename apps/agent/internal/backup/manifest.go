@@ -0,0 +1,297 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// manifestEntryName is the last entry of every archive. It is skipped on
+// restore.
+const manifestEntryName = ".backup-manifest.json"
+
+// manifestSuffix names the sidecar manifest stored next to each archive. The
+// sidecar additionally records the checksum of the archive itself.
+const manifestSuffix = ".manifest.json"
+
+const manifestVersion = 1
+
+// Manifest records what went into a backup so it can be verified later.
+type Manifest struct {
+	Version       int            `json:"version"`
+	Name          string         `json:"name"`
+	Type          string         `json:"type"`
+	SourcePath    string         `json:"source_path"`
+	AgentVersion  string         `json:"agent_version"`
+	StartedAt     int64          `json:"started_at"`
+	CompletedAt   int64          `json:"completed_at"`
+	Encrypted     bool           `json:"encrypted"`
+	ArchiveSize   int64          `json:"archive_size,omitempty"`
+	ArchiveSHA256 string         `json:"archive_sha256,omitempty"`
+	Files         []ManifestFile `json:"files"`
+	// Warnings lists entries that were skipped or only partly read.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+type ManifestFile struct {
+	Path    string `json:"path"`
+	Type    string `json:"type"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mod_time"`
+	SHA256  string `json:"sha256,omitempty"`
+	Link    string `json:"link,omitempty"`
+}
+
+// manifestTotals returns the number of entries and bytes in an archive.
+func manifestTotals(manifest *Manifest) (int64, int64) {
+	var bytes int64
+	for _, file := range manifest.Files {
+		bytes += file.Size
+	}
+	return int64(len(manifest.Files)), bytes
+}
+
+// VerifyResult is the outcome of checking an archive against its manifest.
+type VerifyResult struct {
+	Valid        bool
+	FilesChecked int
+	Problems     []string
+}
+
+func manifestFileType(typeflag byte) string {
+	switch typeflag {
+	case tar.TypeDir:
+		return "dir"
+	case tar.TypeSymlink:
+		return "symlink"
+	case tar.TypeLink:
+		return "hardlink"
+	case tar.TypeReg, tar.TypeRegA:
+		return "file"
+	}
+	return "other"
+}
+
+// hashingWriter computes the SHA-256 and size of everything written through it.
+type hashingWriter struct {
+	writer io.Writer
+	hash   hash.Hash
+	size   int64
+}
+
+func newHashingWriter(w io.Writer) *hashingWriter {
+	return &hashingWriter{writer: w, hash: sha256.New()}
+}
+
+func (w *hashingWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	w.hash.Write(p[:n])
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *hashingWriter) Sum() string {
+	return hex.EncodeToString(w.hash.Sum(nil))
+}
+
+// writeManifestEntry appends the manifest as the final archive entry.
+func writeManifestEntry(tarWriter *tar.Writer, manifest *Manifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	header := &tar.Header{
+		Name:     manifestEntryName,
+		Typeflag: tar.TypeReg,
+		Mode:     0600,
+		Size:     int64(len(data)),
+		ModTime:  time.Unix(manifest.CompletedAt, 0),
+	}
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = tarWriter.Write(data)
+	return err
+}
+
+func readManifest(r io.Reader) (*Manifest, error) {
+	var manifest Manifest
+	if err := json.NewDecoder(r).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %v", err)
+	}
+	return &manifest, nil
+}
+
+// ReadManifest returns the sidecar manifest of a local archive.
+func (s Service) ReadManifest(backupPath string) (*Manifest, error) {
+	file, err := os.Open(backupPath + manifestSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open manifest: %v", err)
+	}
+	defer file.Close()
+
+	return readManifest(file)
+}
+
+// VerifyBackup re-reads an archive, from any target, and checks every entry
+// and the archive checksum against its manifest. The sidecar manifest is
+// preferred; without it the manifest embedded in the archive is used.
+// Snapshots are verified by reading back every chunk.
+func (s Service) VerifyBackup(backupPath, s3Key string) (*VerifyResult, error) {
+	if s3Key != "" {
+		backupPath = S3Path(s3Key)
+	}
+	if id, ok := snapshotID(backupPath); ok {
+		repository, err := s.snapshotRepository()
+		if err != nil {
+			return nil, err
+		}
+		return repository.verifySnapshot(id)
+	}
+
+	archive, sidecar, err := s.openArchive(backupPath)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+
+	return s.verifyArchive(archive, sidecar)
+}
+
+func (s Service) verifyArchive(archive io.Reader, sidecar *Manifest) (*VerifyResult, error) {
+	result := &VerifyResult{}
+	problem := func(format string, args ...interface{}) {
+		result.Problems = append(result.Problems, fmt.Sprintf(format, args...))
+	}
+
+	raw := newHashingWriter(io.Discard)
+	tee := io.TeeReader(archive, raw)
+
+	plaintext, err := s.encryption.open(tee)
+	if err != nil {
+		return nil, err
+	}
+	gzipReader, err := gzip.NewReader(plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gzip reader: %v", err)
+	}
+	defer gzipReader.Close()
+
+	seen := make(map[string]ManifestFile)
+	var embedded *Manifest
+
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			problem("archive is corrupt: %v", err)
+			break
+		}
+
+		if header.Name == manifestEntryName {
+			embedded, err = readManifest(tarReader)
+			if err != nil {
+				problem("embedded manifest: %v", err)
+			}
+			continue
+		}
+
+		entry := ManifestFile{
+			Path: header.Name,
+			Type: manifestFileType(header.Typeflag),
+			Size: header.Size,
+			Link: header.Linkname,
+		}
+		if entry.Type == "file" {
+			hash := sha256.New()
+			if _, err := io.Copy(hash, tarReader); err != nil {
+				problem("%s: failed to read content: %v", header.Name, err)
+				break
+			}
+			entry.SHA256 = hex.EncodeToString(hash.Sum(nil))
+		}
+		seen[header.Name] = entry
+	}
+
+	// Drain the rest so the archive checksum covers every byte
+	io.Copy(io.Discard, tee)
+
+	manifest := sidecar
+	if manifest == nil {
+		manifest = embedded
+	}
+	if manifest == nil {
+		problem("no manifest found")
+		return result, nil
+	}
+
+	if sidecar != nil && sidecar.ArchiveSHA256 != "" {
+		if sum := raw.Sum(); sum != sidecar.ArchiveSHA256 {
+			problem("archive checksum mismatch: expected %s, got %s", sidecar.ArchiveSHA256, sum)
+		}
+		if raw.size != sidecar.ArchiveSize {
+			problem("archive size mismatch: expected %d, got %d", sidecar.ArchiveSize, raw.size)
+		}
+	}
+
+	expected := make(map[string]bool)
+	for _, file := range manifest.Files {
+		expected[file.Path] = true
+		actual, ok := seen[file.Path]
+		if !ok {
+			problem("%s: missing from archive", file.Path)
+			continue
+		}
+		result.FilesChecked++
+
+		if actual.Type != file.Type {
+			problem("%s: type mismatch: expected %s, got %s", file.Path, file.Type, actual.Type)
+		}
+		if file.Type == "file" {
+			if actual.Size != file.Size {
+				problem("%s: size mismatch: expected %d, got %d", file.Path, file.Size, actual.Size)
+			}
+			if actual.SHA256 != file.SHA256 {
+				problem("%s: checksum mismatch", file.Path)
+			}
+		}
+		if actual.Link != file.Link {
+			problem("%s: link target mismatch", file.Path)
+		}
+	}
+
+	var extra []string
+	for path := range seen {
+		if !expected[path] {
+			extra = append(extra, path)
+		}
+	}
+	sort.Strings(extra)
+	for _, path := range extra {
+		problem("%s: not listed in manifest", path)
+	}
+
+	result.Valid = len(result.Problems) == 0
+	return result, nil
+}
+
+// String summarises the result for RPC messages and logs.
+func (r *VerifyResult) String() string {
+	if r.Valid {
+		return fmt.Sprintf("backup verified: %d files checked", r.FilesChecked)
+	}
+	return fmt.Sprintf("backup verification failed with %d problem(s): %s", len(r.Problems), strings.Join(r.Problems, "; "))
+}
@@ -0,0 +1,38 @@
+package backup
+
+import (
+	"fmt"
+	"syscall"
+)
+
+const (
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+	ioprioClassBE    = 2
+	ioprioClassIdle  = 3
+)
+
+// setThreadPriority lowers the CPU and I/O priority of the calling thread.
+func setThreadPriority(config ThrottleConfig) error {
+	tid := syscall.Gettid()
+
+	if config.Nice > 0 {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, config.Nice); err != nil {
+			return fmt.Errorf("failed to set nice: %v", err)
+		}
+	}
+
+	var ioprio int
+	switch config.IOClass {
+	case ioClassBestEffort:
+		ioprio = ioprioClassBE<<ioprioClassShift | config.IOPriority
+	case ioClassIdle:
+		ioprio = ioprioClassIdle << ioprioClassShift
+	default:
+		return nil
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), uintptr(ioprio)); errno != 0 {
+		return fmt.Errorf("failed to set I/O priority: %v", errno)
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package backup
+
+// setThreadPriority is only supported on Linux.
+func setThreadPriority(config ThrottleConfig) error {
+	return nil
+}
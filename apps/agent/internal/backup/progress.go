@@ -0,0 +1,305 @@
+package backup
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Backup job phases reported by WatchBackup.
+const (
+	phasePreHook   = "pre-hook"
+	phaseScanning  = "scanning"
+	phaseArchiving = "archiving"
+	phaseUploading = "uploading"
+	phaseRestoring = "restoring"
+	phasePostHook  = "post-hook"
+	phaseDone      = "done"
+	phaseFailed    = "failed"
+)
+
+// progressInterval rate-limits progress updates between phase changes.
+const progressInterval = 500 * time.Millisecond
+
+// finishedJobs is how many finished jobs are kept for late watchers.
+const finishedJobs = 32
+
+// Progress is the state of a running or finished backup or restore job.
+type Progress struct {
+	JobID string
+	// Operation is "backup" or "restore".
+	Operation string
+	Name      string
+	Phase     string
+	// BytesTotal and FilesTotal are zero while unknown, e.g. during the
+	// scan or when restoring an archive without a sidecar manifest.
+	BytesDone  int64
+	BytesTotal int64
+	FilesDone  int64
+	FilesTotal int64
+	StartedAt  time.Time
+	// ETA is the estimated time left, zero when it cannot be estimated.
+	ETA   time.Duration
+	Done  bool
+	Error string
+}
+
+// progressTracker keeps the state of backup jobs and fans updates out to
+// watchers. Watchers never block a job: each keeps only the latest state
+// of every job it has not consumed yet.
+type progressTracker struct {
+	mu       sync.Mutex
+	jobs     map[string]Progress
+	finished []string
+	watchers map[*progressWatcher]struct{}
+}
+
+type progressWatcher struct {
+	jobID   string
+	pending map[string]Progress
+	notify  chan struct{}
+}
+
+func newProgressTracker() *progressTracker {
+	return &progressTracker{
+		jobs:     make(map[string]Progress),
+		watchers: make(map[*progressWatcher]struct{}),
+	}
+}
+
+// start registers a job. An empty jobID is replaced by a generated one.
+func (t *progressTracker) start(jobID, operation, name string) (*backupJob, error) {
+	if jobID == "" {
+		id := make([]byte, 8)
+		if _, err := rand.Read(id); err != nil {
+			return nil, err
+		}
+		jobID = hex.EncodeToString(id)
+	}
+
+	job := &backupJob{
+		tracker: t,
+		progress: Progress{
+			JobID:     jobID,
+			Operation: operation,
+			Name:      name,
+			StartedAt: time.Now(),
+		},
+	}
+
+	t.mu.Lock()
+	if current, ok := t.jobs[jobID]; ok && !current.Done {
+		t.mu.Unlock()
+		return nil, fmt.Errorf("backup job %s is already running", jobID)
+	}
+	t.jobs[jobID] = job.progress
+	t.mu.Unlock()
+
+	job.publish()
+	return job, nil
+}
+
+func (t *progressTracker) publish(progress Progress) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if current, ok := t.jobs[progress.JobID]; ok && current.Done {
+		// A late update from the job after it finished
+		return
+	}
+	if progress.Done {
+		t.finished = append(t.finished, progress.JobID)
+		if len(t.finished) > finishedJobs {
+			// The ID may have been reused by a running job since
+			if oldest, ok := t.jobs[t.finished[0]]; ok && oldest.Done {
+				delete(t.jobs, t.finished[0])
+			}
+			t.finished = t.finished[1:]
+		}
+	}
+	t.jobs[progress.JobID] = progress
+
+	for watcher := range t.watchers {
+		if watcher.jobID != "" && watcher.jobID != progress.JobID {
+			continue
+		}
+		watcher.pending[progress.JobID] = progress
+		select {
+		case watcher.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// WatchBackup calls fn with the progress of a backup or restore job until
+// it finishes or ctx is done. With an empty jobID every job is watched,
+// starting with those running, until ctx is done. Updates arrive at least
+// on every phase change; intermediate ones may be skipped for slow
+// watchers.
+func (s Service) WatchBackup(ctx context.Context, jobID string, fn func(Progress) error) error {
+	t := s.progress
+	watcher := &progressWatcher{
+		jobID:   jobID,
+		pending: make(map[string]Progress),
+		notify:  make(chan struct{}, 1),
+	}
+
+	t.mu.Lock()
+	if jobID != "" {
+		current, ok := t.jobs[jobID]
+		if !ok {
+			t.mu.Unlock()
+			return fmt.Errorf("unknown backup job: %s", jobID)
+		}
+		watcher.pending[jobID] = current
+	} else {
+		for id, current := range t.jobs {
+			if !current.Done {
+				watcher.pending[id] = current
+			}
+		}
+	}
+	watcher.notify <- struct{}{}
+	t.watchers[watcher] = struct{}{}
+	t.mu.Unlock()
+
+	defer func() {
+		t.mu.Lock()
+		delete(t.watchers, watcher)
+		t.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-watcher.notify:
+		}
+
+		t.mu.Lock()
+		updates := make([]Progress, 0, len(watcher.pending))
+		for _, progress := range watcher.pending {
+			updates = append(updates, progress)
+		}
+		watcher.pending = make(map[string]Progress)
+		t.mu.Unlock()
+
+		sort.Slice(updates, func(i, j int) bool {
+			return updates[i].JobID < updates[j].JobID
+		})
+		for _, progress := range updates {
+			if err := fn(progress); err != nil {
+				return err
+			}
+			if jobID != "" && progress.Done {
+				return nil
+			}
+		}
+	}
+}
+
+// backupJob reports the progress of one job. All methods accept a nil job,
+// so code paths without tracking need no checks.
+type backupJob struct {
+	tracker     *progressTracker
+	mu          sync.Mutex
+	progress    Progress
+	lastPublish time.Time
+}
+
+func (j *backupJob) id() string {
+	if j == nil {
+		return ""
+	}
+	return j.progress.JobID
+}
+
+func (j *backupJob) phase(phase string) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	j.progress.Phase = phase
+	j.mu.Unlock()
+	j.publish()
+}
+
+// setTotal records the expected size of the job, once known.
+func (j *backupJob) setTotal(files, bytes int64) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	j.progress.FilesTotal = files
+	j.progress.BytesTotal = bytes
+	j.mu.Unlock()
+	j.publish()
+}
+
+func (j *backupJob) addFile() {
+	j.add(1, 0)
+}
+
+func (j *backupJob) addBytes(n int64) {
+	j.add(0, n)
+}
+
+func (j *backupJob) add(files, bytes int64) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	j.progress.FilesDone += files
+	j.progress.BytesDone += bytes
+	due := time.Since(j.lastPublish) >= progressInterval
+	j.mu.Unlock()
+	if due {
+		j.publish()
+	}
+}
+
+func (j *backupJob) finish(err error) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	j.progress.Done = true
+	j.progress.ETA = 0
+	if err != nil {
+		j.progress.Phase = phaseFailed
+		j.progress.Error = err.Error()
+	} else {
+		j.progress.Phase = phaseDone
+	}
+	j.mu.Unlock()
+	j.publish()
+}
+
+func (j *backupJob) publish() {
+	j.mu.Lock()
+	j.lastPublish = time.Now()
+	progress := j.progress
+	if !progress.Done && progress.BytesTotal > 0 && progress.BytesDone > 0 && progress.BytesDone < progress.BytesTotal {
+		elapsed := time.Since(progress.StartedAt)
+		progress.ETA = time.Duration(float64(elapsed) * float64(progress.BytesTotal-progress.BytesDone) / float64(progress.BytesDone))
+	}
+	j.mu.Unlock()
+	j.tracker.publish(progress)
+}
+
+// progressReader counts bytes read into a job.
+type progressReader struct {
+	reader io.Reader
+	job    *backupJob
+}
+
+func (r progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.job.addBytes(int64(n))
+	return n, err
+}
@@ -0,0 +1,657 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"hosting-panel-agent/internal/version"
+)
+
+// snapshotPrefix marks backup paths that name a repository snapshot rather
+// than an archive file.
+const snapshotPrefix = "snapshot:"
+
+const (
+	chunksDir    = "chunks"
+	snapshotsDir = "snapshots"
+)
+
+type RepositoryConfig struct {
+	// Enabled makes CreateBackup write deduplicated snapshots instead of
+	// tar.gz archives.
+	Enabled bool
+	// Backend is "local" (the default) or "s3".
+	Backend string
+	// Path is the local repository root, by default <storage path>/repository.
+	Path string
+	// Prefix is the key prefix used in the S3 bucket.
+	Prefix string
+}
+
+// Snapshot is one backup in the repository: the file tree of the source
+// with each regular file stored as a list of chunk IDs.
+type Snapshot struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	Type         string `json:"type"`
+	SourcePath   string `json:"source_path"`
+	AgentVersion string `json:"agent_version"`
+	// Parent is the snapshot unchanged files were taken from, if any.
+	Parent      string         `json:"parent,omitempty"`
+	StartedAt   int64          `json:"started_at"`
+	CompletedAt int64          `json:"completed_at"`
+	Size        int64          `json:"size"`
+	AddedChunks int            `json:"added_chunks"`
+	AddedBytes  int64          `json:"added_bytes"`
+	Files       []SnapshotFile `json:"files"`
+	// Warnings lists entries that were skipped or only partly read.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+type SnapshotFile struct {
+	Path    string    `json:"path"`
+	Type    string    `json:"type"`
+	Mode    int64     `json:"mode"`
+	UID     int       `json:"uid"`
+	GID     int       `json:"gid"`
+	ModTime time.Time `json:"mod_time"`
+	Size    int64     `json:"size"`
+	Link    string    `json:"link,omitempty"`
+	SHA256  string    `json:"sha256,omitempty"`
+	Chunks  []string  `json:"chunks,omitempty"`
+}
+
+// unchanged reports whether a file from the parent snapshot can be reused
+// without reading it again.
+func (f SnapshotFile) unchanged(current SnapshotFile) bool {
+	return f.Type == "file" && current.Type == "file" &&
+		f.Size == current.Size && f.Mode == current.Mode &&
+		f.ModTime.Equal(current.ModTime) &&
+		(f.Size == 0 || len(f.Chunks) > 0)
+}
+
+func (f SnapshotFile) header() *tar.Header {
+	header := &tar.Header{
+		Name:     f.Path,
+		Mode:     f.Mode,
+		Uid:      f.UID,
+		Gid:      f.GID,
+		ModTime:  f.ModTime,
+		Size:     f.Size,
+		Linkname: f.Link,
+	}
+	switch f.Type {
+	case "dir":
+		header.Typeflag = tar.TypeDir
+	case "file":
+		header.Typeflag = tar.TypeReg
+	case "symlink":
+		header.Typeflag = tar.TypeSymlink
+	case "hardlink":
+		header.Typeflag = tar.TypeLink
+	default:
+		header.Typeflag = tar.TypeFifo
+	}
+	return header
+}
+
+// repository is a content-addressed chunk store. Chunks are keyed by the
+// SHA-256 of their plaintext, so identical content is stored once across
+// snapshots and sites. Chunks and snapshots are gzip-compressed and, when
+// encryption is enabled, sealed with age and keyed by an HMAC instead, so
+// that whoever holds the storage cannot confirm known content by its hash.
+type repository struct {
+	store      blobStore
+	encryption *encryption
+	chunkKey   []byte
+
+	// gc holds the write lock while sweeping chunks so that no snapshot
+	// being written loses chunks it has stored but not yet referenced.
+	gc sync.RWMutex
+
+	mu    sync.Mutex
+	known map[string]bool
+}
+
+func (s Service) openRepository(config RepositoryConfig) (*repository, error) {
+	var store blobStore
+	switch config.Backend {
+	case "", "local":
+		root := config.Path
+		if root == "" {
+			root = filepath.Join(s.storagePath, "repository")
+		}
+		store = localStore{root: root}
+	case "s3":
+		svc, err := s.s3Client()
+		if err != nil {
+			return nil, err
+		}
+		store = s3Store{svc: svc, bucket: s.s3Config.Bucket, prefix: config.Prefix}
+	default:
+		return nil, fmt.Errorf("unsupported backup repository backend: %s", config.Backend)
+	}
+
+	var chunkKey []byte
+	if s.encryption.enabled {
+		chunkKey = s.encryption.chunkKey
+		if len(chunkKey) == 0 {
+			return nil, fmt.Errorf("backup repository encryption requires an identity file")
+		}
+	}
+
+	return &repository{
+		store:      store,
+		encryption: s.encryption,
+		chunkKey:   chunkKey,
+		known:      make(map[string]bool),
+	}, nil
+}
+
+// chunkID names a chunk by its content.
+func (r *repository) chunkID(data []byte) string {
+	if r.chunkKey == nil {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, r.chunkKey)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func chunkKey(id string) string {
+	return path.Join(chunksDir, id[:2], id)
+}
+
+func snapshotKey(id string) string {
+	return path.Join(snapshotsDir, id)
+}
+
+// validSnapshotID rejects IDs that would resolve outside the snapshots
+// directory of the store.
+func validSnapshotID(id string) bool {
+	return id != "" && id != "." && id != ".." && !strings.ContainsAny(id, `/\`)
+}
+
+// snapshotID extracts the snapshot ID from a backup path.
+func snapshotID(backupPath string) (string, bool) {
+	if !strings.HasPrefix(backupPath, snapshotPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(backupPath, snapshotPrefix), true
+}
+
+// snapshotRepository returns the repository or the reason it is unavailable.
+func (s Service) snapshotRepository() (*repository, error) {
+	if s.repositoryErr != nil {
+		return nil, s.repositoryErr
+	}
+	if s.repository == nil {
+		return nil, fmt.Errorf("backup repository is not enabled")
+	}
+	return s.repository, nil
+}
+
+func (s Service) createSnapshot(name, backupType, sourcePath string, startedAt time.Time, options BackupOptions) (*BackupResult, error) {
+	snapshot := &Snapshot{
+		ID:           fmt.Sprintf("%s-%s-%s", name, backupType, startedAt.Format("2006-01-02-15-04-05")),
+		Name:         name,
+		Type:         backupType,
+		SourcePath:   sourcePath,
+		AgentVersion: version.Version,
+		StartedAt:    startedAt.Unix(),
+	}
+
+	if err := s.repository.createSnapshot(snapshot, options); err != nil {
+		return nil, err
+	}
+	return &BackupResult{Path: snapshotPrefix + snapshot.ID, Warnings: snapshot.Warnings}, nil
+}
+
+func (r *repository) createSnapshot(snapshot *Snapshot, options BackupOptions) error {
+	if !validSnapshotID(snapshot.ID) {
+		return fmt.Errorf("invalid snapshot name: %s", snapshot.ID)
+	}
+
+	r.gc.RLock()
+	defer r.gc.RUnlock()
+
+	exists, err := r.store.Has(snapshotKey(snapshot.ID))
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("snapshot %s already exists", snapshot.ID)
+	}
+
+	parentFiles := make(map[string]SnapshotFile)
+	if parent, err := r.findParent(snapshot); err != nil {
+		return err
+	} else if parent != nil {
+		snapshot.Parent = parent.ID
+		for _, file := range parent.Files {
+			parentFiles[file.Path] = file
+		}
+	}
+
+	chunker := newChunker()
+	walker := newSourceWalker(options)
+	err = walker.walk(snapshot.SourcePath, "", func(header *tar.Header, source *sourceFile) error {
+		file := SnapshotFile{
+			Path:    header.Name,
+			Type:    manifestFileType(header.Typeflag),
+			Mode:    header.Mode,
+			UID:     header.Uid,
+			GID:     header.Gid,
+			ModTime: header.ModTime,
+			Size:    header.Size,
+			Link:    header.Linkname,
+		}
+
+		if source != nil {
+			if previous, ok := parentFiles[file.Path]; ok && previous.unchanged(file) {
+				file.SHA256 = previous.SHA256
+				file.Chunks = previous.Chunks
+				options.job.addBytes(file.Size)
+			} else if err := r.storeFile(source, &file, chunker, snapshot); err != nil {
+				if source.readErr == nil {
+					return err
+				}
+				// Chunks already stored are left for garbage collection
+				walker.warn(source.path, "skipped, read failed: %v", unwrapPathError(source.readErr))
+				return nil
+			}
+			snapshot.Size += file.Size
+		}
+
+		snapshot.Files = append(snapshot.Files, file)
+		return nil
+	})
+	snapshot.Warnings = walker.Warnings()
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot: %v", err)
+	}
+
+	snapshot.CompletedAt = time.Now().Unix()
+	return r.saveSnapshot(snapshot)
+}
+
+// storeFile chunks a file into the repository, uploading only chunks the
+// repository does not have yet.
+func (r *repository) storeFile(f io.Reader, file *SnapshotFile, chunker *chunker, snapshot *Snapshot) error {
+	hash := sha256.New()
+	chunker.reset(io.TeeReader(f, hash))
+
+	// The file may change while it is read; record what was stored
+	var size int64
+	for {
+		data, err := chunker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		id, added, err := r.putChunk(data)
+		if err != nil {
+			return err
+		}
+		file.Chunks = append(file.Chunks, id)
+		size += int64(len(data))
+		if added {
+			snapshot.AddedChunks++
+			snapshot.AddedBytes += int64(len(data))
+		}
+	}
+
+	file.Size = size
+	file.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	return nil
+}
+
+func (r *repository) putChunk(data []byte) (string, bool, error) {
+	id := r.chunkID(data)
+
+	r.mu.Lock()
+	known := r.known[id]
+	r.mu.Unlock()
+	if known {
+		return id, false, nil
+	}
+
+	exists, err := r.store.Has(chunkKey(id))
+	if err != nil {
+		return "", false, err
+	}
+	if !exists {
+		encoded, err := r.encode(data)
+		if err != nil {
+			return "", false, err
+		}
+		if err := r.store.Put(chunkKey(id), encoded); err != nil {
+			return "", false, err
+		}
+	}
+
+	r.mu.Lock()
+	r.known[id] = true
+	r.mu.Unlock()
+
+	return id, !exists, nil
+}
+
+// getChunk reads a chunk and checks it still matches its ID.
+func (r *repository) getChunk(id string) ([]byte, error) {
+	encoded, err := r.store.Get(chunkKey(id))
+	if err != nil {
+		return nil, err
+	}
+	data, err := r.decode(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("chunk %s: %v", id, err)
+	}
+
+	if r.chunkID(data) != id {
+		// Chunks stored before encryption was enabled keep plain IDs
+		sum := sha256.Sum256(data)
+		if r.chunkKey == nil || hex.EncodeToString(sum[:]) != id {
+			return nil, fmt.Errorf("chunk %s is corrupt", id)
+		}
+	}
+	return data, nil
+}
+
+func (r *repository) encode(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	var w io.Writer = &buf
+	var sealed io.WriteCloser
+	if r.encryption.enabled {
+		var err error
+		sealed, err = r.encryption.seal(&buf)
+		if err != nil {
+			return nil, err
+		}
+		w = sealed
+	}
+
+	gzipWriter := gzip.NewWriter(w)
+	if _, err := gzipWriter.Write(data); err != nil {
+		return nil, err
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return nil, err
+	}
+	if sealed != nil {
+		if err := sealed.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (r *repository) decode(encoded []byte) ([]byte, error) {
+	plaintext, err := r.encryption.open(bytes.NewReader(encoded))
+	if err != nil {
+		return nil, err
+	}
+	gzipReader, err := gzip.NewReader(plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gzip reader: %v", err)
+	}
+	defer gzipReader.Close()
+
+	return io.ReadAll(gzipReader)
+}
+
+func (r *repository) saveSnapshot(snapshot *Snapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	encoded, err := r.encode(data)
+	if err != nil {
+		return err
+	}
+	return r.store.Put(snapshotKey(snapshot.ID), encoded)
+}
+
+func (r *repository) loadSnapshot(id string) (*Snapshot, error) {
+	if !validSnapshotID(id) {
+		return nil, fmt.Errorf("invalid snapshot id: %s", id)
+	}
+
+	encoded, err := r.store.Get(snapshotKey(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load snapshot %s: %v", id, err)
+	}
+	data, err := r.decode(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load snapshot %s: %v", id, err)
+	}
+
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot %s: %v", id, err)
+	}
+	return &snapshot, nil
+}
+
+// snapshotIDs returns every snapshot ID sorted, which puts snapshots of the
+// same name and type in chronological order.
+func (r *repository) snapshotIDs() ([]string, error) {
+	keys, err := r.store.List(snapshotsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(keys))
+	for _, key := range keys {
+		ids = append(ids, path.Base(key))
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (r *repository) listSnapshots() ([]*Snapshot, error) {
+	ids, err := r.snapshotIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []*Snapshot
+	for _, id := range ids {
+		snapshot, err := r.loadSnapshot(id)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, nil
+}
+
+// findParent returns the newest snapshot of the same name, type and source.
+func (r *repository) findParent(snapshot *Snapshot) (*Snapshot, error) {
+	ids, err := r.snapshotIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := snapshot.Name + "-" + snapshot.Type + "-"
+	for i := len(ids) - 1; i >= 0; i-- {
+		if !strings.HasPrefix(ids[i], prefix) {
+			continue
+		}
+		candidate, err := r.loadSnapshot(ids[i])
+		if err != nil {
+			return nil, err
+		}
+		if candidate.Name == snapshot.Name && candidate.Type == snapshot.Type && candidate.SourcePath == snapshot.SourcePath {
+			return candidate, nil
+		}
+	}
+	return nil, nil
+}
+
+// restoreSnapshot restores into targetPath, or the snapshot's source path
+// when it is empty. Chunks are only fetched for files that are restored.
+func (r *repository) restoreSnapshot(id, targetPath string, options RestoreOptions) (*RestoreResult, error) {
+	snapshot, err := r.loadSnapshot(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if targetPath == "" {
+		targetPath = snapshot.SourcePath
+	}
+	if options.SideDirectory {
+		targetPath = sideDirectory(targetPath, time.Now())
+	}
+
+	var bytes int64
+	for _, file := range snapshot.Files {
+		bytes += file.Size
+	}
+	options.job.setTotal(int64(len(snapshot.Files)), bytes)
+
+	extractor, err := newExtractor(targetPath, options)
+	if err != nil {
+		return nil, err
+	}
+
+	// Restored through the extractor so snapshots get the same confinement
+	// as archives
+	for _, file := range snapshot.Files {
+		content := &chunkReader{repository: r, chunks: file.Chunks}
+		if err := extractor.extract(file.header(), content); err != nil {
+			return nil, fmt.Errorf("%s: %v", file.Path, err)
+		}
+	}
+
+	if err := extractor.finish(); err != nil {
+		return nil, err
+	}
+	return &extractor.result, nil
+}
+
+// verifySnapshot reads back every chunk of a snapshot and checks each file
+// against its recorded size and checksum.
+func (r *repository) verifySnapshot(id string) (*VerifyResult, error) {
+	snapshot, err := r.loadSnapshot(id)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &VerifyResult{}
+	for _, file := range snapshot.Files {
+		result.FilesChecked++
+		if file.Type != "file" {
+			continue
+		}
+
+		hash := sha256.New()
+		size, err := io.Copy(hash, &chunkReader{repository: r, chunks: file.Chunks})
+		if err != nil {
+			result.Problems = append(result.Problems, fmt.Sprintf("%s: %v", file.Path, err))
+			continue
+		}
+		if size != file.Size {
+			result.Problems = append(result.Problems, fmt.Sprintf("%s: size mismatch: expected %d, got %d", file.Path, file.Size, size))
+		}
+		if hex.EncodeToString(hash.Sum(nil)) != file.SHA256 {
+			result.Problems = append(result.Problems, fmt.Sprintf("%s: checksum mismatch", file.Path))
+		}
+	}
+
+	result.Valid = len(result.Problems) == 0
+	return result, nil
+}
+
+func (r *repository) deleteSnapshot(id string) error {
+	if !validSnapshotID(id) {
+		return fmt.Errorf("invalid snapshot id: %s", id)
+	}
+	return r.store.Delete(snapshotKey(id))
+}
+
+// collectGarbage deletes chunks that no remaining snapshot references and
+// returns how many were removed.
+func (r *repository) collectGarbage() (int, error) {
+	r.gc.Lock()
+	defer r.gc.Unlock()
+
+	snapshots, err := r.listSnapshots()
+	if err != nil {
+		return 0, err
+	}
+	referenced := make(map[string]bool)
+	for _, snapshot := range snapshots {
+		for _, file := range snapshot.Files {
+			for _, id := range file.Chunks {
+				referenced[id] = true
+			}
+		}
+	}
+
+	keys, err := r.store.List(chunksDir)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, key := range keys {
+		if referenced[path.Base(key)] {
+			continue
+		}
+		if err := r.store.Delete(key); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+
+	r.mu.Lock()
+	r.known = make(map[string]bool)
+	r.mu.Unlock()
+
+	return removed, nil
+}
+
+// chunkReader streams a file's content from its chunks.
+type chunkReader struct {
+	repository *repository
+	chunks     []string
+	current    []byte
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for len(c.current) == 0 {
+		if len(c.chunks) == 0 {
+			return 0, io.EOF
+		}
+		data, err := c.repository.getChunk(c.chunks[0])
+		if err != nil {
+			return 0, err
+		}
+		c.chunks = c.chunks[1:]
+		c.current = data
+	}
+
+	n := copy(p, c.current)
+	c.current = c.current[n:]
+	return n, nil
+}
@@ -0,0 +1,233 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+)
+
+// testRepository opens a local repository under a temporary directory,
+// sealed with a new identity when encrypted.
+func testRepository(t *testing.T, encrypted bool) *repository {
+	dir := t.TempDir()
+	config := Config{
+		StoragePath: dir,
+		Repository:  RepositoryConfig{Enabled: true},
+	}
+	if encrypted {
+		identity, err := age.GenerateX25519Identity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		identityFile := filepath.Join(dir, "identity.txt")
+		if err := os.WriteFile(identityFile, []byte(identity.String()+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		config.Encryption = EncryptionConfig{Enabled: true, IdentityFile: identityFile}
+	}
+
+	s := NewService(config)
+	if s.encryptionErr != nil {
+		t.Fatal(s.encryptionErr)
+	}
+	repository, err := s.snapshotRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repository
+}
+
+func writeSourceFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func takeSnapshot(t *testing.T, r *repository, id, source string) *Snapshot {
+	t.Helper()
+	snapshot := &Snapshot{ID: "site-files-" + id, Name: "site", Type: "files", SourcePath: source}
+	if err := r.createSnapshot(snapshot, BackupOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	return snapshot
+}
+
+func snapshotFile(t *testing.T, snapshot *Snapshot, path string) SnapshotFile {
+	t.Helper()
+	for _, file := range snapshot.Files {
+		if file.Path == path {
+			return file
+		}
+	}
+	t.Fatalf("%s is not in snapshot %s", path, snapshot.ID)
+	return SnapshotFile{}
+}
+
+func storedChunks(t *testing.T, r *repository) []string {
+	t.Helper()
+	keys, err := r.store.List(chunksDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func readChunk(t *testing.T, r *repository, id string) []byte {
+	t.Helper()
+	data, err := r.getChunk(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func checkSnapshot(t *testing.T, r *repository, id string) {
+	t.Helper()
+	result, err := r.verifySnapshot(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Valid {
+		t.Errorf("snapshot %s: %q", id, result.Problems)
+	}
+}
+
+func TestRepositoryDeduplication(t *testing.T) {
+	r := testRepository(t, false)
+	source := filepath.Join(t.TempDir(), "site")
+	content := randomData(5, 3*1024*1024)
+	writeSourceFile(t, filepath.Join(source, "a.bin"), content)
+	writeSourceFile(t, filepath.Join(source, "b.bin"), content)
+
+	// Identical files in one snapshot share their chunks
+	first := takeSnapshot(t, r, "2026-03-01-00-00-00", source)
+	a, b := snapshotFile(t, first, "a.bin"), snapshotFile(t, first, "b.bin")
+	if len(a.Chunks) < 2 || !reflect.DeepEqual(a.Chunks, b.Chunks) {
+		t.Fatalf("chunks of identical files: %v and %v", a.Chunks, b.Chunks)
+	}
+	if first.AddedChunks != len(a.Chunks) || first.AddedBytes != int64(len(content)) {
+		t.Errorf("first snapshot added %d chunks with %d bytes", first.AddedChunks, first.AddedBytes)
+	}
+	for _, id := range a.Chunks {
+		sum := sha256.Sum256(readChunk(t, r, id))
+		if hex.EncodeToString(sum[:]) != id {
+			t.Errorf("chunk %s is not named by its SHA-256", id)
+		}
+	}
+
+	// Content read again, or under a new name, is not stored again
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(source, "a.bin"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	writeSourceFile(t, filepath.Join(source, "copy", "c.bin"), content)
+	second := takeSnapshot(t, r, "2026-03-02-00-00-00", source)
+	if second.Parent != first.ID {
+		t.Errorf("parent %q, want %q", second.Parent, first.ID)
+	}
+	if second.AddedChunks != 0 || second.AddedBytes != 0 {
+		t.Errorf("second snapshot added %d chunks with %d bytes", second.AddedChunks, second.AddedBytes)
+	}
+	if c := snapshotFile(t, second, "copy/c.bin"); !reflect.DeepEqual(c.Chunks, a.Chunks) {
+		t.Errorf("copy stored as %v, want %v", c.Chunks, a.Chunks)
+	}
+	if stored := storedChunks(t, r); len(stored) != len(a.Chunks) {
+		t.Errorf("%d chunks stored, want %d", len(stored), len(a.Chunks))
+	}
+	checkSnapshot(t, r, second.ID)
+}
+
+func TestRepositoryEncryptedChunkIDs(t *testing.T) {
+	r := testRepository(t, true)
+	source := filepath.Join(t.TempDir(), "site")
+	content := randomData(6, 2*1024*1024)
+	writeSourceFile(t, filepath.Join(source, "a.bin"), content)
+
+	snapshot := takeSnapshot(t, r, "2026-03-01-00-00-00", source)
+	file := snapshotFile(t, snapshot, "a.bin")
+	for _, id := range file.Chunks {
+		data := readChunk(t, r, id)
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) == id {
+			t.Errorf("chunk %s is named by its plain SHA-256", id)
+		}
+
+		// Chunks are stored sealed
+		encoded, err := r.store.Get(chunkKey(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(encoded, ageHeader) {
+			t.Errorf("chunk %s is stored unencrypted", id)
+		}
+	}
+	checkSnapshot(t, r, snapshot.ID)
+
+	// The key comes from the identity, so another repository names the same
+	// content differently
+	other := testRepository(t, true)
+	if other.chunkID(content) == r.chunkID(content) {
+		t.Error("repositories with different identities share chunk IDs")
+	}
+	if plain := testRepository(t, false); plain.chunkID(content) == r.chunkID(content) {
+		t.Error("encrypted and plain repositories share chunk IDs")
+	}
+}
+
+func TestRepositoryGarbageCollection(t *testing.T) {
+	r := testRepository(t, false)
+	source := filepath.Join(t.TempDir(), "site")
+	kept := randomData(7, 2*1024*1024)
+	dropped := randomData(8, 2*1024*1024)
+	writeSourceFile(t, filepath.Join(source, "kept.bin"), kept)
+	writeSourceFile(t, filepath.Join(source, "dropped.bin"), dropped)
+
+	first := takeSnapshot(t, r, "2026-03-01-00-00-00", source)
+	if err := os.Remove(filepath.Join(source, "dropped.bin")); err != nil {
+		t.Fatal(err)
+	}
+	second := takeSnapshot(t, r, "2026-03-02-00-00-00", source)
+
+	// Nothing is removed while a snapshot still references it
+	removed, err := r.collectGarbage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 0 {
+		t.Errorf("removed %d chunks with every snapshot kept", removed)
+	}
+
+	if err := r.deleteSnapshot(first.ID); err != nil {
+		t.Fatal(err)
+	}
+	removed, err = r.collectGarbage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := len(snapshotFile(t, first, "dropped.bin").Chunks); removed != want {
+		t.Errorf("removed %d chunks, want %d", removed, want)
+	}
+	if stored, want := len(storedChunks(t, r)), len(snapshotFile(t, second, "kept.bin").Chunks); stored != want {
+		t.Errorf("%d chunks left, want %d", stored, want)
+	}
+	checkSnapshot(t, r, second.ID)
+
+	// Removed chunks are stored again when the content comes back
+	writeSourceFile(t, filepath.Join(source, "dropped.bin"), dropped)
+	third := takeSnapshot(t, r, "2026-03-03-00-00-00", source)
+	if third.AddedBytes != int64(len(dropped)) {
+		t.Errorf("third snapshot added %d bytes, want %d", third.AddedBytes, len(dropped))
+	}
+	checkSnapshot(t, r, third.ID)
+}
@@ -0,0 +1,169 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	conflictOverwrite = "overwrite"
+	conflictSkip      = "skip"
+	conflictRename    = "rename"
+)
+
+// RestoreOptions narrows a restore. The zero value restores everything into
+// the target path, replacing existing files.
+type RestoreOptions struct {
+	// Include and Exclude are path.Match patterns on archive paths. A
+	// pattern containing a slash matches from the top of the archive; one
+	// without matches a base name at any depth. A matching directory
+	// selects everything below it. With no Include patterns everything is
+	// included; Exclude always wins.
+	Include []string
+	Exclude []string
+	// Conflict decides what happens to files that already exist:
+	// "overwrite" (the default), "skip" or "rename", which restores next to
+	// them as "<name>.restored-<time><ext>".
+	Conflict string
+	// SideDirectory restores into a new "<target>.restore-<time>" directory
+	// next to the target instead of into it.
+	SideDirectory bool
+	// JobID names the restore for WatchBackup; generated when empty.
+	JobID string
+
+	job *backupJob
+}
+
+// RestoreResult reports what a restore did.
+type RestoreResult struct {
+	// Path is the directory restored into.
+	Path     string
+	Restored int
+	Skipped  int
+	Renamed  int
+	JobID    string
+}
+
+func (o *RestoreOptions) validate() error {
+	switch o.Conflict {
+	case "":
+		o.Conflict = conflictOverwrite
+	case conflictOverwrite, conflictSkip, conflictRename:
+	default:
+		return fmt.Errorf("unsupported conflict policy: %s", o.Conflict)
+	}
+	for _, pattern := range append(append([]string{}, o.Include...), o.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// partial reports whether some entries may not be restored.
+func (o RestoreOptions) partial() bool {
+	return len(o.Include) > 0 || len(o.Exclude) > 0 || o.Conflict == conflictSkip
+}
+
+// selects reports whether the archive entry name is restored.
+func (o RestoreOptions) selects(name string, dir bool) bool {
+	name = entryPath(name)
+	if name == "" {
+		// The root entry only carries the source directory's metadata
+		return len(o.Include) == 0
+	}
+	for _, pattern := range o.Exclude {
+		if matchEntry(pattern, name) {
+			return false
+		}
+	}
+	if len(o.Include) == 0 {
+		return true
+	}
+	for _, pattern := range o.Include {
+		if matchEntry(pattern, name) || (dir && leadsTo(pattern, name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// entryPath normalises an archive name: no trailing slash, "" for the root.
+func entryPath(name string) string {
+	return strings.Trim(path.Clean("/"+name), "/")
+}
+
+// matchEntry matches pattern against name or any directory above it.
+func matchEntry(pattern, name string) bool {
+	pattern = strings.Trim(pattern, "/")
+	if !strings.Contains(pattern, "/") {
+		for _, part := range strings.Split(name, "/") {
+			if matched, _ := path.Match(pattern, part); matched {
+				return true
+			}
+		}
+		return false
+	}
+
+	for current := name; current != "."; current = path.Dir(current) {
+		if matched, _ := path.Match(pattern, current); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// leadsTo reports whether dir is a directory above entries pattern selects,
+// so that it is restored with its own metadata.
+func leadsTo(pattern, dir string) bool {
+	pattern = strings.Trim(pattern, "/")
+	if !strings.Contains(pattern, "/") {
+		return false
+	}
+	patternParts := strings.Split(pattern, "/")
+	dirParts := strings.Split(dir, "/")
+	if len(dirParts) >= len(patternParts) {
+		return false
+	}
+	for i, part := range dirParts {
+		if matched, _ := path.Match(patternParts[i], part); !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// sideDirectory returns a directory next to targetPath that does not exist yet.
+func sideDirectory(targetPath string, now time.Time) string {
+	base := fmt.Sprintf("%s.restore-%s", filepath.Clean(targetPath), now.Format("20060102-150405"))
+	candidate := base
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+		candidate = fmt.Sprintf("%s-%d", base, i)
+	}
+}
+
+// renamedPath returns a free name for restoring next to an existing file,
+// keeping the extension so the copy still opens as the same type.
+func renamedPath(path string, now time.Time) string {
+	ext := filepath.Ext(path)
+	if ext == filepath.Base(path) {
+		// Dotfiles such as .htaccess have no extension
+		ext = ""
+	}
+	base := strings.TrimSuffix(path, ext) + ".restored-" + now.Format("20060102-150405")
+
+	candidate := base + ext
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+		candidate = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+}
@@ -0,0 +1,237 @@
+package backup
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRestoreSelects(t *testing.T) {
+	tests := []struct {
+		name    string
+		include []string
+		exclude []string
+		entry   string
+		dir     bool
+		want    bool
+	}{
+		{name: "everything by default", entry: "public/index.php", want: true},
+		{name: "root by default", entry: "./", dir: true, want: true},
+		{name: "root with include", include: []string{"public"}, entry: "./", dir: true, want: false},
+
+		// Without a slash a pattern matches a base name at any depth
+		{name: "basename", include: []string{"*.php"}, entry: "public/index.php", want: true},
+		{name: "basename of a directory", include: []string{"uploads"}, entry: "wp-content/uploads/a.jpg", want: true},
+		{name: "basename not matching", include: []string{"*.php"}, entry: "public/style.css", want: false},
+
+		// With a slash it matches from the top of the archive
+		{name: "slash from the top", include: []string{"public/*.php"}, entry: "public/index.php", want: true},
+		{name: "slash not nested", include: []string{"public/*.php"}, entry: "old/public/index.php", want: false},
+		{name: "slash does not cross directories", include: []string{"public/*.php"}, entry: "public/lib/a.php", want: false},
+		{name: "leading slash", include: []string{"/public"}, entry: "public/index.php", want: true},
+		{name: "archive name prefix", include: []string{"public"}, entry: "./public/index.php", want: true},
+
+		// A selected directory brings everything below it
+		{name: "selected directory", include: []string{"wp-content/uploads"}, entry: "wp-content/uploads", dir: true, want: true},
+		{name: "below selected directory", include: []string{"wp-content/uploads"}, entry: "wp-content/uploads/2026/03/a.jpg", want: true},
+		{name: "parent of selected directory", include: []string{"wp-content/uploads"}, entry: "wp-content", dir: true, want: true},
+		{name: "file beside selected directory", include: []string{"wp-content/uploads"}, entry: "wp-content/index.php", want: false},
+		{name: "parent as a file", include: []string{"wp-content/uploads"}, entry: "wp-content", want: false},
+		{name: "unrelated directory", include: []string{"wp-content/uploads"}, entry: "wp-admin", dir: true, want: false},
+
+		// Exclude always wins
+		{name: "excluded", exclude: []string{"*.log"}, entry: "logs/error.log", want: false},
+		{name: "excluded directory", exclude: []string{"cache"}, entry: "public/cache/page.html", want: false},
+		{name: "not excluded", exclude: []string{"*.log"}, entry: "logs/README", want: true},
+		{name: "excluded and included", include: []string{"*.php"}, exclude: []string{"vendor"}, entry: "vendor/autoload.php", want: false},
+		{name: "excluded below included", include: []string{"public"}, exclude: []string{"public/cache"}, entry: "public/cache/a.html", want: false},
+		{name: "excluded parent", include: []string{"public/uploads"}, exclude: []string{"public"}, entry: "public", dir: true, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := RestoreOptions{Include: tt.include, Exclude: tt.exclude}
+			if got := options.selects(tt.entry, tt.dir); got != tt.want {
+				t.Errorf("selects(%q, %v) = %v, want %v", tt.entry, tt.dir, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchEntry(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"*.php", "index.php", true},
+		{"*.php", "a/b/index.php", true},
+		{"*.php", "a.php/readme", true},
+		{"*.php", "index.phps", false},
+		{"cache", "cache", true},
+		{"cache", "a/cache/b", true},
+		{"cache", "a/cached", false},
+		{"a/b", "a/b", true},
+		{"a/b", "a/b/c/d", true},
+		{"a/b", "x/a/b", false},
+		{"a/*", "a/b/c", true},
+		{"*/b", "a/b", true},
+		{"*/b", "a/x/b", false},
+		{"/a/b/", "a/b/c", true},
+		{"[", "a", false},
+	}
+	for _, tt := range tests {
+		if got := matchEntry(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("matchEntry(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLeadsTo(t *testing.T) {
+	tests := []struct {
+		pattern string
+		dir     string
+		want    bool
+	}{
+		{"a/b/c", "a", true},
+		{"a/b/c", "a/b", true},
+		{"a/b/c", "a/b/c", false},
+		{"a/b/c", "a/x", false},
+		{"a/b/c", "x", false},
+		{"*/b/c", "a/b", true},
+		{"a/*/c", "a/x", true},
+		{"/a/b/", "a", true},
+		{"b", "a", false},
+		{"*.php", "a", false},
+	}
+	for _, tt := range tests {
+		if got := leadsTo(tt.pattern, tt.dir); got != tt.want {
+			t.Errorf("leadsTo(%q, %q) = %v, want %v", tt.pattern, tt.dir, got, tt.want)
+		}
+	}
+}
+
+func TestRestoreOptionsValidate(t *testing.T) {
+	options := RestoreOptions{}
+	if err := options.validate(); err != nil || options.Conflict != conflictOverwrite {
+		t.Errorf("defaults: %v, conflict %q", err, options.Conflict)
+	}
+	for _, options := range []RestoreOptions{
+		{Conflict: "merge"},
+		{Include: []string{"["}},
+		{Exclude: []string{"a/[b"}},
+	} {
+		if err := options.validate(); err == nil {
+			t.Errorf("%+v accepted", options)
+		}
+	}
+}
+
+func TestRestoreConflictPolicies(t *testing.T) {
+	tests := []struct {
+		conflict string
+		want     RestoreResult
+		// wantFiles maps the files in the target to their content
+		wantFiles map[string]string
+	}{
+		{
+			conflict:  conflictOverwrite,
+			want:      RestoreResult{Restored: 3},
+			wantFiles: map[string]string{"index.php": "data", "new.txt": "data", ".htaccess": "data"},
+		},
+		{
+			conflict:  conflictSkip,
+			want:      RestoreResult{Restored: 1, Skipped: 2},
+			wantFiles: map[string]string{"index.php": "old", "new.txt": "data", ".htaccess": "old"},
+		},
+		{
+			conflict: conflictRename,
+			want:     RestoreResult{Restored: 3, Renamed: 2},
+			wantFiles: map[string]string{
+				"index.php":                 "old",
+				"index.restored-<time>.php": "data",
+				"new.txt":                   "data",
+				".htaccess":                 "old",
+				".htaccess.restored-<time>": "data",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.conflict, func(t *testing.T) {
+			root := t.TempDir()
+			for _, name := range []string{"index.php", ".htaccess"} {
+				if err := os.WriteFile(filepath.Join(root, name), []byte("old"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			x, err := newExtractor(root, RestoreOptions{Conflict: tt.conflict})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = x.extractAll(buildTar(t, []tar.Header{
+				{Name: "./", Typeflag: tar.TypeDir, Mode: 0755},
+				{Name: "./index.php", Typeflag: tar.TypeReg},
+				{Name: "./new.txt", Typeflag: tar.TypeReg},
+				{Name: "./.htaccess", Typeflag: tar.TypeReg},
+			}))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			x.result.Path = ""
+			if x.result != tt.want {
+				t.Errorf("result %+v, want %+v", x.result, tt.want)
+			}
+
+			suffix := ".restored-" + x.startedAt.Format("20060102-150405")
+			entries, err := os.ReadDir(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]string)
+			for _, entry := range entries {
+				data, err := os.ReadFile(filepath.Join(root, entry.Name()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				got[strings.Replace(entry.Name(), suffix, ".restored-<time>", 1)] = string(data)
+			}
+			if len(got) != len(tt.wantFiles) {
+				t.Errorf("target holds %q, want %q", got, tt.wantFiles)
+			}
+			for name, content := range tt.wantFiles {
+				if got[name] != content {
+					t.Errorf("%s holds %q, want %q", name, got[name], content)
+				}
+			}
+		})
+	}
+}
+
+func TestRestoreSkipsLinksToUnrestoredFiles(t *testing.T) {
+	root := t.TempDir()
+	x, err := newExtractor(root, RestoreOptions{Exclude: []string{"*.bak"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = x.extractAll(buildTar(t, []tar.Header{
+		{Name: "a.txt", Typeflag: tar.TypeReg},
+		{Name: "a.bak", Typeflag: tar.TypeReg},
+		{Name: "link-a", Typeflag: tar.TypeLink, Linkname: "a.txt"},
+		{Name: "link-bak", Typeflag: tar.TypeLink, Linkname: "a.bak"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x.result.Restored != 2 || x.result.Skipped != 2 {
+		t.Errorf("result %+v", x.result)
+	}
+	if _, err := os.Lstat(filepath.Join(root, "link-a")); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Lstat(filepath.Join(root, "link-bak")); !os.IsNotExist(err) {
+		t.Errorf("link to an excluded file was restored: %v", err)
+	}
+}
@@ -0,0 +1,313 @@
+package backup
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RetentionRule decides which backups of a name and type are kept. Keep
+// counts combine: a backup survives if any of them selects it.
+type RetentionRule struct {
+	// Name and Type are path.Match patterns; empty matches everything.
+	Name string `json:"name,omitempty"`
+	Type string `json:"type,omitempty"`
+
+	KeepLast    int `json:"keep_last"`
+	KeepDaily   int `json:"keep_daily"`
+	KeepWeekly  int `json:"keep_weekly"`
+	KeepMonthly int `json:"keep_monthly"`
+	KeepYearly  int `json:"keep_yearly"`
+}
+
+func (r RetentionRule) matches(name, backupType string) bool {
+	return matchPattern(r.Name, name) && matchPattern(r.Type, backupType)
+}
+
+// keepsAnything guards against a rule with no counts deleting everything.
+func (r RetentionRule) keepsAnything() bool {
+	return r.KeepLast > 0 || r.KeepDaily > 0 || r.KeepWeekly > 0 || r.KeepMonthly > 0 || r.KeepYearly > 0
+}
+
+func matchPattern(pattern, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	matched, err := path.Match(pattern, value)
+	return err == nil && matched
+}
+
+const locationRepository = "repository"
+
+// PrunedBackup is a backup considered by a prune run.
+type PrunedBackup struct {
+	Name string
+	Type string
+	Path string
+	// Location is the target holding the backup, or "repository".
+	Location  string
+	CreatedAt int64
+	Size      int64
+	// Reason explains why the backup was kept, e.g. "last 3, daily 7".
+	Reason string
+
+	key string
+}
+
+type PruneResult struct {
+	Kept           []PrunedBackup
+	Removed        []PrunedBackup
+	ReclaimedBytes int64
+	// RemovedChunks counts repository chunks no snapshot references anymore.
+	RemovedChunks int
+	// Warnings lists targets that could not be listed and backups that
+	// could not be removed. The other targets are pruned regardless.
+	Warnings []string
+}
+
+// PruneBackups applies the retention rules to the archives on every target
+// and to repository snapshots. Each target keeps its own history. name and
+// backupType restrict the run to matching backups when set. With dryRun
+// nothing is deleted and the result lists what would be removed.
+func (s Service) PruneBackups(name, backupType string, dryRun bool) (*PruneResult, error) {
+	return s.prune(name, backupType, dryRun, s.retention)
+}
+
+func (s Service) prune(name, backupType string, dryRun bool, rules []RetentionRule) (*PruneResult, error) {
+	result := &PruneResult{}
+	if len(rules) == 0 {
+		return result, nil
+	}
+
+	var candidates []PrunedBackup
+
+	for _, target := range s.targets {
+		backups, err := s.targetBackups(target)
+		if err != nil {
+			result.Warnings = append(result.Warnings, err.Error())
+			continue
+		}
+		candidates = append(candidates, backups...)
+	}
+
+	if s.repository != nil {
+		snapshots, err := s.repository.listSnapshots()
+		if err != nil {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("%s: %v", locationRepository, err))
+		}
+		for _, snapshot := range snapshots {
+			candidates = append(candidates, PrunedBackup{
+				Name:      snapshot.Name,
+				Type:      snapshot.Type,
+				Path:      snapshotPrefix + snapshot.ID,
+				Location:  locationRepository,
+				CreatedAt: snapshot.StartedAt,
+				Size:      snapshot.Size,
+			})
+		}
+	}
+
+	// Each location keeps its own history of every name and type
+	groups := make(map[string][]PrunedBackup)
+	var groupKeys []string
+	for _, candidate := range candidates {
+		if (name != "" && candidate.Name != name) || (backupType != "" && candidate.Type != backupType) {
+			continue
+		}
+		key := candidate.Location + "\x00" + candidate.Name + "\x00" + candidate.Type
+		if _, ok := groups[key]; !ok {
+			groupKeys = append(groupKeys, key)
+		}
+		groups[key] = append(groups[key], candidate)
+	}
+	sort.Strings(groupKeys)
+
+	removedSnapshots := false
+	for _, key := range groupKeys {
+		group := groups[key]
+		rule, ok := retentionRule(rules, group[0].Name, group[0].Type)
+		if !ok {
+			result.Kept = append(result.Kept, group...)
+			continue
+		}
+
+		kept, removed := applyRetention(rule, group)
+		result.Kept = append(result.Kept, kept...)
+
+		for _, backup := range removed {
+			if !dryRun {
+				if err := s.removeBackup(backup); err != nil {
+					result.Warnings = append(result.Warnings, fmt.Sprintf("%s: %v", backup.Path, err))
+					continue
+				}
+				if backup.Location == locationRepository {
+					removedSnapshots = true
+				}
+			}
+			result.Removed = append(result.Removed, backup)
+			result.ReclaimedBytes += backup.Size
+		}
+	}
+
+	if removedSnapshots {
+		removedChunks, err := s.repository.collectGarbage()
+		if err != nil {
+			return result, err
+		}
+		result.RemovedChunks = removedChunks
+	}
+
+	return result, nil
+}
+
+func retentionRule(rules []RetentionRule, name, backupType string) (RetentionRule, bool) {
+	for _, rule := range rules {
+		if rule.matches(name, backupType) && rule.keepsAnything() {
+			return rule, true
+		}
+	}
+	return RetentionRule{}, false
+}
+
+// applyRetention splits a group of backups into kept and removed, walking
+// from newest to oldest. Within each calendar tier the newest backup of a
+// period is kept until the tier's count is used up. Backups of the same
+// second are ordered by path so repeated runs agree on which one stays.
+func applyRetention(rule RetentionRule, backups []PrunedBackup) ([]PrunedBackup, []PrunedBackup) {
+	sort.Slice(backups, func(i, j int) bool {
+		if backups[i].CreatedAt != backups[j].CreatedAt {
+			return backups[i].CreatedAt > backups[j].CreatedAt
+		}
+		return backups[i].Path > backups[j].Path
+	})
+
+	tiers := []struct {
+		label  string
+		count  int
+		period func(time.Time) string
+	}{
+		{"daily", rule.KeepDaily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{"weekly", rule.KeepWeekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-%02d", year, week)
+		}},
+		{"monthly", rule.KeepMonthly, func(t time.Time) string { return t.Format("2006-01") }},
+		{"yearly", rule.KeepYearly, func(t time.Time) string { return t.Format("2006") }},
+	}
+
+	reasons := make([][]string, len(backups))
+	for i := 0; i < len(backups) && i < rule.KeepLast; i++ {
+		reasons[i] = append(reasons[i], fmt.Sprintf("last %d", rule.KeepLast))
+	}
+	for _, tier := range tiers {
+		remaining := tier.count
+		last := ""
+		for i, backup := range backups {
+			if remaining == 0 {
+				break
+			}
+			period := tier.period(time.Unix(backup.CreatedAt, 0))
+			if period == last {
+				continue
+			}
+			last = period
+			reasons[i] = append(reasons[i], fmt.Sprintf("%s %d", tier.label, tier.count))
+			remaining--
+		}
+	}
+
+	var kept, removed []PrunedBackup
+	for i, backup := range backups {
+		if len(reasons[i]) == 0 {
+			removed = append(removed, backup)
+			continue
+		}
+		backup.Reason = strings.Join(reasons[i], ", ")
+		kept = append(kept, backup)
+	}
+	return kept, removed
+}
+
+// targetBackups lists the archives on target by their names. On the local
+// target name, type and time come from the sidecar manifest when there is one.
+func (s Service) targetBackups(target namedTarget) ([]PrunedBackup, error) {
+	objects, err := listArchives(target)
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []PrunedBackup
+	for _, object := range objects {
+		backup := PrunedBackup{
+			Path:     s.targetPath(target, object.Key),
+			Location: target.name,
+			Size:     object.Size,
+			key:      object.Key,
+		}
+
+		var manifest *Manifest
+		if target.name == destinationLocal {
+			manifest, _ = s.ReadManifest(backup.Path)
+		}
+		if manifest != nil {
+			backup.Name = manifest.Name
+			backup.Type = manifest.Type
+			backup.CreatedAt = manifest.StartedAt
+		} else if name, backupType, createdAt, ok := parseArchiveName(path.Base(object.Key)); ok {
+			backup.Name = name
+			backup.Type = backupType
+			backup.CreatedAt = createdAt.Unix()
+		} else {
+			// Archives we cannot attribute are never pruned
+			continue
+		}
+		backups = append(backups, backup)
+	}
+	return backups, nil
+}
+
+// parseArchiveName splits "<name>-<type>-<timestamp>.tar.gz[.age]" as
+// written by CreateBackup. Names may contain dashes; types may not.
+func parseArchiveName(filename string) (string, string, time.Time, bool) {
+	if !isArchiveName(filename) {
+		return "", "", time.Time{}, false
+	}
+	base := strings.TrimSuffix(strings.TrimSuffix(filename, encryptedSuffix), ".tar.gz")
+
+	const layout = "2006-01-02-15-04-05"
+	if len(base) < len(layout)+4 || base[len(base)-len(layout)-1] != '-' {
+		return "", "", time.Time{}, false
+	}
+	createdAt, err := time.ParseInLocation(layout, base[len(base)-len(layout):], time.Local)
+	if err != nil {
+		return "", "", time.Time{}, false
+	}
+
+	rest := base[:len(base)-len(layout)-1]
+	i := strings.LastIndex(rest, "-")
+	if i <= 0 || i == len(rest)-1 {
+		return "", "", time.Time{}, false
+	}
+	return rest[:i], rest[i+1:], createdAt, true
+}
+
+func (s Service) removeBackup(backup PrunedBackup) error {
+	if backup.Location == locationRepository {
+		id, _ := snapshotID(backup.Path)
+		return s.repository.deleteSnapshot(id)
+	}
+
+	target, ok := s.findTarget(backup.Location)
+	if !ok || target.err != nil {
+		return fmt.Errorf("backup target unavailable: %s", backup.Location)
+	}
+	if err := target.target.Delete(backup.key); err != nil {
+		return fmt.Errorf("failed to remove backup: %v", err)
+	}
+	if err := target.target.Delete(backup.key + manifestSuffix); err != nil {
+		return fmt.Errorf("failed to remove manifest: %v", err)
+	}
+	return nil
+}
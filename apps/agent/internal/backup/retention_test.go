@@ -0,0 +1,241 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func backupAt(path string, year int, month time.Month, day, hour int) PrunedBackup {
+	return PrunedBackup{
+		Name:      "site",
+		Type:      "files",
+		Path:      path,
+		Location:  destinationLocal,
+		CreatedAt: time.Date(year, month, day, hour, 0, 0, 0, time.Local).Unix(),
+	}
+}
+
+func TestApplyRetention(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    RetentionRule
+		backups []PrunedBackup
+		kept    []string
+		removed []string
+	}{
+		{
+			name: "keep last",
+			rule: RetentionRule{KeepLast: 2},
+			backups: []PrunedBackup{
+				backupAt("c", 2026, 3, 2, 12),
+				backupAt("a", 2026, 3, 4, 12),
+				backupAt("d", 2026, 3, 1, 12),
+				backupAt("b", 2026, 3, 3, 12),
+			},
+			kept:    []string{"a (last 2)", "b (last 2)"},
+			removed: []string{"c", "d"},
+		},
+		{
+			// The newest backup of a day stands for that day
+			name: "daily",
+			rule: RetentionRule{KeepDaily: 2},
+			backups: []PrunedBackup{
+				backupAt("a", 2026, 3, 4, 18),
+				backupAt("b", 2026, 3, 4, 6),
+				backupAt("c", 2026, 3, 3, 12),
+				backupAt("d", 2026, 3, 2, 12),
+			},
+			kept:    []string{"a (daily 2)", "c (daily 2)"},
+			removed: []string{"b", "d"},
+		},
+		{
+			// ISO weeks start on Monday; March 2, 2026 is one
+			name: "weekly",
+			rule: RetentionRule{KeepWeekly: 2},
+			backups: []PrunedBackup{
+				backupAt("a", 2026, 3, 8, 12),
+				backupAt("b", 2026, 3, 2, 12),
+				backupAt("c", 2026, 3, 1, 12),
+				backupAt("d", 2026, 2, 23, 12),
+				backupAt("e", 2026, 2, 18, 12),
+			},
+			kept:    []string{"a (weekly 2)", "c (weekly 2)"},
+			removed: []string{"b", "d", "e"},
+		},
+		{
+			name: "monthly",
+			rule: RetentionRule{KeepMonthly: 2},
+			backups: []PrunedBackup{
+				backupAt("a", 2026, 3, 20, 12),
+				backupAt("b", 2026, 3, 2, 12),
+				backupAt("c", 2026, 2, 10, 12),
+				backupAt("d", 2026, 1, 5, 12),
+			},
+			kept:    []string{"a (monthly 2)", "c (monthly 2)"},
+			removed: []string{"b", "d"},
+		},
+		{
+			name: "counts combine",
+			rule: RetentionRule{KeepLast: 1, KeepDaily: 2, KeepMonthly: 2},
+			backups: []PrunedBackup{
+				backupAt("a", 2026, 3, 4, 12),
+				backupAt("b", 2026, 3, 4, 8),
+				backupAt("c", 2026, 3, 3, 12),
+				backupAt("d", 2026, 2, 10, 12),
+				backupAt("e", 2026, 2, 1, 12),
+			},
+			kept:    []string{"a (last 1, daily 2, monthly 2)", "c (daily 2)", "d (monthly 2)"},
+			removed: []string{"b", "e"},
+		},
+		{
+			name: "same second",
+			rule: RetentionRule{KeepDaily: 1},
+			backups: []PrunedBackup{
+				backupAt("a", 2026, 3, 4, 12),
+				backupAt("b", 2026, 3, 4, 12),
+			},
+			kept:    []string{"b (daily 1)"},
+			removed: []string{"a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The outcome must not depend on the order backups are listed in
+			for _, reverse := range []bool{false, true} {
+				backups := make([]PrunedBackup, len(tt.backups))
+				for i, backup := range tt.backups {
+					if reverse {
+						i = len(backups) - 1 - i
+					}
+					backups[i] = backup
+				}
+
+				kept, removed := applyRetention(tt.rule, backups)
+				var gotKept, gotRemoved []string
+				for _, backup := range kept {
+					gotKept = append(gotKept, fmt.Sprintf("%s (%s)", backup.Path, backup.Reason))
+				}
+				for _, backup := range removed {
+					gotRemoved = append(gotRemoved, backup.Path)
+				}
+				if strings.Join(gotKept, "; ") != strings.Join(tt.kept, "; ") {
+					t.Errorf("kept %q, want %q", gotKept, tt.kept)
+				}
+				if strings.Join(gotRemoved, "; ") != strings.Join(tt.removed, "; ") {
+					t.Errorf("removed %q, want %q", gotRemoved, tt.removed)
+				}
+			}
+		})
+	}
+}
+
+func TestParseArchiveName(t *testing.T) {
+	createdAt := time.Date(2026, 1, 2, 3, 4, 5, 0, time.Local)
+	tests := []struct {
+		filename   string
+		name       string
+		backupType string
+		ok         bool
+	}{
+		{"site-files-2026-01-02-03-04-05.tar.gz", "site", "files", true},
+		{"my-shop-database-2026-01-02-03-04-05.tar.gz", "my-shop", "database", true},
+		{"site-files-2026-01-02-03-04-05.tar.gz.age", "site", "files", true},
+		{"site-2026-01-02-03-04-05.tar.gz", "", "", false},
+		{"-files-2026-01-02-03-04-05.tar.gz", "", "", false},
+		{"site--2026-01-02-03-04-05.tar.gz", "", "", false},
+		{"site-files-2026-13-02-03-04-05.tar.gz", "", "", false},
+		{"site-files-20260102030405.tar.gz", "", "", false},
+		{"site-files-2026-01-02-03-04-05.zip", "", "", false},
+		{"notes.tar.gz", "", "", false},
+	}
+	for _, tt := range tests {
+		name, backupType, at, ok := parseArchiveName(tt.filename)
+		if ok != tt.ok {
+			t.Errorf("parseArchiveName(%q) ok = %v", tt.filename, ok)
+			continue
+		}
+		if ok && (name != tt.name || backupType != tt.backupType || !at.Equal(createdAt)) {
+			t.Errorf("parseArchiveName(%q) = %q, %q, %v", tt.filename, name, backupType, at)
+		}
+	}
+}
+
+func TestPruneDryRun(t *testing.T) {
+	dir := t.TempDir()
+	names := []string{
+		"site-files-2026-01-01-00-00-00.tar.gz",
+		"site-files-2026-01-02-00-00-00.tar.gz",
+		"site-files-2026-01-03-00-00-00.tar.gz",
+		// Archives that cannot be attributed are never pruned
+		"notes.tar.gz",
+	}
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("archive"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := NewService(Config{StoragePath: dir, Retention: []RetentionRule{{KeepLast: 1}}})
+
+	result, err := s.PruneBackups("", "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Removed) != 2 || len(result.Kept) != 1 || result.ReclaimedBytes != 2*int64(len("archive")) {
+		t.Errorf("removed %d, kept %d, reclaimed %d", len(result.Removed), len(result.Kept), result.ReclaimedBytes)
+	}
+	for _, name := range names {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("dry run removed %s", name)
+		}
+	}
+
+	result, err = s.PruneBackups("", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(result.Removed) != 2 || len(entries) != 2 {
+		t.Errorf("removed %d, %d files left", len(result.Removed), len(entries))
+	}
+}
+
+func TestPruneSkipsUnavailableTargets(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"site-files-2026-01-01-00-00-00.tar.gz",
+		"site-files-2026-01-02-00-00-00.tar.gz",
+		"site-files-2026-01-03-00-00-00.tar.gz",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("archive"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := NewService(Config{
+		StoragePath: dir,
+		Targets:     []TargetConfig{{Name: "offsite", Type: "ftp"}},
+		Retention:   []RetentionRule{{KeepLast: 1}},
+	})
+
+	backups, warnings, err := s.ListBackups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 3 || len(warnings) != 1 {
+		t.Errorf("listed %d backups with warnings %v", len(backups), warnings)
+	}
+
+	result, err := s.PruneBackups("", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Removed) != 2 || len(result.Kept) != 1 || len(result.Warnings) != 1 {
+		t.Errorf("removed %d, kept %d, warnings %v", len(result.Removed), len(result.Kept), result.Warnings)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "site-files-2026-01-03-00-00-00.tar.gz")); err != nil {
+		t.Error("newest backup was removed")
+	}
+}
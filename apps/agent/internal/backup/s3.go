@@ -0,0 +1,146 @@
+package backup
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// s3PathPrefix marks backup paths that name an archive in the S3 bucket.
+const s3PathPrefix = destinationS3 + ":"
+
+const defaultPartSize = 16 * 1024 * 1024
+
+// S3Path returns the backup path that refers to an archive in the bucket.
+func S3Path(key string) string {
+	return s3PathPrefix + key
+}
+
+func (s Service) s3Enabled() bool {
+	return s.s3Config.Enabled && s.s3Config.Bucket != ""
+}
+
+func newS3Client(config S3Config) (*s3.S3, error) {
+	// Create AWS session
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:         aws.String(config.Endpoint),
+		Region:           aws.String(config.Region),
+		Credentials:      credentials.NewStaticCredentials(config.AccessKey, config.SecretKey, ""),
+		S3ForcePathStyle: aws.Bool(config.ForcePathStyle),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AWS session: %v", err)
+	}
+
+	// Create S3 service
+	return s3.New(sess), nil
+}
+
+func newUploader(svc *s3.S3, partSize int64) *s3manager.Uploader {
+	if partSize < s3manager.MinUploadPartSize {
+		partSize = defaultPartSize
+	}
+	return s3manager.NewUploaderWithClient(svc, func(u *s3manager.Uploader) {
+		u.PartSize = partSize
+	})
+}
+
+// s3Target keeps archives in a bucket below prefix. Put is a multipart
+// upload, so an archive can be written while it is being produced.
+type s3Target struct {
+	svc      *s3.S3
+	bucket   string
+	prefix   string
+	partSize int64
+	// pageSize caps the keys per listing request; zero leaves the server
+	// default of 1000.
+	pageSize int64
+}
+
+func newS3Target(config S3Config, prefix string) (*s3Target, error) {
+	if config.Bucket == "" {
+		return nil, fmt.Errorf("S3 target requires a bucket")
+	}
+	svc, err := newS3Client(config)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Target{svc: svc, bucket: config.Bucket, prefix: prefix, partSize: config.PartSize}, nil
+}
+
+func (t *s3Target) key(key string) string {
+	return path.Join(t.prefix, key)
+}
+
+// Put aborts the multipart upload if r fails, so no object is created.
+func (t *s3Target) Put(key string, r io.Reader) error {
+	_, err := newUploader(t.svc, t.partSize).Upload(&s3manager.UploadInput{
+		Bucket: aws.String(t.bucket),
+		Key:    aws.String(t.key(key)),
+		Body:   r,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload %s to S3: %v", key, err)
+	}
+	return nil
+}
+
+func (t *s3Target) Get(key string) (io.ReadCloser, error) {
+	result, err := t.svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(t.bucket),
+		Key:    aws.String(t.key(key)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s from S3: %v", key, err)
+	}
+	return result.Body, nil
+}
+
+func (t *s3Target) List(dir string) ([]TargetObject, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(t.bucket),
+		Delimiter: aws.String("/"),
+	}
+	if t.pageSize > 0 {
+		input.MaxKeys = aws.Int64(t.pageSize)
+	}
+	prefix := ""
+	if root := t.key(dir); root != "" && root != "." {
+		prefix = strings.TrimSuffix(root, "/") + "/"
+		input.Prefix = aws.String(prefix)
+	}
+
+	var objects []TargetObject
+	err := t.svc.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			objects = append(objects, TargetObject{
+				Key:     path.Join(dir, strings.TrimPrefix(aws.StringValue(object.Key), prefix)),
+				Size:    aws.Int64Value(object.Size),
+				ModTime: aws.TimeValue(object.LastModified),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list S3 backups: %v", err)
+	}
+	return objects, nil
+}
+
+func (t *s3Target) Delete(key string) error {
+	_, err := t.svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(t.bucket),
+		Key:    aws.String(t.key(key)),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete %s from S3: %v", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package backup
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// testEndpoint returns the URL in AGENT_TEST_<name>_ENDPOINT, or
+// defaultURL, and skips the test when nothing accepts connections there.
+func testEndpoint(t *testing.T, name, defaultURL string) string {
+	endpoint := testEnv(name+"_ENDPOINT", defaultURL)
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.DialTimeout("tcp", u.Host, time.Second)
+	if err != nil {
+		t.Skipf("%s not reachable at %s: %v", strings.ToLower(name), endpoint, err)
+	}
+	conn.Close()
+	return endpoint
+}
+
+// testEnv returns AGENT_TEST_<name>, or fallback when it is not set.
+func testEnv(name, fallback string) string {
+	if value := os.Getenv("AGENT_TEST_" + name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// testS3Target connects to the MinIO of docker-compose, or the server in
+// AGENT_TEST_S3_ENDPOINT, and skips the test when there is none. Every
+// test writes below its own prefix and removes it afterwards.
+func testS3Target(t *testing.T) *s3Target {
+	config := S3Config{
+		Endpoint:       testEndpoint(t, "S3", "http://localhost:9000"),
+		Bucket:         testEnv("S3_BUCKET", "agent-test"),
+		AccessKey:      testEnv("S3_ACCESS_KEY", "minioadmin"),
+		SecretKey:      testEnv("S3_SECRET_KEY", "minioadmin"),
+		Region:         "us-east-1",
+		ForcePathStyle: true,
+	}
+
+	target, err := newS3Target(config, fmt.Sprintf("test-%d", time.Now().UnixNano()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = target.svc.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String(config.Bucket)})
+	var awsErr awserr.Error
+	if err != nil && !(errors.As(err, &awsErr) && (awsErr.Code() == s3.ErrCodeBucketAlreadyOwnedByYou || awsErr.Code() == s3.ErrCodeBucketAlreadyExists)) {
+		t.Fatalf("failed to create bucket: %v", err)
+	}
+
+	t.Cleanup(func() {
+		target.svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+			Bucket: aws.String(target.bucket),
+			Prefix: aws.String(target.prefix + "/"),
+		}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, object := range page.Contents {
+				target.svc.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(target.bucket), Key: object.Key})
+			}
+			return true
+		})
+	})
+	return target
+}
+
+func getObject(t *testing.T, target *s3Target, key string) []byte {
+	t.Helper()
+	r, err := target.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestS3TargetObjects(t *testing.T) {
+	target := testS3Target(t)
+
+	if err := target.Put("site/a.tar.gz", bytes.NewReader([]byte("archive"))); err != nil {
+		t.Fatal(err)
+	}
+	if got := getObject(t, target, "site/a.tar.gz"); string(got) != "archive" {
+		t.Errorf("got %q", got)
+	}
+
+	objects, err := target.List("site")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].Key != "site/a.tar.gz" || objects[0].Size != int64(len("archive")) || objects[0].ModTime.IsZero() {
+		t.Errorf("listed %+v", objects)
+	}
+
+	if err := target.Delete("site/a.tar.gz"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := target.Get("site/a.tar.gz"); err == nil {
+		t.Error("deleted object can still be read")
+	}
+	if objects, err := target.List("site"); err != nil || len(objects) != 0 {
+		t.Errorf("listed %+v after delete, %v", objects, err)
+	}
+}
+
+func TestS3TargetMultipart(t *testing.T) {
+	target := testS3Target(t)
+	target.partSize = s3manager.MinUploadPartSize
+
+	// Two full parts and a short one, read as a stream of unknown length
+	data := make([]byte, 2*s3manager.MinUploadPartSize+1000)
+	rand.New(rand.NewSource(1)).Read(data)
+	if err := target.Put("big.tar.gz", io.MultiReader(bytes.NewReader(data))); err != nil {
+		t.Fatal(err)
+	}
+	if got := getObject(t, target, "big.tar.gz"); !bytes.Equal(got, data) {
+		t.Errorf("read back %d bytes that differ from the %d written", len(got), len(data))
+	}
+
+	// A failing source aborts the upload instead of leaving a partial object
+	failing := io.MultiReader(bytes.NewReader(data[:s3manager.MinUploadPartSize+1]), &failingReader{})
+	if err := target.Put("broken.tar.gz", failing); err == nil {
+		t.Fatal("upload of a failing reader succeeded")
+	}
+	if _, err := target.Get("broken.tar.gz"); err == nil {
+		t.Error("failed upload left an object")
+	}
+	uploads, err := target.svc.ListMultipartUploads(&s3.ListMultipartUploadsInput{
+		Bucket: aws.String(target.bucket),
+		Prefix: aws.String(target.key("broken.tar.gz")),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uploads.Uploads) != 0 {
+		t.Errorf("failed upload was not aborted: %v", uploads.Uploads)
+	}
+}
+
+func TestS3TargetListPages(t *testing.T) {
+	target := testS3Target(t)
+	target.pageSize = 2
+
+	var want []string
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("site/%d.tar.gz", i)
+		want = append(want, key)
+		if err := target.Put(key, bytes.NewReader([]byte(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Objects in subdirectories are not part of the listing
+	if err := target.Put("site/older/x.tar.gz", bytes.NewReader(nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	objects, err := target.List("site")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, object := range objects {
+		got = append(got, object.Key)
+	}
+	sort.Strings(got)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("listed %v, want %v", got, want)
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("source failed")
+}
@@ -0,0 +1,444 @@
+package backup
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	mathrand "math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// maxSchedulerSleep bounds how long the scheduler sleeps, so that clock
+// changes and suspended hosts are noticed within a minute.
+const maxSchedulerSleep = time.Minute
+
+// defaultScheduleTimeout bounds a scheduled run whose schedule sets none.
+const defaultScheduleTimeout = 24 * time.Hour
+
+// Schedule is a recurring backup job run by the agent itself, so backups
+// continue while the control plane is unreachable.
+type Schedule struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	SourcePath string `json:"source_path"`
+	// Cron is a five-field cron expression or a descriptor such as @daily,
+	// evaluated in the agent's local time.
+	Cron string `json:"cron"`
+	// Destination is a comma-separated list of targets; see CreateBackup.
+	Destination string `json:"destination"`
+	// Retention, when set, replaces the configured rules for this job.
+	Retention *RetentionRule `json:"retention,omitempty"`
+	// Exclude, MaxFileSize, MaxTotalSize and the hooks are passed to
+	// CreateBackup; see BackupOptions.
+	Exclude            []string `json:"exclude,omitempty"`
+	MaxFileSize        int64    `json:"max_file_size,omitempty"`
+	MaxTotalSize       int64    `json:"max_total_size,omitempty"`
+	PreHook            string   `json:"pre_hook,omitempty"`
+	PostHook           string   `json:"post_hook,omitempty"`
+	HookTimeoutSeconds int      `json:"hook_timeout_seconds,omitempty"`
+	// JitterSeconds delays each run by a random amount up to this value.
+	JitterSeconds int `json:"jitter_seconds"`
+	// TimeoutSeconds bounds a run; see runSchedule. 24 hours when zero.
+	TimeoutSeconds int            `json:"timeout_seconds,omitempty"`
+	Enabled        bool           `json:"enabled"`
+	Status         ScheduleStatus `json:"status"`
+}
+
+func (schedule Schedule) backupOptions() BackupOptions {
+	return BackupOptions{
+		Exclude:      schedule.Exclude,
+		MaxFileSize:  schedule.MaxFileSize,
+		MaxTotalSize: schedule.MaxTotalSize,
+		PreHook:      schedule.PreHook,
+		PostHook:     schedule.PostHook,
+		HookTimeout:  time.Duration(schedule.HookTimeoutSeconds) * time.Second,
+	}
+}
+
+func (schedule Schedule) timeout() time.Duration {
+	if schedule.TimeoutSeconds == 0 {
+		return defaultScheduleTimeout
+	}
+	return time.Duration(schedule.TimeoutSeconds) * time.Second
+}
+
+// ScheduleStatus records the outcome of a schedule's most recent run.
+type ScheduleStatus struct {
+	LastStartedAt  int64  `json:"last_started_at"`
+	LastFinishedAt int64  `json:"last_finished_at"`
+	LastSuccess    bool   `json:"last_success"`
+	LastError      string `json:"last_error,omitempty"`
+	LastBackupPath string `json:"last_backup_path,omitempty"`
+	NextRunAt      int64  `json:"next_run_at"`
+	Running        bool   `json:"running"`
+	// LastTargets is the outcome of the last run on each target.
+	LastTargets []TargetStatus `json:"last_targets,omitempty"`
+	// LastWarnings lists entries the last run skipped or only partly read.
+	LastWarnings []string `json:"last_warnings,omitempty"`
+}
+
+// scheduler keeps schedules in memory and persists them with their status
+// as JSON so that both survive agent restarts.
+type scheduler struct {
+	path      string
+	mu        sync.Mutex
+	loaded    bool
+	schedules map[string]*Schedule
+	wake      chan struct{}
+}
+
+func newScheduler(path string) *scheduler {
+	return &scheduler{
+		path:      path,
+		schedules: make(map[string]*Schedule),
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+// load reads the state file on first use. Callers must hold mu.
+func (sc *scheduler) load() error {
+	if sc.loaded {
+		return nil
+	}
+
+	data, err := os.ReadFile(sc.path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read schedule state: %v", err)
+	}
+	if err == nil {
+		var schedules []*Schedule
+		if err := json.Unmarshal(data, &schedules); err != nil {
+			return fmt.Errorf("failed to parse schedule state: %v", err)
+		}
+		for _, schedule := range schedules {
+			// A run in progress when the agent stopped is over now
+			if schedule.Status.Running {
+				schedule.Status.Running = false
+				schedule.Status.LastSuccess = false
+				schedule.Status.LastError = "interrupted by agent restart"
+			}
+			// Recomputed from now; runs missed while the agent was down are skipped
+			schedule.Status.NextRunAt = 0
+			sc.schedules[schedule.ID] = schedule
+		}
+	}
+
+	sc.loaded = true
+	return nil
+}
+
+// save writes the state file atomically. Callers must hold mu.
+func (sc *scheduler) save() error {
+	if err := os.MkdirAll(filepath.Dir(sc.path), 0755); err != nil {
+		return fmt.Errorf("failed to create schedule state directory: %v", err)
+	}
+
+	data, err := json.MarshalIndent(sc.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := sc.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write schedule state: %v", err)
+	}
+	return os.Rename(tmpPath, sc.path)
+}
+
+// list returns copies of all schedules sorted by ID. Callers must hold mu.
+func (sc *scheduler) list() []Schedule {
+	var schedules []Schedule
+	for _, schedule := range sc.schedules {
+		schedules = append(schedules, *schedule)
+	}
+	sort.Slice(schedules, func(i, j int) bool {
+		return schedules[i].ID < schedules[j].ID
+	})
+	return schedules
+}
+
+func (sc *scheduler) notify() {
+	select {
+	case sc.wake <- struct{}{}:
+	default:
+	}
+}
+
+// nextRun returns the next time schedule should fire after now, including
+// a random jitter.
+func nextRun(schedule *Schedule, now time.Time) (time.Time, error) {
+	expression, err := cron.ParseStandard(schedule.Cron)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid cron expression %q: %v", schedule.Cron, err)
+	}
+
+	next := expression.Next(now)
+	if schedule.JitterSeconds > 0 {
+		next = next.Add(time.Duration(mathrand.Int63n(int64(schedule.JitterSeconds) * int64(time.Second))))
+	}
+	return next, nil
+}
+
+func validateSchedule(schedule *Schedule) error {
+	if schedule.Name == "" || schedule.Type == "" || schedule.SourcePath == "" {
+		return fmt.Errorf("schedule requires a name, type and source path")
+	}
+	if _, err := cron.ParseStandard(schedule.Cron); err != nil {
+		return fmt.Errorf("invalid cron expression %q: %v", schedule.Cron, err)
+	}
+	if schedule.Destination == "" {
+		schedule.Destination = destinationLocal
+	}
+	if schedule.JitterSeconds < 0 {
+		return fmt.Errorf("jitter must not be negative")
+	}
+	if schedule.TimeoutSeconds < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+	return nil
+}
+
+// PutSchedule creates a schedule, or replaces the one with the same ID while
+// keeping its run status. A new ID is assigned when none is given.
+func (s Service) PutSchedule(schedule Schedule) (Schedule, error) {
+	if err := validateSchedule(&schedule); err != nil {
+		return Schedule{}, err
+	}
+	if _, err := s.resolveTargets(schedule.Destination); err != nil {
+		return Schedule{}, err
+	}
+	if err := schedule.backupOptions().validate(); err != nil {
+		return Schedule{}, err
+	}
+	if err := s.checkHooks(schedule.backupOptions()); err != nil {
+		return Schedule{}, err
+	}
+
+	sc := s.scheduler
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if err := sc.load(); err != nil {
+		return Schedule{}, err
+	}
+
+	if schedule.ID == "" {
+		id := make([]byte, 8)
+		if _, err := rand.Read(id); err != nil {
+			return Schedule{}, err
+		}
+		schedule.ID = hex.EncodeToString(id)
+	}
+
+	schedule.Status = ScheduleStatus{}
+	if existing, ok := sc.schedules[schedule.ID]; ok {
+		schedule.Status = existing.Status
+	}
+	schedule.Status.NextRunAt = 0
+	if schedule.Enabled {
+		next, err := nextRun(&schedule, time.Now())
+		if err != nil {
+			return Schedule{}, err
+		}
+		schedule.Status.NextRunAt = next.Unix()
+	}
+
+	sc.schedules[schedule.ID] = &schedule
+	if err := sc.save(); err != nil {
+		return Schedule{}, err
+	}
+
+	sc.notify()
+	return schedule, nil
+}
+
+// DeleteSchedule removes a schedule. A run already in progress completes.
+func (s Service) DeleteSchedule(id string) error {
+	sc := s.scheduler
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if err := sc.load(); err != nil {
+		return err
+	}
+	if _, ok := sc.schedules[id]; !ok {
+		return fmt.Errorf("schedule not found: %s", id)
+	}
+	delete(sc.schedules, id)
+	return sc.save()
+}
+
+// Schedules returns every schedule with its last run status.
+func (s Service) Schedules() ([]Schedule, error) {
+	sc := s.scheduler
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if err := sc.load(); err != nil {
+		return nil, err
+	}
+	return sc.list(), nil
+}
+
+// RunScheduler starts due schedules until the process exits. A schedule is
+// never started while its previous run is still going, up to the schedule's
+// timeout; that occurrence is skipped.
+func (s Service) RunScheduler() {
+	for {
+		wait := s.dispatchSchedules(time.Now())
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-s.scheduler.wake:
+			timer.Stop()
+		}
+	}
+}
+
+// dispatchSchedules starts every due schedule and returns how long to sleep
+// before the next one.
+func (s Service) dispatchSchedules(now time.Time) time.Duration {
+	sc := s.scheduler
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if err := sc.load(); err != nil {
+		return maxSchedulerSleep
+	}
+
+	wait := maxSchedulerSleep
+	changed := false
+	for _, schedule := range sc.schedules {
+		if !schedule.Enabled {
+			continue
+		}
+
+		if schedule.Status.NextRunAt == 0 {
+			next, err := nextRun(schedule, now)
+			if err != nil {
+				continue
+			}
+			schedule.Status.NextRunAt = next.Unix()
+			changed = true
+		}
+
+		if schedule.Status.NextRunAt <= now.Unix() {
+			if !schedule.Status.Running {
+				schedule.Status.Running = true
+				schedule.Status.LastStartedAt = now.Unix()
+				go s.runSchedule(*schedule)
+			}
+
+			next, err := nextRun(schedule, now)
+			if err != nil {
+				continue
+			}
+			schedule.Status.NextRunAt = next.Unix()
+			changed = true
+		}
+
+		if until := time.Until(time.Unix(schedule.Status.NextRunAt, 0)); until < wait {
+			wait = until
+		}
+	}
+
+	if changed {
+		sc.save()
+	}
+	if wait < time.Second {
+		wait = time.Second
+	}
+	return wait
+}
+
+// runSchedule runs a scheduled backup and records its outcome. A run that
+// exceeds the schedule's timeout is recorded as failed so that the
+// schedule runs again; the backup itself cannot be interrupted and its
+// eventual outcome is discarded.
+func (s Service) runSchedule(schedule Schedule) {
+	done := make(chan ScheduleStatus, 1)
+	go func() {
+		done <- s.scheduledBackup(schedule)
+	}()
+
+	var status ScheduleStatus
+	timer := time.NewTimer(schedule.timeout())
+	select {
+	case status = <-done:
+		timer.Stop()
+	case <-timer.C:
+		status = ScheduleStatus{
+			LastFinishedAt: time.Now().Unix(),
+			LastError:      fmt.Sprintf("backup did not finish within %s", schedule.timeout()),
+		}
+	}
+
+	sc := s.scheduler
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	current, ok := sc.schedules[schedule.ID]
+	if !ok {
+		// Deleted while running
+		return
+	}
+	status.LastStartedAt = current.Status.LastStartedAt
+	status.NextRunAt = current.Status.NextRunAt
+	current.Status = status
+	sc.save()
+}
+
+// scheduledBackup creates the backup of a schedule and applies its
+// retention.
+func (s Service) scheduledBackup(schedule Schedule) ScheduleStatus {
+	result, err := s.CreateBackup(schedule.Name, schedule.Type, schedule.SourcePath, schedule.Destination, schedule.backupOptions())
+
+	status := ScheduleStatus{
+		LastFinishedAt: time.Now().Unix(),
+		LastSuccess:    err == nil,
+	}
+	if err != nil {
+		status.LastError = err.Error()
+	} else {
+		status.LastBackupPath = result.Path
+		status.LastTargets = result.Targets
+		status.LastWarnings = result.Warnings
+
+		// A job only succeeds once every target has the backup
+		var failed []string
+		for _, target := range result.Targets {
+			if !target.Success {
+				failed = append(failed, fmt.Sprintf("%s: %s", target.Target, target.Error))
+			}
+		}
+		if len(failed) > 0 {
+			status.LastSuccess = false
+			status.LastError = "backup failed on some targets: " + strings.Join(failed, "; ")
+		}
+
+		rules := s.retention
+		if schedule.Retention != nil {
+			rules = []RetentionRule{*schedule.Retention}
+		}
+		pruned, err := s.prune(schedule.Name, schedule.Type, false, rules)
+		if err != nil && status.LastError == "" {
+			status.LastError = fmt.Sprintf("backup succeeded but pruning failed: %v", err)
+		}
+		if pruned != nil {
+			for _, warning := range pruned.Warnings {
+				status.LastWarnings = append(status.LastWarnings, "prune: "+warning)
+			}
+		}
+	}
+	return status
+}
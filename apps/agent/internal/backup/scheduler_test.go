@@ -0,0 +1,223 @@
+package backup
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testScheduleService(t *testing.T, hooks map[string]string) (Service, string) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "site"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "site", "index.html"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := Config{
+		StoragePath:  filepath.Join(dir, "backups"),
+		SchedulePath: filepath.Join(dir, "schedules.json"),
+		Hooks:        hooks,
+	}
+	return NewService(config), dir
+}
+
+// waitForSchedule waits until the schedule's run is over and returns it.
+func waitForSchedule(t *testing.T, s Service, id string) Schedule {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		schedules, err := s.Schedules()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, schedule := range schedules {
+			if schedule.ID == id && !schedule.Status.Running {
+				return schedule
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("schedule did not finish")
+	return Schedule{}
+}
+
+func TestSchedulerRestart(t *testing.T) {
+	s, dir := testScheduleService(t, nil)
+	now := time.Date(2026, 3, 4, 12, 0, 30, 0, time.Local)
+
+	// State left by an agent that stopped during a run
+	state := []Schedule{{
+		ID:          "nightly",
+		Name:        "site",
+		Type:        "files",
+		SourcePath:  filepath.Join(dir, "site"),
+		Cron:        "0 * * * *",
+		Destination: destinationLocal,
+		Enabled:     true,
+		Status: ScheduleStatus{
+			LastStartedAt: now.Add(-2 * time.Hour).Unix(),
+			NextRunAt:     now.Add(-time.Hour).Unix(),
+			Running:       true,
+			LastSuccess:   true,
+		},
+	}}
+	data, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "schedules.json"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	schedules, err := s.Schedules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := schedules[0].Status
+	if status.Running || status.LastSuccess || status.LastError == "" || status.NextRunAt != 0 {
+		t.Errorf("status after restart: %+v", status)
+	}
+
+	// The missed run is skipped rather than started late
+	s.dispatchSchedules(now)
+	schedules, _ = s.Schedules()
+	status = schedules[0].Status
+	if status.Running || status.LastStartedAt != state[0].Status.LastStartedAt {
+		t.Errorf("missed run was started: %+v", status)
+	}
+	if want := time.Date(2026, 3, 4, 13, 0, 0, 0, time.Local).Unix(); status.NextRunAt != want {
+		t.Errorf("next run at %v, want %v", time.Unix(status.NextRunAt, 0), time.Unix(want, 0))
+	}
+
+	// The recomputed time is saved
+	data, err = os.ReadFile(filepath.Join(dir, "schedules.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved []Schedule
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved[0].Status.NextRunAt != status.NextRunAt || saved[0].Status.Running {
+		t.Errorf("saved status: %+v", saved[0].Status)
+	}
+}
+
+func TestSchedulerSkipsOverlappingRuns(t *testing.T) {
+	s, dir := testScheduleService(t, nil)
+	schedule, err := s.PutSchedule(Schedule{
+		Name:       "site",
+		Type:       "files",
+		SourcePath: filepath.Join(dir, "site"),
+		Cron:       "*/5 * * * *",
+		Enabled:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Due while the previous run is still going
+	now := time.Now()
+	s.scheduler.mu.Lock()
+	current := s.scheduler.schedules[schedule.ID]
+	current.Status.Running = true
+	current.Status.LastStartedAt = now.Add(-time.Minute).Unix()
+	current.Status.NextRunAt = now.Unix()
+	s.scheduler.mu.Unlock()
+
+	s.dispatchSchedules(now)
+	s.scheduler.mu.Lock()
+	status := current.Status
+	s.scheduler.mu.Unlock()
+	if status.LastStartedAt != now.Add(-time.Minute).Unix() {
+		t.Error("a second run was started")
+	}
+	if status.NextRunAt <= now.Unix() {
+		t.Errorf("skipped occurrence was not moved on: %v", time.Unix(status.NextRunAt, 0))
+	}
+
+	// Once over, the next occurrence runs
+	s.scheduler.mu.Lock()
+	current.Status.Running = false
+	current.Status.NextRunAt = now.Unix()
+	s.scheduler.mu.Unlock()
+
+	s.dispatchSchedules(now)
+	finished := waitForSchedule(t, s, schedule.ID)
+	if !finished.Status.LastSuccess || finished.Status.LastStartedAt != now.Unix() || finished.Status.LastBackupPath == "" {
+		t.Errorf("status after run: %+v", finished.Status)
+	}
+}
+
+func TestSchedulerRunTimeout(t *testing.T) {
+	s, dir := testScheduleService(t, map[string]string{"slow": "sleep 2"})
+	schedule, err := s.PutSchedule(Schedule{
+		Name:           "site",
+		Type:           "files",
+		SourcePath:     filepath.Join(dir, "site"),
+		Cron:           "@hourly",
+		PreHook:        "slow",
+		TimeoutSeconds: 1,
+		Enabled:        true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.scheduler.mu.Lock()
+	s.scheduler.schedules[schedule.ID].Status.NextRunAt = time.Now().Unix()
+	s.scheduler.mu.Unlock()
+
+	start := time.Now()
+	s.dispatchSchedules(time.Now())
+	finished := waitForSchedule(t, s, schedule.ID)
+	if elapsed := time.Since(start); elapsed > 1900*time.Millisecond {
+		t.Errorf("run was released after %s", elapsed)
+	}
+	if finished.Status.LastSuccess || !strings.Contains(finished.Status.LastError, "did not finish") {
+		t.Errorf("status after timeout: %+v", finished.Status)
+	}
+
+	// The abandoned run finishing later does not overwrite that
+	time.Sleep(2 * time.Second)
+	schedules, _ := s.Schedules()
+	if schedules[0].Status.LastError != finished.Status.LastError {
+		t.Errorf("status replaced by the abandoned run: %+v", schedules[0].Status)
+	}
+}
+
+func TestNextRunJitter(t *testing.T) {
+	now := time.Date(2026, 3, 4, 12, 0, 30, 0, time.Local)
+	base := time.Date(2026, 3, 4, 13, 0, 0, 0, time.Local)
+
+	schedule := &Schedule{Cron: "0 * * * *"}
+	if next, err := nextRun(schedule, now); err != nil || !next.Equal(base) {
+		t.Errorf("without jitter: %v, %v", next, err)
+	}
+
+	schedule.JitterSeconds = 60
+	spread := false
+	for i := 0; i < 200; i++ {
+		next, err := nextRun(schedule, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next.Before(base) || !next.Before(base.Add(time.Minute)) {
+			t.Fatalf("next run %v outside [%v, %v)", next, base, base.Add(time.Minute))
+		}
+		if !next.Equal(base) {
+			spread = true
+		}
+	}
+	if !spread {
+		t.Error("jitter never delayed the run")
+	}
+
+	if _, err := nextRun(&Schedule{Cron: "every day"}, now); err == nil {
+		t.Error("invalid cron expression accepted")
+	}
+}
@@ -0,0 +1,487 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"hosting-panel-agent/internal/version"
+)
+
+// ServerBackupType is the backup type of full-server bundles. A "full"
+// backup ignores its source path and captures every managed site, its nginx
+// configuration and certificates, database dumps and the agent's own config
+// and state, so that RestoreServer can rebuild an empty host from it.
+const ServerBackupType = "full"
+
+// serverIndexName is the first entry of a bundle, describing its contents.
+const serverIndexName = ".server-bundle.json"
+
+const serverIndexVersion = 1
+
+// Inside a bundle, files are stored under their absolute path below
+// serverFilesDir and database dumps as serverDatabasesDir/<type>/<name>.sql.gz.
+const (
+	serverFilesDir     = "files"
+	serverDatabasesDir = "databases"
+)
+
+// ServerInventory tells full-server backups what the server hosts and loads
+// database dumps back on restore. It is provided by whatever manages sites
+// and databases; see SetServerInventory.
+type ServerInventory interface {
+	ServerBundle() (ServerBundle, error)
+	// DumpDatabase writes a gzip-compressed SQL dump of database to w.
+	DumpDatabase(database ServerDatabase, w io.Writer) error
+	// RestoreDatabase loads a dump into database. When user is set the
+	// database and its user are created first.
+	RestoreDatabase(database ServerDatabase, user *DatabaseUser, r io.Reader) error
+}
+
+// ServerBundle lists what a full-server backup contains.
+type ServerBundle struct {
+	Sites []ServerSite
+	// Paths are further files and directories to include, e.g. shared nginx
+	// configuration.
+	Paths     []string
+	Databases []ServerDatabase
+	// Warnings reports parts of the server that could not be inspected, such
+	// as an unreachable database server.
+	Warnings []string
+}
+
+type ServerSite struct {
+	Domain       string `json:"domain"`
+	DocumentRoot string `json:"document_root"`
+	// Paths are the site's files outside its document root, such as its
+	// nginx config and certificate.
+	Paths []string `json:"paths,omitempty"`
+}
+
+type ServerDatabase struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// DatabaseUser is the owner to create a database with on restore. Bundles
+// hold no database credentials.
+type DatabaseUser struct {
+	Type     string
+	Name     string
+	Username string
+	Password string
+}
+
+// serverIndex is stored as the first entry of a bundle.
+type serverIndex struct {
+	Version      int              `json:"version"`
+	Hostname     string           `json:"hostname"`
+	AgentVersion string           `json:"agent_version"`
+	CreatedAt    int64            `json:"created_at"`
+	Sites        []ServerSite     `json:"sites"`
+	Paths        []string         `json:"paths"`
+	Databases    []ServerDatabase `json:"databases"`
+}
+
+// ServerRestoreOptions tunes RestoreServer.
+type ServerRestoreOptions struct {
+	// Root restores files below this directory instead of in place, e.g. to
+	// inspect a bundle. Absolute symlinks are moved along.
+	Root string
+	// Conflict decides what happens to existing files, as in RestoreOptions.
+	Conflict string
+	// SkipDatabases restores files only.
+	SkipDatabases bool
+	// DatabaseUsers are created, with their databases, before the dumps are
+	// loaded. Other databases must already exist.
+	DatabaseUsers []DatabaseUser
+	// JobID names the restore for WatchBackup; generated when empty.
+	JobID string
+}
+
+// ServerRestoreResult reports what RestoreServer did. A database that
+// failed to load does not stop the restore.
+type ServerRestoreResult struct {
+	JobID     string
+	Root      string
+	Restored  int
+	Skipped   int
+	Sites     []string
+	Databases []DatabaseRestoreStatus
+}
+
+type DatabaseRestoreStatus struct {
+	Name    string
+	Type    string
+	Success bool
+	Error   string
+}
+
+// serverInventory holds the inventory set after the Service was created.
+type serverInventory struct {
+	mu        sync.RWMutex
+	inventory ServerInventory
+}
+
+// SetServerInventory enables full-server backups and restores.
+func (s Service) SetServerInventory(inventory ServerInventory) {
+	s.server.mu.Lock()
+	defer s.server.mu.Unlock()
+	s.server.inventory = inventory
+}
+
+func (s Service) serverInventory() (ServerInventory, error) {
+	s.server.mu.RLock()
+	defer s.server.mu.RUnlock()
+	if s.server.inventory == nil {
+		return nil, fmt.Errorf("full-server backups are not available")
+	}
+	return s.server.inventory, nil
+}
+
+func (s Service) createServerBackup(name string, targets []namedTarget, options BackupOptions) (*BackupResult, error) {
+	inventory, err := s.serverInventory()
+	if err != nil {
+		return nil, err
+	}
+	bundle, err := inventory.ServerBundle()
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect server: %v", err)
+	}
+
+	hostname, _ := os.Hostname()
+	index := &serverIndex{
+		Version:      serverIndexVersion,
+		Hostname:     hostname,
+		AgentVersion: version.Version,
+		CreatedAt:    time.Now().Unix(),
+		Sites:        bundle.Sites,
+	}
+
+	var paths []string
+	for _, site := range bundle.Sites {
+		paths = append(paths, site.DocumentRoot)
+		paths = append(paths, site.Paths...)
+	}
+	paths = append(paths, bundle.Paths...)
+	paths = append(paths, s.serverPaths...)
+	index.Paths, bundle.Warnings = serverPaths(paths, bundle.Warnings)
+
+	for _, database := range bundle.Databases {
+		if !validBundleName(database.Name) || !validBundleName(database.Type) {
+			bundle.Warnings = append(bundle.Warnings, fmt.Sprintf("%s database %q: skipped, name cannot be stored", database.Type, database.Name))
+			continue
+		}
+		index.Databases = append(index.Databases, database)
+	}
+
+	options.job.phase(phaseScanning)
+	walker := newSourceWalker(options)
+	var files, bytes int64
+	for _, p := range index.Paths {
+		pathFiles, pathBytes := walker.scan(p)
+		files += pathFiles
+		bytes += pathBytes
+	}
+	options.job.setTotal(files+int64(len(index.Databases)), bytes)
+	options.job.phase(phaseArchiving)
+
+	return s.createArchive(name, ServerBackupType, "", targets, options, func(tarWriter *tar.Writer, walker *sourceWalker, manifest *Manifest) error {
+		for _, warning := range bundle.Warnings {
+			walker.addWarning(warning)
+		}
+
+		data, err := json.MarshalIndent(index, "", "  ")
+		if err != nil {
+			return err
+		}
+		header := &tar.Header{
+			Name:     serverIndexName,
+			Typeflag: tar.TypeReg,
+			Mode:     0600,
+			Size:     int64(len(data)),
+			ModTime:  time.Unix(index.CreatedAt, 0),
+		}
+		if err := addArchiveEntry(tarWriter, header, func(w io.Writer) error {
+			_, err := w.Write(data)
+			return err
+		}, manifest); err != nil {
+			return err
+		}
+
+		for _, p := range index.Paths {
+			if err := s.addToArchive(tarWriter, walker, p, serverFilePath(p), manifest); err != nil {
+				return err
+			}
+		}
+
+		for _, database := range index.Databases {
+			if err := addDatabaseDump(tarWriter, walker, inventory, database, manifest); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// serverPaths cleans paths and drops duplicates, paths inside others and
+// paths that do not exist.
+func serverPaths(paths []string, warnings []string) ([]string, []string) {
+	var cleaned []string
+	for _, p := range paths {
+		if p == "" {
+			continue
+		}
+		if !filepath.IsAbs(p) {
+			warnings = append(warnings, fmt.Sprintf("%s: skipped, path is not absolute", p))
+			continue
+		}
+		if _, err := os.Lstat(p); err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: %v", p, unwrapPathError(err)))
+			continue
+		}
+		cleaned = append(cleaned, filepath.Clean(p))
+	}
+	sort.Strings(cleaned)
+
+	var result []string
+	for _, p := range cleaned {
+		if len(result) > 0 {
+			last := result[len(result)-1]
+			if p == last || last == "/" || strings.HasPrefix(p, last+"/") {
+				continue
+			}
+		}
+		result = append(result, p)
+	}
+	return result, warnings
+}
+
+func serverFilePath(p string) string {
+	return path.Join(serverFilesDir, strings.TrimPrefix(filepath.ToSlash(p), "/"))
+}
+
+func serverDatabasePath(database ServerDatabase) string {
+	return path.Join(serverDatabasesDir, database.Type, database.Name+".sql.gz")
+}
+
+func validBundleName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\")
+}
+
+// addDatabaseDump dumps a database to a temporary file, since tar needs
+// its size up front, and adds it to the archive. A failed dump is a warning.
+func addDatabaseDump(tarWriter *tar.Writer, walker *sourceWalker, inventory ServerInventory, database ServerDatabase, manifest *Manifest) error {
+	name := serverDatabasePath(database)
+
+	dump, err := os.CreateTemp("", "backup-dump-*")
+	if err != nil {
+		return fmt.Errorf("failed to create dump file: %v", err)
+	}
+	defer os.Remove(dump.Name())
+	defer dump.Close()
+
+	if err := inventory.DumpDatabase(database, dump); err != nil {
+		walker.warn(name, "dump failed: %v", err)
+		return nil
+	}
+	size, err := dump.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if err := walker.count(size); err != nil {
+		return err
+	}
+	if _, err := dump.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	header := &tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0600,
+		Size:     size,
+		ModTime:  time.Now(),
+	}
+	if err := addArchiveEntry(tarWriter, header, func(w io.Writer) error {
+		_, err := io.CopyN(w, dump, size)
+		return err
+	}, manifest); err != nil {
+		return err
+	}
+	walker.options.job.addFile()
+	return nil
+}
+
+// RestoreServer restores a full-server bundle: every file is put back at
+// the path it was taken from, below options.Root when set, and each
+// database dump is loaded through the server inventory.
+func (s Service) RestoreServer(backupPath string, options ServerRestoreOptions) (*ServerRestoreResult, error) {
+	restoreOptions := RestoreOptions{Conflict: options.Conflict}
+	if err := restoreOptions.validate(); err != nil {
+		return nil, err
+	}
+
+	job, err := s.progress.start(options.JobID, "restore", backupPath)
+	if err != nil {
+		return nil, err
+	}
+	restoreOptions.job = job
+	job.phase(phaseRestoring)
+
+	var result *ServerRestoreResult
+	s.withPriority(func() {
+		result, err = s.restoreServer(backupPath, options, restoreOptions)
+	})
+	job.finish(err)
+	if err != nil {
+		return nil, err
+	}
+	result.JobID = job.id()
+	return result, nil
+}
+
+func (s Service) restoreServer(backupPath string, options ServerRestoreOptions, restoreOptions RestoreOptions) (*ServerRestoreResult, error) {
+	job := restoreOptions.job
+
+	root := options.Root
+	if root == "" {
+		root = "/"
+	}
+	if !filepath.IsAbs(root) {
+		return nil, fmt.Errorf("restore root must be an absolute path")
+	}
+	root = filepath.Clean(root)
+
+	var inventory ServerInventory
+	if !options.SkipDatabases {
+		var err error
+		inventory, err = s.serverInventory()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if _, ok := snapshotID(backupPath); ok {
+		return nil, fmt.Errorf("%s is not a full-server backup", backupPath)
+	}
+	archive, sidecar, err := s.openArchive(backupPath)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+	if sidecar != nil {
+		job.setTotal(manifestTotals(sidecar))
+	}
+
+	plaintext, err := s.encryption.open(archive)
+	if err != nil {
+		return nil, err
+	}
+	gzipReader, err := gzip.NewReader(plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gzip reader: %v", err)
+	}
+	defer gzipReader.Close()
+	tarReader := tar.NewReader(gzipReader)
+
+	header, err := tarReader.Next()
+	if err != nil || header.Name != serverIndexName {
+		return nil, fmt.Errorf("%s is not a full-server backup", backupPath)
+	}
+	var index serverIndex
+	if err := json.NewDecoder(tarReader).Decode(&index); err != nil {
+		return nil, fmt.Errorf("failed to read server bundle index: %v", err)
+	}
+	if index.Version > serverIndexVersion {
+		return nil, fmt.Errorf("unsupported server bundle version %d", index.Version)
+	}
+
+	extractor, err := newExtractor(root, restoreOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	users := make(map[string]*DatabaseUser)
+	for i, user := range options.DatabaseUsers {
+		users[serverDatabasePath(ServerDatabase{Name: user.Name, Type: user.Type})] = &options.DatabaseUsers[i]
+	}
+
+	result := &ServerRestoreResult{Root: root}
+	loaded := make(map[string]bool)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tar header: %v", err)
+		}
+
+		switch {
+		case strings.HasPrefix(header.Name, serverFilesDir+"/"):
+			name := header.Name
+			header.Name = strings.TrimPrefix(name, serverFilesDir+"/")
+			if header.Name == "" {
+				continue
+			}
+			switch header.Typeflag {
+			case tar.TypeSymlink:
+				if filepath.IsAbs(header.Linkname) {
+					header.Linkname = filepath.Join(root, header.Linkname)
+				}
+			case tar.TypeLink:
+				header.Linkname = strings.TrimPrefix(header.Linkname, serverFilesDir+"/")
+			}
+			if err := extractor.extract(header, tarReader); err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+
+		case strings.HasPrefix(header.Name, serverDatabasesDir+"/") && !options.SkipDatabases:
+			for _, database := range index.Databases {
+				if serverDatabasePath(database) != header.Name {
+					continue
+				}
+				loaded[header.Name] = true
+				status := DatabaseRestoreStatus{Name: database.Name, Type: database.Type, Success: true}
+				if err := inventory.RestoreDatabase(database, users[header.Name], progressReader{reader: tarReader, job: job}); err != nil {
+					status.Success = false
+					status.Error = err.Error()
+				}
+				job.addFile()
+				result.Databases = append(result.Databases, status)
+			}
+		}
+	}
+	if err := extractor.finish(); err != nil {
+		return nil, err
+	}
+
+	if !options.SkipDatabases {
+		for _, database := range index.Databases {
+			if !loaded[serverDatabasePath(database)] {
+				result.Databases = append(result.Databases, DatabaseRestoreStatus{
+					Name:  database.Name,
+					Type:  database.Type,
+					Error: "no dump in backup",
+				})
+			}
+		}
+	}
+
+	for _, site := range index.Sites {
+		result.Sites = append(result.Sites, site.Domain)
+	}
+	result.Restored = extractor.result.Restored
+	result.Skipped = extractor.result.Skipped
+	return result, nil
+}
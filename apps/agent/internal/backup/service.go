@@ -3,35 +3,79 @@ package backup
 import (
 	"archive/tar"
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+
+	"hosting-panel-agent/internal/version"
 )
 
 type Service struct {
-	storagePath string
-	s3Config    S3Config
+	storagePath   string
+	s3Config      S3Config
+	encryption    *encryption
+	encryptionErr error
+	repository    *repository
+	repositoryErr error
+	retention     []RetentionRule
+	scheduler     *scheduler
+	targets       []namedTarget
+	server        *serverInventory
+	serverPaths   []string
+	throttle      ThrottleConfig
+	throttleErr   error
+	hooks         map[string]string
+	readLimiter   *rateLimiter
+	uploadLimiter *rateLimiter
+	progress      *progressTracker
 }
 
 type Config struct {
 	StoragePath string
 	S3          S3Config
+	Encryption  EncryptionConfig
+	Repository  RepositoryConfig
+	Retention   []RetentionRule
+	// SchedulePath is where backup schedules and their status are kept.
+	SchedulePath string
+	// Targets are additional places backups can be written to, next to the
+	// built-in "local" and "s3".
+	Targets []TargetConfig
+	// ServerPaths are included in every full-server backup, typically the
+	// agent's config file and state directory.
+	ServerPaths []string
+	// Throttle limits the disk, network and CPU use of backups.
+	Throttle ThrottleConfig
+	// Hooks are the shell commands backups may run before and after, by
+	// name. Callers only ever pick a name, so that reaching the agent does
+	// not mean running arbitrary commands on the server.
+	Hooks map[string]string
 }
 
 type S3Config struct {
+	// Enabled makes the bucket part of ListBackups and retention, and allows
+	// it as a CreateBackup destination.
+	Enabled   bool
 	Endpoint  string
 	Bucket    string
 	AccessKey string
 	SecretKey string
 	Region    string
+	// Prefix is prepended to the keys of archives streamed by CreateBackup.
+	Prefix string
+	// ForcePathStyle addresses the bucket in the path rather than the host
+	// name, as MinIO and most self-hosted S3 servers require.
+	ForcePathStyle bool
+	// PartSize is the multipart upload part size in bytes.
+	PartSize int64
 }
 
 type BackupInfo struct {
@@ -39,260 +83,514 @@ type BackupInfo struct {
 	Path      string
 	Size      int64
 	CreatedAt int64
+	Snapshot  bool
+	// Location is the target Path refers to, or "repository".
+	Location string
+	// Targets lists every target holding a copy of the archive.
+	Targets []string
+	// S3Key is set for archives that are stored in the bucket.
+	S3Key string
 }
 
 func NewService(config Config) Service {
-	return Service{
-		storagePath: config.StoragePath,
-		s3Config:    config.S3,
+	// A broken key configuration is reported by CreateBackup rather than
+	// silently falling back to writing plaintext archives
+	enc, err := newEncryption(config.Encryption)
+	if err != nil {
+		enc = &encryption{}
+	}
+
+	service := Service{
+		storagePath:   config.StoragePath,
+		s3Config:      config.S3,
+		encryption:    enc,
+		encryptionErr: err,
+		retention:     config.Retention,
+		scheduler:     newScheduler(config.SchedulePath),
+		server:        &serverInventory{},
+		serverPaths:   config.ServerPaths,
+		throttle:      config.Throttle,
+		throttleErr:   config.Throttle.validate(),
+		hooks:         config.Hooks,
+		readLimiter:   newRateLimiter(config.Throttle.ReadBytesPerSecond),
+		uploadLimiter: newRateLimiter(config.Throttle.UploadBytesPerSecond),
+		progress:      newProgressTracker(),
+	}
+	service.targets = service.openTargets(config.Targets)
+	if config.Repository.Enabled {
+		service.repository, service.repositoryErr = service.openRepository(config.Repository)
 	}
+
+	return service
 }
 
-func (s Service) CreateBackup(name, backupType, sourcePath string) (string, error) {
-	// Create backup filename with timestamp
-	timestamp := time.Now().Format("2006-01-02-15-04-05")
-	filename := fmt.Sprintf("%s-%s-%s.tar.gz", name, backupType, timestamp)
-	backupPath := filepath.Join(s.storagePath, filename)
+// CreateBackup archives sourcePath to destination, a comma-separated list
+// of targets ("local" when empty). The archive is produced once and streamed
+// to every target at the same time; a failing target does not stop the
+// others, and the result records each target's outcome. CreateBackup only
+// fails when no target received the backup. With the repository enabled a
+// snapshot is written instead and destination is ignored.
+//
+// options exclude entries, cap sizes and run hooks around the backup.
+// Entries that vanish or cannot be read are skipped and reported in the
+// result's warnings. Progress can be followed with WatchBackup under the
+// result's JobID, or options.JobID when set.
+func (s Service) CreateBackup(name, backupType, sourcePath, destination string, options BackupOptions) (*BackupResult, error) {
+	if s.encryptionErr != nil {
+		return nil, s.encryptionErr
+	}
+	if s.repositoryErr != nil {
+		return nil, s.repositoryErr
+	}
+	if s.throttleErr != nil {
+		return nil, s.throttleErr
+	}
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	if err := s.checkHooks(options); err != nil {
+		return nil, err
+	}
 
-	// Create backup directory if it doesn't exist
-	if err := os.MkdirAll(s.storagePath, 0755); err != nil {
-		return "", fmt.Errorf("failed to create backup directory: %v", err)
+	job, err := s.progress.start(options.JobID, "backup", name)
+	if err != nil {
+		return nil, err
 	}
+	options.job = job
+	options.readLimiter = s.readLimiter
 
-	// Create the backup file
-	file, err := os.Create(backupPath)
+	var result *BackupResult
+	s.withPriority(func() {
+		result, err = s.runBackup(name, backupType, sourcePath, destination, options)
+	})
+	job.finish(err)
 	if err != nil {
-		return "", fmt.Errorf("failed to create backup file: %v", err)
+		return nil, err
 	}
-	defer file.Close()
+	result.JobID = job.id()
+	return result, nil
+}
 
-	// Create gzip writer
-	gzipWriter := gzip.NewWriter(file)
-	defer gzipWriter.Close()
+func (s Service) runBackup(name, backupType, sourcePath, destination string, options BackupOptions) (*BackupResult, error) {
+	job := options.job
 
-	// Create tar writer
-	tarWriter := tar.NewWriter(gzipWriter)
-	defer tarWriter.Close()
+	var targets []namedTarget
+	if s.repository == nil || backupType == ServerBackupType {
+		var err error
+		targets, err = s.resolveTargets(destination)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	env := []string{
+		"BACKUP_NAME=" + name,
+		"BACKUP_TYPE=" + backupType,
+		"BACKUP_SOURCE=" + sourcePath,
+	}
+
+	var result *BackupResult
+	var err error
+	if options.PreHook != "" {
+		job.phase(phasePreHook)
+		if hookErr := options.runHook(s.hooks[options.PreHook], env); hookErr != nil {
+			err = fmt.Errorf("pre-backup hook failed: %v", hookErr)
+		}
+	}
+	if err == nil {
+		result, err = s.createBackup(name, backupType, sourcePath, targets, options)
+	}
+
+	if options.PostHook != "" {
+		job.phase(phasePostHook)
+		if err != nil {
+			env = append(env, "BACKUP_STATUS=failure", "BACKUP_ERROR="+err.Error())
+		} else {
+			env = append(env, "BACKUP_STATUS=success", "BACKUP_PATH="+result.Path)
+		}
+		if hookErr := options.runHook(s.hooks[options.PostHook], env); hookErr != nil {
+			if err != nil {
+				err = fmt.Errorf("%v; post-backup hook failed: %v", err, hookErr)
+			} else {
+				result.Warnings = append(result.Warnings, fmt.Sprintf("post-backup hook failed: %v", hookErr))
+			}
+		}
+	}
 
-	// Add files to the archive
-	err = s.addToArchive(tarWriter, sourcePath, "")
 	if err != nil {
-		return "", fmt.Errorf("failed to create archive: %v", err)
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s Service) createBackup(name, backupType, sourcePath string, targets []namedTarget, options BackupOptions) (*BackupResult, error) {
+	if backupType == ServerBackupType {
+		return s.createServerBackup(name, targets, options)
 	}
 
-	return backupPath, nil
+	options.job.phase(phaseScanning)
+	options.job.setTotal(newSourceWalker(options).scan(sourcePath))
+	options.job.phase(phaseArchiving)
+
+	if s.repository != nil {
+		return s.createSnapshot(name, backupType, sourcePath, time.Now(), options)
+	}
+	return s.createArchive(name, backupType, sourcePath, targets, options, func(tarWriter *tar.Writer, walker *sourceWalker, manifest *Manifest) error {
+		return s.addToArchive(tarWriter, walker, sourcePath, "", manifest)
+	})
 }
 
-func (s Service) RestoreBackup(backupPath, targetPath string) error {
-	// Open the backup file
-	file, err := os.Open(backupPath)
-	if err != nil {
-		return fmt.Errorf("failed to open backup file: %v", err)
+// archiveContent writes the entries of an archive, recording them in
+// manifest.
+type archiveContent func(tarWriter *tar.Writer, walker *sourceWalker, manifest *Manifest) error
+
+// createArchive writes an archive with the given content to every target.
+func (s Service) createArchive(name, backupType, sourcePath string, targets []namedTarget, options BackupOptions, content archiveContent) (*BackupResult, error) {
+	startedAt := time.Now()
+
+	// Create backup filename with timestamp
+	timestamp := startedAt.Format("2006-01-02-15-04-05")
+	filename := fmt.Sprintf("%s-%s-%s.tar.gz", name, backupType, timestamp)
+	if s.encryption.enabled {
+		filename += encryptedSuffix
 	}
-	defer file.Close()
 
-	// Create gzip reader
-	gzipReader, err := gzip.NewReader(file)
-	if err != nil {
-		return fmt.Errorf("failed to create gzip reader: %v", err)
+	fan := &fanout{}
+	for _, target := range targets {
+		fan.uploads = append(fan.uploads, s.startTargetUpload(target, path.Join(target.dir, filename)))
 	}
-	defer gzipReader.Close()
 
-	// Create tar reader
-	tarReader := tar.NewReader(gzipReader)
+	manifest := &Manifest{
+		Version:      manifestVersion,
+		Name:         name,
+		Type:         backupType,
+		SourcePath:   sourcePath,
+		AgentVersion: version.Version,
+		StartedAt:    startedAt.Unix(),
+		Encrypted:    s.encryption.enabled,
+	}
 
-	// Extract files
-	for {
-		header, err := tarReader.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return fmt.Errorf("failed to read tar header: %v", err)
-		}
+	// Hash the archive as written, after compression and encryption
+	hashed := newHashingWriter(fan)
+	err := s.writeArchive(hashed, manifest, options, content)
+	// Remote targets may still be taking in the last parts
+	options.job.phase(phaseUploading)
+	targetsFailed := err != nil && fan.failed()
+	// Aborts every upload if the archive failed
+	fan.finish(err)
+	if targetsFailed {
+		return nil, fmt.Errorf("failed to write backup to any target: %s", fan.targetErrors())
+	}
+	if err != nil {
+		return nil, err
+	}
 
-		// Create target file path
-		targetFile := filepath.Join(targetPath, header.Name)
+	manifest.ArchiveSize = hashed.size
+	manifest.ArchiveSHA256 = hashed.Sum()
 
-		// Create directory if needed
-		if header.Typeflag == tar.TypeDir {
-			if err := os.MkdirAll(targetFile, 0755); err != nil {
-				return fmt.Errorf("failed to create directory: %v", err)
-			}
-			continue
+	result := &BackupResult{Warnings: manifest.Warnings}
+	for _, upload := range fan.uploads {
+		key := path.Join(upload.target.dir, filename)
+		status := TargetStatus{
+			Target: upload.target.name,
+			Path:   s.targetPath(upload.target, key),
+			Size:   hashed.size,
 		}
 
-		// Create parent directory
-		if err := os.MkdirAll(filepath.Dir(targetFile), 0755); err != nil {
-			return fmt.Errorf("failed to create parent directory: %v", err)
+		err := upload.err
+		if err == nil {
+			if err = putManifest(upload.target.target, key+manifestSuffix, manifest); err != nil {
+				// An archive without its manifest cannot be verified later
+				upload.target.target.Delete(key)
+			}
 		}
-
-		// Create file
-		outFile, err := os.Create(targetFile)
 		if err != nil {
-			return fmt.Errorf("failed to create file: %v", err)
+			status.Error = err.Error()
+		} else {
+			status.Success = true
+			if result.Path == "" {
+				result.Path = status.Path
+			}
 		}
+		result.Targets = append(result.Targets, status)
+	}
 
-		// Copy file content
-		_, err = io.Copy(outFile, tarReader)
-		outFile.Close()
-		if err != nil {
-			return fmt.Errorf("failed to copy file content: %v", err)
+	if result.Path == "" {
+		var errors []string
+		for _, status := range result.Targets {
+			errors = append(errors, fmt.Sprintf("%s: %s", status.Target, status.Error))
 		}
+		return nil, fmt.Errorf("failed to write backup to any target: %s", strings.Join(errors, "; "))
+	}
+	return result, nil
+}
 
-		// Set file permissions
-		if err := os.Chmod(targetFile, os.FileMode(header.Mode)); err != nil {
-			return fmt.Errorf("failed to set file permissions: %v", err)
+// writeArchive streams content as tar.gz to w, encrypting it first when
+// encryption is enabled, and ends it with the manifest. Every layer is
+// closed explicitly because the final gzip and age blocks are only written
+// on Close.
+func (s Service) writeArchive(w io.Writer, manifest *Manifest, options BackupOptions, content archiveContent) error {
+	var sealed io.WriteCloser
+	if s.encryption.enabled {
+		var err error
+		sealed, err = s.encryption.seal(w)
+		if err != nil {
+			return err
 		}
+		w = sealed
 	}
 
-	return nil
-}
+	// Create gzip writer
+	gzipWriter := gzip.NewWriter(w)
 
-func (s Service) ListBackups() ([]BackupInfo, error) {
-	files, err := os.ReadDir(s.storagePath)
+	// Create tar writer
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	// Add files to the archive
+	walker := newSourceWalker(options)
+	err := content(tarWriter, walker, manifest)
+	manifest.Warnings = walker.Warnings()
 	if err != nil {
-		return nil, fmt.Errorf("failed to read backup directory: %v", err)
+		return fmt.Errorf("failed to create archive: %v", err)
 	}
 
-	var backups []BackupInfo
-	for _, file := range files {
-		if file.IsDir() {
-			continue
-		}
-
-		if !strings.HasSuffix(file.Name(), ".tar.gz") {
-			continue
-		}
+	manifest.CompletedAt = time.Now().Unix()
+	if err := writeManifestEntry(tarWriter, manifest); err != nil {
+		return fmt.Errorf("failed to write manifest: %v", err)
+	}
 
-		info, err := file.Info()
-		if err != nil {
-			continue
+	if err := tarWriter.Close(); err != nil {
+		return fmt.Errorf("failed to finish archive: %v", err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return fmt.Errorf("failed to finish compression: %v", err)
+	}
+	if sealed != nil {
+		if err := sealed.Close(); err != nil {
+			return fmt.Errorf("failed to finish encryption: %v", err)
 		}
-
-		backups = append(backups, BackupInfo{
-			Name:      file.Name(),
-			Path:      filepath.Join(s.storagePath, file.Name()),
-			Size:      info.Size(),
-			CreatedAt: info.ModTime().Unix(),
-		})
 	}
 
-	return backups, nil
+	return nil
 }
 
-func (s Service) UploadToS3(backupPath, s3Key string) error {
-	// Create AWS session
-	sess, err := session.NewSession(&aws.Config{
-		Endpoint:    aws.String(s.s3Config.Endpoint),
-		Region:      aws.String(s.s3Config.Region),
-		Credentials: credentials.NewStaticCredentials(s.s3Config.AccessKey, s.s3Config.SecretKey, ""),
-	})
-	if err != nil {
-		return fmt.Errorf("failed to create AWS session: %v", err)
+// RestoreBackup extracts a backup into targetPath, or into the path it was
+// taken from when targetPath is empty. options select entries, decide what
+// happens to existing files and can redirect the restore to a side
+// directory. Progress can be followed with WatchBackup.
+func (s Service) RestoreBackup(backupPath, targetPath string, options RestoreOptions) (*RestoreResult, error) {
+	if err := options.validate(); err != nil {
+		return nil, err
 	}
 
-	// Create S3 service
-	svc := s3.New(sess)
-
-	// Open backup file
-	file, err := os.Open(backupPath)
+	job, err := s.progress.start(options.JobID, "restore", backupPath)
 	if err != nil {
-		return fmt.Errorf("failed to open backup file: %v", err)
+		return nil, err
 	}
-	defer file.Close()
+	options.job = job
+	job.phase(phaseRestoring)
 
-	// Upload to S3
-	_, err = svc.PutObject(&s3.PutObjectInput{
-		Bucket: aws.String(s.s3Config.Bucket),
-		Key:    aws.String(s3Key),
-		Body:   file,
+	var result *RestoreResult
+	s.withPriority(func() {
+		result, err = s.restoreBackup(backupPath, targetPath, options)
 	})
+	job.finish(err)
 	if err != nil {
-		return fmt.Errorf("failed to upload to S3: %v", err)
+		return nil, err
 	}
-
-	return nil
+	result.JobID = job.id()
+	return result, nil
 }
 
-func (s Service) DownloadFromS3(s3Key, localPath string) error {
-	// Create AWS session
-	sess, err := session.NewSession(&aws.Config{
-		Endpoint:    aws.String(s.s3Config.Endpoint),
-		Region:      aws.String(s.s3Config.Region),
-		Credentials: credentials.NewStaticCredentials(s.s3Config.AccessKey, s.s3Config.SecretKey, ""),
-	})
+func (s Service) restoreBackup(backupPath, targetPath string, options RestoreOptions) (*RestoreResult, error) {
+	if id, ok := snapshotID(backupPath); ok {
+		repository, err := s.snapshotRepository()
+		if err != nil {
+			return nil, err
+		}
+		return repository.restoreSnapshot(id, targetPath, options)
+	}
+
+	// Open the backup, streaming it from its target for "<target>:<key>" paths
+	archive, sidecar, err := s.openArchive(backupPath)
 	if err != nil {
-		return fmt.Errorf("failed to create AWS session: %v", err)
+		return nil, err
 	}
+	defer archive.Close()
 
-	// Create S3 service
-	svc := s3.New(sess)
+	if targetPath == "" {
+		// The embedded manifest is only read at the end of the archive
+		if sidecar == nil || sidecar.SourcePath == "" {
+			return nil, fmt.Errorf("target path is required for backups without a manifest")
+		}
+		targetPath = sidecar.SourcePath
+	}
+	if options.SideDirectory {
+		targetPath = sideDirectory(targetPath, time.Now())
+	}
+	if sidecar != nil {
+		options.job.setTotal(manifestTotals(sidecar))
+	}
 
-	// Download from S3
-	result, err := svc.GetObject(&s3.GetObjectInput{
-		Bucket: aws.String(s.s3Config.Bucket),
-		Key:    aws.String(s3Key),
-	})
+	// Decrypt transparently if the archive is encrypted
+	plaintext, err := s.encryption.open(archive)
 	if err != nil {
-		return fmt.Errorf("failed to download from S3: %v", err)
+		return nil, err
 	}
-	defer result.Body.Close()
 
-	// Create local file
-	file, err := os.Create(localPath)
+	// Create gzip reader
+	gzipReader, err := gzip.NewReader(plaintext)
 	if err != nil {
-		return fmt.Errorf("failed to create local file: %v", err)
+		return nil, fmt.Errorf("failed to create gzip reader: %v", err)
 	}
-	defer file.Close()
+	defer gzipReader.Close()
 
-	// Copy content
-	_, err = io.Copy(file, result.Body)
+	extractor, err := newExtractor(targetPath, options)
 	if err != nil {
-		return fmt.Errorf("failed to copy content: %v", err)
+		return nil, err
 	}
 
-	return nil
+	// Create tar reader
+	tarReader := tar.NewReader(gzipReader)
+
+	// Extract files, confined to targetPath
+	if err := extractor.extractAll(tarReader); err != nil {
+		return nil, err
+	}
+	return &extractor.result, nil
 }
 
-func (s Service) addToArchive(tarWriter *tar.Writer, sourcePath, basePath string) error {
-	return filepath.Walk(sourcePath, func(path string, info os.FileInfo, err error) error {
+// ListBackups merges the archives on every target and repository
+// snapshots. An archive held by several targets is listed once, with Path
+// referring to the first of them. A target that cannot be listed is left
+// out and reported in the returned warnings.
+func (s Service) ListBackups() ([]BackupInfo, []string, error) {
+	var backups []BackupInfo
+	var warnings []string
+	seen := make(map[string]int)
+
+	for _, target := range s.targets {
+		objects, err := listArchives(target)
 		if err != nil {
-			return err
+			warnings = append(warnings, err.Error())
+			continue
 		}
 
-		// Create tar header
-		header, err := tar.FileInfoHeader(info, "")
-		if err != nil {
-			return err
+		for _, object := range objects {
+			name := path.Base(object.Key)
+			i, ok := seen[name]
+			if !ok {
+				i = len(backups)
+				seen[name] = i
+				backups = append(backups, BackupInfo{
+					Name:      name,
+					Path:      s.targetPath(target, object.Key),
+					Size:      object.Size,
+					CreatedAt: object.ModTime.Unix(),
+					Location:  target.name,
+				})
+			}
+			backups[i].Targets = append(backups[i].Targets, target.name)
+			if target.name == destinationS3 {
+				backups[i].S3Key = object.Key
+			}
 		}
+	}
 
-		// Update header name
-		relPath, err := filepath.Rel(sourcePath, path)
+	if s.repository != nil {
+		snapshots, err := s.repository.listSnapshots()
 		if err != nil {
-			return err
+			warnings = append(warnings, fmt.Sprintf("%s: %v", locationRepository, err))
+		}
+		for _, snapshot := range snapshots {
+			backups = append(backups, BackupInfo{
+				Name:      snapshot.ID,
+				Path:      snapshotPrefix + snapshot.ID,
+				Size:      snapshot.Size,
+				CreatedAt: snapshot.StartedAt,
+				Snapshot:  true,
+				Location:  locationRepository,
+			})
 		}
-		header.Name = filepath.Join(basePath, relPath)
+	}
+
+	return backups, warnings, nil
+}
+
+func isArchiveName(name string) bool {
+	return strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tar.gz"+encryptedSuffix)
+}
+
+func (s Service) s3Client() (*s3.S3, error) {
+	return newS3Client(s.s3Config)
+}
+
+// addToArchive writes the entries walker selects below sourcePath into the
+// archive under basePath, recording each in manifest.
+func (s Service) addToArchive(tarWriter *tar.Writer, walker *sourceWalker, sourcePath, basePath string, manifest *Manifest) error {
+	return walker.walk(sourcePath, basePath, func(header *tar.Header, file *sourceFile) error {
+		if file == nil {
+			return addArchiveEntry(tarWriter, header, nil, manifest)
+		}
+		return addArchiveEntry(tarWriter, header, func(w io.Writer) error {
+			return file.copyTo(w, header.Size)
+		}, manifest)
+	})
+}
+
+// addArchiveEntry writes header and, for regular files, the content write
+// produces, recording the entry in manifest.
+func addArchiveEntry(tarWriter *tar.Writer, header *tar.Header, write func(w io.Writer) error, manifest *Manifest) error {
+	// Write header
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return err
+	}
+
+	entry := ManifestFile{
+		Path:    header.Name,
+		Type:    manifestFileType(header.Typeflag),
+		Size:    header.Size,
+		ModTime: header.ModTime.Unix(),
+		Link:    header.Linkname,
+	}
 
-		// Write header
-		if err := tarWriter.WriteHeader(header); err != nil {
+	// Write file content if it's a regular file
+	if write != nil {
+		hash := sha256.New()
+		if err := write(io.MultiWriter(tarWriter, hash)); err != nil {
 			return err
 		}
+		entry.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	}
 
-		// Write file content if it's a regular file
-		if info.Mode().IsRegular() {
-			file, err := os.Open(path)
-			if err != nil {
-				return err
-			}
-			defer file.Close()
+	manifest.Files = append(manifest.Files, entry)
+	return nil
+}
 
-			_, err = io.Copy(tarWriter, file)
-			if err != nil {
-				return err
-			}
+// archiveHeader builds the tar header for path, named relative to
+// sourcePath under basePath and recording where symlinks point.
+func archiveHeader(sourcePath, basePath, path string, info os.FileInfo) (*tar.Header, error) {
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		link, err = os.Readlink(path)
+		if err != nil {
+			return nil, err
 		}
+	}
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return nil, err
+	}
 
-		return nil
-	})
+	relPath, err := filepath.Rel(sourcePath, path)
+	if err != nil {
+		return nil, err
+	}
+	header.Name = filepath.ToSlash(filepath.Join(basePath, relPath))
+	if info.IsDir() {
+		header.Name += "/"
+	}
+
+	return header, nil
 }
@@ -0,0 +1,231 @@
+package backup
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+type SFTPConfig struct {
+	// Host is "host" or "host:port"; the port defaults to 22.
+	Host           string
+	User           string
+	Password       string
+	PrivateKeyFile string
+	// HostKey pins the server key, in authorized_keys format. Otherwise the
+	// server must be listed in KnownHostsFile; unverified hosts are refused.
+	HostKey        string
+	KnownHostsFile string
+}
+
+// sftpTarget keeps archives below root on an SSH server. Each operation
+// opens its own connection, so a dropped link never poisons later backups.
+type sftpTarget struct {
+	address string
+	root    string
+	config  *ssh.ClientConfig
+}
+
+func newSFTPTarget(root string, config SFTPConfig) (*sftpTarget, error) {
+	if config.Host == "" || config.User == "" {
+		return nil, fmt.Errorf("sftp target requires a host and user")
+	}
+
+	address := config.Host
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "22")
+	}
+
+	var auth []ssh.AuthMethod
+	if config.PrivateKeyFile != "" {
+		data, err := os.ReadFile(config.PrivateKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read sftp private key: %v", err)
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse sftp private key: %v", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if config.Password != "" {
+		auth = append(auth, ssh.Password(config.Password))
+	}
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("sftp target requires a password or private key")
+	}
+
+	var hostKeyCallback ssh.HostKeyCallback
+	switch {
+	case config.HostKey != "":
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(config.HostKey))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse sftp host key: %v", err)
+		}
+		hostKeyCallback = ssh.FixedHostKey(key)
+	case config.KnownHostsFile != "":
+		callback, err := knownhosts.New(config.KnownHostsFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read known hosts: %v", err)
+		}
+		hostKeyCallback = callback
+	default:
+		return nil, fmt.Errorf("sftp target requires a host key or known hosts file")
+	}
+
+	if root == "" {
+		root = "."
+	}
+
+	return &sftpTarget{
+		address: address,
+		root:    root,
+		config: &ssh.ClientConfig{
+			User:            config.User,
+			Auth:            auth,
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         30 * time.Second,
+		},
+	}, nil
+}
+
+// sftpSession is one SSH connection with its SFTP subsystem.
+type sftpSession struct {
+	conn   *ssh.Client
+	client *sftp.Client
+}
+
+func (t *sftpTarget) connect() (*sftpSession, error) {
+	conn, err := ssh.Dial("tcp", t.address, t.config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", t.address, err)
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to start sftp on %s: %v", t.address, err)
+	}
+	return &sftpSession{conn: conn, client: client}, nil
+}
+
+func (s *sftpSession) Close() error {
+	s.client.Close()
+	return s.conn.Close()
+}
+
+func (t *sftpTarget) path(key string) string {
+	return path.Join(t.root, key)
+}
+
+// Put uploads to a temporary name and renames it into place once complete.
+func (t *sftpTarget) Put(key string, r io.Reader) error {
+	session, err := t.connect()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	target := t.path(key)
+	if err := session.client.MkdirAll(path.Dir(target)); err != nil {
+		return fmt.Errorf("failed to create %s: %v", path.Dir(target), err)
+	}
+
+	tmpPath := path.Join(path.Dir(target), ".tmp-"+path.Base(target))
+	file, err := session.client.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", tmpPath, err)
+	}
+	if _, err := file.ReadFrom(r); err != nil {
+		file.Close()
+		session.client.Remove(tmpPath)
+		return fmt.Errorf("failed to upload %s: %v", key, err)
+	}
+	if err := file.Close(); err != nil {
+		session.client.Remove(tmpPath)
+		return fmt.Errorf("failed to upload %s: %v", key, err)
+	}
+
+	// Plain SFTP rename refuses to replace an existing file
+	if err := session.client.PosixRename(tmpPath, target); err != nil {
+		session.client.Remove(target)
+		if err := session.client.Rename(tmpPath, target); err != nil {
+			session.client.Remove(tmpPath)
+			return fmt.Errorf("failed to upload %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// sftpReader closes the connection together with the file.
+type sftpReader struct {
+	*sftp.File
+	session *sftpSession
+}
+
+func (r *sftpReader) Close() error {
+	r.File.Close()
+	return r.session.Close()
+}
+
+func (t *sftpTarget) Get(key string) (io.ReadCloser, error) {
+	session, err := t.connect()
+	if err != nil {
+		return nil, err
+	}
+	file, err := session.client.Open(t.path(key))
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("failed to open %s: %v", key, err)
+	}
+	return &sftpReader{File: file, session: session}, nil
+}
+
+func (t *sftpTarget) List(dir string) ([]TargetObject, error) {
+	session, err := t.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	files, err := session.client.ReadDir(t.path(dir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %v", t.path(dir), err)
+	}
+
+	var objects []TargetObject
+	for _, file := range files {
+		if !file.Mode().IsRegular() || strings.HasPrefix(file.Name(), ".tmp-") {
+			continue
+		}
+		objects = append(objects, TargetObject{
+			Key:     path.Join(dir, file.Name()),
+			Size:    file.Size(),
+			ModTime: file.ModTime(),
+		})
+	}
+	return objects, nil
+}
+
+func (t *sftpTarget) Delete(key string) error {
+	session, err := t.connect()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	if err := session.client.Remove(t.path(key)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete %s: %v", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// blobStore holds repository objects under slash-separated keys.
+type blobStore interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+	Has(key string) (bool, error)
+	// List returns the keys of every object below dir.
+	List(dir string) ([]string, error)
+	Delete(key string) error
+}
+
+// localStore keeps objects as files below root.
+type localStore struct {
+	root string
+}
+
+func (l localStore) path(key string) string {
+	return filepath.Join(l.root, filepath.FromSlash(key))
+}
+
+// Put writes through a temporary file so readers never see partial objects.
+func (l localStore) Put(key string, data []byte) error {
+	target := l.path(key)
+	if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		return fmt.Errorf("failed to create repository directory: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(target), ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %v", key, err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write %s: %v", key, err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write %s: %v", key, err)
+	}
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write %s: %v", key, err)
+	}
+	return nil
+}
+
+func (l localStore) Get(key string) ([]byte, error) {
+	data, err := os.ReadFile(l.path(key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", key, err)
+	}
+	return data, nil
+}
+
+func (l localStore) Has(key string) (bool, error) {
+	_, err := os.Stat(l.path(key))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (l localStore) List(dir string) ([]string, error) {
+	var keys []string
+	err := filepath.Walk(l.path(dir), func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".tmp-") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(l.root, p)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %v", dir, err)
+	}
+	return keys, nil
+}
+
+func (l localStore) Delete(key string) error {
+	if err := os.Remove(l.path(key)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete %s: %v", key, err)
+	}
+	return nil
+}
+
+// s3Store keeps objects in the backup bucket below prefix.
+type s3Store struct {
+	svc    *s3.S3
+	bucket string
+	prefix string
+}
+
+func (s s3Store) key(key string) string {
+	return path.Join(s.prefix, key)
+}
+
+func (s s3Store) Put(key string, data []byte) error {
+	_, err := s.svc.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(key)),
+		Body:   bytes.NewReader(data),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload %s to S3: %v", key, err)
+	}
+	return nil
+}
+
+func (s s3Store) Get(key string) ([]byte, error) {
+	result, err := s.svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(key)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s from S3: %v", key, err)
+	}
+	defer result.Body.Close()
+
+	data, err := io.ReadAll(result.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s from S3: %v", key, err)
+	}
+	return data, nil
+}
+
+func (s s3Store) Has(key string) (bool, error) {
+	_, err := s.svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(key)),
+	})
+	if failure, ok := err.(awserr.RequestFailure); ok && failure.StatusCode() == 404 {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to check %s in S3: %v", key, err)
+	}
+	return true, nil
+}
+
+func (s s3Store) List(dir string) ([]string, error) {
+	var keys []string
+	prefix := s.key(dir) + "/"
+	err := s.svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			keys = append(keys, path.Join(dir, strings.TrimPrefix(aws.StringValue(object.Key), prefix)))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s in S3: %v", dir, err)
+	}
+	return keys, nil
+}
+
+func (s s3Store) Delete(key string) error {
+	_, err := s.svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(key)),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete %s from S3: %v", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,466 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	destinationLocal = "local"
+	destinationS3    = "s3"
+	// destinationBoth is kept as an alias for "local,s3"
+	destinationBoth = "both"
+)
+
+// BackupTarget is a place archives are stored. Keys are slash-separated and
+// relative to the target's root. Put and Get stream, so archives of any
+// size never sit in memory.
+type BackupTarget interface {
+	// Put stores everything read from r under key. If r fails, nothing is
+	// left behind under key.
+	Put(key string, r io.Reader) error
+	Get(key string) (io.ReadCloser, error)
+	// List returns the objects directly below dir.
+	List(dir string) ([]TargetObject, error)
+	// Delete removes key; a missing key is not an error.
+	Delete(key string) error
+}
+
+type TargetObject struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// TargetConfig configures an additional backup target. Path is the root
+// directory for local and sftp targets; s3 targets use S3.Prefix and webdav
+// targets the path of WebDAV.URL.
+type TargetConfig struct {
+	Name   string
+	Type   string
+	Path   string
+	S3     S3Config
+	SFTP   SFTPConfig
+	WebDAV WebDAVConfig
+}
+
+// TargetStatus is the outcome of writing one backup to one target.
+type TargetStatus struct {
+	Target  string `json:"target"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+	Path    string `json:"path,omitempty"`
+	Size    int64  `json:"size"`
+}
+
+// BackupResult is returned by CreateBackup. Path refers to the first target
+// that succeeded.
+type BackupResult struct {
+	Path    string
+	Targets []TargetStatus
+	// Warnings lists entries that were skipped or only partly read.
+	Warnings []string
+	JobID    string
+}
+
+// namedTarget is a configured target. CreateBackup writes archives below dir.
+type namedTarget struct {
+	name   string
+	dir    string
+	target BackupTarget
+	// err is reported whenever the target is used
+	err error
+}
+
+// openTargets builds the built-in "local" and "s3" targets followed by the
+// configured ones.
+func (s Service) openTargets(configs []TargetConfig) []namedTarget {
+	targets := []namedTarget{
+		{name: destinationLocal, target: localTarget{root: s.storagePath}},
+	}
+	if s.s3Enabled() {
+		target, err := newS3Target(s.s3Config, "")
+		targets = append(targets, namedTarget{name: destinationS3, dir: s.s3Config.Prefix, target: target, err: err})
+	}
+
+	seen := map[string]bool{destinationLocal: true, destinationS3: true, destinationBoth: true}
+	for _, config := range configs {
+		named := namedTarget{name: config.Name}
+		switch {
+		case config.Name == "" || strings.ContainsAny(config.Name, ":,/ ") || config.Name == strings.TrimSuffix(snapshotPrefix, ":"):
+			named.err = fmt.Errorf("invalid backup target name: %q", config.Name)
+		case seen[config.Name]:
+			named.err = fmt.Errorf("duplicate backup target name: %s", config.Name)
+		default:
+			named.target, named.err = newTarget(config)
+		}
+		seen[config.Name] = true
+		targets = append(targets, named)
+	}
+	return targets
+}
+
+func newTarget(config TargetConfig) (BackupTarget, error) {
+	switch config.Type {
+	case "local":
+		if config.Path == "" {
+			return nil, fmt.Errorf("backup target %s requires a path", config.Name)
+		}
+		return localTarget{root: config.Path}, nil
+	case "s3":
+		return newS3Target(config.S3, config.S3.Prefix)
+	case "sftp":
+		return newSFTPTarget(config.Path, config.SFTP)
+	case "webdav":
+		return newWebDAVTarget(config.WebDAV)
+	}
+	return nil, fmt.Errorf("unsupported backup target type for %s: %q", config.Name, config.Type)
+}
+
+func (s Service) findTarget(name string) (namedTarget, bool) {
+	for _, target := range s.targets {
+		if target.name == name {
+			return target, true
+		}
+	}
+	return namedTarget{}, false
+}
+
+// resolveTargets parses a destination: a comma-separated list of target
+// names, empty meaning "local".
+func (s Service) resolveTargets(destination string) ([]namedTarget, error) {
+	if destination == "" {
+		destination = destinationLocal
+	}
+
+	var names []string
+	for _, name := range strings.Split(destination, ",") {
+		name = strings.TrimSpace(name)
+		if name == destinationBoth {
+			names = append(names, destinationLocal, destinationS3)
+			continue
+		}
+		names = append(names, name)
+	}
+
+	var targets []namedTarget
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		target, ok := s.findTarget(name)
+		if !ok {
+			if name == destinationS3 {
+				return nil, fmt.Errorf("S3 is not configured")
+			}
+			return nil, fmt.Errorf("unknown backup target: %s", name)
+		}
+		if target.err != nil {
+			return nil, target.err
+		}
+		targets = append(targets, target)
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no backup target given")
+	}
+	return targets, nil
+}
+
+// targetPath is the backup path for key on target. Archives on the built-in
+// local target keep their plain file path; all others are "<target>:<key>".
+func (s Service) targetPath(target namedTarget, key string) string {
+	if target.name == destinationLocal {
+		return filepath.Join(s.storagePath, filepath.FromSlash(key))
+	}
+	return target.name + ":" + key
+}
+
+// parseTargetPath splits a "<target>:<key>" backup path. Anything else is a
+// local file path.
+func (s Service) parseTargetPath(backupPath string) (namedTarget, string, bool, error) {
+	i := strings.Index(backupPath, ":")
+	if i <= 0 {
+		return namedTarget{}, "", false, nil
+	}
+	target, ok := s.findTarget(backupPath[:i])
+	if !ok && backupPath[:i] == destinationS3 {
+		return namedTarget{}, "", false, fmt.Errorf("S3 is not configured")
+	}
+	if !ok || target.name == destinationLocal {
+		return namedTarget{}, "", false, nil
+	}
+	if target.err != nil {
+		return namedTarget{}, "", false, target.err
+	}
+
+	key := backupPath[i+1:]
+	if !validTargetKey(key) {
+		return namedTarget{}, "", false, fmt.Errorf("invalid backup key: %s", key)
+	}
+	return target, key, true, nil
+}
+
+func validTargetKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, "/") {
+		return false
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// openArchive streams an archive and, when there is one, its sidecar
+// manifest from a backup path.
+func (s Service) openArchive(backupPath string) (io.ReadCloser, *Manifest, error) {
+	target, key, ok, err := s.parseTargetPath(backupPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !ok {
+		file, err := os.Open(backupPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open backup file: %v", err)
+		}
+		var sidecar *Manifest
+		if _, err := os.Stat(backupPath + manifestSuffix); err == nil {
+			sidecar, err = s.ReadManifest(backupPath)
+			if err != nil {
+				file.Close()
+				return nil, nil, err
+			}
+		}
+		return file, sidecar, nil
+	}
+
+	archive, err := target.target.Get(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Older uploads have no sidecar; the embedded manifest still applies
+	var sidecar *Manifest
+	if body, err := target.target.Get(key + manifestSuffix); err == nil {
+		sidecar, err = readManifest(body)
+		body.Close()
+		if err != nil {
+			archive.Close()
+			return nil, nil, err
+		}
+	}
+	return archive, sidecar, nil
+}
+
+func putManifest(target BackupTarget, key string, manifest *Manifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := target.Put(key, bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("failed to write manifest: %v", err)
+	}
+	return nil
+}
+
+// listArchives returns the archives CreateBackup wrote to target.
+func listArchives(target namedTarget) ([]TargetObject, error) {
+	if target.err != nil {
+		return nil, target.err
+	}
+	objects, err := target.target.List(target.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups on %s: %v", target.name, err)
+	}
+
+	var archives []TargetObject
+	for _, object := range objects {
+		if isArchiveName(path.Base(object.Key)) {
+			archives = append(archives, object)
+		}
+	}
+	return archives, nil
+}
+
+// targetUpload feeds one target's Put through a pipe.
+type targetUpload struct {
+	target namedTarget
+	writer *io.PipeWriter
+	done   chan error
+	err    error
+}
+
+// startTargetUpload starts writing key to target. Uploads to remote targets
+// share the configured upload rate.
+func (s Service) startTargetUpload(target namedTarget, key string) *targetUpload {
+	reader, writer := io.Pipe()
+	upload := &targetUpload{target: target, writer: writer, done: make(chan error, 1)}
+
+	var body io.Reader = reader
+	if _, local := target.target.(localTarget); !local && s.uploadLimiter != nil {
+		body = limitedReader{reader: reader, limiter: s.uploadLimiter}
+	}
+
+	s.goWithPriority(func() {
+		err := target.target.Put(key, body)
+		// Unblock the archive writer if the target gave up early
+		reader.CloseWithError(err)
+		upload.done <- err
+	})
+
+	return upload
+}
+
+// fanout writes the archive to every target at once. A target that fails
+// is dropped and the others continue; writing only fails once all have.
+type fanout struct {
+	uploads []*targetUpload
+}
+
+func (f *fanout) Write(p []byte) (int, error) {
+	alive := 0
+	for _, upload := range f.uploads {
+		if upload.err != nil {
+			continue
+		}
+		if _, err := upload.writer.Write(p); err != nil {
+			upload.err = err
+			continue
+		}
+		alive++
+	}
+	if alive == 0 {
+		return 0, fmt.Errorf("all backup targets failed")
+	}
+	return len(p), nil
+}
+
+// failed reports whether every target has dropped out.
+func (f *fanout) failed() bool {
+	for _, upload := range f.uploads {
+		if upload.err == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// finish ends every upload and records each target's error. When
+// archiveErr is set all uploads are aborted.
+func (f *fanout) finish(archiveErr error) {
+	for _, upload := range f.uploads {
+		if archiveErr != nil {
+			upload.writer.CloseWithError(archiveErr)
+		} else {
+			upload.writer.Close()
+		}
+	}
+	for _, upload := range f.uploads {
+		if err := <-upload.done; err != nil {
+			upload.err = err
+		} else if archiveErr != nil {
+			upload.err = archiveErr
+		}
+	}
+}
+
+// targetErrors summarises why every target failed.
+func (f *fanout) targetErrors() string {
+	var errors []string
+	for _, upload := range f.uploads {
+		if upload.err != nil {
+			errors = append(errors, fmt.Sprintf("%s: %v", upload.target.name, upload.err))
+		}
+	}
+	return strings.Join(errors, "; ")
+}
+
+// localTarget keeps archives as files below root, e.g. the storage path or
+// a mirror on a second disk.
+type localTarget struct {
+	root string
+}
+
+func (l localTarget) path(key string) string {
+	return filepath.Join(l.root, filepath.FromSlash(key))
+}
+
+// Put writes through a temporary file so readers never see partial archives.
+func (l localTarget) Put(key string, r io.Reader) error {
+	target := l.path(key)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("failed to create backup directory: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(target), ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create backup file: %v", err)
+	}
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to close backup file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write %s: %v", key, err)
+	}
+	return nil
+}
+
+func (l localTarget) Get(key string) (io.ReadCloser, error) {
+	file, err := os.Open(l.path(key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open backup file: %v", err)
+	}
+	return file, nil
+}
+
+func (l localTarget) List(dir string) ([]TargetObject, error) {
+	files, err := os.ReadDir(l.path(dir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup directory: %v", err)
+	}
+
+	var objects []TargetObject
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".tmp-") {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		objects = append(objects, TargetObject{
+			Key:     path.Join(dir, file.Name()),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+	}
+	return objects, nil
+}
+
+func (l localTarget) Delete(key string) error {
+	if err := os.Remove(l.path(key)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove %s: %v", key, err)
+	}
+	return nil
+}
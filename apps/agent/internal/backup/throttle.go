@@ -0,0 +1,140 @@
+package backup
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// ThrottleConfig keeps backup work from starving hosted sites.
+type ThrottleConfig struct {
+	// ReadBytesPerSecond limits reading backup sources; 0 means no limit.
+	ReadBytesPerSecond int64
+	// UploadBytesPerSecond limits streaming to remote targets, shared by
+	// all of them; 0 means no limit.
+	UploadBytesPerSecond int64
+	// Nice is the CPU niceness of backup work, from 0 to 19.
+	Nice int
+	// IOClass is the I/O scheduling class of backup work, "best-effort"
+	// or "idle". Empty leaves it alone.
+	IOClass string
+	// IOPriority is the best-effort level, from 0 (highest) to 7.
+	IOPriority int
+}
+
+const (
+	ioClassBestEffort = "best-effort"
+	ioClassIdle       = "idle"
+)
+
+func (c ThrottleConfig) validate() error {
+	if c.ReadBytesPerSecond < 0 || c.UploadBytesPerSecond < 0 {
+		return fmt.Errorf("backup rate limits must not be negative")
+	}
+	if c.Nice < 0 || c.Nice > 19 {
+		return fmt.Errorf("backup nice must be between 0 and 19")
+	}
+	switch c.IOClass {
+	case "", ioClassBestEffort, ioClassIdle:
+	default:
+		return fmt.Errorf("unsupported backup I/O class: %s", c.IOClass)
+	}
+	if c.IOPriority < 0 || c.IOPriority > 7 {
+		return fmt.Errorf("backup I/O priority must be between 0 and 7")
+	}
+	return nil
+}
+
+// prioritized reports whether backup work runs at a lowered priority.
+func (c ThrottleConfig) prioritized() bool {
+	return c.Nice > 0 || c.IOClass != ""
+}
+
+// withPriority runs fn at the configured CPU and I/O priority. Both are set
+// on an OS thread of its own, which is discarded afterwards so the lowered
+// priority cannot leak into other work. Commands fn starts, such as hooks
+// and database dumps, inherit it; goroutines do not, so fn must start them
+// with goWithPriority.
+func (s Service) withPriority(fn func()) {
+	if !s.throttle.prioritized() {
+		fn()
+		return
+	}
+
+	done := make(chan struct{})
+	s.goWithPriority(func() {
+		defer close(done)
+		fn()
+	})
+	<-done
+}
+
+// goWithPriority runs fn in a new goroutine at the configured priority.
+// Goroutines that libraries start in turn, such as the part uploads of the
+// S3 uploader, run at normal priority; they mostly wait on the network and
+// are paced by UploadBytesPerSecond.
+func (s Service) goWithPriority(fn func()) {
+	if !s.throttle.prioritized() {
+		go fn()
+		return
+	}
+
+	go func() {
+		// Never unlocked: the thread exits with the goroutine
+		runtime.LockOSThread()
+		if err := setThreadPriority(s.throttle); err != nil {
+			log.Printf("Failed to lower backup priority: %v", err)
+		}
+		fn()
+	}()
+}
+
+// rateLimiter paces a byte stream to a rate, allowing a burst of one
+// second. It is shared by every backup of a Service.
+type rateLimiter struct {
+	rate float64
+	mu   sync.Mutex
+	// at is when the bytes admitted so far will have been paid for
+	at time.Time
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: float64(bytesPerSecond)}
+}
+
+func (l *rateLimiter) wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if earliest := now.Add(-time.Second); l.at.Before(earliest) {
+		l.at = earliest
+	}
+	l.at = l.at.Add(time.Duration(float64(n) / l.rate * float64(time.Second)))
+	delay := l.at.Sub(now)
+	l.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// limitedReader paces reads through a rateLimiter.
+type limitedReader struct {
+	reader  io.Reader
+	limiter *rateLimiter
+}
+
+func (r limitedReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.limiter.wait(n)
+	return n, err
+}
@@ -0,0 +1,311 @@
+package backup
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const defaultHookTimeout = 5 * time.Minute
+
+// maxWarnings bounds the warnings kept per backup; the rest are counted.
+const maxWarnings = 100
+
+// BackupOptions tunes what CreateBackup reads from the source.
+type BackupOptions struct {
+	// Exclude lists patterns of entries to leave out, matched like
+	// RestoreOptions.Exclude, e.g. "node_modules", "cache/*" or "*.log".
+	// An excluded directory is not descended into.
+	Exclude []string
+	// MaxFileSize skips larger files with a warning; 0 means no limit.
+	MaxFileSize int64
+	// MaxTotalSize fails the backup once the files read exceed it; 0 means
+	// no limit.
+	MaxTotalSize int64
+	// PreHook names a hook of Config.Hooks run before the source is read,
+	// e.g. to enable maintenance mode or flush a database. The backup is not
+	// taken if it fails.
+	PreHook string
+	// PostHook names a hook run after every backup attempt, also when it or
+	// PreHook failed, with BACKUP_STATUS set to "success" or "failure".
+	PostHook string
+	// HookTimeout bounds each hook; five minutes when zero.
+	HookTimeout time.Duration
+	// JobID names the backup for WatchBackup; generated when empty.
+	JobID string
+
+	job         *backupJob
+	readLimiter *rateLimiter
+}
+
+func (o BackupOptions) validate() error {
+	for _, pattern := range o.Exclude {
+		if err := (&RestoreOptions{Exclude: []string{pattern}}).validate(); err != nil {
+			return err
+		}
+	}
+	if o.MaxFileSize < 0 || o.MaxTotalSize < 0 || o.HookTimeout < 0 {
+		return fmt.Errorf("size limits and hook timeout must not be negative")
+	}
+	return nil
+}
+
+// checkHooks fails unless the hooks options name are configured.
+func (s Service) checkHooks(options BackupOptions) error {
+	for _, name := range []string{options.PreHook, options.PostHook} {
+		if name == "" {
+			continue
+		}
+		if _, ok := s.hooks[name]; !ok {
+			return fmt.Errorf("unknown backup hook: %s", name)
+		}
+	}
+	return nil
+}
+
+// runHook runs a hook command with sh, passing the backup's details in the
+// environment as BACKUP_* variables.
+func (o BackupOptions) runHook(command string, env []string) error {
+	timeout := o.HookTimeout
+	if timeout == 0 {
+		timeout = defaultHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = append(os.Environ(), env...)
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+	if err != nil {
+		message := strings.TrimSpace(string(output))
+		if len(message) > 1024 {
+			message = message[len(message)-1024:]
+		}
+		return fmt.Errorf("%v: %s", err, message)
+	}
+	return nil
+}
+
+// sourceWalker walks backup sources applying BackupOptions. Problems with
+// single entries, such as files that vanish or cannot be read, become
+// warnings so that they do not cost the whole backup. Size limits apply
+// across every source walked.
+type sourceWalker struct {
+	options BackupOptions
+
+	total    int64
+	warnings []string
+	dropped  int
+}
+
+func newSourceWalker(options BackupOptions) *sourceWalker {
+	return &sourceWalker{options: options}
+}
+
+func (w *sourceWalker) warn(path string, format string, args ...interface{}) {
+	w.addWarning(path + ": " + fmt.Sprintf(format, args...))
+}
+
+func (w *sourceWalker) addWarning(warning string) {
+	if len(w.warnings) >= maxWarnings {
+		w.dropped++
+		return
+	}
+	w.warnings = append(w.warnings, warning)
+}
+
+// Warnings returns the warnings collected so far.
+func (w *sourceWalker) Warnings() []string {
+	if w.dropped == 0 {
+		return w.warnings
+	}
+	return append(w.warnings, fmt.Sprintf("%d more warnings not shown", w.dropped))
+}
+
+// walk calls fn with the header of every entry below root, named under
+// base. Regular files are passed already open, so a file that cannot be
+// opened is skipped before its header is written.
+func (w *sourceWalker) walk(root, base string, fn func(header *tar.Header, file *sourceFile) error) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == root && info == nil {
+				return err
+			}
+			// Vanished since its directory was listed, or an unreadable
+			// directory whose contents are skipped
+			w.warn(path, "%v", unwrapPathError(err))
+			return nil
+		}
+
+		if w.excluded(root, path) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !backedUp(info) {
+			// Sockets, FIFOs and devices cannot be restored into a site
+			return nil
+		}
+
+		var file *sourceFile
+		if info.Mode().IsRegular() {
+			if w.tooLarge(info) {
+				w.warn(path, "skipped, %d bytes exceeds the %d byte file size limit", info.Size(), w.options.MaxFileSize)
+				return nil
+			}
+
+			f, err := os.Open(path)
+			if err != nil {
+				w.warn(path, "%v", unwrapPathError(err))
+				return nil
+			}
+			defer f.Close()
+			file = &sourceFile{path: path, file: f, walker: w}
+
+			if err := w.count(info.Size()); err != nil {
+				return err
+			}
+		}
+
+		header, err := archiveHeader(root, base, path, info)
+		if err != nil {
+			w.warn(path, "%v", unwrapPathError(err))
+			return nil
+		}
+
+		if err := fn(header, file); err != nil {
+			return err
+		}
+		w.options.job.addFile()
+		return nil
+	})
+}
+
+// scan counts the files and bytes walk would back up below root, for
+// progress reporting. Errors are left for walk to report.
+func (w *sourceWalker) scan(root string) (int64, int64) {
+	var files, bytes int64
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if w.excluded(root, path) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !backedUp(info) || (info.Mode().IsRegular() && w.tooLarge(info)) {
+			return nil
+		}
+		files++
+		if info.Mode().IsRegular() {
+			bytes += info.Size()
+		}
+		return nil
+	})
+	return files, bytes
+}
+
+func (w *sourceWalker) excluded(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." {
+		return false
+	}
+	for _, pattern := range w.options.Exclude {
+		if matchEntry(pattern, filepath.ToSlash(rel)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *sourceWalker) tooLarge(info os.FileInfo) bool {
+	return w.options.MaxFileSize > 0 && info.Size() > w.options.MaxFileSize
+}
+
+// backedUp reports whether entries of this type are backed up at all.
+func backedUp(info os.FileInfo) bool {
+	return info.Mode()&(os.ModeSocket|os.ModeNamedPipe|os.ModeDevice|os.ModeCharDevice|os.ModeIrregular) == 0
+}
+
+// count adds size to the bytes read, failing once MaxTotalSize is exceeded.
+func (w *sourceWalker) count(size int64) error {
+	w.total += size
+	if w.options.MaxTotalSize > 0 && w.total > w.options.MaxTotalSize {
+		return fmt.Errorf("source exceeds the %d byte size limit", w.options.MaxTotalSize)
+	}
+	return nil
+}
+
+func unwrapPathError(err error) error {
+	if pathErr, ok := err.(*os.PathError); ok {
+		return pathErr.Err
+	}
+	return err
+}
+
+// sourceFile reads a file being backed up and remembers read errors, so
+// they can be told apart from failures writing the backup.
+type sourceFile struct {
+	path    string
+	file    *os.File
+	walker  *sourceWalker
+	readErr error
+}
+
+func (f *sourceFile) Read(p []byte) (int, error) {
+	n, err := f.file.Read(p)
+	if err != nil && err != io.EOF {
+		f.readErr = err
+	}
+	f.walker.options.readLimiter.wait(n)
+	f.walker.options.job.addBytes(int64(n))
+	return n, err
+}
+
+// copyTo writes exactly size bytes of the file to w, the size recorded in
+// its header. A file that shrank or failed to read is padded with zeros
+// and one that grew is cut off, each with a warning, so the archive stays
+// valid. Only errors writing to w are returned.
+func (f *sourceFile) copyTo(w io.Writer, size int64) error {
+	n, err := io.CopyN(w, f, size)
+	if err != nil && err != io.EOF && f.readErr == nil {
+		return err
+	}
+
+	if n < size {
+		if f.readErr != nil {
+			f.walker.warn(f.path, "read failed after %d bytes, rest stored as zeros: %v", n, unwrapPathError(f.readErr))
+		} else {
+			f.walker.warn(f.path, "shrank from %d to %d bytes while being read, rest stored as zeros", size, n)
+		}
+		zeros := make([]byte, 32*1024)
+		for remaining := size - n; remaining > 0; {
+			chunk := int64(len(zeros))
+			if remaining < chunk {
+				chunk = remaining
+			}
+			if _, err := w.Write(zeros[:chunk]); err != nil {
+				return err
+			}
+			remaining -= chunk
+		}
+		return nil
+	}
+
+	if info, err := f.file.Stat(); err == nil && info.Size() > size {
+		f.walker.warn(f.path, "grew while being read, first %d of %d bytes backed up", size, info.Size())
+	}
+	return nil
+}
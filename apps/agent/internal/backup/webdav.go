@@ -0,0 +1,227 @@
+package backup
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type WebDAVConfig struct {
+	// URL is the collection archives are stored in, e.g.
+	// "https://cloud.example.com/remote.php/dav/files/backup/server1".
+	URL      string
+	Username string
+	Password string
+}
+
+// webdavTimeout bounds requests that carry no archive data, and the wait
+// for the response to those that do.
+const webdavTimeout = time.Minute
+
+// webdavTarget keeps archives in a WebDAV collection, e.g. Nextcloud.
+type webdavTarget struct {
+	base   *url.URL
+	config WebDAVConfig
+	client *http.Client
+}
+
+func newWebDAVTarget(config WebDAVConfig) (*webdavTarget, error) {
+	base, err := url.Parse(config.URL)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return nil, fmt.Errorf("invalid webdav URL: %s", config.URL)
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/")
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = webdavTimeout
+	return &webdavTarget{base: base, config: config, client: &http.Client{Transport: transport}}, nil
+}
+
+func (t *webdavTarget) url(key string, collection bool) string {
+	u := *t.base
+	u.Path = path.Join(t.base.Path, key)
+	if collection {
+		u.Path += "/"
+	}
+	return u.String()
+}
+
+func (t *webdavTarget) do(ctx context.Context, method, target string, body io.Reader, header map[string]string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	if t.config.Username != "" {
+		req.SetBasicAuth(t.config.Username, t.config.Password)
+	}
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	return t.client.Do(req)
+}
+
+// request performs a request whose response body is not needed and checks
+// the status against ok. Requests without a body are bounded by
+// webdavTimeout; uploads take as long as the archive needs.
+func (t *webdavTarget) request(method, target string, body io.Reader, header map[string]string, ok ...int) error {
+	ctx := context.Background()
+	if body == nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, webdavTimeout)
+		defer cancel()
+	}
+	resp, err := t.do(ctx, method, target, body, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	for _, status := range ok {
+		if resp.StatusCode == status {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s %s: %s", method, target, resp.Status)
+}
+
+// mkcol creates the base collection and those leading to dir. Existing
+// ones answer 405. The parent of the base collection must exist.
+func (t *webdavTarget) mkcol(dir string) error {
+	collections := []string{""}
+	if dir != "" && dir != "." {
+		current := ""
+		for _, part := range strings.Split(dir, "/") {
+			current = path.Join(current, part)
+			collections = append(collections, current)
+		}
+	}
+
+	for _, collection := range collections {
+		err := t.request("MKCOL", t.url(collection, true), nil, nil, http.StatusCreated, http.StatusMethodNotAllowed)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Put uploads to a temporary name and moves it into place once complete,
+// since servers keep whatever arrived of an interrupted PUT.
+func (t *webdavTarget) Put(key string, r io.Reader) error {
+	if err := t.mkcol(path.Dir(key)); err != nil {
+		return fmt.Errorf("failed to create collection for %s: %v", key, err)
+	}
+
+	tmpKey := path.Join(path.Dir(key), ".tmp-"+path.Base(key))
+	err := t.request(http.MethodPut, t.url(tmpKey, false), r, nil,
+		http.StatusCreated, http.StatusNoContent, http.StatusOK)
+	if err != nil {
+		t.request(http.MethodDelete, t.url(tmpKey, false), nil, nil)
+		return fmt.Errorf("failed to upload %s: %v", key, err)
+	}
+
+	err = t.request("MOVE", t.url(tmpKey, false), nil, map[string]string{
+		"Destination": t.url(key, false),
+		"Overwrite":   "T",
+	}, http.StatusCreated, http.StatusNoContent)
+	if err != nil {
+		t.request(http.MethodDelete, t.url(tmpKey, false), nil, nil)
+		return fmt.Errorf("failed to upload %s: %v", key, err)
+	}
+	return nil
+}
+
+func (t *webdavTarget) Get(key string) (io.ReadCloser, error) {
+	resp, err := t.do(context.Background(), http.MethodGet, t.url(key, false), nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %v", key, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to download %s: %s", key, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:"><d:prop><d:resourcetype/><d:getcontentlength/><d:getlastmodified/></d:prop></d:propfind>`
+
+type davMultistatus struct {
+	Responses []struct {
+		Href string `xml:"href"`
+		Prop struct {
+			ResourceType struct {
+				Collection *struct{} `xml:"collection"`
+			} `xml:"resourcetype"`
+			ContentLength string `xml:"getcontentlength"`
+			LastModified  string `xml:"getlastmodified"`
+		} `xml:"propstat>prop"`
+	} `xml:"response"`
+}
+
+func (t *webdavTarget) List(dir string) ([]TargetObject, error) {
+	collection := t.url(dir, true)
+	ctx, cancel := context.WithTimeout(context.Background(), webdavTimeout)
+	defer cancel()
+	resp, err := t.do(ctx, "PROPFIND", collection, strings.NewReader(propfindBody), map[string]string{
+		"Depth":        "1",
+		"Content-Type": "application/xml",
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, fmt.Errorf("PROPFIND %s: %s", collection, resp.Status)
+	}
+
+	var status davMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("failed to parse listing of %s: %v", collection, err)
+	}
+
+	var objects []TargetObject
+	for _, response := range status.Responses {
+		if response.Prop.ResourceType.Collection != nil {
+			continue
+		}
+		href, err := url.PathUnescape(response.Href)
+		if err != nil {
+			continue
+		}
+		name := path.Base(strings.TrimSuffix(href, "/"))
+		if strings.HasPrefix(name, ".tmp-") {
+			continue
+		}
+
+		size, _ := strconv.ParseInt(response.Prop.ContentLength, 10, 64)
+		modTime, _ := time.Parse(http.TimeFormat, response.Prop.LastModified)
+		objects = append(objects, TargetObject{
+			Key:     path.Join(dir, name),
+			Size:    size,
+			ModTime: modTime,
+		})
+	}
+	return objects, nil
+}
+
+func (t *webdavTarget) Delete(key string) error {
+	err := t.request(http.MethodDelete, t.url(key, false), nil, nil,
+		http.StatusOK, http.StatusNoContent, http.StatusNotFound)
+	if err != nil {
+		return fmt.Errorf("failed to delete %s: %v", key, err)
+	}
+	return nil
+}
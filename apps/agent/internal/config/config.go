@@ -2,6 +2,7 @@ package config
 
 import (
 	"os"
+	"path/filepath"
 	"gopkg.in/yaml.v3"
 )
 
@@ -12,9 +13,14 @@ type Config struct {
 	SSL     SSLConfig     `yaml:"ssl"`
 	Database DatabaseConfig `yaml:"database"`
 	Backup  BackupConfig  `yaml:"backup"`
+	Metrics MetricsConfig `yaml:"metrics"`
 	Logging LoggingConfig `yaml:"logging"`
 }
 
+type MetricsConfig struct {
+	InterfaceExclude string `yaml:"interface_exclude"`
+}
+
 type GRPCConfig struct {
 	Port int    `yaml:"port"`
 	Host string `yaml:"host"`
@@ -36,6 +42,8 @@ type NginxConfig struct {
 	ConfigPath    string `yaml:"config_path"`
 	SitesPath     string `yaml:"sites_path"`
 	ReloadCommand string `yaml:"reload_command"`
+	LogPath       string `yaml:"log_path"`
+	TrafficStatePath string `yaml:"traffic_state_path"`
 }
 
 type SSLConfig struct {
@@ -51,7 +59,12 @@ type LetsEncryptConfig struct {
 
 type DatabaseConfig struct {
 	MySQL     MySQLConfig     `yaml:"mysql"`
+	MariaDB   MySQLConfig     `yaml:"mariadb"`
 	PostgreSQL PostgreSQLConfig `yaml:"postgresql"`
+	Redis     RedisConfig     `yaml:"redis"`
+	MongoDB   MongoDBConfig   `yaml:"mongodb"`
+	SQLite    SQLiteConfig    `yaml:"sqlite"`
+	QuotaStatePath string     `yaml:"quota_state_path"`
 }
 
 type MySQLConfig struct {
@@ -68,17 +81,107 @@ type PostgreSQLConfig struct {
 	Password string `yaml:"password"`
 }
 
+type RedisConfig struct {
+	Host      string `yaml:"host"`
+	Port      int    `yaml:"port"`
+	Username  string `yaml:"username"`
+	Password  string `yaml:"password"`
+	Databases int    `yaml:"databases"`
+}
+
+type MongoDBConfig struct {
+	URI      string `yaml:"uri"`
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+type SQLiteConfig struct {
+	Path string `yaml:"path"`
+}
+
 type BackupConfig struct {
 	StoragePath string `yaml:"storage_path"`
 	S3          S3Config `yaml:"s3"`
+	Encryption  BackupEncryptionConfig `yaml:"encryption"`
+	Repository  BackupRepositoryConfig `yaml:"repository"`
+	Retention   []RetentionRuleConfig  `yaml:"retention"`
+	SchedulePath string `yaml:"schedule_path"`
+	Targets      []BackupTargetConfig `yaml:"targets"`
+	// ServerPaths are added to full-server backups; the agent's config file
+	// and state directory by default.
+	ServerPaths []string `yaml:"server_paths"`
+	Throttle    BackupThrottleConfig `yaml:"throttle"`
+	// Hooks are the commands backups may run, by name
+	Hooks map[string]string `yaml:"hooks"`
+}
+
+type BackupThrottleConfig struct {
+	ReadBytesPerSecond   int64  `yaml:"read_bytes_per_second"`
+	UploadBytesPerSecond int64  `yaml:"upload_bytes_per_second"`
+	Nice                 int    `yaml:"nice"`
+	IOClass              string `yaml:"io_class"`
+	IOPriority           int    `yaml:"io_priority"`
+}
+
+type BackupTargetConfig struct {
+	Name   string             `yaml:"name"`
+	Type   string             `yaml:"type"`
+	Path   string             `yaml:"path"`
+	S3     S3Config           `yaml:"s3"`
+	SFTP   BackupSFTPConfig   `yaml:"sftp"`
+	WebDAV BackupWebDAVConfig `yaml:"webdav"`
+}
+
+type BackupSFTPConfig struct {
+	Host           string `yaml:"host"`
+	User           string `yaml:"user"`
+	Password       string `yaml:"password"`
+	PrivateKeyFile string `yaml:"private_key_file"`
+	HostKey        string `yaml:"host_key"`
+	KnownHostsFile string `yaml:"known_hosts_file"`
+}
+
+type BackupWebDAVConfig struct {
+	URL      string `yaml:"url"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+type RetentionRuleConfig struct {
+	Name        string `yaml:"name"`
+	Type        string `yaml:"type"`
+	KeepLast    int    `yaml:"keep_last"`
+	KeepDaily   int    `yaml:"keep_daily"`
+	KeepWeekly  int    `yaml:"keep_weekly"`
+	KeepMonthly int    `yaml:"keep_monthly"`
+	KeepYearly  int    `yaml:"keep_yearly"`
+}
+
+type BackupRepositoryConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Backend string `yaml:"backend"`
+	Path    string `yaml:"path"`
+	Prefix  string `yaml:"prefix"`
+}
+
+type BackupEncryptionConfig struct {
+	Enabled      bool     `yaml:"enabled"`
+	Recipients   []string `yaml:"recipients"`
+	IdentityFile string   `yaml:"identity_file"`
 }
 
 type S3Config struct {
-	Endpoint  string `yaml:"endpoint"`
-	Bucket    string `yaml:"bucket"`
-	AccessKey string `yaml:"access_key"`
-	SecretKey string `yaml:"secret_key"`
-	Region    string `yaml:"region"`
+	Enabled        bool   `yaml:"enabled"`
+	Endpoint       string `yaml:"endpoint"`
+	Bucket         string `yaml:"bucket"`
+	AccessKey      string `yaml:"access_key"`
+	SecretKey      string `yaml:"secret_key"`
+	Region         string `yaml:"region"`
+	Prefix         string `yaml:"prefix"`
+	ForcePathStyle bool   `yaml:"force_path_style"`
+	PartSize       int64  `yaml:"part_size"`
 }
 
 type LoggingConfig struct {
@@ -113,15 +216,34 @@ func Load(path string) (*Config, error) {
 	if config.Nginx.ReloadCommand == "" {
 		config.Nginx.ReloadCommand = "nginx -s reload"
 	}
+	if config.Nginx.LogPath == "" {
+		config.Nginx.LogPath = "/var/log/nginx"
+	}
+	if config.Nginx.TrafficStatePath == "" {
+		config.Nginx.TrafficStatePath = "/var/lib/hosting-panel-agent/traffic.json"
+	}
 	if config.SSL.CertPath == "" {
 		config.SSL.CertPath = "/etc/ssl/certs"
 	}
 	if config.SSL.KeyPath == "" {
 		config.SSL.KeyPath = "/etc/ssl/private"
 	}
+	if config.Database.QuotaStatePath == "" {
+		config.Database.QuotaStatePath = "/var/lib/hosting-panel-agent/quotas.json"
+	}
 	if config.Backup.StoragePath == "" {
 		config.Backup.StoragePath = "/var/backups"
 	}
+	if config.Backup.SchedulePath == "" {
+		config.Backup.SchedulePath = "/var/lib/hosting-panel-agent/schedules.json"
+	}
+	if len(config.Backup.ServerPaths) == 0 {
+		configFile, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		config.Backup.ServerPaths = []string{configFile, "/var/lib/hosting-panel-agent"}
+	}
 	if config.Logging.Level == "" {
 		config.Logging.Level = "info"
 	}
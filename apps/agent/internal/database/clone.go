@@ -0,0 +1,103 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// DatabaseCloner is implemented by providers that can copy one database into
+// a new one and run SQL scripts against it. Scripts run with the privileges
+// of the database's tenant and cannot leave the database.
+type DatabaseCloner interface {
+	CloneDatabase(source, target string) error
+	ExecScript(name, script string) error
+}
+
+// CloneDatabase copies source into a new target database that the tenant of
+// source can use. When sanitizeSQL is set it runs against the copy
+// afterwards with the tenant's privileges, typically to scrub PII; if it
+// fails the copy is dropped rather than left behind unsanitized.
+func (s Service) CloneDatabase(source, target, dbType, sanitizeSQL string) error {
+	provider, err := s.Provider(dbType)
+	if err != nil {
+		return err
+	}
+	cloner, ok := provider.(DatabaseCloner)
+	if !ok {
+		return fmt.Errorf("cloning is not supported for database type: %s", dbType)
+	}
+
+	if source == target {
+		return fmt.Errorf("source and target database must differ")
+	}
+
+	return provision(
+		provisionStep{
+			name: "clone",
+			run: always(func() error {
+				return cloner.CloneDatabase(source, target)
+			}),
+			compensate: func() error {
+				return provider.DeleteDatabase(target)
+			},
+		},
+		provisionStep{
+			name: "sanitize",
+			run: func() (bool, error) {
+				if strings.TrimSpace(sanitizeSQL) == "" {
+					return false, nil
+				}
+				if err := cloner.ExecScript(target, sanitizeSQL); err != nil {
+					return false, fmt.Errorf("failed to run sanitization script: %v", err)
+				}
+				return false, nil
+			},
+		},
+	)
+}
+
+// pipeCommands streams the output of dump into restore, as in
+// "dump | restore", and fails if either side fails.
+func pipeCommands(dump, restore *exec.Cmd) error {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to create pipe: %v", err)
+	}
+
+	var dumpErr, restoreErr bytes.Buffer
+	dump.Stdout = writer
+	dump.Stderr = &dumpErr
+	restore.Stdin = reader
+	restore.Stderr = &restoreErr
+
+	if err := restore.Start(); err != nil {
+		reader.Close()
+		writer.Close()
+		return fmt.Errorf("failed to start %s: %v", restore.Path, err)
+	}
+	if err := dump.Start(); err != nil {
+		reader.Close()
+		writer.Close()
+		restore.Wait()
+		return fmt.Errorf("failed to start %s: %v", dump.Path, err)
+	}
+
+	// The children hold their own copies of the pipe ends
+	reader.Close()
+	writer.Close()
+
+	dumpWaitErr := dump.Wait()
+	restoreWaitErr := restore.Wait()
+
+	if dumpWaitErr != nil {
+		return fmt.Errorf("dump failed: %v: %s", dumpWaitErr, strings.TrimSpace(dumpErr.String()))
+	}
+	if restoreWaitErr != nil {
+		return fmt.Errorf("restore failed: %v: %s", restoreWaitErr, strings.TrimSpace(restoreErr.String()))
+	}
+
+	return nil
+}
@@ -0,0 +1,299 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// DatabaseImporter is implemented by providers that can load a SQL dump into
+// a database and write one out of it.
+type DatabaseImporter interface {
+	ImportSQL(name string, r io.Reader, onStatement func(count int64)) error
+	ExportSQL(name string, w io.Writer) error
+}
+
+// ImportResult describes how far an import got.
+type ImportResult struct {
+	BytesRead  int64
+	Statements int64
+	Compressed bool
+	// FailedStatement is the 1-based number of the statement that failed,
+	// and FailedLine the line it started on. Both are zero on success.
+	FailedStatement int64
+	FailedLine      int64
+}
+
+// StatementError reports the statement an import stopped at.
+type StatementError struct {
+	Number int64
+	Line   int64
+	Err    error
+}
+
+func (e *StatementError) Error() string {
+	return fmt.Sprintf("statement %d (line %d) failed: %v", e.Number, e.Line, e.Err)
+}
+
+func (e *StatementError) Unwrap() error {
+	return e.Err
+}
+
+// importProgressInterval rate-limits progress callbacks during an import.
+const importProgressInterval = time.Second
+
+// ImportDatabase loads a SQL dump, plain or gzip-compressed, into an existing
+// database. The dump runs with the privileges of the database's tenant, not
+// the agent's. progress, when set, is called periodically while statements
+// execute.
+func (s Service) ImportDatabase(name, dbType string, r io.Reader, progress func(ImportResult)) (ImportResult, error) {
+	var result ImportResult
+
+	provider, err := s.Provider(dbType)
+	if err != nil {
+		return result, err
+	}
+	importer, ok := provider.(DatabaseImporter)
+	if !ok {
+		return result, fmt.Errorf("import is not supported for database type: %s", dbType)
+	}
+
+	counter := &countingReader{reader: r}
+	input, compressed, err := decompress(counter)
+	if err != nil {
+		return result, err
+	}
+	result.Compressed = compressed
+
+	lastProgress := time.Now()
+	err = importer.ImportSQL(name, input, func(count int64) {
+		result.Statements = count
+		result.BytesRead = counter.count
+		if progress != nil && time.Since(lastProgress) >= importProgressInterval {
+			progress(result)
+			lastProgress = time.Now()
+		}
+	})
+	result.BytesRead = counter.count
+
+	var statementErr *StatementError
+	if errors.As(err, &statementErr) {
+		result.FailedStatement = statementErr.Number
+		result.FailedLine = statementErr.Line
+	}
+	if err != nil {
+		return result, err
+	}
+
+	return result, nil
+}
+
+// ExportDatabase writes a SQL dump of the database to w, gzip-compressed
+// when compress is set.
+func (s Service) ExportDatabase(name, dbType string, w io.Writer, compress bool) error {
+	provider, err := s.Provider(dbType)
+	if err != nil {
+		return err
+	}
+	importer, ok := provider.(DatabaseImporter)
+	if !ok {
+		return fmt.Errorf("export is not supported for database type: %s", dbType)
+	}
+
+	if !compress {
+		return importer.ExportSQL(name, w)
+	}
+
+	gzipWriter := gzip.NewWriter(w)
+	if err := importer.ExportSQL(name, gzipWriter); err != nil {
+		gzipWriter.Close()
+		return err
+	}
+	return gzipWriter.Close()
+}
+
+// DatabaseSize reports the on-disk size of a database when its provider can
+// measure it, or zero otherwise.
+func (s Service) DatabaseSize(name, dbType string) int64 {
+	provider, err := s.Provider(dbType)
+	if err != nil {
+		return 0
+	}
+	quotaProvider, ok := provider.(QuotaProvider)
+	if !ok {
+		return 0
+	}
+	size, err := quotaProvider.DatabaseSize(name)
+	if err != nil {
+		return 0
+	}
+	return size
+}
+
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count += int64(n)
+	return n, err
+}
+
+// decompress sniffs the gzip magic number and unwraps the stream if present.
+func decompress(r io.Reader) (io.Reader, bool, error) {
+	buffered := bufio.NewReader(r)
+
+	magic, err := buffered.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, false, fmt.Errorf("failed to read input: %v", err)
+	}
+	if len(magic) < 2 || magic[0] != 0x1f || magic[1] != 0x8b {
+		return buffered, false, nil
+	}
+
+	gzipReader, err := gzip.NewReader(buffered)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to create gzip reader: %v", err)
+	}
+	return gzipReader, true, nil
+}
+
+// copyInFunc loads the inline rows of a COPY ... FROM stdin statement.
+type copyInFunc func(ctx context.Context, conn *sql.Conn, statement *sqlStatement, scanner *sqlScanner) error
+
+// roleSwitch matches statements that change the role a session runs as.
+var roleSwitch = regexp.MustCompile(`(?i)^(SET\s+(SESSION\s+|LOCAL\s+)?(ROLE|SESSION\s+AUTHORIZATION|DEFAULT\s+ROLE)|RESET\s+(ROLE|SESSION\s+AUTHORIZATION))\b`)
+
+var useStatement = regexp.MustCompile("(?i)^USE\\s+(`([^`]+)`|([^\\s;*]+))")
+
+// definerClause matches the DEFINER of a MySQL view, routine, trigger or
+// event, which only an administrator may set to another account.
+var definerClause = regexp.MustCompile("(?i)\\bDEFINER\\s*=\\s*(CURRENT_USER(\\s*\\(\\s*\\))?|(`[^`]*`|'[^']*'|\"[^\"]*\"|[\\w.$-]+)(\\s*@\\s*(`[^`]*`|'[^']*'|\"[^\"]*\"|[\\w.%:$-]+))?)")
+
+var createOrAlter = regexp.MustCompile(`(?i)^(CREATE|ALTER)\b`)
+
+// statementStart skips the comments a statement starts with, keeping the
+// body of MySQL conditional comments, which the server executes.
+func statementStart(text string) string {
+	for {
+		text = strings.TrimLeft(text, " \t\r\n")
+		switch {
+		case strings.HasPrefix(text, "--"), strings.HasPrefix(text, "#"):
+			end := strings.IndexByte(text, '\n')
+			if end < 0 {
+				return ""
+			}
+			text = text[end+1:]
+		case strings.HasPrefix(text, "/*!"):
+			text = strings.TrimLeft(text[3:], "0123456789")
+		case strings.HasPrefix(text, "/*"):
+			end := strings.Index(text[2:], "*/")
+			if end < 0 {
+				return ""
+			}
+			text = text[end+4:]
+		default:
+			return text
+		}
+	}
+}
+
+// checkStatement rejects statements that would leave database or the role
+// a tenant's SQL runs as.
+func checkStatement(text, database string) error {
+	start := statementStart(text)
+	if roleSwitch.MatchString(start) {
+		return fmt.Errorf("changing the session role is not allowed")
+	}
+	if match := useStatement.FindStringSubmatch(start); match != nil && match[2]+match[3] != database {
+		return fmt.Errorf("switching to another database is not allowed")
+	}
+	return nil
+}
+
+// stripDefiner drops the DEFINER clause of a MySQL CREATE or ALTER, so that
+// the object is defined by the account running the statement.
+func stripDefiner(text string) string {
+	if !createOrAlter.MatchString(statementStart(text)) {
+		return text
+	}
+	return definerClause.ReplaceAllString(text, "")
+}
+
+// randomToken returns n random bytes, hex-encoded, for the names and
+// passwords of short-lived accounts.
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate random token: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// execStatements runs every statement from scanner on a single connection,
+// so session settings made by the dump carry over to later statements.
+// Statements that would leave database are refused.
+func execStatements(conn *sql.Conn, scanner *sqlScanner, database string, copyIn copyInFunc, onStatement func(int64)) error {
+	ctx := context.Background()
+
+	var count int64
+	for {
+		statement, err := scanner.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return &StatementError{Number: count + 1, Line: scanner.line, Err: err}
+		}
+		count++
+
+		if err := checkStatement(statement.Text, database); err != nil {
+			return &StatementError{Number: count, Line: statement.Line, Err: err}
+		}
+		if scanner.dialect == dialectMySQL {
+			statement.Text = stripDefiner(statement.Text)
+		}
+
+		if statement.Copy {
+			if copyIn == nil {
+				err = fmt.Errorf("COPY FROM stdin is not supported")
+			} else {
+				err = copyIn(ctx, conn, statement, scanner)
+			}
+		} else {
+			_, err = conn.ExecContext(ctx, statement.Text)
+		}
+		if err != nil {
+			return &StatementError{Number: count, Line: statement.Line, Err: err}
+		}
+
+		if onStatement != nil {
+			onStatement(count)
+		}
+	}
+}
+
+// runDump runs a dump command with its output going to w.
+func runDump(cmd *exec.Cmd, w io.Writer) error {
+	var stderr bytes.Buffer
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("dump failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// recordingConn records the statements it executes and fails those
+// mentioning "fail".
+type recordingConn struct {
+	executed []string
+}
+
+func (c *recordingConn) Connect(context.Context) (driver.Conn, error) { return c, nil }
+func (c *recordingConn) Driver() driver.Driver                        { return nil }
+func (c *recordingConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+func (c *recordingConn) Close() error              { return nil }
+func (c *recordingConn) Begin() (driver.Tx, error) { return nil, errors.New("not supported") }
+
+func (c *recordingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if strings.Contains(query, "fail") {
+		return nil, errors.New("syntax error")
+	}
+	c.executed = append(c.executed, query)
+	return driver.RowsAffected(0), nil
+}
+
+func TestExecStatements(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		executed int
+		number   int64
+		line     int64
+	}{
+		{
+			name:     "statement fails",
+			input:    "CREATE TABLE a (id int);\n\n-- rows\nINSERT INTO a VALUES (1);\nINSERT INTO a VALUES\n  (fail);\nSELECT 1;\n",
+			executed: 2,
+			number:   3,
+			line:     5,
+		},
+		{
+			name:     "statement refused",
+			input:    "SELECT 1;\nUSE other;\nSELECT 2;\n",
+			executed: 1,
+			number:   2,
+			line:     2,
+		},
+		{
+			name:     "dump cannot be parsed",
+			input:    "SELECT 1;\nSELECT 'a;\n",
+			executed: 1,
+			number:   2,
+			line:     3,
+		},
+		{
+			name:     "success",
+			input:    "SELECT 1;\nSELECT 2;\n",
+			executed: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := &recordingConn{}
+			db := sql.OpenDB(recorder)
+			defer db.Close()
+			conn, err := db.Conn(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			var progress []int64
+			err = execStatements(conn, newSQLScanner(strings.NewReader(tt.input), dialectMySQL), "shop", nil, func(count int64) {
+				progress = append(progress, count)
+			})
+
+			if len(recorder.executed) != tt.executed {
+				t.Errorf("executed %q", recorder.executed)
+			}
+			if len(progress) != tt.executed || (tt.executed > 0 && progress[tt.executed-1] != int64(tt.executed)) {
+				t.Errorf("progress %v", progress)
+			}
+			if tt.number == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var statementErr *StatementError
+			if !errors.As(err, &statementErr) {
+				t.Fatalf("got %v, want a statement error", err)
+			}
+			if statementErr.Number != tt.number || statementErr.Line != tt.line {
+				t.Errorf("failed at statement %d, line %d; want %d, line %d", statementErr.Number, statementErr.Line, tt.number, tt.line)
+			}
+		})
+	}
+}
+
+func TestCheckStatement(t *testing.T) {
+	tests := []struct {
+		statement string
+		allowed   bool
+	}{
+		{"CREATE TABLE items (id int)", true},
+		{"USE shop", true},
+		{"USE `shop`", true},
+		{"/*!40101 SET NAMES utf8mb4 */", true},
+		{"SET search_path = public", true},
+		{"SELECT 'SET ROLE postgres'", true},
+		{"USE other", false},
+		{"use `other`", false},
+		{"-- switch\nUSE other", false},
+		{"/* switch */ USE other", false},
+		{"/*!40000 USE other */", false},
+		{"SET ROLE postgres", false},
+		{"set local role postgres", false},
+		{"RESET ROLE", false},
+		{"SET SESSION AUTHORIZATION postgres", false},
+		{"SET SESSION SESSION AUTHORIZATION postgres", false},
+		{"RESET SESSION AUTHORIZATION", false},
+		{"SET DEFAULT ROLE ALL TO 'root'@'%'", false},
+	}
+	for _, tt := range tests {
+		err := checkStatement(tt.statement, "shop")
+		if tt.allowed && err != nil {
+			t.Errorf("%q refused: %v", tt.statement, err)
+		}
+		if !tt.allowed && err == nil {
+			t.Errorf("%q allowed", tt.statement)
+		}
+	}
+}
+
+func TestStripDefiner(t *testing.T) {
+	tests := []struct {
+		statement string
+		want      string
+	}{
+		{
+			"CREATE DEFINER=`root`@`%` PROCEDURE p() SELECT 1",
+			"CREATE  PROCEDURE p() SELECT 1",
+		},
+		{
+			"/*!50001 CREATE ALGORITHM=UNDEFINED */ /*!50013 DEFINER=`shop`@`localhost` SQL SECURITY DEFINER */ /*!50001 VIEW v AS SELECT 1 */",
+			"/*!50001 CREATE ALGORITHM=UNDEFINED */ /*!50013  SQL SECURITY DEFINER */ /*!50001 VIEW v AS SELECT 1 */",
+		},
+		{
+			"/*!50003 CREATE*/ /*!50017 DEFINER='root'@'%'*/ /*!50003 TRIGGER t BEFORE INSERT ON items FOR EACH ROW SET NEW.id = 1 */",
+			"/*!50003 CREATE*/ /*!50017 */ /*!50003 TRIGGER t BEFORE INSERT ON items FOR EACH ROW SET NEW.id = 1 */",
+		},
+		{
+			"ALTER DEFINER = CURRENT_USER() VIEW v AS SELECT 1",
+			"ALTER  VIEW v AS SELECT 1",
+		},
+		{
+			// Data is left alone
+			"INSERT INTO notes VALUES ('DEFINER=`root`@`%`')",
+			"INSERT INTO notes VALUES ('DEFINER=`root`@`%`')",
+		},
+	}
+	for _, tt := range tests {
+		if got := stripDefiner(tt.statement); got != tt.want {
+			t.Errorf("stripDefiner(%q) = %q, want %q", tt.statement, got, tt.want)
+		}
+	}
+}
+
+func TestScannerRefusesConnect(t *testing.T) {
+	scanner := newSQLScanner(strings.NewReader("CREATE TABLE a (id int);\n\\connect other\nCREATE TABLE b (id int);\n"), dialectPostgreSQL)
+	if _, err := scanner.Next(); err != nil {
+		t.Fatal(err)
+	}
+	_, err := scanner.Next()
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("\\connect: %v", err)
+	}
+}
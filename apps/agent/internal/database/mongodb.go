@@ -0,0 +1,162 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const mongoTimeout = 10 * time.Second
+
+// mongoPlaceholderCollection is created alongside the user because MongoDB
+// only materialises a database once it holds data.
+const mongoPlaceholderCollection = "_panel"
+
+type mongodbProvider struct {
+	config MongoDBConfig
+}
+
+func newMongoDBProvider(config MongoDBConfig) *mongodbProvider {
+	if config.Port == 0 {
+		config.Port = 27017
+	}
+	return &mongodbProvider{config: config}
+}
+
+func (p *mongodbProvider) open(ctx context.Context) (*mongo.Client, error) {
+	uri := p.config.URI
+	if uri == "" {
+		uri = fmt.Sprintf("mongodb://%s:%d/", p.config.Host, p.config.Port)
+	}
+
+	opts := options.Client().ApplyURI(uri)
+	if p.config.Username != "" {
+		opts.SetAuth(options.Credential{
+			Username: p.config.Username,
+			Password: p.config.Password,
+		})
+	}
+
+	client, err := mongo.Connect(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to MongoDB: %v", err)
+	}
+	return client, nil
+}
+
+func (p *mongodbProvider) CreateDatabase(name, username, password string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+
+	client, err := p.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(ctx)
+
+	db := client.Database(name)
+
+	return provision(
+		provisionStep{
+			name: "database",
+			run: func() (bool, error) {
+				if err := db.CreateCollection(ctx, mongoPlaceholderCollection); err != nil {
+					if isMongoNamespaceExists(err) {
+						return false, nil
+					}
+					return false, fmt.Errorf("failed to create database: %v", err)
+				}
+				return true, nil
+			},
+			compensate: func() error {
+				return db.Drop(ctx)
+			},
+		},
+		provisionStep{
+			name: "user",
+			run: always(func() error {
+				// Create user scoped to the database
+				err := db.RunCommand(ctx, bson.D{
+					{Key: "createUser", Value: username},
+					{Key: "pwd", Value: password},
+					{Key: "roles", Value: bson.A{
+						bson.D{{Key: "role", Value: "dbOwner"}, {Key: "db", Value: name}},
+					}},
+				}).Err()
+				if err != nil {
+					return fmt.Errorf("failed to create user: %v", err)
+				}
+				return nil
+			}),
+			compensate: func() error {
+				return db.RunCommand(ctx, bson.D{{Key: "dropUser", Value: username}}).Err()
+			},
+		},
+	)
+}
+
+func (p *mongodbProvider) DeleteDatabase(name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+
+	client, err := p.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(ctx)
+
+	db := client.Database(name)
+
+	if err := db.RunCommand(ctx, bson.D{{Key: "dropAllUsersFromDatabase", Value: 1}}).Err(); err != nil {
+		return fmt.Errorf("failed to delete users: %v", err)
+	}
+
+	if err := db.Drop(ctx); err != nil {
+		return fmt.Errorf("failed to delete database: %v", err)
+	}
+
+	return nil
+}
+
+func (p *mongodbProvider) ListDatabases() ([]DatabaseInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+
+	client, err := p.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Disconnect(ctx)
+
+	result, err := client.ListDatabases(ctx, bson.D{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query databases: %v", err)
+	}
+
+	var databases []DatabaseInfo
+	for _, spec := range result.Databases {
+		// Skip system databases
+		if spec.Name == "admin" || spec.Name == "local" || spec.Name == "config" {
+			continue
+		}
+
+		databases = append(databases, DatabaseInfo{
+			Name: spec.Name,
+			Type: "mongodb",
+			Size: spec.SizeOnDisk,
+		})
+	}
+
+	return databases, nil
+}
+
+func isMongoNamespaceExists(err error) bool {
+	if cmdErr, ok := err.(mongo.CommandError); ok {
+		return cmdErr.Name == "NamespaceExists"
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// testMongoDBProvider connects to the MongoDB in AGENT_TEST_MONGODB_ADDR and
+// skips the test when there is none.
+func testMongoDBProvider(t *testing.T) *mongodbProvider {
+	host, port := testServer(t, "MONGODB", "localhost:27017")
+	return newMongoDBProvider(MongoDBConfig{
+		Host:     host,
+		Port:     port,
+		Username: testEnv("MONGODB_USERNAME", ""),
+		Password: testEnv("MONGODB_PASSWORD", ""),
+	})
+}
+
+func mongoDatabaseNames(t *testing.T, p *mongodbProvider) map[string]bool {
+	t.Helper()
+	databases, err := p.ListDatabases()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]bool)
+	for _, database := range databases {
+		names[database.Name] = true
+	}
+	return names
+}
+
+// mongoTenant connects as a database user, authenticating against its own
+// database.
+func mongoTenant(ctx context.Context, t *testing.T, p *mongodbProvider, name, username, password string) *mongo.Client {
+	t.Helper()
+	opts := options.Client().
+		ApplyURI(fmt.Sprintf("mongodb://%s:%d/", p.config.Host, p.config.Port)).
+		SetAuth(options.Credential{Username: username, Password: password, AuthSource: name})
+	client, err := mongo.Connect(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestMongoDBProviderDatabases(t *testing.T) {
+	p := testMongoDBProvider(t)
+	const name, username, password = "agenttest_db", "agenttest_user", "secret"
+	ctx, cancel := context.WithTimeout(context.Background(), 4*mongoTimeout)
+	defer cancel()
+
+	p.DeleteDatabase(name)
+	defer p.DeleteDatabase(name)
+
+	if err := p.CreateDatabase(name, username, password); err != nil {
+		t.Fatal(err)
+	}
+	// The placeholder collection makes the database show up before any data
+	if names := mongoDatabaseNames(t, p); !names[name] || names["admin"] || names["local"] {
+		t.Errorf("listed %v", names)
+	}
+
+	tenant := mongoTenant(ctx, t, p, name, username, password)
+	defer tenant.Disconnect(ctx)
+	if _, err := tenant.Database(name).Collection("posts").InsertOne(ctx, bson.D{{Key: "title", Value: "hello"}}); err != nil {
+		t.Fatalf("writing to the own database failed: %v", err)
+	}
+	// Roles are only enforced when the server requires authentication
+	if p.config.Username != "" {
+		if _, err := tenant.Database("agenttest_other").Collection("posts").InsertOne(ctx, bson.D{{Key: "title", Value: "hello"}}); err == nil {
+			t.Error("the user wrote to another database")
+		}
+	}
+
+	// Creating the user again fails and leaves the existing database alone
+	if err := p.CreateDatabase(name, username, password); err == nil {
+		t.Error("an existing user was created again")
+	}
+	if n, err := tenant.Database(name).Collection("posts").CountDocuments(ctx, bson.D{}); err != nil || n != 1 {
+		t.Errorf("database after the failed create: %d documents, %v", n, err)
+	}
+
+	if err := p.DeleteDatabase(name); err != nil {
+		t.Fatal(err)
+	}
+	if names := mongoDatabaseNames(t, p); names[name] {
+		t.Error("database listed after delete")
+	}
+
+	// The user went with its database
+	removed := mongoTenant(ctx, t, p, name, username, password)
+	defer removed.Disconnect(ctx)
+	if err := removed.Ping(ctx, nil); err == nil {
+		t.Error("the user could still log in after delete")
+	}
+}
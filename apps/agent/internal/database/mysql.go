@@ -0,0 +1,489 @@
+package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	_ "github.com/go-sql-driver/mysql"
+)
+
+type mysqlFlavor string
+
+const (
+	flavorMySQL   mysqlFlavor = "mysql"
+	flavorMariaDB mysqlFlavor = "mariadb"
+)
+
+// mysqlProvider manages MySQL and MariaDB servers. Both speak the same wire
+// protocol, so they share a driver and differ only in the SQL they accept.
+type mysqlProvider struct {
+	config     MySQLConfig
+	flavor     mysqlFlavor
+	driverName string
+}
+
+func newMySQLProvider(config MySQLConfig, flavor mysqlFlavor) *mysqlProvider {
+	return &mysqlProvider{
+		config:     config,
+		flavor:     flavor,
+		driverName: "mysql",
+	}
+}
+
+func (p *mysqlProvider) open() (*sql.DB, error) {
+	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/", p.config.Username, p.config.Password, p.config.Host, p.config.Port)
+
+	db, err := sql.Open(p.driverName, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", p.displayName(), err)
+	}
+	return db, nil
+}
+
+func (p *mysqlProvider) displayName() string {
+	if p.flavor == flavorMariaDB {
+		return "MariaDB"
+	}
+	return "MySQL"
+}
+
+func (p *mysqlProvider) CreateDatabase(name, username, password string) error {
+	db, err := p.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return provision(
+		provisionStep{
+			name: "database",
+			run: func() (bool, error) {
+				existed, err := p.exists(db, "SELECT COUNT(*) FROM information_schema.SCHEMATA WHERE SCHEMA_NAME = ?", name)
+				if err != nil {
+					return false, fmt.Errorf("failed to check database: %v", err)
+				}
+				if _, err := db.Exec(p.createDatabaseStatement(name, true)); err != nil {
+					return false, fmt.Errorf("failed to create database: %v", err)
+				}
+				return !existed, nil
+			},
+			compensate: func() error {
+				_, err := db.Exec(fmt.Sprintf("DROP DATABASE IF EXISTS `%s`", name))
+				return err
+			},
+		},
+		provisionStep{
+			name: "user",
+			run: func() (bool, error) {
+				existed, err := p.exists(db, "SELECT COUNT(*) FROM mysql.user WHERE User = ? AND Host = '%'", username)
+				if err != nil {
+					return false, fmt.Errorf("failed to check user: %v", err)
+				}
+				_, err = db.Exec(fmt.Sprintf("CREATE USER IF NOT EXISTS '%s'@'%%' IDENTIFIED BY '%s'", username, password))
+				if err != nil {
+					return false, fmt.Errorf("failed to create user: %v", err)
+				}
+				return !existed, nil
+			},
+			compensate: func() error {
+				_, err := db.Exec(fmt.Sprintf("DROP USER IF EXISTS '%s'@'%%'", username))
+				return err
+			},
+		},
+		provisionStep{
+			name: "grant",
+			run: func() (bool, error) {
+				_, err := db.Exec(fmt.Sprintf("GRANT ALL PRIVILEGES ON `%s`.* TO '%s'@'%%'", name, username))
+				if err != nil {
+					return false, fmt.Errorf("failed to grant privileges: %v", err)
+				}
+				return false, nil
+			},
+		},
+		provisionStep{
+			name: "flush",
+			run: func() (bool, error) {
+				if _, err := db.Exec("FLUSH PRIVILEGES"); err != nil {
+					return false, fmt.Errorf("failed to flush privileges: %v", err)
+				}
+				return false, nil
+			},
+		},
+	)
+}
+
+func (p *mysqlProvider) createDatabaseStatement(name string, ifNotExists bool) string {
+	statement := "CREATE DATABASE "
+	if ifNotExists {
+		statement += "IF NOT EXISTS "
+	}
+	statement += fmt.Sprintf("`%s`", name)
+
+	// MariaDB does not understand the MySQL 8 default collation
+	// (utf8mb4_0900_ai_ci), so pin one both servers support.
+	if p.flavor == flavorMariaDB {
+		statement += " CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci"
+	}
+	return statement
+}
+
+// exists runs a COUNT(*) query and reports whether it matched anything.
+func (p *mysqlProvider) exists(db *sql.DB, query string, args ...interface{}) (bool, error) {
+	var count int
+	if err := db.QueryRow(query, args...).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (p *mysqlProvider) DeleteDatabase(name string) error {
+	db, err := p.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = db.Exec(fmt.Sprintf("DROP DATABASE IF EXISTS `%s`", name))
+	if err != nil {
+		return fmt.Errorf("failed to delete database: %v", err)
+	}
+
+	if _, err := db.Exec(fmt.Sprintf("DROP USER IF EXISTS '%s'@'%%'", sessionUser(name))); err != nil {
+		return fmt.Errorf("failed to delete session user: %v", err)
+	}
+
+	return nil
+}
+
+func (p *mysqlProvider) ListDatabases() ([]DatabaseInfo, error) {
+	db, err := p.open()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SHOW DATABASES")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query databases: %v", err)
+	}
+	defer rows.Close()
+
+	var databases []DatabaseInfo
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			continue
+		}
+
+		// Skip system databases
+		if name == "information_schema" || name == "mysql" || name == "performance_schema" || name == "sys" {
+			continue
+		}
+
+		databases = append(databases, DatabaseInfo{
+			Name: name,
+			Type: string(p.flavor),
+		})
+	}
+
+	return databases, nil
+}
+
+func (p *mysqlProvider) DatabaseSize(name string) (int64, error) {
+	db, err := p.open()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var size sql.NullInt64
+	err = db.QueryRow("SELECT SUM(data_length + index_length) FROM information_schema.TABLES WHERE table_schema = ?", name).Scan(&size)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query database size: %v", err)
+	}
+
+	return size.Int64, nil
+}
+
+func (p *mysqlProvider) RestrictWrites(name, username string) error {
+	return p.execPrivileges(fmt.Sprintf("REVOKE INSERT, UPDATE, CREATE ON `%s`.* FROM '%s'@'%%'", name, username))
+}
+
+func (p *mysqlProvider) RestoreWrites(name, username string) error {
+	return p.execPrivileges(fmt.Sprintf("GRANT INSERT, UPDATE, CREATE ON `%s`.* TO '%s'@'%%'", name, username))
+}
+
+func (p *mysqlProvider) execPrivileges(statement string) error {
+	db, err := p.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if _, err := db.Exec(statement); err != nil {
+		return fmt.Errorf("failed to change privileges: %v", err)
+	}
+
+	_, err = db.Exec("FLUSH PRIVILEGES")
+	if err != nil {
+		return fmt.Errorf("failed to flush privileges: %v", err)
+	}
+
+	return nil
+}
+
+// CloneDatabase copies source into target and gives the users of source
+// the same privileges on target.
+func (p *mysqlProvider) CloneDatabase(source, target string) error {
+	db, err := p.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return provision(
+		provisionStep{
+			name: "database",
+			run: always(func() error {
+				// No IF NOT EXISTS: cloning must never write into an existing schema
+				if _, err := db.Exec(p.createDatabaseStatement(target, false)); err != nil {
+					return fmt.Errorf("failed to create database: %v", err)
+				}
+				return nil
+			}),
+			compensate: func() error {
+				_, err := db.Exec(fmt.Sprintf("DROP DATABASE IF EXISTS `%s`", target))
+				return err
+			},
+		},
+		provisionStep{
+			name: "copy",
+			run: func() (bool, error) {
+				if err := pipeCommands(p.dumpCommand(source), p.clientCommand(target)); err != nil {
+					return false, fmt.Errorf("failed to copy database: %v", err)
+				}
+				return false, nil
+			},
+		},
+		provisionStep{
+			name: "grant",
+			run: func() (bool, error) {
+				grants, err := p.tenantGrants(db, source)
+				if err != nil {
+					return false, err
+				}
+				for user, privileges := range grants {
+					if _, err := db.Exec(fmt.Sprintf("GRANT %s ON `%s`.* TO %s", strings.Join(privileges, ", "), target, user)); err != nil {
+						return false, fmt.Errorf("failed to grant privileges: %v", err)
+					}
+				}
+				return false, nil
+			},
+		},
+	)
+}
+
+func (p *mysqlProvider) ExecScript(name, script string) error {
+	return p.execAsTenant(name, strings.NewReader(script), nil)
+}
+
+func (p *mysqlProvider) ImportSQL(name string, r io.Reader, onStatement func(count int64)) error {
+	return p.execAsTenant(name, r, onStatement)
+}
+
+// databasePrivileges maps the privilege columns of mysql.db to the names
+// GRANT takes.
+var databasePrivileges = []struct {
+	column    string
+	privilege string
+}{
+	{"Select_priv", "SELECT"},
+	{"Insert_priv", "INSERT"},
+	{"Update_priv", "UPDATE"},
+	{"Delete_priv", "DELETE"},
+	{"Create_priv", "CREATE"},
+	{"Drop_priv", "DROP"},
+	{"References_priv", "REFERENCES"},
+	{"Index_priv", "INDEX"},
+	{"Alter_priv", "ALTER"},
+	{"Create_tmp_table_priv", "CREATE TEMPORARY TABLES"},
+	{"Lock_tables_priv", "LOCK TABLES"},
+	{"Create_view_priv", "CREATE VIEW"},
+	{"Show_view_priv", "SHOW VIEW"},
+	{"Create_routine_priv", "CREATE ROUTINE"},
+	{"Alter_routine_priv", "ALTER ROUTINE"},
+	{"Execute_priv", "EXECUTE"},
+	{"Event_priv", "EVENT"},
+	{"Trigger_priv", "TRIGGER"},
+}
+
+// tenantGrants returns the privileges each user other than the session
+// user holds on a database, keyed by quoted account name. GRANT OPTION is
+// left out.
+func (p *mysqlProvider) tenantGrants(db *sql.DB, name string) (map[string][]string, error) {
+	columns := make([]string, len(databasePrivileges))
+	for i, privilege := range databasePrivileges {
+		columns[i] = privilege.column
+	}
+	rows, err := db.Query("SELECT User, Host, "+strings.Join(columns, ", ")+" FROM mysql.db WHERE Db = ? AND User <> ?", name, sessionUser(name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query privileges: %v", err)
+	}
+	defer rows.Close()
+
+	grants := make(map[string][]string)
+	for rows.Next() {
+		var user, host string
+		flags := make([]string, len(columns))
+		dest := []interface{}{&user, &host}
+		for i := range flags {
+			dest = append(dest, &flags[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+
+		var privileges []string
+		for i, flag := range flags {
+			if flag == "Y" {
+				privileges = append(privileges, databasePrivileges[i].privilege)
+			}
+		}
+		if len(privileges) > 0 {
+			grants[fmt.Sprintf("'%s'@'%s'", user, host)] = privileges
+		}
+	}
+	return grants, rows.Err()
+}
+
+// sessionUser is the account SQL supplied by the tenants of a database runs
+// as. MySQL usernames are limited to 32 characters, so it is named by hash.
+func sessionUser(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return "agent_" + hex.EncodeToString(sum[:8])
+}
+
+// execAsTenant runs SQL a tenant supplied against its database, as an
+// account that holds the tenants' privileges on that database and nothing
+// else. Views, routines, triggers and events keep working only while the
+// account that defined them exists, so the account is locked afterwards
+// rather than dropped, and DeleteDatabase drops it.
+func (p *mysqlProvider) execAsTenant(name string, r io.Reader, onStatement func(count int64)) (err error) {
+	admin, err := p.open()
+	if err != nil {
+		return err
+	}
+	defer admin.Close()
+
+	grants, err := p.tenantGrants(admin, name)
+	if err != nil {
+		return err
+	}
+	if len(grants) == 0 {
+		return fmt.Errorf("database %s has no user to run as", name)
+	}
+	seen := make(map[string]bool)
+	var privileges []string
+	for _, userPrivileges := range grants {
+		for _, privilege := range userPrivileges {
+			if !seen[privilege] {
+				seen[privilege] = true
+				privileges = append(privileges, privilege)
+			}
+		}
+	}
+
+	password, err := randomToken(24)
+	if err != nil {
+		return err
+	}
+	user := fmt.Sprintf("'%s'@'%%'", sessionUser(name))
+	statements := []string{
+		fmt.Sprintf("CREATE USER IF NOT EXISTS %s IDENTIFIED BY '%s' ACCOUNT LOCK", user, password),
+		fmt.Sprintf("REVOKE ALL PRIVILEGES, GRANT OPTION FROM %s", user),
+		fmt.Sprintf("GRANT %s ON `%s`.* TO %s", strings.Join(privileges, ", "), name, user),
+		fmt.Sprintf("ALTER USER %s IDENTIFIED BY '%s' ACCOUNT UNLOCK", user, password),
+	}
+	for _, statement := range statements {
+		if _, err := admin.Exec(statement); err != nil {
+			return fmt.Errorf("failed to prepare session user: %v", err)
+		}
+	}
+	defer func() {
+		if _, lockErr := admin.Exec(fmt.Sprintf("ALTER USER %s ACCOUNT LOCK", user)); lockErr != nil && err == nil {
+			err = fmt.Errorf("failed to lock session user: %v", lockErr)
+		}
+	}()
+
+	db, err := p.openDatabaseAs(name, sessionUser(name), password)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %v", p.displayName(), err)
+	}
+	defer conn.Close()
+
+	return execStatements(conn, newSQLScanner(r, dialectMySQL), name, nil, onStatement)
+}
+
+func (p *mysqlProvider) ExportSQL(name string, w io.Writer) error {
+	return runDump(p.dumpCommand(name), w)
+}
+
+// openDatabaseAs connects as username with name as the default schema.
+func (p *mysqlProvider) openDatabaseAs(name, username, password string) (*sql.DB, error) {
+	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s", username, password, p.config.Host, p.config.Port, name)
+
+	db, err := sql.Open(p.driverName, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", p.displayName(), err)
+	}
+	return db, nil
+}
+
+// binary returns the client tool name for the server flavor. Recent MariaDB
+// releases only ship the mariadb-* names.
+func (p *mysqlProvider) binary(name string) string {
+	if p.flavor != flavorMariaDB {
+		return name
+	}
+	switch name {
+	case "mysqldump":
+		return "mariadb-dump"
+	case "mysql":
+		return "mariadb"
+	}
+	return name
+}
+
+func (p *mysqlProvider) command(name string, args ...string) *exec.Cmd {
+	connArgs := []string{
+		"--host", p.config.Host,
+		"--port", strconv.Itoa(p.config.Port),
+		"--user", p.config.Username,
+	}
+
+	cmd := exec.Command(p.binary(name), append(connArgs, args...)...)
+	cmd.Env = append(os.Environ(), "MYSQL_PWD="+p.config.Password)
+	return cmd
+}
+
+func (p *mysqlProvider) dumpCommand(name string) *exec.Cmd {
+	return p.command("mysqldump", "--single-transaction", "--routines", "--triggers", "--events", name)
+}
+
+func (p *mysqlProvider) clientCommand(name string) *exec.Cmd {
+	return p.command("mysql", name)
+}
@@ -0,0 +1,118 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// testMySQLProvider connects to the server in AGENT_TEST_MYSQL_ADDR or
+// AGENT_TEST_MARIADB_ADDR, depending on the flavor, and skips the test when
+// there is none.
+func testMySQLProvider(t *testing.T, flavor mysqlFlavor) *mysqlProvider {
+	name, defaultAddr := "MYSQL", "localhost:3306"
+	if flavor == flavorMariaDB {
+		name, defaultAddr = "MARIADB", "localhost:3307"
+	}
+	host, port := testServer(t, name, defaultAddr)
+	return newMySQLProvider(MySQLConfig{
+		Host:     host,
+		Port:     port,
+		Username: testEnv(name+"_USERNAME", "root"),
+		Password: testEnv(name+"_PASSWORD", "password"),
+	}, flavor)
+}
+
+func mysqlDatabaseNames(t *testing.T, p *mysqlProvider) map[string]bool {
+	t.Helper()
+	databases, err := p.ListDatabases()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]bool)
+	for _, database := range databases {
+		if database.Type != string(p.flavor) {
+			t.Errorf("%s listed as %s", database.Name, database.Type)
+		}
+		names[database.Name] = true
+	}
+	return names
+}
+
+func TestMySQLProviderDatabases(t *testing.T) {
+	for _, flavor := range []mysqlFlavor{flavorMySQL, flavorMariaDB} {
+		t.Run(string(flavor), func(t *testing.T) {
+			p := testMySQLProvider(t, flavor)
+			const name, username, password = "agenttest_db", "agenttest_user", "secret"
+
+			admin, err := p.open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer admin.Close()
+			cleanup := func() {
+				p.DeleteDatabase(name)
+				admin.Exec(fmt.Sprintf("DROP USER IF EXISTS '%s'@'%%'", username))
+			}
+			cleanup()
+			defer cleanup()
+
+			if err := p.CreateDatabase(name, username, password); err != nil {
+				t.Fatal(err)
+			}
+			if names := mysqlDatabaseNames(t, p); !names[name] || names["mysql"] || names["information_schema"] {
+				t.Errorf("listed %v", names)
+			}
+
+			// The user owns its database and nothing else
+			tenant, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:%d)/%s", username, password, p.config.Host, p.config.Port, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tenant.Close()
+			for _, statement := range []string{
+				"CREATE TABLE posts (id int PRIMARY KEY, title varchar(100))",
+				"INSERT INTO posts VALUES (1, 'hello')",
+				"DROP TABLE posts",
+			} {
+				if _, err := tenant.Exec(statement); err != nil {
+					t.Fatalf("%s: %v", statement, err)
+				}
+			}
+			if _, err := tenant.Exec("CREATE DATABASE agenttest_other"); err == nil {
+				admin.Exec("DROP DATABASE agenttest_other")
+				t.Error("the user created another database")
+			}
+			if _, err := tenant.Exec("SELECT COUNT(*) FROM mysql.user"); err == nil {
+				t.Error("the user read mysql.user")
+			}
+
+			if err := p.DeleteDatabase(name); err != nil {
+				t.Fatal(err)
+			}
+			if names := mysqlDatabaseNames(t, p); names[name] {
+				t.Error("database listed after delete")
+			}
+		})
+	}
+}
+
+func TestMySQLProviderRollsBackFailedCreate(t *testing.T) {
+	for _, flavor := range []mysqlFlavor{flavorMySQL, flavorMariaDB} {
+		t.Run(string(flavor), func(t *testing.T) {
+			p := testMySQLProvider(t, flavor)
+			const name = "agenttest_rollback"
+			p.DeleteDatabase(name)
+			defer p.DeleteDatabase(name)
+
+			// No server accepts a user name this long
+			if err := p.CreateDatabase(name, strings.Repeat("u", 200), "secret"); err == nil {
+				t.Fatal("creating a user with an overlong name succeeded")
+			}
+			if names := mysqlDatabaseNames(t, p); names[name] {
+				t.Error("database left behind after the user failed")
+			}
+		})
+	}
+}
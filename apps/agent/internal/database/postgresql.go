@@ -0,0 +1,568 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var copyStatement = regexp.MustCompile(`(?is)^\s*COPY\s+(.+?)\s*\((.*)\)\s*FROM\s+stdin`)
+
+type postgresqlProvider struct {
+	config     PostgreSQLConfig
+	driverName string
+}
+
+func newPostgreSQLProvider(config PostgreSQLConfig) *postgresqlProvider {
+	return &postgresqlProvider{
+		config:     config,
+		driverName: "postgres",
+	}
+}
+
+func (p *postgresqlProvider) open() (*sql.DB, error) {
+	dsn := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=postgres sslmode=disable",
+		p.config.Host, p.config.Port, p.config.Username, p.config.Password)
+
+	db, err := sql.Open(p.driverName, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to PostgreSQL: %v", err)
+	}
+	return db, nil
+}
+
+func (p *postgresqlProvider) CreateDatabase(name, username, password string) error {
+	db, err := p.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// PostgreSQL has no IF NOT EXISTS for databases or roles, so a
+	// successful CREATE always means the object is ours to roll back.
+	return provision(
+		provisionStep{
+			name: "database",
+			run: always(func() error {
+				if _, err := db.Exec(fmt.Sprintf("CREATE DATABASE %s", name)); err != nil {
+					return fmt.Errorf("failed to create database: %v", err)
+				}
+				return nil
+			}),
+			compensate: func() error {
+				_, err := db.Exec(fmt.Sprintf("DROP DATABASE IF EXISTS %s", name))
+				return err
+			},
+		},
+		provisionStep{
+			name: "user",
+			run: always(func() error {
+				if _, err := db.Exec(fmt.Sprintf("CREATE USER %s WITH PASSWORD '%s'", username, password)); err != nil {
+					return fmt.Errorf("failed to create user: %v", err)
+				}
+				return nil
+			}),
+			compensate: func() error {
+				_, err := db.Exec(fmt.Sprintf("DROP ROLE IF EXISTS %s", username))
+				return err
+			},
+		},
+		provisionStep{
+			name: "grant",
+			run: func() (bool, error) {
+				if _, err := db.Exec(fmt.Sprintf("GRANT ALL PRIVILEGES ON DATABASE %s TO %s", name, username)); err != nil {
+					return false, fmt.Errorf("failed to grant privileges: %v", err)
+				}
+				return false, nil
+			},
+		},
+	)
+}
+
+func (p *postgresqlProvider) DeleteDatabase(name string) error {
+	db, err := p.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = db.Exec(fmt.Sprintf("DROP DATABASE IF EXISTS %s", name))
+	if err != nil {
+		return fmt.Errorf("failed to delete database: %v", err)
+	}
+
+	return nil
+}
+
+func (p *postgresqlProvider) ListDatabases() ([]DatabaseInfo, error) {
+	db, err := p.open()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT datname FROM pg_database WHERE datistemplate = false")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query databases: %v", err)
+	}
+	defer rows.Close()
+
+	var databases []DatabaseInfo
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			continue
+		}
+
+		// Skip system databases
+		if name == "postgres" || name == "template0" || name == "template1" {
+			continue
+		}
+
+		databases = append(databases, DatabaseInfo{
+			Name: name,
+			Type: "postgresql",
+		})
+	}
+
+	return databases, nil
+}
+
+// openDatabase connects to name itself, which table and schema level
+// privileges require.
+func (p *postgresqlProvider) openDatabase(name string) (*sql.DB, error) {
+	dsn := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
+		p.config.Host, p.config.Port, p.config.Username, p.config.Password, name)
+
+	db, err := sql.Open(p.driverName, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to PostgreSQL: %v", err)
+	}
+	return db, nil
+}
+
+func (p *postgresqlProvider) DatabaseSize(name string) (int64, error) {
+	db, err := p.open()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var size int64
+	if err := db.QueryRow("SELECT pg_database_size($1)", name).Scan(&size); err != nil {
+		return 0, fmt.Errorf("failed to query database size: %v", err)
+	}
+
+	return size, nil
+}
+
+// quotaRole is the role that holds a user's objects while its database is
+// over quota.
+func quotaRole(username string) string {
+	return username + "_quota"
+}
+
+// RestrictWrites hands everything the user owns in the database to
+// quotaRole, since an owner can always grant itself privileges back, and
+// leaves the user SELECT, DELETE and TRUNCATE on its tables so that it can
+// get back under quota. DELETE frees space once vacuumed, TRUNCATE at once.
+// CREATE is revoked so no new objects can be written to either.
+func (p *postgresqlProvider) RestrictWrites(name, username string) error {
+	db, err := p.openDatabase(name)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	holder := quotaRole(username)
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = $1)", holder).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to look up role %s: %v", holder, err)
+	}
+	var statements []string
+	if !exists {
+		statements = append(statements, fmt.Sprintf("CREATE ROLE %s NOLOGIN", holder))
+	}
+	statements = append(statements,
+		fmt.Sprintf("REVOKE CREATE ON DATABASE %s FROM %s", name, username),
+		// Granted to PUBLIC before PostgreSQL 15
+		"REVOKE CREATE ON SCHEMA public FROM PUBLIC",
+		fmt.Sprintf("REVOKE CREATE ON SCHEMA public FROM %s", username),
+		fmt.Sprintf("REASSIGN OWNED BY %s TO %s", username, holder),
+	)
+	if err := execPrivileges(db, statements); err != nil {
+		return err
+	}
+
+	// What the user owned is the holder's now; let it read and shrink it
+	grants, err := queryPrivileges(db, `
+		SELECT format('GRANT USAGE ON SCHEMA %I TO %I', nspname, $2::text)
+		FROM pg_namespace WHERE nspowner = $1::regrole
+		UNION ALL
+		SELECT format('GRANT SELECT, DELETE, TRUNCATE ON TABLE %I.%I TO %I', n.nspname, c.relname, $2::text)
+		FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relowner = $1::regrole AND c.relkind IN ('r', 'p')
+		UNION ALL
+		SELECT format('GRANT SELECT ON TABLE %I.%I TO %I', n.nspname, c.relname, $2::text)
+		FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relowner = $1::regrole AND c.relkind IN ('v', 'm', 'S', 'f')`,
+		holder, username)
+	if err != nil {
+		return err
+	}
+	return execPrivileges(db, grants)
+}
+
+// RestoreWrites gives the user back what RestrictWrites took.
+func (p *postgresqlProvider) RestoreWrites(name, username string) error {
+	db, err := p.openDatabase(name)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	holder := quotaRole(username)
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = $1)", holder).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to look up role %s: %v", holder, err)
+	}
+	var version int
+	if err := db.QueryRow("SELECT current_setting('server_version_num')::int").Scan(&version); err != nil {
+		return fmt.Errorf("failed to query server version: %v", err)
+	}
+
+	var statements []string
+	if exists {
+		statements = append(statements, fmt.Sprintf("REASSIGN OWNED BY %s TO %s", holder, username))
+	}
+	statements = append(statements, fmt.Sprintf("GRANT CREATE ON DATABASE %s TO %s", name, username))
+	if version < 150000 {
+		// The user had it through PUBLIC, which RestrictWrites revoked
+		statements = append(statements, fmt.Sprintf("GRANT CREATE ON SCHEMA public TO %s", username))
+	}
+	return execPrivileges(db, statements)
+}
+
+func execPrivileges(db *sql.DB, statements []string) error {
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			return fmt.Errorf("failed to change privileges: %v", err)
+		}
+	}
+	return nil
+}
+
+// queryPrivileges returns the statements a query generates, one per row.
+func queryPrivileges(db *sql.DB, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query privileges: %v", err)
+	}
+	defer rows.Close()
+
+	var statements []string
+	for rows.Next() {
+		var statement string
+		if err := rows.Scan(&statement); err != nil {
+			return nil, err
+		}
+		statements = append(statements, statement)
+	}
+	return statements, rows.Err()
+}
+
+// CloneDatabase copies source into target and gives the tenant of source
+// the same access to target.
+func (p *postgresqlProvider) CloneDatabase(source, target string) error {
+	db, err := p.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return provision(
+		provisionStep{
+			name: "database",
+			run: always(func() error {
+				return p.copyDatabase(db, source, target)
+			}),
+			compensate: func() error {
+				_, err := db.Exec(fmt.Sprintf("DROP DATABASE IF EXISTS %s", target))
+				return err
+			},
+		},
+		provisionStep{
+			name: "grant",
+			run: func() (bool, error) {
+				tenant, err := p.tenantRole(db, source)
+				if err != nil || tenant == "" {
+					return false, err
+				}
+				if _, err := db.Exec(fmt.Sprintf("GRANT ALL PRIVILEGES ON DATABASE %s TO %s", target, pq.QuoteIdentifier(tenant))); err != nil {
+					return false, fmt.Errorf("failed to grant privileges: %v", err)
+				}
+				return false, nil
+			},
+		},
+	)
+}
+
+func (p *postgresqlProvider) copyDatabase(db *sql.DB, source, target string) error {
+	// A template copy is a fast file-level clone, but PostgreSQL refuses it
+	// while anyone else is connected to the source
+	if _, err := db.Exec(fmt.Sprintf("CREATE DATABASE %s TEMPLATE %s", target, source)); err == nil {
+		return nil
+	}
+
+	return provision(
+		provisionStep{
+			name: "database",
+			run: always(func() error {
+				if _, err := db.Exec(fmt.Sprintf("CREATE DATABASE %s", target)); err != nil {
+					return fmt.Errorf("failed to create database: %v", err)
+				}
+				return nil
+			}),
+			compensate: func() error {
+				_, err := db.Exec(fmt.Sprintf("DROP DATABASE IF EXISTS %s", target))
+				return err
+			},
+		},
+		provisionStep{
+			name: "copy",
+			run: func() (bool, error) {
+				if err := pipeCommands(p.dumpCommand(source), p.clientCommand(target)); err != nil {
+					return false, fmt.Errorf("failed to copy database: %v", err)
+				}
+				return false, nil
+			},
+		},
+	)
+}
+
+func (p *postgresqlProvider) ExecScript(name, script string) error {
+	return p.execAsTenant(name, strings.NewReader(script), nil)
+}
+
+func (p *postgresqlProvider) ImportSQL(name string, r io.Reader, onStatement func(count int64)) error {
+	return p.execAsTenant(name, r, onStatement)
+}
+
+// tenantRole returns the role a database belongs to: its owner, or, since
+// the agent creates databases as the admin, the one other role allowed to
+// connect to it. It returns "" when there is none.
+func (p *postgresqlProvider) tenantRole(db *sql.DB, name string) (string, error) {
+	var owner string
+	var superuser bool
+	err := db.QueryRow("SELECT r.rolname, r.rolsuper FROM pg_database d JOIN pg_roles r ON r.oid = d.datdba WHERE d.datname = $1", name).Scan(&owner, &superuser)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("database %s does not exist", name)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to look up owner of %s: %v", name, err)
+	}
+	if !superuser && owner != p.config.Username {
+		return owner, nil
+	}
+
+	roles, err := queryPrivileges(db, `
+		SELECT DISTINCT r.rolname
+		FROM pg_database d CROSS JOIN LATERAL aclexplode(d.datacl) AS a
+		JOIN pg_roles r ON r.oid = a.grantee
+		WHERE d.datname = $1 AND a.privilege_type = 'CONNECT' AND NOT r.rolsuper AND r.rolname <> $2`,
+		name, p.config.Username)
+	if err != nil {
+		return "", err
+	}
+	switch len(roles) {
+	case 0:
+		return "", nil
+	case 1:
+		return roles[0], nil
+	}
+	return "", fmt.Errorf("database %s is shared by roles %s", name, strings.Join(roles, ", "))
+}
+
+// execAsTenant runs SQL a tenant supplied against its database. It logs in
+// as a short-lived role that is a member of the tenant role and nothing
+// else, so the SQL gets the tenant's privileges rather than the agent's.
+// The role is dropped afterwards, and what it created handed to the tenant.
+func (p *postgresqlProvider) execAsTenant(name string, r io.Reader, onStatement func(count int64)) (err error) {
+	admin, err := p.openDatabase(name)
+	if err != nil {
+		return err
+	}
+	defer admin.Close()
+
+	tenant, err := p.tenantRole(admin, name)
+	if err != nil {
+		return err
+	}
+	if tenant == "" {
+		return fmt.Errorf("database %s has no tenant role to run as", name)
+	}
+
+	token, err := randomToken(8)
+	if err != nil {
+		return err
+	}
+	password, err := randomToken(24)
+	if err != nil {
+		return err
+	}
+	role := "agent_session_" + token
+	// Should the agent die before dropping it, the role expires by itself
+	expires := time.Now().Add(24 * time.Hour).UTC().Format(time.RFC3339)
+	err = execPrivileges(admin, []string{
+		fmt.Sprintf("CREATE ROLE %s LOGIN NOSUPERUSER NOCREATEDB NOCREATEROLE PASSWORD '%s' VALID UNTIL '%s' IN ROLE %s",
+			role, password, expires, pq.QuoteIdentifier(tenant)),
+		// Objects are created as the tenant, even after RESET ROLE
+		fmt.Sprintf("ALTER ROLE %s SET role = %s", role, pq.QuoteLiteral(tenant)),
+	})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		dropErr := execPrivileges(admin, []string{
+			fmt.Sprintf("REASSIGN OWNED BY %s TO %s", role, pq.QuoteIdentifier(tenant)),
+			fmt.Sprintf("DROP OWNED BY %s", role),
+			fmt.Sprintf("DROP ROLE %s", role),
+		})
+		if err == nil {
+			err = dropErr
+		}
+	}()
+
+	return p.execAs(name, role, password, r, onStatement)
+}
+
+func (p *postgresqlProvider) execAs(name, username, password string, r io.Reader, onStatement func(count int64)) error {
+	dsn := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
+		p.config.Host, p.config.Port, username, password, name)
+	db, err := sql.Open(p.driverName, dsn)
+	if err != nil {
+		return fmt.Errorf("failed to connect to PostgreSQL: %v", err)
+	}
+	defer db.Close()
+
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to connect to PostgreSQL: %v", err)
+	}
+	defer conn.Close()
+
+	return execStatements(conn, newSQLScanner(r, dialectPostgreSQL), name, p.copyIn, onStatement)
+}
+
+func (p *postgresqlProvider) ExportSQL(name string, w io.Writer) error {
+	return runDump(p.dumpCommand(name), w)
+}
+
+// copyIn replays the inline rows of a pg_dump COPY statement through the
+// driver's COPY support.
+func (p *postgresqlProvider) copyIn(ctx context.Context, conn *sql.Conn, statement *sqlStatement, scanner *sqlScanner) error {
+	match := copyStatement.FindStringSubmatch(statement.Text)
+	if match == nil {
+		return fmt.Errorf("unsupported COPY statement")
+	}
+
+	table := splitIdentifiers(match[1], '.')
+	columns := splitIdentifiers(match[2], ',')
+	schema := "public"
+	if len(table) == 2 {
+		schema = table[0]
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyInSchema(schema, table[len(table)-1], columns...))
+	if err != nil {
+		return err
+	}
+
+	for {
+		row, err := scanner.CopyRow()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			stmt.Close()
+			return err
+		}
+		if _, err := stmt.ExecContext(ctx, parseCopyRow(row)...); err != nil {
+			stmt.Close()
+			return err
+		}
+	}
+
+	// An Exec without arguments flushes the buffered rows
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		return err
+	}
+	if err := stmt.Close(); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// splitIdentifiers splits a list of possibly double-quoted identifiers and
+// unquotes them.
+func splitIdentifiers(list string, sep byte) []string {
+	var identifiers []string
+	var current strings.Builder
+	quoted := false
+
+	for i := 0; i < len(list); i++ {
+		c := list[i]
+		switch {
+		case c == '"' && quoted && i+1 < len(list) && list[i+1] == '"':
+			current.WriteByte('"')
+			i++
+		case c == '"':
+			quoted = !quoted
+		case c == sep && !quoted:
+			identifiers = append(identifiers, strings.TrimSpace(current.String()))
+			current.Reset()
+		default:
+			current.WriteByte(c)
+		}
+	}
+
+	return append(identifiers, strings.TrimSpace(current.String()))
+}
+
+func (p *postgresqlProvider) command(name string, args ...string) *exec.Cmd {
+	connArgs := []string{
+		"--host", p.config.Host,
+		"--port", strconv.Itoa(p.config.Port),
+		"--username", p.config.Username,
+		"--no-password",
+	}
+
+	cmd := exec.Command(name, append(connArgs, args...)...)
+	cmd.Env = append(os.Environ(), "PGPASSWORD="+p.config.Password)
+	return cmd
+}
+
+func (p *postgresqlProvider) dumpCommand(name string) *exec.Cmd {
+	return p.command("pg_dump", "--dbname", name)
+}
+
+func (p *postgresqlProvider) clientCommand(name string) *exec.Cmd {
+	return p.command("psql", "--quiet", "--set", "ON_ERROR_STOP=1", "--dbname", name)
+}
@@ -0,0 +1,212 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// testPostgreSQLProvider connects to the PostgreSQL of docker-compose, or
+// the one in AGENT_TEST_POSTGRES_ADDR, and skips the test when there is
+// none.
+func testPostgreSQLProvider(t *testing.T) *postgresqlProvider {
+	host, port := testServer(t, "POSTGRES", "localhost:5432")
+	return newPostgreSQLProvider(PostgreSQLConfig{
+		Host:     host,
+		Port:     port,
+		Username: testEnv("POSTGRES_USERNAME", "postgres"),
+		Password: testEnv("POSTGRES_PASSWORD", "password"),
+	})
+}
+
+func TestPostgreSQLQuotaRestrictsOwner(t *testing.T) {
+	p := testPostgreSQLProvider(t)
+	const name, username, password = "agenttest_quota", "agenttest_quota_user", "secret"
+
+	admin, err := p.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+	cleanup := func() {
+		p.DeleteDatabase(name)
+		admin.Exec("DROP ROLE IF EXISTS " + username)
+		admin.Exec("DROP ROLE IF EXISTS " + quotaRole(username))
+	}
+	cleanup()
+	defer cleanup()
+
+	if err := p.CreateDatabase(name, username, password); err != nil {
+		t.Fatal(err)
+	}
+
+	tenant, err := sql.Open("postgres", fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
+		p.config.Host, p.config.Port, username, password, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tenant.Close()
+	// One session, so that SET applies to the statements after it
+	tenant.SetMaxOpenConns(1)
+
+	mustExec := func(statement string) {
+		t.Helper()
+		if _, err := tenant.Exec(statement); err != nil {
+			t.Fatalf("%s: %v", statement, err)
+		}
+	}
+	mustFail := func(statement string) {
+		t.Helper()
+		if _, err := tenant.Exec(statement); err == nil {
+			t.Errorf("%s succeeded over quota", statement)
+		}
+	}
+
+	mustExec("CREATE SCHEMA app")
+	mustExec("CREATE TABLE app.items (value text)")
+	mustExec("INSERT INTO app.items VALUES ('a'), ('b')")
+
+	if err := p.RestrictWrites(name, username); err != nil {
+		t.Fatal(err)
+	}
+
+	mustFail("INSERT INTO app.items VALUES ('c')")
+	mustFail("UPDATE app.items SET value = 'c'")
+	mustExec("SET default_transaction_read_only = off")
+	mustFail("INSERT INTO app.items VALUES ('c')")
+	mustFail("GRANT INSERT ON app.items TO " + username)
+	mustFail("ALTER TABLE app.items OWNER TO " + username)
+	mustFail("CREATE TABLE app.more (value text)")
+	mustFail("CREATE TABLE public.more (value text)")
+	mustFail("CREATE SCHEMA other")
+
+	// Getting back under quota stays possible
+	mustExec("SELECT count(*) FROM app.items")
+	mustExec("DELETE FROM app.items WHERE value = 'a'")
+	mustExec("TRUNCATE app.items")
+
+	if err := p.RestoreWrites(name, username); err != nil {
+		t.Fatal(err)
+	}
+	mustExec("INSERT INTO app.items VALUES ('c')")
+	mustExec("CREATE TABLE app.more (value text)")
+	mustExec("DROP TABLE app.more")
+
+	// Restricting twice in a row must not fail
+	if err := p.RestrictWrites(name, username); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.RestrictWrites(name, username); err != nil {
+		t.Fatal(err)
+	}
+	mustFail("INSERT INTO app.items VALUES ('d')")
+}
+
+func TestPostgreSQLImportRunsAsTenant(t *testing.T) {
+	p := testPostgreSQLProvider(t)
+	const name, username = "agenttest_import", "agenttest_import_user"
+
+	admin, err := p.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+	cleanup := func() {
+		p.DeleteDatabase(name)
+		admin.Exec("DROP ROLE IF EXISTS " + username)
+	}
+	cleanup()
+	defer cleanup()
+
+	if err := p.CreateDatabase(name, username, "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Since PostgreSQL 15 only the database owner may create in public
+	dump := "CREATE SCHEMA app;\nCREATE TABLE app.items (value text);\nCOPY app.items (value) FROM stdin;\na\nb\n\\.\n"
+	if err := p.ImportSQL(name, strings.NewReader(dump), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := p.openDatabase(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var owner string
+	var count int
+	if err := db.QueryRow("SELECT tableowner FROM pg_tables WHERE schemaname = 'app' AND tablename = 'items'").Scan(&owner); err != nil {
+		t.Fatal(err)
+	}
+	if owner != username {
+		t.Errorf("table owned by %s, want %s", owner, username)
+	}
+	if err := db.QueryRow("SELECT count(*) FROM app.items").Scan(&count); err != nil || count != 2 {
+		t.Errorf("imported %d rows: %v", count, err)
+	}
+
+	for _, statement := range []string{
+		"COPY app.items FROM PROGRAM 'true'",
+		"ALTER ROLE " + username + " SUPERUSER",
+		"SET SESSION AUTHORIZATION " + p.config.Username,
+		"SET ROLE " + p.config.Username,
+		"SELECT set_config('role', '" + p.config.Username + "', false); CREATE TABLE app.stolen (value text)",
+		"DROP DATABASE postgres",
+	} {
+		if err := p.ImportSQL(name, strings.NewReader(statement), nil); err == nil {
+			t.Errorf("%s succeeded", statement)
+		}
+	}
+
+	if err := admin.QueryRow("SELECT count(*) FROM pg_roles WHERE rolname LIKE 'agent_session_%'").Scan(&count); err != nil || count != 0 {
+		t.Errorf("%d session roles left behind: %v", count, err)
+	}
+}
+
+func TestPostgreSQLSanitizeRunsInClone(t *testing.T) {
+	p := testPostgreSQLProvider(t)
+	const source, target, username = "agenttest_clone", "agenttest_clone_copy", "agenttest_clone_user"
+
+	admin, err := p.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+	cleanup := func() {
+		p.DeleteDatabase(target)
+		p.DeleteDatabase(source)
+		admin.Exec("DROP ROLE IF EXISTS " + username)
+	}
+	cleanup()
+	defer cleanup()
+
+	if err := p.CreateDatabase(source, username, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.ImportSQL(source, strings.NewReader("CREATE SCHEMA app;\nCREATE TABLE app.users (email text);\nINSERT INTO app.users VALUES ('a@example.com');\n"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewService(Config{})
+	s.Register("postgresql", p)
+	if err := s.CloneDatabase(source, target, "postgresql", "UPDATE app.users SET email = 'x'; DROP DATABASE "+source); err == nil {
+		t.Fatal("sanitization script dropped another database")
+	}
+	if err := s.CloneDatabase(source, target, "postgresql", "COPY app.users FROM PROGRAM 'true'"); err == nil {
+		t.Fatal("sanitization script ran a program")
+	}
+	if err := s.CloneDatabase(source, target, "postgresql", "UPDATE app.users SET email = 'x'"); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := p.openDatabase(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var email string
+	if err := db.QueryRow("SELECT email FROM app.users").Scan(&email); err != nil || email != "x" {
+		t.Errorf("clone has %q: %v", email, err)
+	}
+}
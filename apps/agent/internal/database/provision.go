@@ -0,0 +1,62 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+)
+
+// provisionStep is one action of a provisioning sequence. run reports whether
+// it actually created something; compensate is only called for steps that
+// did, so objects reused through IF NOT EXISTS are never dropped on rollback.
+type provisionStep struct {
+	name       string
+	run        func() (created bool, err error)
+	compensate func() error
+}
+
+// provision runs steps in order. When a step fails, the compensating actions
+// of the steps that created something run in reverse order before the
+// original error is returned.
+func provision(steps ...provisionStep) error {
+	var completed []provisionStep
+
+	for _, step := range steps {
+		created, err := step.run()
+		if err != nil {
+			if rollbackErr := rollback(completed); rollbackErr != nil {
+				return fmt.Errorf("%v (rollback failed: %v)", err, rollbackErr)
+			}
+			return err
+		}
+
+		if created && step.compensate != nil {
+			completed = append(completed, step)
+		}
+	}
+
+	return nil
+}
+
+func rollback(completed []provisionStep) error {
+	var failures []string
+	for i := len(completed) - 1; i >= 0; i-- {
+		if err := completed[i].compensate(); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", completed[i].name, err))
+		}
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("%s", strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// always adapts an action that unconditionally creates its object.
+func always(action func() error) func() (bool, error) {
+	return func() (bool, error) {
+		if err := action(); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+}
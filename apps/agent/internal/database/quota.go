@@ -0,0 +1,227 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// QuotaProvider is implemented by providers that can measure a database and
+// restrict writes to it once it grows past its quota.
+type QuotaProvider interface {
+	DatabaseSize(name string) (int64, error)
+	RestrictWrites(name, username string) error
+	RestoreWrites(name, username string) error
+}
+
+// Quota is the storage limit attached to a database and the usage last
+// measured against it.
+type Quota struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	Username   string `json:"username"`
+	LimitBytes int64  `json:"limit_bytes"`
+	UsedBytes  int64  `json:"used_bytes"`
+	Exceeded   bool   `json:"exceeded"`
+	CheckedAt  int64  `json:"checked_at"`
+}
+
+// quotaStore keeps quotas in memory and persists them as JSON so that
+// enforcement survives agent restarts.
+type quotaStore struct {
+	path   string
+	mu     sync.Mutex
+	loaded bool
+	quotas map[string]*Quota
+}
+
+func newQuotaStore(path string) *quotaStore {
+	return &quotaStore{
+		path:   path,
+		quotas: make(map[string]*Quota),
+	}
+}
+
+func quotaKey(dbType, name string) string {
+	return dbType + "/" + name
+}
+
+// load reads the state file on first use. Callers must hold mu.
+func (q *quotaStore) load() error {
+	if q.loaded {
+		return nil
+	}
+
+	data, err := os.ReadFile(q.path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read quota state: %v", err)
+	}
+	if err == nil {
+		var quotas []*Quota
+		if err := json.Unmarshal(data, &quotas); err != nil {
+			return fmt.Errorf("failed to parse quota state: %v", err)
+		}
+		for _, quota := range quotas {
+			q.quotas[quotaKey(quota.Type, quota.Name)] = quota
+		}
+	}
+
+	q.loaded = true
+	return nil
+}
+
+// save writes the state file atomically. Callers must hold mu.
+func (q *quotaStore) save() error {
+	if err := os.MkdirAll(filepath.Dir(q.path), 0755); err != nil {
+		return fmt.Errorf("failed to create quota state directory: %v", err)
+	}
+
+	data, err := json.MarshalIndent(q.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := q.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write quota state: %v", err)
+	}
+	return os.Rename(tmpPath, q.path)
+}
+
+// list returns copies of all quotas sorted by key. Callers must hold mu.
+func (q *quotaStore) list() []Quota {
+	var quotas []Quota
+	for _, quota := range q.quotas {
+		quotas = append(quotas, *quota)
+	}
+	sort.Slice(quotas, func(i, j int) bool {
+		return quotaKey(quotas[i].Type, quotas[i].Name) < quotaKey(quotas[j].Type, quotas[j].Name)
+	})
+	return quotas
+}
+
+func (q *quotaStore) set(quota Quota) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := q.load(); err != nil {
+		return err
+	}
+	q.quotas[quotaKey(quota.Type, quota.Name)] = &quota
+	return q.save()
+}
+
+func (q *quotaStore) remove(dbType, name string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := q.load(); err != nil {
+		return err
+	}
+	key := quotaKey(dbType, name)
+	if _, ok := q.quotas[key]; !ok {
+		return nil
+	}
+	delete(q.quotas, key)
+	return q.save()
+}
+
+// SetQuota attaches a storage limit to a database. A limit of zero or less
+// removes the quota.
+func (s Service) SetQuota(name, dbType, username string, limitBytes int64) error {
+	provider, err := s.Provider(dbType)
+	if err != nil {
+		return err
+	}
+
+	if limitBytes <= 0 {
+		return s.quotas.remove(normalizeType(dbType), name)
+	}
+
+	if _, ok := provider.(QuotaProvider); !ok {
+		return fmt.Errorf("quotas are not supported for database type: %s", dbType)
+	}
+
+	return s.quotas.set(Quota{
+		Name:       name,
+		Type:       normalizeType(dbType),
+		Username:   username,
+		LimitBytes: limitBytes,
+	})
+}
+
+// Quotas returns every quota with the usage measured by the last
+// EnforceQuotas run.
+func (s Service) Quotas() ([]Quota, error) {
+	s.quotas.mu.Lock()
+	defer s.quotas.mu.Unlock()
+
+	if err := s.quotas.load(); err != nil {
+		return nil, err
+	}
+	return s.quotas.list(), nil
+}
+
+// EnforceQuotas measures every database that has a quota, revokes write
+// privileges from those over their limit and restores them for those that
+// dropped back under it.
+func (s Service) EnforceQuotas() error {
+	s.quotas.mu.Lock()
+	defer s.quotas.mu.Unlock()
+
+	if err := s.quotas.load(); err != nil {
+		return err
+	}
+
+	var failures []error
+	for _, quota := range s.quotas.quotas {
+		if err := s.enforceQuota(quota); err != nil {
+			failures = append(failures, fmt.Errorf("%s %s: %v", quota.Type, quota.Name, err))
+		}
+	}
+
+	if err := s.quotas.save(); err != nil {
+		return err
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("failed to enforce %d quota(s), first error: %v", len(failures), failures[0])
+	}
+	return nil
+}
+
+func (s Service) enforceQuota(quota *Quota) error {
+	provider, err := s.Provider(quota.Type)
+	if err != nil {
+		return err
+	}
+	quotaProvider, ok := provider.(QuotaProvider)
+	if !ok {
+		return fmt.Errorf("quotas are not supported for database type: %s", quota.Type)
+	}
+
+	used, err := quotaProvider.DatabaseSize(quota.Name)
+	if err != nil {
+		return fmt.Errorf("failed to measure database size: %v", err)
+	}
+	quota.UsedBytes = used
+	quota.CheckedAt = time.Now().Unix()
+
+	over := used > quota.LimitBytes
+	switch {
+	case over && !quota.Exceeded:
+		if err := quotaProvider.RestrictWrites(quota.Name, quota.Username); err != nil {
+			return fmt.Errorf("failed to restrict writes: %v", err)
+		}
+	case !over && quota.Exceeded:
+		if err := quotaProvider.RestoreWrites(quota.Name, quota.Username); err != nil {
+			return fmt.Errorf("failed to restore writes: %v", err)
+		}
+	}
+	quota.Exceeded = over
+
+	return nil
+}
@@ -0,0 +1,233 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const redisTimeout = 10 * time.Second
+
+// redisProvider maps "databases" onto Redis logical DB indexes and "users"
+// onto ACL users that may only SELECT their own index. Index 0 is the
+// default for every new connection, so it is never handed out.
+//
+// ACL rules cannot tell DB indexes apart, and every connection starts on
+// DB 0, so users are also confined to the keys and channels of their
+// database's prefix, "db<index>:". That is what keeps tenants out of each
+// other's keys in DB 0; the DB index keeps their data apart for FLUSHDB and
+// usage.
+type redisProvider struct {
+	config RedisConfig
+}
+
+func newRedisProvider(config RedisConfig) *redisProvider {
+	if config.Port == 0 {
+		config.Port = 6379
+	}
+	if config.Databases == 0 {
+		config.Databases = 16
+	}
+	return &redisProvider{config: config}
+}
+
+func (p *redisProvider) open(index int) *redis.Client {
+	return redis.NewClient(&redis.Options{
+		Addr:     fmt.Sprintf("%s:%d", p.config.Host, p.config.Port),
+		Username: p.config.Username,
+		Password: p.config.Password,
+		DB:       index,
+	})
+}
+
+// redisKeyPrefix is the prefix of the keys and channels of a database.
+func redisKeyPrefix(index int) string {
+	return fmt.Sprintf("db%d:", index)
+}
+
+func (p *redisProvider) parseIndex(name string) (int, error) {
+	index, err := strconv.Atoi(name)
+	if err != nil {
+		return 0, fmt.Errorf("redis database name must be a numeric index: %s", name)
+	}
+	if index < 1 || index >= p.config.Databases {
+		return 0, fmt.Errorf("redis database index out of range 1-%d: %d", p.config.Databases-1, index)
+	}
+	return index, nil
+}
+
+func (p *redisProvider) CreateDatabase(name, username, password string) error {
+	index, err := p.parseIndex(name)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	client := p.open(index)
+	defer client.Close()
+
+	// SETUSER would silently replace an existing user
+	err = client.Do(ctx, "ACL", "GETUSER", username).Err()
+	if err == nil {
+		return fmt.Errorf("user %s already exists", username)
+	}
+	if err != redis.Nil {
+		return fmt.Errorf("failed to look up user: %v", err)
+	}
+
+	users, err := p.usersByIndex(ctx, client)
+	if err != nil {
+		return err
+	}
+	if len(users[index]) > 0 {
+		return fmt.Errorf("redis database %d is already assigned to %s", index, strings.Join(users[index], ", "))
+	}
+	size, err := client.DBSize(ctx).Result()
+	if err != nil {
+		return fmt.Errorf("failed to check database: %v", err)
+	}
+	if size > 0 {
+		return fmt.Errorf("redis database %d already holds keys", index)
+	}
+
+	// Create an ACL user confined to its own DB index and key prefix. SCAN
+	// and RANDOMKEY ignore key patterns and would list other tenants' keys
+	// in DB 0.
+	prefix := redisKeyPrefix(index)
+	err = client.Do(ctx, "ACL", "SETUSER", username,
+		"reset", "on", ">"+password, "~"+prefix+"*", "&"+prefix+"*",
+		"+@all", "-@dangerous", "-select", fmt.Sprintf("+select|%d", index),
+		"-move", "-copy", "-scan", "-randomkey",
+	).Err()
+	if err != nil {
+		return fmt.Errorf("failed to create user: %v", err)
+	}
+
+	return nil
+}
+
+func (p *redisProvider) DeleteDatabase(name string) error {
+	index, err := p.parseIndex(name)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	client := p.open(index)
+	defer client.Close()
+
+	if err := client.FlushDB(ctx).Err(); err != nil {
+		return fmt.Errorf("failed to delete database: %v", err)
+	}
+
+	// Keys written before SELECT land in DB 0
+	defaultDB := p.open(0)
+	defer defaultDB.Close()
+	iter := defaultDB.Scan(ctx, 0, redisKeyPrefix(index)+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		if err := defaultDB.Unlink(ctx, iter.Val()).Err(); err != nil {
+			return fmt.Errorf("failed to delete key %s: %v", iter.Val(), err)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("failed to scan DB 0: %v", err)
+	}
+
+	users, err := p.usersByIndex(ctx, client)
+	if err != nil {
+		return err
+	}
+	for _, username := range users[index] {
+		if err := client.Do(ctx, "ACL", "DELUSER", username).Err(); err != nil {
+			return fmt.Errorf("failed to delete user %s: %v", username, err)
+		}
+	}
+
+	return nil
+}
+
+func (p *redisProvider) ListDatabases() ([]DatabaseInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	client := p.open(0)
+	defer client.Close()
+
+	// A DB index is in use when it holds keys or has a user assigned
+	indexes := make(map[int]bool)
+
+	keyspace, err := client.Info(ctx, "keyspace").Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to query databases: %v", err)
+	}
+	for _, line := range strings.Split(keyspace, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "db") {
+			continue
+		}
+		field, _, _ := strings.Cut(line, ":")
+		if index, err := strconv.Atoi(strings.TrimPrefix(field, "db")); err == nil && index > 0 {
+			indexes[index] = true
+		}
+	}
+
+	users, err := p.usersByIndex(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	for index := range users {
+		indexes[index] = true
+	}
+
+	var sorted []int
+	for index := range indexes {
+		sorted = append(sorted, index)
+	}
+	sort.Ints(sorted)
+
+	var databases []DatabaseInfo
+	for _, index := range sorted {
+		databases = append(databases, DatabaseInfo{
+			Name: strconv.Itoa(index),
+			Type: "redis",
+		})
+	}
+
+	return databases, nil
+}
+
+// usersByIndex parses ACL LIST and groups users by the DB index their
+// +select|<n> rule grants.
+func (p *redisProvider) usersByIndex(ctx context.Context, client *redis.Client) (map[int][]string, error) {
+	rules, err := client.Do(ctx, "ACL", "LIST").StringSlice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %v", err)
+	}
+
+	users := make(map[int][]string)
+	for _, rule := range rules {
+		fields := strings.Fields(rule)
+		if len(fields) < 2 || fields[0] != "user" {
+			continue
+		}
+		for _, field := range fields[2:] {
+			if !strings.HasPrefix(field, "+select|") {
+				continue
+			}
+			if index, err := strconv.Atoi(strings.TrimPrefix(field, "+select|")); err == nil {
+				users[index] = append(users[index], fields[1])
+			}
+		}
+	}
+
+	return users, nil
+}
@@ -0,0 +1,112 @@
+package database
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// testRedisProvider connects to the Redis of docker-compose, or the one in
+// AGENT_TEST_REDIS_ADDR, and skips the test when there is none.
+func testRedisProvider(t *testing.T) *redisProvider {
+	host, port := testServer(t, "REDIS", "localhost:6379")
+	return newRedisProvider(RedisConfig{
+		Host:     host,
+		Port:     port,
+		Username: testEnv("REDIS_USERNAME", ""),
+		Password: testEnv("REDIS_PASSWORD", ""),
+	})
+}
+
+func tenantClient(p *redisProvider, username string, index int) *redis.Client {
+	return redis.NewClient(&redis.Options{
+		Addr:     net.JoinHostPort(p.config.Host, strconv.Itoa(p.config.Port)),
+		Username: username,
+		Password: "secret-" + username,
+		DB:       index,
+	})
+}
+
+func isNoPerm(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "NOPERM")
+}
+
+func TestRedisProviderIsolatesTenants(t *testing.T) {
+	p := testRedisProvider(t)
+	ctx := context.Background()
+
+	for _, tenant := range []struct {
+		name, username string
+	}{{"14", "agenttest14"}, {"15", "agenttest15"}} {
+		p.DeleteDatabase(tenant.name)
+		if err := p.CreateDatabase(tenant.name, tenant.username, "secret-"+tenant.username); err != nil {
+			t.Fatal(err)
+		}
+		defer p.DeleteDatabase(tenant.name)
+	}
+
+	own := tenantClient(p, "agenttest14", 14)
+	defer own.Close()
+	if err := own.Set(ctx, "db14:key", "value", 0).Err(); err != nil {
+		t.Fatalf("writing an own key failed: %v", err)
+	}
+	if err := own.Set(ctx, "key", "value", 0).Err(); !isNoPerm(err) {
+		t.Errorf("writing outside the key prefix: %v", err)
+	}
+	if err := own.Do(ctx, "SELECT", "0").Err(); !isNoPerm(err) {
+		t.Errorf("selecting DB 0: %v", err)
+	}
+
+	// Every connection starts on DB 0
+	other := tenantClient(p, "agenttest15", 0)
+	defer other.Close()
+	if err := other.Set(ctx, "db15:key", "value", 0).Err(); err != nil {
+		t.Fatalf("writing an own key to DB 0 failed: %v", err)
+	}
+	defaultDB := tenantClient(p, "agenttest14", 0)
+	defer defaultDB.Close()
+	if err := defaultDB.Get(ctx, "db15:key").Err(); !isNoPerm(err) {
+		t.Errorf("reading another tenant's key in DB 0: %v", err)
+	}
+	if err := defaultDB.Set(ctx, "db15:key", "stolen", 0).Err(); !isNoPerm(err) {
+		t.Errorf("writing another tenant's key in DB 0: %v", err)
+	}
+	if err := defaultDB.Do(ctx, "SCAN", "0").Err(); !isNoPerm(err) {
+		t.Errorf("listing keys in DB 0: %v", err)
+	}
+
+	// Deleting a database also removes its keys from DB 0
+	if err := p.DeleteDatabase("15"); err != nil {
+		t.Fatal(err)
+	}
+	admin := p.open(0)
+	defer admin.Close()
+	if n, err := admin.Exists(ctx, "db15:key").Result(); err != nil || n != 0 {
+		t.Errorf("DB 0 key survived deleting its database: %d, %v", n, err)
+	}
+}
+
+func TestRedisProviderRefusesTakenUsersAndIndexes(t *testing.T) {
+	p := testRedisProvider(t)
+
+	p.DeleteDatabase("13")
+	if err := p.CreateDatabase("13", "agenttest13", "secret-agenttest13"); err != nil {
+		t.Fatal(err)
+	}
+	defer p.DeleteDatabase("13")
+
+	if err := p.CreateDatabase("12", "agenttest13", "other"); err == nil {
+		p.DeleteDatabase("12")
+		t.Error("an existing user was replaced")
+	}
+	if err := p.CreateDatabase("13", "agenttest13b", "other"); err == nil {
+		t.Error("an assigned index was handed out again")
+	}
+	if err := p.CreateDatabase("0", "agenttest0", "other"); err == nil {
+		t.Error("DB 0 was handed out")
+	}
+}
@@ -1,22 +1,24 @@
 package database
 
 import (
-	"database/sql"
 	"fmt"
+	"sort"
 	"strings"
-
-	_ "github.com/go-sql-driver/mysql"
-	_ "github.com/lib/pq"
 )
 
 type Service struct {
-	mysql     MySQLConfig
-	postgres  PostgreSQLConfig
+	providers map[string]DatabaseProvider
+	quotas    *quotaStore
 }
 
 type Config struct {
-	MySQL     MySQLConfig
-	PostgreSQL PostgreSQLConfig
+	MySQL          MySQLConfig
+	MariaDB        MySQLConfig
+	PostgreSQL     PostgreSQLConfig
+	Redis          RedisConfig
+	MongoDB        MongoDBConfig
+	SQLite         SQLiteConfig
+	QuotaStatePath string
 }
 
 type MySQLConfig struct {
@@ -33,6 +35,26 @@ type PostgreSQLConfig struct {
 	Password string
 }
 
+type RedisConfig struct {
+	Host      string
+	Port      int
+	Username  string
+	Password  string
+	Databases int
+}
+
+type MongoDBConfig struct {
+	URI      string
+	Host     string
+	Port     int
+	Username string
+	Password string
+}
+
+type SQLiteConfig struct {
+	Path string
+}
+
 type DatabaseInfo struct {
 	Name     string
 	Type     string
@@ -46,216 +68,139 @@ type UserInfo struct {
 	Privileges []string
 }
 
-func NewService(config Config) Service {
-	return Service{
-		mysql:    config.MySQL,
-		postgres: config.PostgreSQL,
-	}
+// DatabaseProvider is implemented by every database engine the agent can
+// manage. Providers are registered on the Service keyed by engine type.
+type DatabaseProvider interface {
+	CreateDatabase(name, username, password string) error
+	DeleteDatabase(name string) error
+	ListDatabases() ([]DatabaseInfo, error)
 }
 
-func (s Service) CreateDatabase(name, username, password, dbType string) error {
-	switch strings.ToLower(dbType) {
-	case "mysql":
-		return s.createMySQLDatabase(name, username, password)
-	case "postgresql", "postgres":
-		return s.createPostgreSQLDatabase(name, username, password)
-	default:
-		return fmt.Errorf("unsupported database type: %s", dbType)
-	}
+// typeAliases maps alternative engine names onto their registry key.
+var typeAliases = map[string]string{
+	"postgres": "postgresql",
+	"pgsql":    "postgresql",
+	"mongo":    "mongodb",
+	"sqlite3":  "sqlite",
 }
 
-func (s Service) DeleteDatabase(name, dbType string) error {
-	switch strings.ToLower(dbType) {
-	case "mysql":
-		return s.deleteMySQLDatabase(name)
-	case "postgresql", "postgres":
-		return s.deletePostgreSQLDatabase(name)
-	default:
-		return fmt.Errorf("unsupported database type: %s", dbType)
+func NewService(config Config) Service {
+	s := Service{
+		providers: make(map[string]DatabaseProvider),
+		quotas:    newQuotaStore(config.QuotaStatePath),
 	}
-}
 
-func (s Service) createMySQLDatabase(name, username, password string) error {
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/", s.mysql.Username, s.mysql.Password, s.mysql.Host, s.mysql.Port)
-	
-	db, err := sql.Open("mysql", dsn)
-	if err != nil {
-		return fmt.Errorf("failed to connect to MySQL: %v", err)
-	}
-	defer db.Close()
+	s.Register("mysql", newMySQLProvider(config.MySQL, flavorMySQL))
+	s.Register("postgresql", newPostgreSQLProvider(config.PostgreSQL))
 
-	// Create database
-	_, err = db.Exec(fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s`", name))
-	if err != nil {
-		return fmt.Errorf("failed to create database: %v", err)
+	// Optional engines are only available when configured
+	if config.MariaDB.Host != "" {
+		s.Register("mariadb", newMySQLProvider(config.MariaDB, flavorMariaDB))
 	}
-
-	// Create user
-	_, err = db.Exec(fmt.Sprintf("CREATE USER IF NOT EXISTS '%s'@'%%' IDENTIFIED BY '%s'", username, password))
-	if err != nil {
-		return fmt.Errorf("failed to create user: %v", err)
+	if config.Redis.Host != "" {
+		s.Register("redis", newRedisProvider(config.Redis))
 	}
-
-	// Grant privileges
-	_, err = db.Exec(fmt.Sprintf("GRANT ALL PRIVILEGES ON `%s`.* TO '%s'@'%%'", name, username))
-	if err != nil {
-		return fmt.Errorf("failed to grant privileges: %v", err)
+	if config.MongoDB.URI != "" || config.MongoDB.Host != "" {
+		s.Register("mongodb", newMongoDBProvider(config.MongoDB))
 	}
-
-	_, err = db.Exec("FLUSH PRIVILEGES")
-	if err != nil {
-		return fmt.Errorf("failed to flush privileges: %v", err)
+	if config.SQLite.Path != "" {
+		s.Register("sqlite", newSQLiteProvider(config.SQLite))
 	}
 
-	return nil
+	return s
 }
 
-func (s Service) deleteMySQLDatabase(name string) error {
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/", s.mysql.Username, s.mysql.Password, s.mysql.Host, s.mysql.Port)
-	
-	db, err := sql.Open("mysql", dsn)
-	if err != nil {
-		return fmt.Errorf("failed to connect to MySQL: %v", err)
-	}
-	defer db.Close()
-
-	_, err = db.Exec(fmt.Sprintf("DROP DATABASE IF EXISTS `%s`", name))
-	if err != nil {
-		return fmt.Errorf("failed to delete database: %v", err)
-	}
-
-	return nil
+// Register adds or replaces the provider used for dbType.
+func (s Service) Register(dbType string, provider DatabaseProvider) {
+	s.providers[normalizeType(dbType)] = provider
 }
 
-func (s Service) createPostgreSQLDatabase(name, username, password string) error {
-	dsn := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=postgres sslmode=disable",
-		s.postgres.Host, s.postgres.Port, s.postgres.Username, s.postgres.Password)
-	
-	db, err := sql.Open("postgres", dsn)
-	if err != nil {
-		return fmt.Errorf("failed to connect to PostgreSQL: %v", err)
+// Provider returns the provider registered for dbType.
+func (s Service) Provider(dbType string) (DatabaseProvider, error) {
+	provider, ok := s.providers[normalizeType(dbType)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported database type: %s", dbType)
 	}
-	defer db.Close()
+	return provider, nil
+}
 
-	// Create database
-	_, err = db.Exec(fmt.Sprintf("CREATE DATABASE %s", name))
-	if err != nil {
-		return fmt.Errorf("failed to create database: %v", err)
+// Types returns the registered engine types.
+func (s Service) Types() []string {
+	var types []string
+	for dbType := range s.providers {
+		types = append(types, dbType)
 	}
+	sort.Strings(types)
+	return types
+}
 
-	// Create user
-	_, err = db.Exec(fmt.Sprintf("CREATE USER %s WITH PASSWORD '%s'", username, password))
+// CreateDatabase provisions a database and its user. A positive quotaBytes
+// attaches a storage quota that EnforceQuotas keeps the database under.
+func (s Service) CreateDatabase(name, username, password, dbType string, quotaBytes int64) error {
+	provider, err := s.Provider(dbType)
 	if err != nil {
-		return fmt.Errorf("failed to create user: %v", err)
+		return err
 	}
 
-	// Grant privileges
-	_, err = db.Exec(fmt.Sprintf("GRANT ALL PRIVILEGES ON DATABASE %s TO %s", name, username))
-	if err != nil {
-		return fmt.Errorf("failed to grant privileges: %v", err)
+	if quotaBytes > 0 {
+		if _, ok := provider.(QuotaProvider); !ok {
+			return fmt.Errorf("quotas are not supported for database type: %s", dbType)
+		}
 	}
 
-	return nil
+	if quotaBytes <= 0 {
+		return provider.CreateDatabase(name, username, password)
+	}
+
+	// A database whose quota could not be set is dropped again, like any
+	// other failed provisioning step
+	return provision(
+		provisionStep{
+			name: "database",
+			run: always(func() error {
+				return provider.CreateDatabase(name, username, password)
+			}),
+			compensate: func() error {
+				return provider.DeleteDatabase(name)
+			},
+		},
+		provisionStep{
+			name: "quota",
+			run: always(func() error {
+				if err := s.SetQuota(name, dbType, username, quotaBytes); err != nil {
+					return fmt.Errorf("failed to set quota: %v", err)
+				}
+				return nil
+			}),
+		},
+	)
 }
 
-func (s Service) deletePostgreSQLDatabase(name string) error {
-	dsn := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=postgres sslmode=disable",
-		s.postgres.Host, s.postgres.Port, s.postgres.Username, s.postgres.Password)
-	
-	db, err := sql.Open("postgres", dsn)
+func (s Service) DeleteDatabase(name, dbType string) error {
+	provider, err := s.Provider(dbType)
 	if err != nil {
-		return fmt.Errorf("failed to connect to PostgreSQL: %v", err)
+		return err
 	}
-	defer db.Close()
 
-	_, err = db.Exec(fmt.Sprintf("DROP DATABASE IF EXISTS %s", name))
-	if err != nil {
-		return fmt.Errorf("failed to delete database: %v", err)
+	if err := provider.DeleteDatabase(name); err != nil {
+		return err
 	}
 
-	return nil
+	return s.quotas.remove(normalizeType(dbType), name)
 }
 
 func (s Service) ListDatabases(dbType string) ([]DatabaseInfo, error) {
-	switch strings.ToLower(dbType) {
-	case "mysql":
-		return s.listMySQLDatabases()
-	case "postgresql", "postgres":
-		return s.listPostgreSQLDatabases()
-	default:
-		return nil, fmt.Errorf("unsupported database type: %s", dbType)
-	}
-}
-
-func (s Service) listMySQLDatabases() ([]DatabaseInfo, error) {
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/", s.mysql.Username, s.mysql.Password, s.mysql.Host, s.mysql.Port)
-	
-	db, err := sql.Open("mysql", dsn)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to MySQL: %v", err)
-	}
-	defer db.Close()
-
-	rows, err := db.Query("SHOW DATABASES")
+	provider, err := s.Provider(dbType)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query databases: %v", err)
+		return nil, err
 	}
-	defer rows.Close()
-
-	var databases []DatabaseInfo
-	for rows.Next() {
-		var name string
-		if err := rows.Scan(&name); err != nil {
-			continue
-		}
-		
-		// Skip system databases
-		if name == "information_schema" || name == "mysql" || name == "performance_schema" || name == "sys" {
-			continue
-		}
-
-		databases = append(databases, DatabaseInfo{
-			Name: name,
-			Type: "mysql",
-		})
-	}
-
-	return databases, nil
+	return provider.ListDatabases()
 }
 
-func (s Service) listPostgreSQLDatabases() ([]DatabaseInfo, error) {
-	dsn := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=postgres sslmode=disable",
-		s.postgres.Host, s.postgres.Port, s.postgres.Username, s.postgres.Password)
-	
-	db, err := sql.Open("postgres", dsn)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to PostgreSQL: %v", err)
-	}
-	defer db.Close()
-
-	rows, err := db.Query("SELECT datname FROM pg_database WHERE datistemplate = false")
-	if err != nil {
-		return nil, fmt.Errorf("failed to query databases: %v", err)
-	}
-	defer rows.Close()
-
-	var databases []DatabaseInfo
-	for rows.Next() {
-		var name string
-		if err := rows.Scan(&name); err != nil {
-			continue
-		}
-		
-		// Skip system databases
-		if name == "postgres" || name == "template0" || name == "template1" {
-			continue
-		}
-
-		databases = append(databases, DatabaseInfo{
-			Name: name,
-			Type: "postgresql",
-		})
+func normalizeType(dbType string) string {
+	dbType = strings.ToLower(strings.TrimSpace(dbType))
+	if alias, ok := typeAliases[dbType]; ok {
+		return alias
 	}
-
-	return databases, nil
+	return dbType
 }
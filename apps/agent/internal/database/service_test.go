@@ -0,0 +1,95 @@
+package database
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testServer returns the host and port of the server in
+// AGENT_TEST_<name>_ADDR, or defaultAddr, and skips the test when nothing
+// accepts connections there.
+func testServer(t *testing.T, name, defaultAddr string) (string, int) {
+	addr := testEnv(name+"_ADDR", defaultAddr)
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Skipf("%s not reachable at %s: %v", strings.ToLower(name), addr, err)
+	}
+	conn.Close()
+
+	host, port, _ := net.SplitHostPort(addr)
+	portNumber, _ := strconv.Atoi(port)
+	return host, portNumber
+}
+
+// testEnv returns AGENT_TEST_<name>, or fallback when it is not set.
+func testEnv(name, fallback string) string {
+	if value := os.Getenv("AGENT_TEST_" + name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// fakeProvider records the databases it holds.
+type fakeProvider struct {
+	databases map[string]bool
+}
+
+func (p *fakeProvider) CreateDatabase(name, username, password string) error {
+	p.databases[name] = true
+	return nil
+}
+
+func (p *fakeProvider) DeleteDatabase(name string) error {
+	delete(p.databases, name)
+	return nil
+}
+
+func (p *fakeProvider) ListDatabases() ([]DatabaseInfo, error) {
+	return nil, nil
+}
+
+func (p *fakeProvider) DatabaseSize(name string) (int64, error) {
+	return 0, nil
+}
+
+func (p *fakeProvider) RestrictWrites(name, username string) error {
+	return nil
+}
+
+func (p *fakeProvider) RestoreWrites(name, username string) error {
+	return nil
+}
+
+func TestCreateDatabaseRollsBackWhenQuotaFails(t *testing.T) {
+	dir := t.TempDir()
+	// A file where the state directory should be makes saving quotas fail
+	blocked := filepath.Join(dir, "blocked")
+	if err := os.WriteFile(blocked, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewService(Config{QuotaStatePath: filepath.Join(blocked, "quotas.json")})
+	provider := &fakeProvider{databases: make(map[string]bool)}
+	s.Register("fake", provider)
+
+	if err := s.CreateDatabase("shop", "shop", "secret", "fake", 1<<20); err == nil {
+		t.Fatal("expected the quota to fail")
+	}
+	if provider.databases["shop"] {
+		t.Error("database was left behind after its quota failed")
+	}
+
+	s = NewService(Config{QuotaStatePath: filepath.Join(dir, "quotas.json")})
+	s.Register("fake", provider)
+	if err := s.CreateDatabase("shop", "shop", "secret", "fake", 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if !provider.databases["shop"] {
+		t.Error("database was not created")
+	}
+}
@@ -0,0 +1,93 @@
+package database
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const sqliteExtension = ".sqlite"
+
+// sqliteProvider manages SQLite database files under a single directory.
+// SQLite has no server-side users, so username and password are ignored.
+// A zero-length file is a valid empty SQLite database, so no driver is needed.
+type sqliteProvider struct {
+	path string
+}
+
+func newSQLiteProvider(config SQLiteConfig) *sqliteProvider {
+	return &sqliteProvider{path: config.Path}
+}
+
+func (p *sqliteProvider) databasePath(name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid sqlite database name: %s", name)
+	}
+	return filepath.Join(p.path, name+sqliteExtension), nil
+}
+
+func (p *sqliteProvider) CreateDatabase(name, username, password string) error {
+	path, err := p.databasePath(name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(p.path, 0755); err != nil {
+		return fmt.Errorf("failed to create sqlite directory: %v", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to create database: %v", err)
+	}
+
+	return file.Close()
+}
+
+func (p *sqliteProvider) DeleteDatabase(name string) error {
+	path, err := p.databasePath(name)
+	if err != nil {
+		return err
+	}
+
+	// Remove the database together with its journal files
+	for _, suffix := range []string{"", "-journal", "-wal", "-shm"} {
+		if err := os.Remove(path + suffix); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete database: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func (p *sqliteProvider) ListDatabases() ([]DatabaseInfo, error) {
+	files, err := os.ReadDir(p.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read sqlite directory: %v", err)
+	}
+
+	var databases []DatabaseInfo
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), sqliteExtension) {
+			continue
+		}
+
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+
+		databases = append(databases, DatabaseInfo{
+			Name:    strings.TrimSuffix(file.Name(), sqliteExtension),
+			Type:    "sqlite",
+			Size:    info.Size(),
+			Created: info.ModTime().Format("2006-01-02 15:04:05"),
+		})
+	}
+
+	return databases, nil
+}
@@ -0,0 +1,102 @@
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func sqliteNames(t *testing.T, p *sqliteProvider) []string {
+	t.Helper()
+	databases, err := p.ListDatabases()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, database := range databases {
+		if database.Type != "sqlite" {
+			t.Errorf("%s listed as %s", database.Name, database.Type)
+		}
+		names = append(names, database.Name)
+	}
+	return names
+}
+
+func TestSQLiteProvider(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "sqlite")
+	p := newSQLiteProvider(SQLiteConfig{Path: dir})
+
+	// Nothing created yet
+	if names := sqliteNames(t, p); len(names) != 0 {
+		t.Errorf("listed %q before creating anything", names)
+	}
+
+	for _, name := range []string{"shop", "blog"} {
+		if err := p.CreateDatabase(name, "ignored", "ignored"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "dir.sqlite"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if names := sqliteNames(t, p); !reflect.DeepEqual(names, []string{"blog", "shop"}) {
+		t.Errorf("listed %q", names)
+	}
+
+	// Creating an existing database keeps its content
+	path := filepath.Join(dir, "shop.sqlite")
+	if err := os.WriteFile(path, []byte("data"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.CreateDatabase("shop", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "data" {
+		t.Errorf("existing database holds %q after create", data)
+	}
+
+	// Deleting removes the journal files too
+	for _, suffix := range []string{"-journal", "-wal", "-shm"} {
+		if err := os.WriteFile(path+suffix, nil, 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.DeleteDatabase("shop"); err != nil {
+		t.Fatal(err)
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, "shop*"))
+	if len(matches) != 0 {
+		t.Errorf("left behind %q", matches)
+	}
+	if names := sqliteNames(t, p); !reflect.DeepEqual(names, []string{"blog"}) {
+		t.Errorf("listed %q after delete", names)
+	}
+	if err := p.DeleteDatabase("shop"); err != nil {
+		t.Errorf("deleting a missing database: %v", err)
+	}
+}
+
+func TestSQLiteProviderRejectsInvalidNames(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "sqlite")
+	p := newSQLiteProvider(SQLiteConfig{Path: dir})
+	if err := os.WriteFile(filepath.Join(root, "outside.sqlite"), nil, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"", ".", "..", "../outside", "a/b", ".hidden", "/etc/passwd"} {
+		if err := p.CreateDatabase(name, "", ""); err == nil {
+			t.Errorf("created %q", name)
+		}
+		if err := p.DeleteDatabase(name); err == nil {
+			t.Errorf("deleted %q", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "outside.sqlite")); err != nil {
+		t.Errorf("file outside the directory: %v", err)
+	}
+}
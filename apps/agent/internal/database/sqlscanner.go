@@ -0,0 +1,426 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+type sqlDialect int
+
+const (
+	dialectMySQL sqlDialect = iota
+	dialectPostgreSQL
+)
+
+var copyFromStdin = regexp.MustCompile(`(?is)^\s*COPY\s+.+\s+FROM\s+stdin`)
+
+// connectCommand matches psql's \connect, which would switch databases.
+var connectCommand = regexp.MustCompile(`^\\(c|connect)(\s|$)`)
+
+// sqlStatement is one statement read from a dump.
+type sqlStatement struct {
+	Text string
+	Line int64
+	// Copy is set for PostgreSQL "COPY ... FROM stdin" statements; their
+	// rows must be drained with CopyRow before the next call to Next.
+	Copy bool
+}
+
+// sqlScanner splits a SQL dump into statements without loading it into
+// memory. It understands quoting, comments, MySQL DELIMITER commands and
+// conditional comments, PostgreSQL dollar quoting, psql meta-commands and
+// the inline data of COPY ... FROM stdin.
+type sqlScanner struct {
+	reader    *bufio.Reader
+	dialect   sqlDialect
+	delimiter string
+	line      int64
+	inCopy    bool
+}
+
+func newSQLScanner(r io.Reader, dialect sqlDialect) *sqlScanner {
+	return &sqlScanner{
+		reader:    bufio.NewReaderSize(r, 256*1024),
+		dialect:   dialect,
+		delimiter: ";",
+		line:      1,
+	}
+}
+
+func (s *sqlScanner) readByte() (byte, error) {
+	b, err := s.reader.ReadByte()
+	if err == nil && b == '\n' {
+		s.line++
+	}
+	return b, err
+}
+
+func (s *sqlScanner) readLine() (string, error) {
+	line, err := s.reader.ReadString('\n')
+	if strings.HasSuffix(line, "\n") {
+		s.line++
+	}
+	return line, err
+}
+
+// skipClientCommand consumes client-side commands that may start a
+// statement: MySQL's DELIMITER and psql backslash meta-commands.
+func (s *sqlScanner) skipClientCommand() (bool, error) {
+	for {
+		b, err := s.reader.Peek(1)
+		if err != nil {
+			return false, nil
+		}
+		if b[0] == ' ' || b[0] == '\t' || b[0] == '\r' || b[0] == '\n' {
+			s.readByte()
+			continue
+		}
+		break
+	}
+
+	switch s.dialect {
+	case dialectMySQL:
+		peek, _ := s.reader.Peek(len("delimiter "))
+		if !strings.EqualFold(string(peek), "delimiter ") {
+			return false, nil
+		}
+		line, err := s.readLine()
+		if err != nil && err != io.EOF {
+			return false, err
+		}
+		delimiter := strings.TrimSpace(line[len("delimiter "):])
+		if delimiter == "" {
+			return false, fmt.Errorf("line %d: empty DELIMITER", s.line-1)
+		}
+		s.delimiter = delimiter
+		return true, nil
+	case dialectPostgreSQL:
+		peek, _ := s.reader.Peek(1)
+		if len(peek) == 0 || peek[0] != '\\' {
+			return false, nil
+		}
+		start := s.line
+		line, err := s.readLine()
+		if err != nil && err != io.EOF {
+			return false, err
+		}
+		if connectCommand.MatchString(line) {
+			return false, fmt.Errorf("line %d: switching to another database is not allowed", start)
+		}
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// Next returns the next statement, or io.EOF when the input is exhausted.
+func (s *sqlScanner) Next() (*sqlStatement, error) {
+	if s.inCopy {
+		return nil, fmt.Errorf("COPY data not drained before next statement")
+	}
+
+	var buf bytes.Buffer
+	var startLine int64
+	hasContent := false
+	escapes := s.dialect == dialectMySQL
+
+	for {
+		if !hasContent {
+			if buf.Len() == 0 || buf.Bytes()[buf.Len()-1] == '\n' {
+				skipped, err := s.skipClientCommand()
+				if err != nil {
+					return nil, err
+				}
+				if skipped {
+					continue
+				}
+			}
+			startLine = s.line
+		}
+
+		b, err := s.readByte()
+		if err == io.EOF {
+			if hasContent {
+				return &sqlStatement{Text: strings.TrimSpace(buf.String()), Line: startLine}, nil
+			}
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteByte(b)
+
+		switch {
+		case b == '\'' || b == '"' || (b == '`' && s.dialect == dialectMySQL):
+			// PostgreSQL only honours backslash escapes in E'...' strings
+			stringEscapes := escapes
+			if s.dialect == dialectPostgreSQL && b == '\'' && buf.Len() >= 2 {
+				prev := buf.Bytes()[buf.Len()-2]
+				stringEscapes = prev == 'E' || prev == 'e'
+			}
+			if err := s.readQuoted(&buf, b, stringEscapes && b != '`'); err != nil {
+				return nil, err
+			}
+			hasContent = true
+			continue
+		case b == '-' && s.peekIs('-'), b == '#' && s.dialect == dialectMySQL:
+			line, err := s.readLine()
+			buf.WriteString(line)
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+			continue
+		case b == '/' && s.peekIs('*'):
+			// MySQL executes /*! ... */ conditional comments
+			if s.dialect == dialectMySQL {
+				if peek, _ := s.reader.Peek(2); len(peek) == 2 && peek[1] == '!' {
+					hasContent = true
+				}
+			}
+			if err := s.readBlockComment(&buf); err != nil {
+				return nil, err
+			}
+			continue
+		case b == '$' && s.dialect == dialectPostgreSQL:
+			tag, ok := s.readDollarTag(&buf)
+			if ok {
+				if err := s.readDollarQuoted(&buf, tag); err != nil {
+					return nil, err
+				}
+			}
+			hasContent = true
+			continue
+		}
+
+		if !bytes.HasSuffix(buf.Bytes(), []byte(s.delimiter)) {
+			if b != ' ' && b != '\t' && b != '\r' && b != '\n' {
+				hasContent = true
+			}
+		} else {
+			text := strings.TrimSpace(string(buf.Bytes()[:buf.Len()-len(s.delimiter)]))
+			if !hasContent || text == "" {
+				buf.Reset()
+				hasContent = false
+				continue
+			}
+
+			statement := &sqlStatement{Text: text, Line: startLine}
+			if s.dialect == dialectPostgreSQL && copyFromStdin.MatchString(text) {
+				// Data starts on the line after the statement
+				if _, err := s.readLine(); err != nil && err != io.EOF {
+					return nil, err
+				}
+				statement.Copy = true
+				s.inCopy = true
+			}
+			return statement, nil
+		}
+	}
+}
+
+// CopyRow returns the next data row of the current COPY statement without
+// its line terminator, or io.EOF at the "\." end marker.
+func (s *sqlScanner) CopyRow() (string, error) {
+	if !s.inCopy {
+		return "", io.EOF
+	}
+
+	line, err := s.readLine()
+	if err == io.EOF && line == "" {
+		return "", fmt.Errorf("line %d: unterminated COPY data", s.line)
+	}
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+	if line == `\.` {
+		s.inCopy = false
+		return "", io.EOF
+	}
+	return line, nil
+}
+
+func (s *sqlScanner) peekIs(b byte) bool {
+	peek, err := s.reader.Peek(1)
+	return err == nil && peek[0] == b
+}
+
+func (s *sqlScanner) readQuoted(buf *bytes.Buffer, quote byte, escapes bool) error {
+	for {
+		b, err := s.readByte()
+		if err != nil {
+			return fmt.Errorf("line %d: unterminated quoted string", s.line)
+		}
+		buf.WriteByte(b)
+
+		if escapes && b == '\\' {
+			next, err := s.readByte()
+			if err != nil {
+				return fmt.Errorf("line %d: unterminated quoted string", s.line)
+			}
+			buf.WriteByte(next)
+			continue
+		}
+		if b == quote {
+			return nil
+		}
+	}
+}
+
+func (s *sqlScanner) readBlockComment(buf *bytes.Buffer) error {
+	var prev byte
+	first := true
+	for {
+		b, err := s.readByte()
+		if err != nil {
+			return fmt.Errorf("line %d: unterminated comment", s.line)
+		}
+		buf.WriteByte(b)
+
+		// The opening '*' cannot also close the comment
+		if !first && prev == '*' && b == '/' {
+			return nil
+		}
+		first = false
+		prev = b
+	}
+}
+
+// readDollarTag reads the rest of a $tag$ opener. Positional parameters
+// such as $1 are not tags.
+func (s *sqlScanner) readDollarTag(buf *bytes.Buffer) (string, bool) {
+	var tag []byte
+	for i := 1; ; i++ {
+		peek, err := s.reader.Peek(i)
+		if err != nil || len(peek) < i {
+			return "", false
+		}
+		c := peek[i-1]
+		if c == '$' {
+			tag = append([]byte(nil), peek[:i-1]...)
+			break
+		}
+		isLetter := c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+		isDigit := c >= '0' && c <= '9'
+		if !isLetter && !(isDigit && i > 1) {
+			return "", false
+		}
+	}
+
+	for range tag {
+		b, _ := s.readByte()
+		buf.WriteByte(b)
+	}
+	b, _ := s.readByte()
+	buf.WriteByte(b)
+
+	return "$" + string(tag) + "$", true
+}
+
+func (s *sqlScanner) readDollarQuoted(buf *bytes.Buffer, tag string) error {
+	start := buf.Len()
+	for {
+		b, err := s.readByte()
+		if err != nil {
+			return fmt.Errorf("line %d: unterminated dollar-quoted string", s.line)
+		}
+		buf.WriteByte(b)
+
+		if b == '$' && bytes.HasSuffix(buf.Bytes()[start:], []byte(tag)) {
+			return nil
+		}
+	}
+}
+
+// parseCopyRow splits a PostgreSQL text-format COPY row into column values.
+// \N becomes nil; backslash escapes are decoded.
+func parseCopyRow(row string) []interface{} {
+	fields := strings.Split(row, "\t")
+	values := make([]interface{}, len(fields))
+
+	for i, field := range fields {
+		if field == `\N` {
+			values[i] = nil
+			continue
+		}
+		if !strings.Contains(field, `\`) {
+			values[i] = field
+			continue
+		}
+
+		var out strings.Builder
+		for j := 0; j < len(field); j++ {
+			c := field[j]
+			if c != '\\' || j+1 >= len(field) {
+				out.WriteByte(c)
+				continue
+			}
+
+			j++
+			switch next := field[j]; next {
+			case 'b':
+				out.WriteByte('\b')
+			case 'f':
+				out.WriteByte('\f')
+			case 'n':
+				out.WriteByte('\n')
+			case 'r':
+				out.WriteByte('\r')
+			case 't':
+				out.WriteByte('\t')
+			case 'v':
+				out.WriteByte('\v')
+			case 'x':
+				value, width := parseRadix(field[j+1:], 16, 2)
+				if width == 0 {
+					out.WriteByte('x')
+					continue
+				}
+				out.WriteByte(value)
+				j += width
+			default:
+				if next >= '0' && next <= '7' {
+					value, width := parseRadix(field[j:], 8, 3)
+					out.WriteByte(value)
+					j += width - 1
+					continue
+				}
+				out.WriteByte(next)
+			}
+		}
+		values[i] = out.String()
+	}
+
+	return values
+}
+
+// parseRadix decodes up to max leading digits of s in the given base.
+func parseRadix(s string, base, max int) (byte, int) {
+	var value int
+	width := 0
+	for width < max && width < len(s) {
+		c := s[width]
+		var digit int
+		switch {
+		case c >= '0' && c <= '9':
+			digit = int(c - '0')
+		case c >= 'a' && c <= 'f':
+			digit = int(c-'a') + 10
+		case c >= 'A' && c <= 'F':
+			digit = int(c-'A') + 10
+		default:
+			digit = base
+		}
+		if digit >= base {
+			break
+		}
+		value = value*base + digit
+		width++
+	}
+	return byte(value), width
+}
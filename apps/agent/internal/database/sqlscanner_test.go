@@ -0,0 +1,231 @@
+package database
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// scanAll returns every statement as "line: text".
+func scanAll(scanner *sqlScanner) ([]string, error) {
+	var statements []string
+	for {
+		statement, err := scanner.Next()
+		if err == io.EOF {
+			return statements, nil
+		}
+		if err != nil {
+			return statements, err
+		}
+		statements = append(statements, fmt.Sprintf("%d: %s", statement.Line, statement.Text))
+	}
+}
+
+func TestSQLScannerNext(t *testing.T) {
+	tests := []struct {
+		name    string
+		dialect sqlDialect
+		input   string
+		want    []string
+		wantErr string
+	}{
+		{
+			name:    "quoting",
+			dialect: dialectMySQL,
+			input:   "INSERT INTO t VALUES ('a;b', \"c;d\", 'it\\'s;', 'x''y;');\nCREATE TABLE `a;b` (id int);\n",
+			want: []string{
+				"1: INSERT INTO t VALUES ('a;b', \"c;d\", 'it\\'s;', 'x''y;')",
+				"2: CREATE TABLE `a;b` (id int)",
+			},
+		},
+		{
+			name:    "comments",
+			dialect: dialectMySQL,
+			input:   "-- a; comment\n# another; one\nSELECT 1; /* block; */ SELECT 2;\n/* only a comment */;\n-- trailing;\n",
+			want: []string{
+				"3: -- a; comment\n# another; one\nSELECT 1",
+				"3: /* block; */ SELECT 2",
+			},
+		},
+		{
+			// MySQL executes conditional comments, so they are statements
+			name:    "conditional comments",
+			dialect: dialectMySQL,
+			input:   "/*!40101 SET NAMES utf8mb4 */;\n/*!40014 SET @x=1 */;\n",
+			want: []string{
+				"1: /*!40101 SET NAMES utf8mb4 */",
+				"2: /*!40014 SET @x=1 */",
+			},
+		},
+		{
+			name:    "delimiter",
+			dialect: dialectMySQL,
+			input:   "DELIMITER ;;\nCREATE PROCEDURE p() BEGIN SELECT 1; SELECT 2; END ;;\ndelimiter ;\nSELECT 3;\n",
+			want: []string{
+				"2: CREATE PROCEDURE p() BEGIN SELECT 1; SELECT 2; END",
+				"4: SELECT 3",
+			},
+		},
+		{
+			name:    "empty delimiter",
+			dialect: dialectMySQL,
+			input:   "SELECT 1;\nDELIMITER \nSELECT 2;\n",
+			want:    []string{"1: SELECT 1"},
+			wantErr: "line 2: empty DELIMITER",
+		},
+		{
+			name:    "last statement without delimiter",
+			dialect: dialectMySQL,
+			input:   "SELECT 1;\n\nSELECT 2",
+			want:    []string{"1: SELECT 1", "3: SELECT 2"},
+		},
+		{
+			name:    "unterminated string",
+			dialect: dialectMySQL,
+			input:   "SELECT 1;\nSELECT 'a;\nb\n",
+			want:    []string{"1: SELECT 1"},
+			wantErr: "line 4: unterminated quoted string",
+		},
+		{
+			name:    "unterminated comment",
+			dialect: dialectMySQL,
+			input:   "SELECT 1 /* ;\n",
+			wantErr: "unterminated comment",
+		},
+		{
+			// Only E'' strings honour backslash escapes; '#' is an operator
+			name:    "postgresql strings",
+			dialect: dialectPostgreSQL,
+			input:   "SELECT 'a\\';\nSELECT E'a\\'b;';\nSELECT 1 # 2;\n",
+			want: []string{
+				"1: SELECT 'a\\'",
+				"2: SELECT E'a\\'b;'",
+				"3: SELECT 1 # 2",
+			},
+		},
+		{
+			name:    "dollar quoting",
+			dialect: dialectPostgreSQL,
+			input: "CREATE FUNCTION f() RETURNS int AS $$ SELECT 1; $$ LANGUAGE sql;\n" +
+				"CREATE FUNCTION g() RETURNS text AS $body$ SELECT '$$;'; $body$ LANGUAGE sql;\n" +
+				"PREPARE p AS SELECT $1;\n",
+			want: []string{
+				"1: CREATE FUNCTION f() RETURNS int AS $$ SELECT 1; $$ LANGUAGE sql",
+				"2: CREATE FUNCTION g() RETURNS text AS $body$ SELECT '$$;'; $body$ LANGUAGE sql",
+				"3: PREPARE p AS SELECT $1",
+			},
+		},
+		{
+			name:    "unterminated dollar quote",
+			dialect: dialectPostgreSQL,
+			input:   "SELECT $tag$ a; $other$;\n",
+			wantErr: "unterminated dollar-quoted string",
+		},
+		{
+			name:    "meta-commands",
+			dialect: dialectPostgreSQL,
+			input:   "\\restrict abc\n\\set ON_ERROR_STOP on\nSELECT 1;\n\\unrestrict abc\n",
+			want:    []string{"3: SELECT 1"},
+		},
+		{
+			name:    "connect",
+			dialect: dialectPostgreSQL,
+			input:   "SELECT 1;\n\\c other\nSELECT 2;\n",
+			want:    []string{"1: SELECT 1"},
+			wantErr: "line 2: switching to another database is not allowed",
+		},
+		{
+			// A backslash inside a statement is not a meta-command
+			name:    "backslash inside a statement",
+			dialect: dialectPostgreSQL,
+			input:   "SELECT 1\n\\c other;\n",
+			want:    []string{"1: SELECT 1\n\\c other"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := scanAll(newSQLScanner(strings.NewReader(tt.input), tt.dialect))
+			if tt.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("got error %v, want %q", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSQLScannerCopy(t *testing.T) {
+	input := "COPY public.t (a, b) FROM stdin;\n1\tx\r\n2\t\\N\n\\.\nSELECT 1;\n"
+	scanner := newSQLScanner(strings.NewReader(input), dialectPostgreSQL)
+
+	statement, err := scanner.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !statement.Copy || statement.Line != 1 {
+		t.Fatalf("got %+v", statement)
+	}
+	if _, err := scanner.Next(); err == nil {
+		t.Error("Next succeeded with COPY data pending")
+	}
+
+	var rows []string
+	for {
+		row, err := scanner.CopyRow()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, row)
+	}
+	if want := []string{"1\tx", "2\t\\N"}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("rows %q, want %q", rows, want)
+	}
+
+	statement, err = scanner.Next()
+	if err != nil || statement.Text != "SELECT 1" || statement.Line != 5 || statement.Copy {
+		t.Errorf("after COPY: %+v, %v", statement, err)
+	}
+
+	// Data that ends before the end marker
+	scanner = newSQLScanner(strings.NewReader("COPY t FROM stdin;\n1\n"), dialectPostgreSQL)
+	if _, err := scanner.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := scanner.CopyRow(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := scanner.CopyRow(); err == nil || !strings.Contains(err.Error(), "unterminated COPY data") {
+		t.Errorf("missing end marker: %v", err)
+	}
+}
+
+func TestParseCopyRow(t *testing.T) {
+	tests := []struct {
+		row  string
+		want []interface{}
+	}{
+		{"a\tb", []interface{}{"a", "b"}},
+		{"\\N\t", []interface{}{nil, ""}},
+		{`\\N`, []interface{}{`\N`}},
+		{`a\tb\nc\\d`, []interface{}{"a\tb\nc\\d"}},
+		{`\b\f\r\v`, []interface{}{"\b\f\r\v"}},
+		{`\101\0\1018`, []interface{}{"A\x00A8"}},
+		{`\x41\x4\xg`, []interface{}{"A\x04xg"}},
+		{`\q`, []interface{}{"q"}},
+		{`abc\`, []interface{}{`abc\`}},
+	}
+	for _, tt := range tests {
+		if got := parseCopyRow(tt.row); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseCopyRow(%q) = %q, want %q", tt.row, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package grpc
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"hosting-panel-agent/internal/backup"
+	"hosting-panel-agent/internal/database"
+	"hosting-panel-agent/internal/nginx"
+	"hosting-panel-agent/internal/ssl"
+)
+
+// serverInventory describes the sites and databases this agent manages to
+// full-server backups.
+type serverInventory struct {
+	nginxService nginx.Service
+	sslService   ssl.Service
+	dbService    database.Service
+}
+
+func (i serverInventory) ServerBundle() (backup.ServerBundle, error) {
+	var bundle backup.ServerBundle
+
+	sites, err := i.nginxService.ListSites()
+	if err != nil {
+		return bundle, err
+	}
+	for _, site := range sites {
+		paths := i.nginxService.SiteFiles(site.Domain)
+		certFile, keyFile := i.sslService.CertificateFiles(site.Domain)
+		paths = append(paths, certFile, keyFile)
+		// Certificates installed elsewhere are only referenced by the config
+		if site.SSLCert != "" {
+			paths = append(paths, site.SSLCert, site.SSLKey)
+		}
+
+		bundle.Sites = append(bundle.Sites, backup.ServerSite{
+			Domain:       site.Domain,
+			DocumentRoot: site.DocumentRoot,
+			Paths:        existingPaths(paths),
+		})
+	}
+
+	for _, dbType := range i.dbService.Types() {
+		databases, err := i.dbService.ListDatabases(dbType)
+		if err != nil {
+			// Engines that are registered but not running are common
+			bundle.Warnings = append(bundle.Warnings, fmt.Sprintf("%s databases: %v", dbType, err))
+			continue
+		}
+		for _, db := range databases {
+			bundle.Databases = append(bundle.Databases, backup.ServerDatabase{Name: db.Name, Type: dbType})
+		}
+	}
+
+	return bundle, nil
+}
+
+func (i serverInventory) DumpDatabase(db backup.ServerDatabase, w io.Writer) error {
+	return i.dbService.ExportDatabase(db.Name, db.Type, w, true)
+}
+
+func (i serverInventory) RestoreDatabase(db backup.ServerDatabase, user *backup.DatabaseUser, r io.Reader) error {
+	if user != nil {
+		if err := i.dbService.CreateDatabase(db.Name, user.Username, user.Password, db.Type, 0); err != nil {
+			return err
+		}
+	}
+	_, err := i.dbService.ImportDatabase(db.Name, db.Type, r, nil)
+	return err
+}
+
+// existingPaths drops paths that do not exist, such as the certificate of a
+// site without SSL.
+func existingPaths(paths []string) []string {
+	var existing []string
+	for _, path := range paths {
+		if _, err := os.Lstat(path); err == nil {
+			existing = append(existing, path)
+		}
+	}
+	return existing
+}
@@ -0,0 +1,70 @@
+package grpc
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	"hosting-panel-agent/internal/backup"
+	"hosting-panel-agent/internal/metrics"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// UnaryMetricsInterceptor counts unary calls and their latency by method.
+func UnaryMetricsInterceptor(metricsService metrics.Service) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		metricsService.ObserveRPC(path.Base(info.FullMethod), status.Code(err).String(), time.Since(start))
+		return resp, err
+	}
+}
+
+// StreamMetricsInterceptor counts streaming calls and how long they stayed
+// open by method.
+func StreamMetricsInterceptor(metricsService metrics.Service) grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		err := handler(srv, stream)
+		metricsService.ObserveRPC(path.Base(info.FullMethod), status.Code(err).String(), time.Since(start))
+		return err
+	}
+}
+
+// updateCertificateExpiry exports the expiry of every site certificate.
+func (s *AgentServer) updateCertificateExpiry() error {
+	sites, err := s.nginxService.ListSites()
+	if err != nil {
+		return fmt.Errorf("failed to list sites: %v", err)
+	}
+
+	expiry := make(map[string]time.Time)
+	for _, site := range sites {
+		if !site.SSLEnabled || site.SSLCert == "" {
+			continue
+		}
+		expiresAt, err := s.sslService.CertificateExpiry(site.SSLCert)
+		if err != nil {
+			// Leave the site out; a missing certificate shows in nginx reloads
+			continue
+		}
+		expiry[site.Domain] = expiresAt
+	}
+
+	s.metricsService.SetCertificateExpiry(expiry)
+	return nil
+}
+
+// recordBackupJobs exports the duration of every backup and restore job
+// once it finishes.
+func (s *AgentServer) recordBackupJobs() {
+	s.backupService.WatchBackup(context.Background(), "", func(progress backup.Progress) error {
+		if progress.Done {
+			s.metricsService.ObserveJob(progress.Operation, time.Since(progress.StartedAt), progress.Error != "")
+		}
+		return nil
+	})
+}
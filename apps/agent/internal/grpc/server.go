@@ -2,7 +2,10 @@ package grpc
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"log"
+	"time"
 
 	"hosting-panel-agent/internal/backup"
 	"hosting-panel-agent/internal/database"
@@ -30,13 +33,29 @@ func NewAgentServer(
 	backupService backup.Service,
 	metricsService metrics.Service,
 ) *AgentServer {
-	return &AgentServer{
+	// Full-server backups need the sites and databases managed here
+	backupService.SetServerInventory(serverInventory{
+		nginxService: nginxService,
+		sslService:   sslService,
+		dbService:    dbService,
+	})
+
+	server := &AgentServer{
 		nginxService:   nginxService,
 		sslService:     sslService,
 		dbService:      dbService,
 		backupService:  backupService,
 		metricsService: metricsService,
 	}
+
+	// Feed reloads, certificate expiry and job durations to /metrics
+	nginxService.ObserveReloads(func(err error) {
+		metricsService.ObserveReload("nginx", err)
+	})
+	metricsService.AddTask("certificate expiry", server.updateCertificateExpiry)
+	go server.recordBackupJobs()
+
+	return server
 }
 
 func (s *AgentServer) Register(grpcServer *grpc.Server) {
@@ -57,6 +76,51 @@ func (s *AgentServer) GetMetrics(ctx context.Context, req *pb.GetMetricsRequest)
 		return &pb.GetMetricsResponse{}, err
 	}
 
+	// Per-mount figures are an addition; the system metrics still count
+	// if they cannot be read
+	var filesystems []*pb.FilesystemMetrics
+	disks, err := s.metricsService.GetDiskMetrics()
+	if err != nil {
+		log.Printf("Error getting disk metrics: %v", err)
+	}
+	for _, disk := range disks {
+		filesystems = append(filesystems, &pb.FilesystemMetrics{
+			MountPoint:          disk.MountPoint,
+			Device:              disk.Device,
+			FsType:              disk.FSType,
+			TotalBytes:          disk.TotalBytes,
+			UsedBytes:           disk.UsedBytes,
+			AvailableBytes:      disk.AvailableBytes,
+			TotalInodes:         disk.TotalInodes,
+			UsedInodes:          disk.UsedInodes,
+			FreeInodes:          disk.FreeInodes,
+			ReadBytesPerSecond:  disk.ReadBytesPerSecond,
+			WriteBytesPerSecond: disk.WriteBytesPerSecond,
+			ReadsPerSecond:      disk.ReadsPerSecond,
+			WritesPerSecond:     disk.WritesPerSecond,
+			Paths:               disk.Paths,
+		})
+	}
+
+	var interfaces []*pb.InterfaceMetrics
+	rates, err := s.metricsService.GetNetworkMetrics()
+	if err != nil {
+		log.Printf("Error getting network metrics: %v", err)
+	}
+	for _, iface := range rates {
+		interfaces = append(interfaces, &pb.InterfaceMetrics{
+			Name:      iface.Name,
+			RxBytes:   iface.RxBytes,
+			TxBytes:   iface.TxBytes,
+			RxPackets: iface.RxPackets,
+			TxPackets: iface.TxPackets,
+			RxErrors:  iface.RxErrors,
+			TxErrors:  iface.TxErrors,
+			RxDrops:   iface.RxDrops,
+			TxDrops:   iface.TxDrops,
+		})
+	}
+
 	return &pb.GetMetricsResponse{
 		Metrics: &pb.SystemMetrics{
 			CpuUsage:    metrics.CPUUsage,
@@ -65,9 +129,151 @@ func (s *AgentServer) GetMetrics(ctx context.Context, req *pb.GetMetricsRequest)
 			Bandwidth:   metrics.Bandwidth,
 			Uptime:      metrics.Uptime,
 		},
+		Filesystems: filesystems,
+		Interfaces:  interfaces,
+	}, nil
+}
+
+func (s *AgentServer) QueryMetrics(ctx context.Context, req *pb.QueryMetricsRequest) (*pb.QueryMetricsResponse, error) {
+	end := time.Now()
+	if req.End != 0 {
+		end = time.Unix(req.End, 0)
+	}
+	start := end.Add(-time.Hour)
+	if req.Start != 0 {
+		start = time.Unix(req.Start, 0)
+	}
+
+	samples, err := s.metricsService.QueryMetrics(start, end, time.Duration(req.StepSeconds)*time.Second)
+	if err != nil {
+		log.Printf("Error querying metrics: %v", err)
+		return &pb.QueryMetricsResponse{
+			Success: false,
+			Message: err.Error(),
+		}, nil
+	}
+
+	var points []*pb.MetricsSample
+	for _, sample := range samples {
+		points = append(points, &pb.MetricsSample{
+			Timestamp:   sample.Time.Unix(),
+			CpuUsage:    sample.CPUUsage,
+			MemoryUsage: sample.MemoryUsage,
+			DiskUsage:   sample.DiskUsage,
+			Bandwidth:   sample.Bandwidth,
+		})
+	}
+
+	return &pb.QueryMetricsResponse{
+		Success: true,
+		Message: fmt.Sprintf("%d samples", len(points)),
+		Samples: points,
 	}, nil
 }
 
+func (s *AgentServer) GetServiceMetrics(ctx context.Context, req *pb.GetServiceMetricsRequest) (*pb.GetServiceMetricsResponse, error) {
+	// Node processes are accounted to the site they run in
+	siteRoots := make(map[string]string)
+	sites, err := s.nginxService.ListSites()
+	if err != nil {
+		log.Printf("Error listing sites: %v", err)
+	}
+	for _, site := range sites {
+		if site.DocumentRoot != "" {
+			siteRoots[site.Domain] = site.DocumentRoot
+		}
+	}
+
+	services, err := s.metricsService.GetServiceMetrics(siteRoots, req.IncludeProcesses)
+	if err != nil {
+		log.Printf("Error getting service metrics: %v", err)
+		return &pb.GetServiceMetricsResponse{
+			Success: false,
+			Message: err.Error(),
+		}, nil
+	}
+
+	var infos []*pb.ServiceMetrics
+	for _, service := range services {
+		if req.Service != "" && service.Service != req.Service {
+			continue
+		}
+
+		info := &pb.ServiceMetrics{
+			Service:             service.Service,
+			Instance:            service.Instance,
+			CpuUsage:            service.CPUUsage,
+			MemoryUsage:         service.MemoryUsage,
+			RssBytes:            service.RSSBytes,
+			OpenFds:             int32(service.OpenFDs),
+			Threads:             int32(service.Threads),
+			ReadBytes:           service.ReadBytes,
+			WriteBytes:          service.WriteBytes,
+			ReadBytesPerSecond:  service.ReadBytesPerSecond,
+			WriteBytesPerSecond: service.WriteBytesPerSecond,
+		}
+		for _, pid := range service.PIDs {
+			info.Pids = append(info.Pids, int32(pid))
+		}
+		for _, process := range service.Processes {
+			info.Processes = append(info.Processes, &pb.ProcessMetrics{
+				Pid:                 int32(process.PID),
+				Name:                process.Name,
+				Command:             process.Command,
+				CpuUsage:            process.CPUUsage,
+				MemoryUsage:         process.MemoryUsage,
+				RssBytes:            process.RSSBytes,
+				OpenFds:             int32(process.OpenFDs),
+				Threads:             int32(process.Threads),
+				ReadBytes:           process.ReadBytes,
+				WriteBytes:          process.WriteBytes,
+				ReadBytesPerSecond:  process.ReadBytesPerSecond,
+				WriteBytesPerSecond: process.WriteBytesPerSecond,
+			})
+		}
+		infos = append(infos, info)
+	}
+
+	return &pb.GetServiceMetricsResponse{
+		Success:  true,
+		Message:  fmt.Sprintf("%d services", len(infos)),
+		Services: infos,
+	}, nil
+}
+
+func (s *AgentServer) StreamMetrics(req *pb.StreamMetricsRequest, stream pb.AgentService_StreamMetricsServer) error {
+	interval := 5 * time.Second
+	if req.IntervalSeconds != 0 {
+		interval = time.Duration(req.IntervalSeconds) * time.Second
+	}
+
+	names := req.Metrics
+	if len(names) == 0 {
+		names = metrics.SampleMetrics
+	}
+	for _, name := range names {
+		if _, ok := (metrics.MetricsSample{}).Value(name); !ok {
+			return fmt.Errorf("unknown metric: %s", name)
+		}
+	}
+
+	err := s.metricsService.StreamMetrics(stream.Context(), interval, func(sample metrics.MetricsSample) error {
+		values := make(map[string]float64, len(names))
+		for _, name := range names {
+			values[name], _ = sample.Value(name)
+		}
+		return stream.Send(&pb.MetricsUpdate{
+			Timestamp: sample.Time.Unix(),
+			Values:    values,
+		})
+	})
+	if err != nil && stream.Context().Err() == nil {
+		log.Printf("Error streaming metrics: %v", err)
+		return err
+	}
+	return nil
+}
+
 func (s *AgentServer) CreateSite(ctx context.Context, req *pb.CreateSiteRequest) (*pb.CreateSiteResponse, error) {
 	err := s.nginxService.CreateSite(req.Domain, req.DocumentRoot, req.PhpVersion, req.NodeVersion)
 	if err != nil {
@@ -132,8 +338,59 @@ func (s *AgentServer) DisableSSL(ctx context.Context, req *pb.DisableSSLRequest)
 	}, nil
 }
 
+func (s *AgentServer) GetSiteTraffic(ctx context.Context, req *pb.GetSiteTrafficRequest) (*pb.GetSiteTrafficResponse, error) {
+	topPaths := int(req.TopPaths)
+	if topPaths <= 0 {
+		topPaths = 10
+	}
+
+	sites, warnings, err := s.nginxService.SiteTraffic(req.Domain, topPaths)
+	if err != nil {
+		log.Printf("Error getting site traffic: %v", err)
+		return &pb.GetSiteTrafficResponse{
+			Success: false,
+			Message: err.Error(),
+		}, nil
+	}
+	for _, warning := range warnings {
+		log.Printf("Warning getting site traffic: %s", warning)
+	}
+
+	var infos []*pb.SiteTraffic
+	for _, site := range sites {
+		info := &pb.SiteTraffic{
+			Domain:        site.Domain,
+			Requests:      site.Requests,
+			BytesSent:     site.BytesSent,
+			BytesReceived: site.BytesReceived,
+			StatusClasses: site.StatusClasses,
+		}
+		if !site.Since.IsZero() {
+			info.Since = site.Since.Unix()
+		}
+		if !site.LastRequest.IsZero() {
+			info.LastRequest = site.LastRequest.Unix()
+		}
+		for _, path := range site.TopPaths {
+			info.TopPaths = append(info.TopPaths, &pb.PathTraffic{
+				Path:      path.Path,
+				Requests:  path.Requests,
+				BytesSent: path.BytesSent,
+			})
+		}
+		infos = append(infos, info)
+	}
+
+	return &pb.GetSiteTrafficResponse{
+		Success:  true,
+		Message:  fmt.Sprintf("%d sites", len(infos)),
+		Sites:    infos,
+		Warnings: warnings,
+	}, nil
+}
+
 func (s *AgentServer) CreateDatabase(ctx context.Context, req *pb.CreateDatabaseRequest) (*pb.CreateDatabaseResponse, error) {
-	err := s.dbService.CreateDatabase(req.Name, req.Username, req.Password, req.Type)
+	err := s.dbService.CreateDatabase(req.Name, req.Username, req.Password, req.Type, req.QuotaBytes)
 	if err != nil {
 		log.Printf("Error creating database: %v", err)
 		return &pb.CreateDatabaseResponse{
@@ -164,8 +421,139 @@ func (s *AgentServer) DeleteDatabase(ctx context.Context, req *pb.DeleteDatabase
 	}, nil
 }
 
+func (s *AgentServer) CloneDatabase(ctx context.Context, req *pb.CloneDatabaseRequest) (*pb.CloneDatabaseResponse, error) {
+	err := s.dbService.CloneDatabase(req.Source, req.Target, req.Type, req.SanitizeSql)
+	if err != nil {
+		log.Printf("Error cloning database: %v", err)
+		return &pb.CloneDatabaseResponse{
+			Success: false,
+			Message: err.Error(),
+		}, nil
+	}
+
+	return &pb.CloneDatabaseResponse{
+		Success: true,
+		Message: "Database cloned successfully",
+	}, nil
+}
+
+func (s *AgentServer) ImportDatabase(stream pb.AgentService_ImportDatabaseServer) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+
+	// Feed the incoming chunks to the importer as one continuous stream
+	reader, writer := io.Pipe()
+	go func() {
+		req := first
+		for {
+			if len(req.Chunk) > 0 {
+				if _, err := writer.Write(req.Chunk); err != nil {
+					return
+				}
+			}
+
+			var err error
+			req, err = stream.Recv()
+			if err == io.EOF {
+				writer.Close()
+				return
+			}
+			if err != nil {
+				writer.CloseWithError(err)
+				return
+			}
+		}
+	}()
+
+	// A client that went away also fails the import through Recv
+	result, err := s.dbService.ImportDatabase(first.Name, first.Type, reader, func(progress database.ImportResult) {
+		stream.Send(&pb.ImportDatabaseResponse{
+			BytesReceived:      progress.BytesRead,
+			StatementsExecuted: progress.Statements,
+			Compressed:         progress.Compressed,
+		})
+	})
+	reader.Close()
+
+	resp := &pb.ImportDatabaseResponse{
+		Done:               true,
+		Success:            true,
+		Message:            "Database imported successfully",
+		BytesReceived:      result.BytesRead,
+		StatementsExecuted: result.Statements,
+		Compressed:         result.Compressed,
+		FailedStatement:    result.FailedStatement,
+		FailedLine:         result.FailedLine,
+	}
+	if err != nil {
+		log.Printf("Error importing database: %v", err)
+		resp.Success = false
+		resp.Message = err.Error()
+	}
+
+	return stream.Send(resp)
+}
+
+func (s *AgentServer) ExportDatabase(req *pb.ExportDatabaseRequest, stream pb.AgentService_ExportDatabaseServer) error {
+	// The on-disk size lets clients show rough progress for the dump
+	estimatedSize := s.dbService.DatabaseSize(req.Name, req.Type)
+
+	writer := newChunkWriter(func(chunk []byte, sent int64) error {
+		return stream.Send(&pb.ExportDatabaseResponse{
+			Chunk:         chunk,
+			BytesSent:     sent,
+			EstimatedSize: estimatedSize,
+		})
+	})
+
+	err := s.dbService.ExportDatabase(req.Name, req.Type, writer, req.Compress)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		log.Printf("Error exporting database: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+func (s *AgentServer) GetDatabaseUsage(ctx context.Context, req *pb.GetDatabaseUsageRequest) (*pb.GetDatabaseUsageResponse, error) {
+	quotas, err := s.dbService.Quotas()
+	if err != nil {
+		log.Printf("Error getting database usage: %v", err)
+		return &pb.GetDatabaseUsageResponse{}, err
+	}
+
+	var usage []*pb.DatabaseUsage
+	for _, quota := range quotas {
+		usage = append(usage, &pb.DatabaseUsage{
+			Name:       quota.Name,
+			Type:       quota.Type,
+			UsedBytes:  quota.UsedBytes,
+			QuotaBytes: quota.LimitBytes,
+			Exceeded:   quota.Exceeded,
+			CheckedAt:  quota.CheckedAt,
+		})
+	}
+
+	return &pb.GetDatabaseUsageResponse{
+		Databases: usage,
+	}, nil
+}
+
 func (s *AgentServer) CreateBackup(ctx context.Context, req *pb.CreateBackupRequest) (*pb.CreateBackupResponse, error) {
-	backupPath, err := s.backupService.CreateBackup(req.Name, req.Type, req.Path)
+	result, err := s.backupService.CreateBackup(req.Name, req.Type, req.Path, req.Destination, backup.BackupOptions{
+		Exclude:      req.Exclude,
+		MaxFileSize:  req.MaxFileSize,
+		MaxTotalSize: req.MaxTotalSize,
+		PreHook:      req.PreHook,
+		PostHook:     req.PostHook,
+		HookTimeout:  time.Duration(req.HookTimeoutSeconds) * time.Second,
+		JobID:        req.JobId,
+	})
 	if err != nil {
 		log.Printf("Error creating backup: %v", err)
 		return &pb.CreateBackupResponse{
@@ -174,15 +562,54 @@ func (s *AgentServer) CreateBackup(ctx context.Context, req *pb.CreateBackupRequ
 		}, nil
 	}
 
+	// Apply retention to this backup's history now that a new one exists
+	pruned, err := s.backupService.PruneBackups(req.Name, req.Type, false)
+	if err != nil {
+		log.Printf("Error pruning backups: %v", err)
+	}
+	if pruned != nil {
+		for _, warning := range pruned.Warnings {
+			log.Printf("Warning pruning backups: %s", warning)
+		}
+	}
+
+	message := "Backup created successfully"
+	succeeded := 0
+	for _, target := range result.Targets {
+		if target.Success {
+			succeeded++
+		}
+	}
+	if succeeded < len(result.Targets) {
+		message = fmt.Sprintf("Backup created on %d of %d targets", succeeded, len(result.Targets))
+	}
+	if len(result.Warnings) > 0 {
+		message += fmt.Sprintf(" with %d warnings", len(result.Warnings))
+	}
+
 	return &pb.CreateBackupResponse{
 		Success:    true,
-		Message:    "Backup created successfully",
-		BackupPath: backupPath,
+		Message:    message,
+		BackupPath: result.Path,
+		Targets:    backupTargetStatuses(result.Targets),
+		Warnings:   result.Warnings,
+		JobId:      result.JobID,
 	}, nil
 }
 
 func (s *AgentServer) RestoreBackup(ctx context.Context, req *pb.RestoreBackupRequest) (*pb.RestoreBackupResponse, error) {
-	err := s.backupService.RestoreBackup(req.BackupPath, req.TargetPath)
+	backupPath := req.BackupPath
+	if req.S3Key != "" {
+		backupPath = backup.S3Path(req.S3Key)
+	}
+
+	result, err := s.backupService.RestoreBackup(backupPath, req.TargetPath, backup.RestoreOptions{
+		Include:       req.Include,
+		Exclude:       req.Exclude,
+		Conflict:      req.Conflict,
+		SideDirectory: req.SideDirectory,
+		JobID:         req.JobId,
+	})
 	if err != nil {
 		log.Printf("Error restoring backup: %v", err)
 		return &pb.RestoreBackupResponse{
@@ -192,17 +619,149 @@ func (s *AgentServer) RestoreBackup(ctx context.Context, req *pb.RestoreBackupRe
 	}
 
 	return &pb.RestoreBackupResponse{
+		Success:      true,
+		Message:      fmt.Sprintf("Restored %d entries to %s", result.Restored, result.Path),
+		RestoredPath: result.Path,
+		Restored:     int32(result.Restored),
+		Skipped:      int32(result.Skipped),
+		Renamed:      int32(result.Renamed),
+		JobId:        result.JobID,
+	}, nil
+}
+
+func (s *AgentServer) BrowseBackup(ctx context.Context, req *pb.BrowseBackupRequest) (*pb.BrowseBackupResponse, error) {
+	backupPath := req.BackupPath
+	if req.S3Key != "" {
+		backupPath = backup.S3Path(req.S3Key)
+	}
+
+	entries, err := s.backupService.BrowseBackup(backupPath, req.Dir, req.Recursive)
+	if err != nil {
+		log.Printf("Error browsing backup: %v", err)
+		return &pb.BrowseBackupResponse{
+			Success: false,
+			Message: err.Error(),
+		}, nil
+	}
+
+	var infos []*pb.BackupEntry
+	for _, entry := range entries {
+		infos = append(infos, &pb.BackupEntry{
+			Path:    entry.Path,
+			Type:    entry.Type,
+			Size:    entry.Size,
+			ModTime: entry.ModTime,
+			Link:    entry.Link,
+		})
+	}
+
+	return &pb.BrowseBackupResponse{
 		Success: true,
-		Message: "Backup restored successfully",
+		Message: fmt.Sprintf("%d entries", len(infos)),
+		Entries: infos,
 	}, nil
 }
 
+func (s *AgentServer) RestoreServer(ctx context.Context, req *pb.RestoreServerRequest) (*pb.RestoreServerResponse, error) {
+	backupPath := req.BackupPath
+	if req.S3Key != "" {
+		backupPath = backup.S3Path(req.S3Key)
+	}
+
+	options := backup.ServerRestoreOptions{
+		Root:          req.Root,
+		Conflict:      req.Conflict,
+		SkipDatabases: req.SkipDatabases,
+		JobID:         req.JobId,
+	}
+	for _, user := range req.DatabaseUsers {
+		options.DatabaseUsers = append(options.DatabaseUsers, backup.DatabaseUser{
+			Type:     user.Type,
+			Name:     user.Name,
+			Username: user.Username,
+			Password: user.Password,
+		})
+	}
+
+	result, err := s.backupService.RestoreServer(backupPath, options)
+	if err != nil {
+		log.Printf("Error restoring server: %v", err)
+		return &pb.RestoreServerResponse{
+			Success: false,
+			Message: err.Error(),
+		}, nil
+	}
+
+	message := "Server restored successfully"
+	var databases []*pb.ServerDatabaseStatus
+	loaded := 0
+	for _, db := range result.Databases {
+		if db.Success {
+			loaded++
+		}
+		databases = append(databases, &pb.ServerDatabaseStatus{
+			Type:    db.Type,
+			Name:    db.Name,
+			Success: db.Success,
+			Error:   db.Error,
+		})
+	}
+	if loaded < len(result.Databases) {
+		message = fmt.Sprintf("Server restored, %d of %d databases loaded", loaded, len(result.Databases))
+	}
+
+	// Only an in-place restore changes the running configuration
+	if req.Root == "" || req.Root == "/" {
+		if err := s.nginxService.Reload(); err != nil {
+			log.Printf("Error reloading nginx: %v", err)
+			message += fmt.Sprintf("; nginx reload failed: %v", err)
+		}
+	}
+
+	return &pb.RestoreServerResponse{
+		Success:   true,
+		Message:   message,
+		Restored:  int32(result.Restored),
+		Skipped:   int32(result.Skipped),
+		Sites:     result.Sites,
+		Databases: databases,
+		JobId:     result.JobID,
+	}, nil
+}
+
+func (s *AgentServer) WatchBackup(req *pb.WatchBackupRequest, stream pb.AgentService_WatchBackupServer) error {
+	err := s.backupService.WatchBackup(stream.Context(), req.JobId, func(progress backup.Progress) error {
+		return stream.Send(&pb.BackupProgress{
+			JobId:      progress.JobID,
+			Operation:  progress.Operation,
+			Name:       progress.Name,
+			Phase:      progress.Phase,
+			BytesDone:  progress.BytesDone,
+			BytesTotal: progress.BytesTotal,
+			FilesDone:  progress.FilesDone,
+			FilesTotal: progress.FilesTotal,
+			EtaSeconds: int64(progress.ETA / time.Second),
+			StartedAt:  progress.StartedAt.Unix(),
+			Done:       progress.Done,
+			Error:      progress.Error,
+		})
+	})
+	if err != nil && stream.Context().Err() == nil {
+		log.Printf("Error watching backup: %v", err)
+		return err
+	}
+	return nil
+}
+
 func (s *AgentServer) ListBackups(ctx context.Context, req *pb.ListBackupsRequest) (*pb.ListBackupsResponse, error) {
-	backups, err := s.backupService.ListBackups()
+	backups, warnings, err := s.backupService.ListBackups()
 	if err != nil {
 		log.Printf("Error listing backups: %v", err)
 		return &pb.ListBackupsResponse{}, err
 	}
+	for _, warning := range warnings {
+		log.Printf("Warning listing backups: %s", warning)
+	}
 
 	var backupInfos []*pb.BackupInfo
 	for _, backup := range backups {
@@ -211,10 +770,218 @@ func (s *AgentServer) ListBackups(ctx context.Context, req *pb.ListBackupsReques
 			Path:      backup.Path,
 			Size:      backup.Size,
 			CreatedAt: backup.CreatedAt,
+			Snapshot:  backup.Snapshot,
+			Location:  backup.Location,
+			S3Key:     backup.S3Key,
+			Targets:   backup.Targets,
 		})
 	}
 
 	return &pb.ListBackupsResponse{
-		Backups: backupInfos,
+		Backups:  backupInfos,
+		Warnings: warnings,
+	}, nil
+}
+
+func (s *AgentServer) VerifyBackup(ctx context.Context, req *pb.VerifyBackupRequest) (*pb.VerifyBackupResponse, error) {
+	result, err := s.backupService.VerifyBackup(req.BackupPath, req.S3Key)
+	if err != nil {
+		log.Printf("Error verifying backup: %v", err)
+		return &pb.VerifyBackupResponse{
+			Success: false,
+			Message: err.Error(),
+		}, nil
+	}
+
+	return &pb.VerifyBackupResponse{
+		Success:      true,
+		Message:      result.String(),
+		Valid:        result.Valid,
+		FilesChecked: int32(result.FilesChecked),
+		Problems:     result.Problems,
 	}, nil
 }
+
+func (s *AgentServer) PruneBackups(ctx context.Context, req *pb.PruneBackupsRequest) (*pb.PruneBackupsResponse, error) {
+	result, err := s.backupService.PruneBackups(req.Name, req.Type, req.DryRun)
+	if err != nil {
+		log.Printf("Error pruning backups: %v", err)
+		return &pb.PruneBackupsResponse{
+			Success: false,
+			Message: err.Error(),
+		}, nil
+	}
+
+	message := fmt.Sprintf("Removed %d backups", len(result.Removed))
+	if req.DryRun {
+		message = fmt.Sprintf("Would remove %d backups", len(result.Removed))
+	}
+
+	return &pb.PruneBackupsResponse{
+		Success:        true,
+		Message:        message,
+		Kept:           prunedBackups(result.Kept),
+		Removed:        prunedBackups(result.Removed),
+		ReclaimedBytes: result.ReclaimedBytes,
+		RemovedChunks:  int32(result.RemovedChunks),
+		Warnings:       result.Warnings,
+	}, nil
+}
+
+func (s *AgentServer) ListBackupSchedules(ctx context.Context, req *pb.ListBackupSchedulesRequest) (*pb.ListBackupSchedulesResponse, error) {
+	schedules, err := s.backupService.Schedules()
+	if err != nil {
+		log.Printf("Error listing backup schedules: %v", err)
+		return &pb.ListBackupSchedulesResponse{}, err
+	}
+
+	var infos []*pb.BackupSchedule
+	for _, schedule := range schedules {
+		infos = append(infos, backupScheduleToProto(schedule))
+	}
+
+	return &pb.ListBackupSchedulesResponse{
+		Schedules: infos,
+	}, nil
+}
+
+func (s *AgentServer) PutBackupSchedule(ctx context.Context, req *pb.PutBackupScheduleRequest) (*pb.PutBackupScheduleResponse, error) {
+	if req.Schedule == nil {
+		return &pb.PutBackupScheduleResponse{
+			Success: false,
+			Message: "schedule is required",
+		}, nil
+	}
+
+	schedule, err := s.backupService.PutSchedule(backupScheduleFromProto(req.Schedule))
+	if err != nil {
+		log.Printf("Error saving backup schedule: %v", err)
+		return &pb.PutBackupScheduleResponse{
+			Success: false,
+			Message: err.Error(),
+		}, nil
+	}
+
+	return &pb.PutBackupScheduleResponse{
+		Success:  true,
+		Message:  "Backup schedule saved successfully",
+		Schedule: backupScheduleToProto(schedule),
+	}, nil
+}
+
+func (s *AgentServer) DeleteBackupSchedule(ctx context.Context, req *pb.DeleteBackupScheduleRequest) (*pb.DeleteBackupScheduleResponse, error) {
+	err := s.backupService.DeleteSchedule(req.Id)
+	if err != nil {
+		log.Printf("Error deleting backup schedule: %v", err)
+		return &pb.DeleteBackupScheduleResponse{
+			Success: false,
+			Message: err.Error(),
+		}, nil
+	}
+
+	return &pb.DeleteBackupScheduleResponse{
+		Success: true,
+		Message: "Backup schedule deleted successfully",
+	}, nil
+}
+
+func backupScheduleFromProto(in *pb.BackupSchedule) backup.Schedule {
+	schedule := backup.Schedule{
+		ID:                 in.Id,
+		Name:               in.Name,
+		Type:               in.Type,
+		SourcePath:         in.SourcePath,
+		Cron:               in.Cron,
+		Destination:        in.Destination,
+		Exclude:            in.Exclude,
+		MaxFileSize:        in.MaxFileSize,
+		MaxTotalSize:       in.MaxTotalSize,
+		PreHook:            in.PreHook,
+		PostHook:           in.PostHook,
+		HookTimeoutSeconds: int(in.HookTimeoutSeconds),
+		JitterSeconds:      int(in.JitterSeconds),
+		TimeoutSeconds:     int(in.TimeoutSeconds),
+		Enabled:            in.Enabled,
+	}
+	if in.Retention != nil {
+		schedule.Retention = &backup.RetentionRule{
+			KeepLast:    int(in.Retention.KeepLast),
+			KeepDaily:   int(in.Retention.KeepDaily),
+			KeepWeekly:  int(in.Retention.KeepWeekly),
+			KeepMonthly: int(in.Retention.KeepMonthly),
+			KeepYearly:  int(in.Retention.KeepYearly),
+		}
+	}
+	return schedule
+}
+
+func backupScheduleToProto(schedule backup.Schedule) *pb.BackupSchedule {
+	out := &pb.BackupSchedule{
+		Id:                 schedule.ID,
+		Name:               schedule.Name,
+		Type:               schedule.Type,
+		SourcePath:         schedule.SourcePath,
+		Cron:               schedule.Cron,
+		Destination:        schedule.Destination,
+		Exclude:            schedule.Exclude,
+		MaxFileSize:        schedule.MaxFileSize,
+		MaxTotalSize:       schedule.MaxTotalSize,
+		PreHook:            schedule.PreHook,
+		PostHook:           schedule.PostHook,
+		HookTimeoutSeconds: int32(schedule.HookTimeoutSeconds),
+		JitterSeconds:      int32(schedule.JitterSeconds),
+		TimeoutSeconds:     int32(schedule.TimeoutSeconds),
+		Enabled:            schedule.Enabled,
+		Status: &pb.BackupScheduleStatus{
+			LastStartedAt:  schedule.Status.LastStartedAt,
+			LastFinishedAt: schedule.Status.LastFinishedAt,
+			LastSuccess:    schedule.Status.LastSuccess,
+			LastError:      schedule.Status.LastError,
+			LastBackupPath: schedule.Status.LastBackupPath,
+			NextRunAt:      schedule.Status.NextRunAt,
+			Running:        schedule.Status.Running,
+			LastTargets:    backupTargetStatuses(schedule.Status.LastTargets),
+			LastWarnings:   schedule.Status.LastWarnings,
+		},
+	}
+	if schedule.Retention != nil {
+		out.Retention = &pb.RetentionPolicy{
+			KeepLast:    int32(schedule.Retention.KeepLast),
+			KeepDaily:   int32(schedule.Retention.KeepDaily),
+			KeepWeekly:  int32(schedule.Retention.KeepWeekly),
+			KeepMonthly: int32(schedule.Retention.KeepMonthly),
+			KeepYearly:  int32(schedule.Retention.KeepYearly),
+		}
+	}
+	return out
+}
+
+func prunedBackups(backups []backup.PrunedBackup) []*pb.PrunedBackup {
+	var infos []*pb.PrunedBackup
+	for _, b := range backups {
+		infos = append(infos, &pb.PrunedBackup{
+			Name:      b.Name,
+			Type:      b.Type,
+			Path:      b.Path,
+			Location:  b.Location,
+			CreatedAt: b.CreatedAt,
+			Size:      b.Size,
+			Reason:    b.Reason,
+		})
+	}
+	return infos
+}
+
+func backupTargetStatuses(statuses []backup.TargetStatus) []*pb.BackupTargetStatus {
+	var infos []*pb.BackupTargetStatus
+	for _, status := range statuses {
+		infos = append(infos, &pb.BackupTargetStatus{
+			Target:  status.Target,
+			Success: status.Success,
+			Error:   status.Error,
+			Path:    status.Path,
+			Size:    status.Size,
+		})
+	}
+	return infos
+}
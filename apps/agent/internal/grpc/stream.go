@@ -0,0 +1,50 @@
+package grpc
+
+// streamChunkSize is the payload size of chunked streaming messages.
+const streamChunkSize = 64 * 1024
+
+// chunkWriter buffers writes into fixed-size chunks and hands each one to
+// send together with the running byte count.
+type chunkWriter struct {
+	send func(chunk []byte, sent int64) error
+	buf  []byte
+	sent int64
+}
+
+func newChunkWriter(send func(chunk []byte, sent int64) error) *chunkWriter {
+	return &chunkWriter{
+		send: send,
+		buf:  make([]byte, 0, streamChunkSize),
+	}
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+
+		if len(w.buf) == cap(w.buf) {
+			if err := w.Flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Flush sends any buffered bytes.
+func (w *chunkWriter) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+
+	w.sent += int64(len(w.buf))
+	chunk := make([]byte, len(w.buf))
+	copy(chunk, w.buf)
+	w.buf = w.buf[:0]
+
+	return w.send(chunk, w.sent)
+}
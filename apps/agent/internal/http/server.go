@@ -3,7 +3,9 @@ package http
 import (
 	"context"
 	"fmt"
+	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"hosting-panel-agent/internal/config"
@@ -31,6 +33,7 @@ func NewServer(config config.HTTPConfig, metricsService metrics.Service) *Server
 	// Register routes
 	mux.HandleFunc("/health", s.healthHandler)
 	mux.HandleFunc("/metrics", s.metricsHandler)
+	mux.HandleFunc("/metrics/json", s.jsonMetricsHandler)
 	mux.HandleFunc("/", s.rootHandler)
 
 	return s
@@ -50,7 +53,22 @@ func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, `{"status":"healthy","timestamp":"%s"}`, time.Now().Format(time.RFC3339))
 }
 
+// metricsHandler serves Prometheus scrapes, in OpenMetrics when the
+// scraper asks for it.
 func (s *Server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	if openMetrics {
+		w.Header().Set("Content-Type", metrics.OpenMetricsContentType)
+	} else {
+		w.Header().Set("Content-Type", metrics.PrometheusContentType)
+	}
+
+	if err := s.metricsService.WriteMetrics(w, openMetrics); err != nil {
+		log.Printf("Error writing metrics: %v", err)
+	}
+}
+
+func (s *Server) jsonMetricsHandler(w http.ResponseWriter, r *http.Request) {
 	metrics, err := s.metricsService.GetSystemMetrics()
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -84,6 +102,7 @@ func (s *Server) rootHandler(w http.ResponseWriter, r *http.Request) {
 				<ul>
 					<li><a href="/health">Health Check</a></li>
 					<li><a href="/metrics">Metrics</a></li>
+					<li><a href="/metrics/json">Metrics (JSON)</a></li>
 				</ul>
 			</body>
 		</html>
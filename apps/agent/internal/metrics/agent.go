@@ -0,0 +1,199 @@
+package metrics
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Histogram buckets in seconds for RPC latencies and job durations.
+var (
+	rpcBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+	jobBuckets = []float64{0.1, 1, 5, 15, 30, 60, 300, 900, 1800, 3600, 7200}
+)
+
+// agentMetrics are the agent's own counters, fed by the gRPC server,
+// backup jobs and the collection loop.
+type agentMetrics struct {
+	mu             sync.Mutex
+	rpcRequests    map[[2]string]float64
+	rpcDurations   map[string]*histogram
+	jobDurations   map[string]*histogram
+	jobFailures    map[string]float64
+	reloads        map[string]float64
+	reloadFailures map[string]float64
+	// certExpiry holds Unix times by domain
+	certExpiry map[string]float64
+}
+
+func newAgentMetrics() *agentMetrics {
+	return &agentMetrics{
+		rpcRequests:    make(map[[2]string]float64),
+		rpcDurations:   make(map[string]*histogram),
+		jobDurations:   make(map[string]*histogram),
+		jobFailures:    make(map[string]float64),
+		reloads:        make(map[string]float64),
+		reloadFailures: make(map[string]float64),
+		certExpiry:     make(map[string]float64),
+	}
+}
+
+// ObserveRPC records a finished gRPC call by method and status code.
+func (s Service) ObserveRPC(method, code string, duration time.Duration) {
+	a := s.agent
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.rpcRequests[[2]string{method, code}]++
+	h, ok := a.rpcDurations[method]
+	if !ok {
+		h = newHistogram(rpcBuckets)
+		a.rpcDurations[method] = h
+	}
+	h.observe(duration.Seconds())
+}
+
+// ObserveJob records how long a background job took, such as a backup or a
+// task run after each collection. Failed runs are counted separately.
+func (s Service) ObserveJob(job string, duration time.Duration, failed bool) {
+	a := s.agent
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	h, ok := a.jobDurations[job]
+	if !ok {
+		h = newHistogram(jobBuckets)
+		a.jobDurations[job] = h
+	}
+	h.observe(duration.Seconds())
+	if failed {
+		a.jobFailures[job]++
+	} else if _, ok := a.jobFailures[job]; !ok {
+		// Export the series from the start so that increase() sees the first failure
+		a.jobFailures[job] = 0
+	}
+}
+
+// ObserveReload records a reload of a service such as nginx.
+func (s Service) ObserveReload(service string, err error) {
+	a := s.agent
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.reloads[service]++
+	if err != nil {
+		a.reloadFailures[service]++
+	} else if _, ok := a.reloadFailures[service]; !ok {
+		a.reloadFailures[service] = 0
+	}
+}
+
+// SetCertificateExpiry replaces the known certificate expiry times, keyed
+// by domain.
+func (s Service) SetCertificateExpiry(expiry map[string]time.Time) {
+	a := s.agent
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.certExpiry = make(map[string]float64, len(expiry))
+	for domain, expiresAt := range expiry {
+		a.certExpiry[domain] = float64(expiresAt.Unix())
+	}
+}
+
+func (a *agentMetrics) write(e *expositionWriter) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	e.family("agent_rpc_requests", "counter", "gRPC requests handled, by method and status code.")
+	keys := make([][2]string, 0, len(a.rpcRequests))
+	for key := range a.rpcRequests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	for _, key := range keys {
+		e.sample("agent_rpc_requests_total", a.rpcRequests[key], "method", key[0], "code", key[1])
+	}
+
+	e.family("agent_rpc_duration_seconds", "histogram", "gRPC request latency, by method.")
+	for _, method := range sortedHistograms(a.rpcDurations) {
+		a.rpcDurations[method].write(e, "agent_rpc_duration_seconds", "method", method)
+	}
+
+	e.family("agent_job_duration_seconds", "histogram", "Duration of backups, restores and collection tasks.")
+	for _, job := range sortedHistograms(a.jobDurations) {
+		a.jobDurations[job].write(e, "agent_job_duration_seconds", "job", job)
+	}
+	e.family("agent_job_failures", "counter", "Failed backups, restores and collection tasks.")
+	for _, job := range sortedKeys(a.jobFailures) {
+		e.sample("agent_job_failures_total", a.jobFailures[job], "job", job)
+	}
+
+	e.family("agent_reloads", "counter", "Service reloads attempted.")
+	for _, service := range sortedKeys(a.reloads) {
+		e.sample("agent_reloads_total", a.reloads[service], "service", service)
+	}
+	e.family("agent_reload_failures", "counter", "Service reloads that failed.")
+	for _, service := range sortedKeys(a.reloadFailures) {
+		e.sample("agent_reload_failures_total", a.reloadFailures[service], "service", service)
+	}
+
+	e.family("agent_certificate_expiry_timestamp_seconds", "gauge", "Expiry time of installed TLS certificates.")
+	for _, domain := range sortedKeys(a.certExpiry) {
+		e.sample("agent_certificate_expiry_timestamp_seconds", a.certExpiry[domain], "domain", domain)
+	}
+}
+
+// histogram is a cumulative Prometheus histogram.
+type histogram struct {
+	bounds []float64
+	counts []float64
+	sum    float64
+	count  float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]float64, len(bounds))}
+}
+
+func (h *histogram) observe(value float64) {
+	for i, bound := range h.bounds {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+func (h *histogram) write(e *expositionWriter, name string, labels ...string) {
+	for i, bound := range h.bounds {
+		e.sample(name+"_bucket", h.counts[i], append(labels, "le", formatFloat(bound))...)
+	}
+	e.sample(name+"_bucket", h.count, append(labels, "le", "+Inf")...)
+	e.sample(name+"_count", h.count, labels...)
+	e.sample(name+"_sum", h.sum, labels...)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedHistograms(m map[string]*histogram) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
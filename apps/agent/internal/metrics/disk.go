@@ -0,0 +1,334 @@
+package metrics
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// diskStats are the capacity figures of a mounted filesystem, in bytes.
+type diskStats struct {
+	Total uint64
+	Used  uint64
+	// Available excludes blocks reserved for root
+	Available  uint64
+	Inodes     uint64
+	InodesFree uint64
+}
+
+// usage returns the used percentage the way df reports it, relative to the
+// space available to unprivileged users.
+func (d diskStats) usage() float64 {
+	if d.Used+d.Available == 0 {
+		return 0
+	}
+	return float64(d.Used) / float64(d.Used+d.Available) * 100
+}
+
+// virtualFilesystems hold no site data and are left out of per-mount
+// metrics.
+var virtualFilesystems = map[string]bool{
+	"autofs": true, "binfmt_misc": true, "bpf": true, "cgroup": true,
+	"cgroup2": true, "configfs": true, "debugfs": true, "devpts": true,
+	"devtmpfs": true, "efivarfs": true, "fusectl": true, "hugetlbfs": true,
+	"mqueue": true, "nsfs": true, "proc": true, "pstore": true,
+	"ramfs": true, "rpc_pipefs": true, "securityfs": true, "squashfs": true,
+	"sysfs": true, "tmpfs": true, "tracefs": true,
+}
+
+// filesystem is a mounted filesystem with its usage.
+type filesystem struct {
+	mountEntry
+	diskStats
+	// Major and Minor identify the device in /proc/diskstats
+	Major uint32
+	Minor uint32
+}
+
+// filesystems returns the usage of every real mounted filesystem. A device
+// mounted more than once, e.g. by bind mounts, is reported at its first
+// mount point.
+func filesystems() ([]filesystem, error) {
+	mounts, err := readMounts()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []filesystem
+	seen := make(map[string]bool)
+	for _, mount := range mounts {
+		if virtualFilesystems[mount.FSType] || seen[mount.Device] {
+			continue
+		}
+		stats, err := statfs(mount.MountPoint)
+		if err != nil || stats.Total == 0 {
+			// Unmounted since, or not accessible to the agent
+			continue
+		}
+		seen[mount.Device] = true
+		fs := filesystem{mountEntry: mount, diskStats: stats}
+		fs.Major, fs.Minor, _ = deviceNumber(mount.MountPoint)
+		result = append(result, fs)
+	}
+	return result, nil
+}
+
+func (fs filesystem) labels() []string {
+	return []string{"mountpoint", fs.MountPoint, "device", fs.Device, "fstype", fs.FSType}
+}
+
+// DiskMetrics describes a mounted filesystem.
+type DiskMetrics struct {
+	MountPoint     string
+	Device         string
+	FSType         string
+	TotalBytes     uint64
+	UsedBytes      uint64
+	AvailableBytes uint64
+	TotalInodes    uint64
+	UsedInodes     uint64
+	FreeInodes     uint64
+	// Throughput and IOPS of the underlying device. Zero for filesystems
+	// without one, such as network or overlay mounts.
+	ReadBytesPerSecond  float64
+	WriteBytesPerSecond float64
+	ReadsPerSecond      float64
+	WritesPerSecond     float64
+	// Paths maps the names of configured paths stored on this filesystem
+	// to the paths; see AddPath.
+	Paths map[string]string
+}
+
+// pathList holds configured paths reported with their filesystem.
+type pathList struct {
+	mu    sync.Mutex
+	paths map[string]string
+}
+
+// AddPath reports path, such as the backup storage path, with the
+// filesystem it is stored on under name. Empty paths are ignored.
+func (s Service) AddPath(name, path string) {
+	if path == "" {
+		return
+	}
+
+	s.paths.mu.Lock()
+	defer s.paths.mu.Unlock()
+
+	if s.paths.paths == nil {
+		s.paths.paths = make(map[string]string)
+	}
+	s.paths.paths[name] = path
+}
+
+func (s Service) configuredPaths() map[string]string {
+	s.paths.mu.Lock()
+	defer s.paths.mu.Unlock()
+
+	paths := make(map[string]string, len(s.paths.paths))
+	for name, path := range s.paths.paths {
+		paths[name] = path
+	}
+	return paths
+}
+
+// GetDiskMetrics returns usage and I/O rates for every real mounted
+// filesystem.
+func (s Service) GetDiskMetrics() ([]DiskMetrics, error) {
+	fss, err := filesystems()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read filesystems: %v", err)
+	}
+	rates, err := s.disk.sample()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read disk stats: %v", err)
+	}
+	mountPaths, err := s.mountPaths(fss)
+	if err != nil {
+		return nil, fmt.Errorf("failed to map paths to filesystems: %v", err)
+	}
+
+	var disks []DiskMetrics
+	for _, fs := range fss {
+		rate := rates[[2]uint32{fs.Major, fs.Minor}]
+		disks = append(disks, DiskMetrics{
+			MountPoint:          fs.MountPoint,
+			Device:              fs.Device,
+			FSType:              fs.FSType,
+			TotalBytes:          fs.Total,
+			UsedBytes:           fs.Used,
+			AvailableBytes:      fs.Available,
+			TotalInodes:         fs.Inodes,
+			UsedInodes:          fs.Inodes - fs.InodesFree,
+			FreeInodes:          fs.InodesFree,
+			ReadBytesPerSecond:  rate.ReadBytes,
+			WriteBytesPerSecond: rate.WriteBytes,
+			ReadsPerSecond:      rate.Reads,
+			WritesPerSecond:     rate.Writes,
+			Paths:               mountPaths[fs.MountPoint],
+		})
+	}
+	return disks, nil
+}
+
+// mountPaths groups the configured paths by the mount point of the
+// filesystem they are on, as reported by filesystems.
+func (s Service) mountPaths(fss []filesystem) (map[string]map[string]string, error) {
+	paths := s.configuredPaths()
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	mounts, err := readMounts()
+	if err != nil {
+		return nil, err
+	}
+
+	// A path on a bind mount belongs to the filesystem reported for the
+	// mounted device
+	reported := make(map[string]string)
+	for _, fs := range fss {
+		reported[fs.Device] = fs.MountPoint
+	}
+
+	result := make(map[string]map[string]string)
+	for name, path := range paths {
+		mount, ok := mountOf(mounts, resolvePath(path))
+		if !ok {
+			continue
+		}
+		mountPoint, ok := reported[mount.Device]
+		if !ok {
+			continue
+		}
+		if result[mountPoint] == nil {
+			result[mountPoint] = make(map[string]string)
+		}
+		result[mountPoint][name] = path
+	}
+	return result, nil
+}
+
+// resolvePath follows the symlinks of the longest existing prefix of path,
+// which need not exist yet.
+func resolvePath(path string) string {
+	path = filepath.Clean(path)
+	for dir, rest := path, ""; ; {
+		if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+			return filepath.Join(resolved, rest)
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return path
+		}
+		rest = filepath.Join(filepath.Base(dir), rest)
+		dir = parent
+	}
+}
+
+// mountOf returns the mount path is on: the last mounted of those with the
+// longest matching mount point.
+func mountOf(mounts []mountEntry, path string) (mountEntry, bool) {
+	var best mountEntry
+	found := false
+	for _, mount := range mounts {
+		if !pathWithin(path, mount.MountPoint) {
+			continue
+		}
+		if !found || len(mount.MountPoint) >= len(best.MountPoint) {
+			best, found = mount, true
+		}
+	}
+	return best, found
+}
+
+func pathWithin(path, dir string) bool {
+	return dir == "/" || path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+// ioRates are the I/O rates of a block device.
+type ioRates struct {
+	ReadBytes  float64
+	WriteBytes float64
+	Reads      float64
+	Writes     float64
+}
+
+// ioSampler measures device I/O rates as the delta between successive
+// reads of /proc/diskstats, like cpuSampler.
+type ioSampler struct {
+	mu     sync.Mutex
+	prev   map[[2]uint32]diskIOStats
+	prevAt time.Time
+	rates  map[[2]uint32]ioRates
+}
+
+func (d *ioSampler) sample() (map[[2]uint32]ioRates, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.prevAt.IsZero() && time.Since(d.prevAt) < minCPUInterval {
+		return d.rates, nil
+	}
+
+	if d.prevAt.IsZero() {
+		stats, err := readDiskstats()
+		if err != nil {
+			return nil, err
+		}
+		d.prev, d.prevAt = indexDiskstats(stats), time.Now()
+		time.Sleep(minCPUInterval)
+	}
+
+	stats, err := readDiskstats()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	current := indexDiskstats(stats)
+	elapsed := now.Sub(d.prevAt).Seconds()
+
+	d.rates = make(map[[2]uint32]ioRates, len(current))
+	for key, cur := range current {
+		prev, ok := d.prev[key]
+		if !ok {
+			continue
+		}
+		d.rates[key] = ioRates{
+			ReadBytes:  counterRate(prev.ReadSectors, cur.ReadSectors, elapsed) * sectorSize,
+			WriteBytes: counterRate(prev.WriteSectors, cur.WriteSectors, elapsed) * sectorSize,
+			Reads:      counterRate(prev.Reads, cur.Reads, elapsed),
+			Writes:     counterRate(prev.Writes, cur.Writes, elapsed),
+		}
+	}
+	d.prev, d.prevAt = current, now
+	return d.rates, nil
+}
+
+func indexDiskstats(stats []diskIOStats) map[[2]uint32]diskIOStats {
+	index := make(map[[2]uint32]diskIOStats, len(stats))
+	for _, stat := range stats {
+		index[[2]uint32{stat.Major, stat.Minor}] = stat
+	}
+	return index
+}
+
+// counterRate returns the per-second rate of a counter, zero when it was
+// reset, e.g. by a device being re-added.
+func counterRate(prev, cur uint64, seconds float64) float64 {
+	if cur < prev || seconds <= 0 {
+		return 0
+	}
+	return float64(cur-prev) / seconds
+}
+
+func sortedPathNames(paths map[string]string) []string {
+	names := make([]string, 0, len(paths))
+	for name := range paths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,219 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Content types of the text exposition formats.
+const (
+	PrometheusContentType  = "text/plain; version=0.0.4; charset=utf-8"
+	OpenMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// expositionWriter writes metric families in the Prometheus text format or
+// in OpenMetrics, which differ only in how counters are declared and in
+// the closing "# EOF".
+type expositionWriter struct {
+	w           *bufio.Writer
+	openMetrics bool
+}
+
+func newExpositionWriter(w io.Writer, openMetrics bool) *expositionWriter {
+	return &expositionWriter{w: bufio.NewWriter(w), openMetrics: openMetrics}
+}
+
+// family declares a metric family. Counter families are named without
+// their "_total" suffix.
+func (e *expositionWriter) family(name, typ, help string) {
+	if typ == "counter" && !e.openMetrics {
+		name += "_total"
+	}
+	e.w.WriteString("# HELP " + name + " " + escapeHelp(help) + "\n")
+	e.w.WriteString("# TYPE " + name + " " + typ + "\n")
+}
+
+// sample writes one sample; labels are name and value pairs.
+func (e *expositionWriter) sample(name string, value float64, labels ...string) {
+	e.w.WriteString(name)
+	if len(labels) > 0 {
+		e.w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				e.w.WriteByte(',')
+			}
+			e.w.WriteString(labels[i] + `="` + escapeLabel(labels[i+1]) + `"`)
+		}
+		e.w.WriteByte('}')
+	}
+	e.w.WriteString(" " + formatFloat(value) + "\n")
+}
+
+func (e *expositionWriter) close() error {
+	if e.openMetrics {
+		e.w.WriteString("# EOF\n")
+	}
+	return e.w.Flush()
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+// WriteMetrics writes the system metrics and the agent's own counters in
+// the Prometheus text format, or in OpenMetrics when openMetrics is set.
+// Sources that cannot be read are left out rather than failing the scrape.
+func (s Service) WriteMetrics(w io.Writer, openMetrics bool) error {
+	e := newExpositionWriter(w, openMetrics)
+
+	if usage, err := s.getCPUUsage(); err != nil {
+		fmt.Printf("Error reading CPU usage: %v\n", err)
+	} else {
+		e.family("agent_cpu_usage_percent", "gauge", "CPU busy time since the previous sample.")
+		e.sample("agent_cpu_usage_percent", usage)
+	}
+
+	if info, err := readMeminfo(); err != nil {
+		fmt.Printf("Error reading memory usage: %v\n", err)
+	} else {
+		e.family("agent_memory_total_bytes", "gauge", "Physical memory.")
+		e.sample("agent_memory_total_bytes", float64(info.Total))
+		e.family("agent_memory_available_bytes", "gauge", "Memory available without swapping.")
+		e.sample("agent_memory_available_bytes", float64(info.Available))
+		e.family("agent_memory_usage_percent", "gauge", "Memory in use.")
+		e.sample("agent_memory_usage_percent", info.usage())
+	}
+
+	if fss, err := filesystems(); err != nil {
+		fmt.Printf("Error reading filesystems: %v\n", err)
+	} else {
+		e.family("agent_filesystem_size_bytes", "gauge", "Filesystem size.")
+		for _, fs := range fss {
+			e.sample("agent_filesystem_size_bytes", float64(fs.Total), fs.labels()...)
+		}
+		e.family("agent_filesystem_used_bytes", "gauge", "Filesystem space in use.")
+		for _, fs := range fss {
+			e.sample("agent_filesystem_used_bytes", float64(fs.Used), fs.labels()...)
+		}
+		e.family("agent_filesystem_avail_bytes", "gauge", "Filesystem space available to unprivileged users.")
+		for _, fs := range fss {
+			e.sample("agent_filesystem_avail_bytes", float64(fs.Available), fs.labels()...)
+		}
+		e.family("agent_filesystem_files", "gauge", "Filesystem inodes.")
+		for _, fs := range fss {
+			e.sample("agent_filesystem_files", float64(fs.Inodes), fs.labels()...)
+		}
+		e.family("agent_filesystem_files_free", "gauge", "Filesystem inodes free.")
+		for _, fs := range fss {
+			e.sample("agent_filesystem_files_free", float64(fs.InodesFree), fs.labels()...)
+		}
+
+		if mountPaths, err := s.mountPaths(fss); err != nil {
+			fmt.Printf("Error mapping paths to filesystems: %v\n", err)
+		} else {
+			e.family("agent_filesystem_path_info", "gauge", "Configured paths and the filesystem they are on.")
+			for _, fs := range fss {
+				paths := mountPaths[fs.MountPoint]
+				for _, name := range sortedPathNames(paths) {
+					e.sample("agent_filesystem_path_info", 1, "name", name, "path", paths[name], "mountpoint", fs.MountPoint)
+				}
+			}
+		}
+
+		if stats, err := readDiskstats(); err != nil {
+			fmt.Printf("Error reading disk stats: %v\n", err)
+		} else {
+			s.writeDiskIO(e, fss, stats)
+		}
+	}
+
+	if stats, err := readNetDev(); err != nil {
+		fmt.Printf("Error reading network interfaces: %v\n", err)
+	} else {
+		counters := []struct {
+			name, help string
+			value      func(netDevStats) uint64
+		}{
+			{"agent_network_receive_bytes", "Bytes received.", func(n netDevStats) uint64 { return n.RxBytes }},
+			{"agent_network_transmit_bytes", "Bytes sent.", func(n netDevStats) uint64 { return n.TxBytes }},
+			{"agent_network_receive_packets", "Packets received.", func(n netDevStats) uint64 { return n.RxPackets }},
+			{"agent_network_transmit_packets", "Packets sent.", func(n netDevStats) uint64 { return n.TxPackets }},
+			{"agent_network_receive_errors", "Receive errors.", func(n netDevStats) uint64 { return n.RxErrors }},
+			{"agent_network_transmit_errors", "Transmit errors.", func(n netDevStats) uint64 { return n.TxErrors }},
+			{"agent_network_receive_drops", "Received packets dropped.", func(n netDevStats) uint64 { return n.RxDropped }},
+			{"agent_network_transmit_drops", "Packets dropped before sending.", func(n netDevStats) uint64 { return n.TxDropped }},
+		}
+		for _, counter := range counters {
+			e.family(counter.name, "counter", counter.help)
+			for _, iface := range stats {
+				if s.interfaceExclude.MatchString(iface.Name) {
+					continue
+				}
+				e.sample(counter.name+"_total", float64(counter.value(iface)), "interface", iface.Name)
+			}
+		}
+	}
+
+	e.family("agent_uptime_seconds", "gauge", "Time since the agent started.")
+	e.sample("agent_uptime_seconds", time.Since(s.startTime).Seconds())
+
+	s.agent.write(e)
+	return e.close()
+}
+
+// writeDiskIO writes the I/O counters of the devices holding fss.
+func (s Service) writeDiskIO(e *expositionWriter, fss []filesystem, stats []diskIOStats) {
+	index := indexDiskstats(stats)
+	var devices []diskIOStats
+	seen := make(map[[2]uint32]bool)
+	for _, fs := range fss {
+		key := [2]uint32{fs.Major, fs.Minor}
+		if stat, ok := index[key]; ok && !seen[key] {
+			seen[key] = true
+			devices = append(devices, stat)
+		}
+	}
+
+	counters := []struct {
+		name, help string
+		value      func(diskIOStats) float64
+	}{
+		{"agent_disk_read_bytes", "Bytes read.", func(d diskIOStats) float64 { return float64(d.ReadSectors * sectorSize) }},
+		{"agent_disk_written_bytes", "Bytes written.", func(d diskIOStats) float64 { return float64(d.WriteSectors * sectorSize) }},
+		{"agent_disk_reads_completed", "Reads completed.", func(d diskIOStats) float64 { return float64(d.Reads) }},
+		{"agent_disk_writes_completed", "Writes completed.", func(d diskIOStats) float64 { return float64(d.Writes) }},
+		{"agent_disk_io_time_seconds", "Time the device was busy.", func(d diskIOStats) float64 { return float64(d.IOTime) / 1000 }},
+	}
+	for _, counter := range counters {
+		e.family(counter.name, "counter", counter.help)
+		for _, device := range devices {
+			e.sample(counter.name+"_total", counter.value(device), "device", device.Name)
+		}
+	}
+}
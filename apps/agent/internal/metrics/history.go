@@ -0,0 +1,163 @@
+package metrics
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// The history keeps every collection for a day and five-minute averages for
+// a month, in buffers allocated up front.
+const (
+	historyResolution = 30 * time.Second
+	historyPoints     = int(24 * time.Hour / historyResolution)
+	archiveResolution = 5 * time.Minute
+	archivePoints     = int(30 * 24 * time.Hour / archiveResolution)
+)
+
+// MetricsSample is the system metrics at one point in time.
+type MetricsSample struct {
+	Time        time.Time
+	CPUUsage    float64
+	MemoryUsage float64
+	DiskUsage   float64
+	// Bandwidth is in bytes per second
+	Bandwidth int64
+}
+
+// sampleRing is a fixed-capacity buffer that overwrites its oldest sample.
+type sampleRing struct {
+	samples []MetricsSample
+	start   int
+	size    int
+}
+
+func newSampleRing(capacity int) *sampleRing {
+	return &sampleRing{samples: make([]MetricsSample, capacity)}
+}
+
+func (r *sampleRing) push(sample MetricsSample) {
+	if r.size < len(r.samples) {
+		r.samples[(r.start+r.size)%len(r.samples)] = sample
+		r.size++
+		return
+	}
+	r.samples[r.start] = sample
+	r.start = (r.start + 1) % len(r.samples)
+}
+
+// at returns the i-th oldest sample.
+func (r *sampleRing) at(i int) MetricsSample {
+	return r.samples[(r.start+i)%len(r.samples)]
+}
+
+// history holds recent samples at full resolution and older ones
+// downsampled.
+type history struct {
+	mu      sync.RWMutex
+	recent  *sampleRing
+	archive *sampleRing
+	// pending are the samples of the five-minute window not archived yet
+	pending []MetricsSample
+}
+
+func newHistory() *history {
+	return &history{
+		recent:  newSampleRing(historyPoints),
+		archive: newSampleRing(archivePoints),
+	}
+}
+
+func (h *history) add(sample MetricsSample) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.recent.push(sample)
+
+	window := sample.Time.Truncate(archiveResolution)
+	if len(h.pending) > 0 && !h.pending[0].Time.Truncate(archiveResolution).Equal(window) {
+		h.archive.push(averageSamples(h.pending[0].Time.Truncate(archiveResolution), h.pending))
+		h.pending = h.pending[:0]
+	}
+	h.pending = append(h.pending, sample)
+}
+
+// query returns the samples between start and end, inclusive. A step
+// longer than the stored resolution averages the samples of each step;
+// otherwise the stored samples are returned. Full resolution samples are
+// used wherever they still exist.
+func (h *history) query(start, end time.Time, step time.Duration) []MetricsSample {
+	h.mu.RLock()
+	var samples []MetricsSample
+	var recentStart time.Time
+	if h.recent.size > 0 {
+		recentStart = h.recent.at(0).Time
+	}
+	for i := 0; i < h.archive.size; i++ {
+		sample := h.archive.at(i)
+		if h.recent.size > 0 && !sample.Time.Add(archiveResolution).Before(recentStart) {
+			break
+		}
+		if inRange(sample.Time, start, end) {
+			samples = append(samples, sample)
+		}
+	}
+	for i := 0; i < h.recent.size; i++ {
+		if sample := h.recent.at(i); inRange(sample.Time, start, end) {
+			samples = append(samples, sample)
+		}
+	}
+	h.mu.RUnlock()
+
+	if step <= historyResolution || len(samples) == 0 {
+		return samples
+	}
+
+	var result []MetricsSample
+	var bucket []MetricsSample
+	var bucketStart time.Time
+	for _, sample := range samples {
+		sampleBucket := start.Add(sample.Time.Sub(start) / step * step)
+		if len(bucket) > 0 && !sampleBucket.Equal(bucketStart) {
+			result = append(result, averageSamples(bucketStart, bucket))
+			bucket = bucket[:0]
+		}
+		bucketStart = sampleBucket
+		bucket = append(bucket, sample)
+	}
+	return append(result, averageSamples(bucketStart, bucket))
+}
+
+func inRange(t, start, end time.Time) bool {
+	return !t.Before(start) && !t.After(end)
+}
+
+func averageSamples(at time.Time, samples []MetricsSample) MetricsSample {
+	average := MetricsSample{Time: at}
+	var bandwidth int64
+	for _, sample := range samples {
+		average.CPUUsage += sample.CPUUsage
+		average.MemoryUsage += sample.MemoryUsage
+		average.DiskUsage += sample.DiskUsage
+		bandwidth += sample.Bandwidth
+	}
+	n := float64(len(samples))
+	average.CPUUsage /= n
+	average.MemoryUsage /= n
+	average.DiskUsage /= n
+	average.Bandwidth = bandwidth / int64(len(samples))
+	return average
+}
+
+// QueryMetrics returns the collected system metrics between start and end,
+// averaged per step when step is longer than the stored resolution: 30
+// seconds for the last day, five minutes for the last 30 days.
+func (s Service) QueryMetrics(start, end time.Time, step time.Duration) ([]MetricsSample, error) {
+	if end.Before(start) {
+		return nil, fmt.Errorf("end of range is before its start")
+	}
+	if step < 0 {
+		return nil, fmt.Errorf("step must not be negative")
+	}
+	return s.history.query(start, end, step), nil
+}
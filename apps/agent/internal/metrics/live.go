@@ -0,0 +1,132 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// minLiveInterval bounds how often subscribers can make the collection loop
+// sample.
+const minLiveInterval = time.Second
+
+// liveFeed fans the samples of the collection loop out to subscribers. The
+// loop samples as often as the most demanding subscriber asks, so every
+// sample is collected once however many subscribers there are.
+type liveFeed struct {
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+	// changed wakes the collection loop when a faster subscriber joins
+	changed chan struct{}
+}
+
+type subscriber struct {
+	interval time.Duration
+	lastSent time.Time
+	// samples holds only the latest sample, so a slow subscriber never
+	// blocks the loop
+	samples chan MetricsSample
+}
+
+func newLiveFeed() *liveFeed {
+	return &liveFeed{
+		subscribers: make(map[*subscriber]struct{}),
+		changed:     make(chan struct{}, 1),
+	}
+}
+
+// interval returns how often the loop must sample to serve every
+// subscriber, at most max.
+func (f *liveFeed) interval(max time.Duration) time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	interval := max
+	for sub := range f.subscribers {
+		if sub.interval < interval {
+			interval = sub.interval
+		}
+	}
+	return interval
+}
+
+func (f *liveFeed) publish(sample MetricsSample) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for sub := range f.subscribers {
+		// Allow for timer jitter so that a 5s subscriber is not skipped
+		// by a sample taken a little under 5s after the last
+		if !sub.lastSent.IsZero() && sample.Time.Sub(sub.lastSent) < sub.interval*9/10 {
+			continue
+		}
+		sub.lastSent = sample.Time
+		select {
+		case <-sub.samples:
+		default:
+		}
+		sub.samples <- sample
+	}
+}
+
+// StreamMetrics calls fn with a sample of the system metrics every interval
+// until ctx is done or fn fails. Samples come from the collection loop of
+// Start, which speeds up while there are subscribers; interval is raised to
+// one second at least.
+func (s Service) StreamMetrics(ctx context.Context, interval time.Duration, fn func(MetricsSample) error) error {
+	if interval < 0 {
+		return fmt.Errorf("interval must not be negative")
+	}
+	if interval < minLiveInterval {
+		interval = minLiveInterval
+	}
+
+	f := s.live
+	sub := &subscriber{
+		interval: interval,
+		samples:  make(chan MetricsSample, 1),
+	}
+	f.mu.Lock()
+	f.subscribers[sub] = struct{}{}
+	f.mu.Unlock()
+	select {
+	case f.changed <- struct{}{}:
+	default:
+	}
+
+	defer func() {
+		f.mu.Lock()
+		delete(f.subscribers, sub)
+		f.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case sample := <-sub.samples:
+			if err := fn(sample); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// SampleMetrics are the names StreamMetrics subscribers can select.
+var SampleMetrics = []string{"cpu_usage", "memory_usage", "disk_usage", "bandwidth"}
+
+// Value returns the named metric of the sample; see SampleMetrics.
+func (m MetricsSample) Value(name string) (float64, bool) {
+	switch name {
+	case "cpu_usage":
+		return m.CPUUsage, true
+	case "memory_usage":
+		return m.MemoryUsage, true
+	case "disk_usage":
+		return m.DiskUsage, true
+	case "bandwidth":
+		return float64(m.Bandwidth), true
+	}
+	return 0, false
+}
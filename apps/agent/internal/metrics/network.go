@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// DefaultInterfaceExclude leaves out loopback and the virtual interfaces of
+// containers, bridges and tunnels.
+const DefaultInterfaceExclude = `^(lo|veth.*|docker.*|br-.*|virbr.*|vnet.*|cali.*|flannel.*|cni.*|ifb.*|tun.*|tap.*|wg.*)$`
+
+// InterfaceMetrics are the traffic rates of a network interface, per
+// second.
+type InterfaceMetrics struct {
+	Name      string
+	RxBytes   float64
+	TxBytes   float64
+	RxPackets float64
+	TxPackets float64
+	RxErrors  float64
+	TxErrors  float64
+	RxDrops   float64
+	TxDrops   float64
+}
+
+// netSampler measures interface rates as the delta between successive
+// reads of /proc/net/dev, like cpuSampler.
+type netSampler struct {
+	mu     sync.Mutex
+	prev   map[string]netDevStats
+	prevAt time.Time
+	rates  []InterfaceMetrics
+}
+
+func (n *netSampler) sample(exclude *regexp.Regexp) ([]InterfaceMetrics, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.prevAt.IsZero() || time.Since(n.prevAt) >= minCPUInterval {
+		if n.prevAt.IsZero() {
+			stats, err := readNetDev()
+			if err != nil {
+				return nil, err
+			}
+			n.prev, n.prevAt = indexNetDev(stats), time.Now()
+			time.Sleep(minCPUInterval)
+		}
+
+		stats, err := readNetDev()
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		elapsed := now.Sub(n.prevAt).Seconds()
+
+		n.rates = n.rates[:0]
+		for _, cur := range stats {
+			prev, ok := n.prev[cur.Name]
+			if !ok {
+				// Appeared since the last sample
+				continue
+			}
+			n.rates = append(n.rates, InterfaceMetrics{
+				Name:      cur.Name,
+				RxBytes:   counterRate(prev.RxBytes, cur.RxBytes, elapsed),
+				TxBytes:   counterRate(prev.TxBytes, cur.TxBytes, elapsed),
+				RxPackets: counterRate(prev.RxPackets, cur.RxPackets, elapsed),
+				TxPackets: counterRate(prev.TxPackets, cur.TxPackets, elapsed),
+				RxErrors:  counterRate(prev.RxErrors, cur.RxErrors, elapsed),
+				TxErrors:  counterRate(prev.TxErrors, cur.TxErrors, elapsed),
+				RxDrops:   counterRate(prev.RxDropped, cur.RxDropped, elapsed),
+				TxDrops:   counterRate(prev.TxDropped, cur.TxDropped, elapsed),
+			})
+		}
+		n.prev, n.prevAt = indexNetDev(stats), now
+	}
+
+	var rates []InterfaceMetrics
+	for _, rate := range n.rates {
+		if !exclude.MatchString(rate.Name) {
+			rates = append(rates, rate)
+		}
+	}
+	return rates, nil
+}
+
+func indexNetDev(stats []netDevStats) map[string]netDevStats {
+	index := make(map[string]netDevStats, len(stats))
+	for _, stat := range stats {
+		index[stat.Name] = stat
+	}
+	return index
+}
+
+// GetNetworkMetrics returns the traffic rates of every interface not
+// excluded by Config.InterfaceExclude.
+func (s Service) GetNetworkMetrics() ([]InterfaceMetrics, error) {
+	rates, err := s.network.sample(s.interfaceExclude)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read network interfaces: %v", err)
+	}
+	return rates, nil
+}
@@ -0,0 +1,353 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// procPath is where procfs is mounted.
+const procPath = "/proc"
+
+// minCPUInterval is the shortest window CPU usage is measured over; callers
+// polling faster get the previous value.
+const minCPUInterval = 250 * time.Millisecond
+
+// cpuTimes are the cumulative jiffies of the "cpu" line of /proc/stat.
+type cpuTimes struct {
+	Idle  uint64
+	Total uint64
+}
+
+// parseCPUStat reads the aggregate CPU times from /proc/stat. Guest time is
+// already part of user time and not counted twice.
+func parseCPUStat(r io.Reader) (cpuTimes, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || fields[0] != "cpu" {
+			continue
+		}
+
+		var times cpuTimes
+		// user nice system idle iowait irq softirq steal guest guest_nice
+		for i, field := range fields[1:] {
+			if i >= 8 {
+				break
+			}
+			value, err := strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				return cpuTimes{}, fmt.Errorf("invalid cpu time %q: %v", field, err)
+			}
+			times.Total += value
+			// idle and iowait
+			if i == 3 || i == 4 {
+				times.Idle += value
+			}
+		}
+		return times, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return cpuTimes{}, err
+	}
+	return cpuTimes{}, fmt.Errorf("no cpu line in stat")
+}
+
+// usageSince returns the busy percentage between two samples.
+func (t cpuTimes) usageSince(prev cpuTimes) float64 {
+	if t.Total <= prev.Total {
+		return 0
+	}
+	total := float64(t.Total - prev.Total)
+	idle := float64(t.Idle - prev.Idle)
+	if t.Idle < prev.Idle {
+		idle = 0
+	}
+	return (total - idle) / total * 100
+}
+
+// cpuSampler measures CPU usage as the delta between successive reads of
+// /proc/stat.
+type cpuSampler struct {
+	mu     sync.Mutex
+	prev   cpuTimes
+	prevAt time.Time
+	usage  float64
+}
+
+func (c *cpuSampler) sample() (float64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.prevAt.IsZero() && time.Since(c.prevAt) < minCPUInterval {
+		return c.usage, nil
+	}
+
+	if c.prevAt.IsZero() {
+		// Nothing to compare with yet
+		times, err := readCPUStat()
+		if err != nil {
+			return 0, err
+		}
+		c.prev, c.prevAt = times, time.Now()
+		time.Sleep(minCPUInterval)
+	}
+
+	times, err := readCPUStat()
+	if err != nil {
+		return 0, err
+	}
+	c.usage = times.usageSince(c.prev)
+	c.prev, c.prevAt = times, time.Now()
+	return c.usage, nil
+}
+
+func readCPUStat() (cpuTimes, error) {
+	f, err := os.Open(procPath + "/stat")
+	if err != nil {
+		return cpuTimes{}, err
+	}
+	defer f.Close()
+	return parseCPUStat(f)
+}
+
+// memInfo holds the /proc/meminfo values used for memory usage, in bytes.
+type memInfo struct {
+	Total     uint64
+	Available uint64
+}
+
+// parseMeminfo reads /proc/meminfo. Kernels before 3.14 have no
+// MemAvailable; it is then estimated from free memory and caches.
+func parseMeminfo(r io.Reader) (memInfo, error) {
+	values := make(map[string]uint64)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// "MemTotal:       16314264 kB"
+		name, rest, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			return memInfo{}, fmt.Errorf("invalid %s value %q: %v", name, fields[0], err)
+		}
+		if len(fields) > 1 && fields[1] == "kB" {
+			value *= 1024
+		}
+		values[name] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return memInfo{}, err
+	}
+
+	info := memInfo{Total: values["MemTotal"]}
+	if info.Total == 0 {
+		return memInfo{}, fmt.Errorf("no MemTotal in meminfo")
+	}
+	if available, ok := values["MemAvailable"]; ok {
+		info.Available = available
+	} else {
+		info.Available = values["MemFree"] + values["Buffers"] + values["Cached"]
+	}
+	if info.Available > info.Total {
+		info.Available = info.Total
+	}
+	return info, nil
+}
+
+// usage returns the percentage of memory in use.
+func (m memInfo) usage() float64 {
+	return float64(m.Total-m.Available) / float64(m.Total) * 100
+}
+
+func readMeminfo() (memInfo, error) {
+	f, err := os.Open(procPath + "/meminfo")
+	if err != nil {
+		return memInfo{}, err
+	}
+	defer f.Close()
+	return parseMeminfo(f)
+}
+
+// netDevStats are the cumulative counters of one interface in
+// /proc/net/dev.
+type netDevStats struct {
+	Name      string
+	RxBytes   uint64
+	RxPackets uint64
+	RxErrors  uint64
+	RxDropped uint64
+	TxBytes   uint64
+	TxPackets uint64
+	TxErrors  uint64
+	TxDropped uint64
+}
+
+// parseNetDev reads the per-interface counters of /proc/net/dev.
+func parseNetDev(r io.Reader) ([]netDevStats, error) {
+	var stats []netDevStats
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// "  eth0: 1234 56 0 0 0 0 0 0 7890 12 0 0 0 0 0 0"; the two header
+		// lines have no colon before the counters
+		name, rest, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(rest)
+		if len(fields) < 16 {
+			continue
+		}
+
+		var values [16]uint64
+		for i := range values {
+			value, err := strconv.ParseUint(fields[i], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid counter %q for %s: %v", fields[i], strings.TrimSpace(name), err)
+			}
+			values[i] = value
+		}
+		stats = append(stats, netDevStats{
+			Name:      strings.TrimSpace(name),
+			RxBytes:   values[0],
+			RxPackets: values[1],
+			RxErrors:  values[2],
+			RxDropped: values[3],
+			TxBytes:   values[8],
+			TxPackets: values[9],
+			TxErrors:  values[10],
+			TxDropped: values[11],
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func readNetDev() ([]netDevStats, error) {
+	f, err := os.Open(procPath + "/net/dev")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseNetDev(f)
+}
+
+// mountEntry is a line of /proc/self/mounts.
+type mountEntry struct {
+	Device     string
+	MountPoint string
+	FSType     string
+}
+
+// mountEscaper undoes the octal escapes the kernel uses in mount paths.
+var mountEscaper = strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`)
+
+// parseMounts reads the mount table in /proc/self/mounts format.
+func parseMounts(r io.Reader) ([]mountEntry, error) {
+	var mounts []mountEntry
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		mounts = append(mounts, mountEntry{
+			Device:     mountEscaper.Replace(fields[0]),
+			MountPoint: mountEscaper.Replace(fields[1]),
+			FSType:     fields[2],
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return mounts, nil
+}
+
+func readMounts() ([]mountEntry, error) {
+	f, err := os.Open(procPath + "/self/mounts")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseMounts(f)
+}
+
+// diskIOStats are the cumulative counters of one block device in
+// /proc/diskstats.
+type diskIOStats struct {
+	Major        uint32
+	Minor        uint32
+	Name         string
+	Reads        uint64
+	ReadSectors  uint64
+	Writes       uint64
+	WriteSectors uint64
+	// IOTime is the time the device was busy, in milliseconds
+	IOTime uint64
+}
+
+// sectorSize is the unit of the sector counts in /proc/diskstats,
+// whatever the device's actual sector size.
+const sectorSize = 512
+
+// parseDiskstats reads the per-device counters of /proc/diskstats.
+func parseDiskstats(r io.Reader) ([]diskIOStats, error) {
+	var stats []diskIOStats
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// major minor name reads merged sectors ms writes merged sectors ms
+		// in-flight io-ms weighted-ms, followed by discard and flush
+		// counters on newer kernels
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 14 {
+			continue
+		}
+
+		var values [14]uint64
+		for i := range values {
+			if i == 2 {
+				continue
+			}
+			value, err := strconv.ParseUint(fields[i], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid counter %q for %s: %v", fields[i], fields[2], err)
+			}
+			values[i] = value
+		}
+		stats = append(stats, diskIOStats{
+			Major:        uint32(values[0]),
+			Minor:        uint32(values[1]),
+			Name:         fields[2],
+			Reads:        values[3],
+			ReadSectors:  values[5],
+			Writes:       values[7],
+			WriteSectors: values[9],
+			IOTime:       values[12],
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func readDiskstats() ([]diskIOStats, error) {
+	f, err := os.Open(procPath + "/diskstats")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseDiskstats(f)
+}
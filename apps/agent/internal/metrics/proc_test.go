@@ -0,0 +1,184 @@
+package metrics
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func openTestdata(t *testing.T, name string) *os.File {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestParseCPUStat(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  cpuTimes
+	}{
+		{
+			name:  "capture",
+			input: "stat",
+			// user nice system idle iowait irq softirq steal; guest is in user
+			want: cpuTimes{Idle: 541662 + 9861, Total: 106273 + 6 + 21000 + 541662 + 9861 + 0 + 23 + 3370},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCPUStat(openTestdata(t, tt.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	// Kernels before 2.6.11 only have the first four counters
+	got, err := parseCPUStat(strings.NewReader("cpu  100 0 50 850\ncpu0 100 0 50 850\n"))
+	if err != nil || got != (cpuTimes{Idle: 850, Total: 1000}) {
+		t.Errorf("short cpu line: %+v, %v", got, err)
+	}
+	if _, err := parseCPUStat(strings.NewReader("intr 1 2 3\n")); err == nil {
+		t.Error("stat without a cpu line was accepted")
+	}
+	if usage := (cpuTimes{Idle: 150, Total: 300}).usageSince(cpuTimes{Idle: 100, Total: 100}); usage != 75 {
+		t.Errorf("usageSince = %v, want 75", usage)
+	}
+}
+
+func TestParseMeminfo(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  memInfo
+	}{
+		{
+			name:  "capture",
+			input: "meminfo",
+			want:  memInfo{Total: 6147400 * 1024, Available: 5474944 * 1024},
+		},
+		{
+			// Kernels before 3.14 estimate from MemFree, Buffers and Cached
+			name:  "no MemAvailable",
+			input: "meminfo_no_available",
+			want:  memInfo{Total: 3922956 * 1024, Available: (242140 + 187628 + 2295668) * 1024},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseMeminfo(openTestdata(t, tt.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := parseMeminfo(strings.NewReader("MemFree: 10 kB\n")); err == nil {
+		t.Error("meminfo without MemTotal was accepted")
+	}
+}
+
+func TestParseNetDev(t *testing.T) {
+	stats, err := parseNetDev(openTestdata(t, "net_dev"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]netDevStats{
+		"lo":   {Name: "lo", RxBytes: 194842702, RxPackets: 25243, TxBytes: 194842702, TxPackets: 25243},
+		"ifb0": {Name: "ifb0"},
+		"ifb1": {Name: "ifb1"},
+		"eth0": {Name: "eth0", RxBytes: 64381094, RxPackets: 3147, TxBytes: 333249, TxPackets: 3157},
+	}
+	if len(stats) != len(want) {
+		t.Fatalf("got %d interfaces, want %d: %+v", len(stats), len(want), stats)
+	}
+	for _, stat := range stats {
+		if stat != want[stat.Name] {
+			t.Errorf("got %+v, want %+v", stat, want[stat.Name])
+		}
+	}
+}
+
+func TestParseMounts(t *testing.T) {
+	mounts, err := parseMounts(openTestdata(t, "mounts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, mount := range mounts {
+		if mount.MountPoint == "/" {
+			found = true
+			if mount != (mountEntry{Device: "/dev/vda", MountPoint: "/", FSType: "ext4"}) {
+				t.Errorf("root mount: %+v", mount)
+			}
+		}
+	}
+	if !found {
+		t.Error("root mount missing")
+	}
+
+	// The kernel escapes blanks and backslashes in paths
+	mounts, err = parseMounts(strings.NewReader(`/dev/sdb1 /mnt/backup\040disk\134x ext4 rw 0 0` + "\n"))
+	if err != nil || len(mounts) != 1 || mounts[0].MountPoint != `/mnt/backup disk\x` {
+		t.Errorf("escaped mount point: %+v, %v", mounts, err)
+	}
+}
+
+func TestParseDiskstats(t *testing.T) {
+	sda := diskIOStats{Major: 8, Minor: 0, Name: "sda", Reads: 112131, ReadSectors: 2675778, Writes: 46792, WriteSectors: 7155296, IOTime: 109752}
+	tests := []struct {
+		name  string
+		input string
+		count int
+		want  diskIOStats
+	}{
+		{
+			// Kernels since 5.5 add flush counters
+			name:  "capture with discard and flush",
+			input: "diskstats",
+			count: 11,
+			want:  diskIOStats{Major: 254, Minor: 0, Name: "vda", Reads: 112131, ReadSectors: 2675778, Writes: 46792, WriteSectors: 7155296, IOTime: 109752},
+		},
+		{
+			name:  "discard without flush",
+			input: "diskstats_discard",
+			count: 2,
+			want:  sda,
+		},
+		{
+			name:  "without discard and flush",
+			input: "diskstats_legacy",
+			count: 3,
+			want:  sda,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats, err := parseDiskstats(openTestdata(t, tt.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(stats) != tt.count {
+				t.Errorf("got %d devices, want %d", len(stats), tt.count)
+			}
+			for _, stat := range stats {
+				if stat.Name == tt.want.Name && stat != tt.want {
+					t.Errorf("got %+v, want %+v", stat, tt.want)
+				}
+			}
+		})
+	}
+}
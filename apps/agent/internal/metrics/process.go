@@ -0,0 +1,466 @@
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clockTicks is USER_HZ, the unit of the CPU times in /proc/<pid>/stat. It
+// is 100 on every architecture Linux runs services on.
+const clockTicks = 100
+
+// procStat holds the fields of /proc/<pid>/stat the agent uses.
+type procStat struct {
+	Comm    string
+	State   string
+	PPID    int
+	UTime   uint64
+	STime   uint64
+	Threads int
+	// StartTime tells a process from a later one with the same PID
+	StartTime uint64
+	// RSS is in pages
+	RSS uint64
+}
+
+// parseProcStat reads /proc/<pid>/stat. The command name is in parentheses
+// and may itself contain spaces and parentheses, so fields are counted from
+// the last closing one.
+func parseProcStat(data []byte) (procStat, error) {
+	open := bytes.IndexByte(data, '(')
+	end := bytes.LastIndexByte(data, ')')
+	if open < 0 || end < open {
+		return procStat{}, fmt.Errorf("malformed stat")
+	}
+	fields := strings.Fields(string(data[end+1:]))
+	// fields[0] is field 3 (state) of proc(5)
+	if len(fields) < 22 {
+		return procStat{}, fmt.Errorf("malformed stat: %d fields", len(fields)+2)
+	}
+
+	var values [22]uint64
+	for _, i := range []int{1, 11, 12, 17, 19, 21} {
+		value, err := strconv.ParseUint(fields[i], 10, 64)
+		if err != nil {
+			return procStat{}, fmt.Errorf("invalid stat field %d %q: %v", i+3, fields[i], err)
+		}
+		values[i] = value
+	}
+	return procStat{
+		Comm:      string(data[open+1 : end]),
+		State:     fields[0],
+		PPID:      int(values[1]),
+		UTime:     values[11],
+		STime:     values[12],
+		Threads:   int(values[17]),
+		StartTime: values[19],
+		RSS:       values[21],
+	}, nil
+}
+
+// procIO holds the storage I/O of /proc/<pid>/io, in bytes.
+type procIO struct {
+	ReadBytes  uint64
+	WriteBytes uint64
+}
+
+// parseProcIO reads /proc/<pid>/io. read_bytes and write_bytes count what
+// reached storage, unlike rchar and wchar which include the page cache and
+// sockets.
+func parseProcIO(r io.Reader) (procIO, error) {
+	var result procIO
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		var target *uint64
+		switch name {
+		case "read_bytes":
+			target = &result.ReadBytes
+		case "write_bytes":
+			target = &result.WriteBytes
+		default:
+			continue
+		}
+		parsed, err := strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			return procIO{}, fmt.Errorf("invalid %s %q: %v", name, value, err)
+		}
+		*target = parsed
+	}
+	return result, scanner.Err()
+}
+
+// ProcessMetrics are the resource use of one process. Rates are measured
+// between samples.
+type ProcessMetrics struct {
+	PID     int
+	Name    string
+	Command string
+	// CPUUsage is in percent of one core, so a busy process with several
+	// threads can exceed 100.
+	CPUUsage float64
+	// MemoryUsage is the resident set in percent of physical memory.
+	MemoryUsage float64
+	RSSBytes    uint64
+	OpenFDs     int
+	Threads     int
+	// ReadBytes and WriteBytes are the storage I/O since the process
+	// started. They need the agent to run as root for other users'
+	// processes.
+	ReadBytes           uint64
+	WriteBytes          uint64
+	ReadBytesPerSecond  float64
+	WriteBytesPerSecond float64
+
+	cwd string
+}
+
+// processSample is a reading of a process's counters.
+type processSample struct {
+	at        time.Time
+	startTime uint64
+	cpuTicks  uint64
+	io        procIO
+	// rates computed when the sample was taken
+	cpuUsage  float64
+	readRate  float64
+	writeRate float64
+}
+
+// processSampler measures process CPU and I/O rates between calls, like
+// cpuSampler, keeping the last sample of every process seen.
+type processSampler struct {
+	mu   sync.Mutex
+	prev map[int]processSample
+}
+
+func readProcessStat(pid int) (procStat, error) {
+	data, err := os.ReadFile(filepath.Join(procPath, strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return procStat{}, err
+	}
+	return parseProcStat(data)
+}
+
+// readProcess reads the metrics of a process apart from its rates.
+func readProcess(pid int, stat procStat) (ProcessMetrics, procIO) {
+	dir := filepath.Join(procPath, strconv.Itoa(pid))
+	process := ProcessMetrics{
+		PID:      pid,
+		Name:     stat.Comm,
+		RSSBytes: stat.RSS * uint64(os.Getpagesize()),
+		Threads:  stat.Threads,
+	}
+	if cmdline, err := os.ReadFile(filepath.Join(dir, "cmdline")); err == nil {
+		process.Command = strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " "))
+	}
+	if fds, err := os.ReadDir(filepath.Join(dir, "fd")); err == nil {
+		process.OpenFDs = len(fds)
+	}
+	process.cwd, _ = os.Readlink(filepath.Join(dir, "cwd"))
+
+	var counters procIO
+	if f, err := os.Open(filepath.Join(dir, "io")); err == nil {
+		counters, _ = parseProcIO(f)
+		f.Close()
+	}
+	process.ReadBytes = counters.ReadBytes
+	process.WriteBytes = counters.WriteBytes
+	return process, counters
+}
+
+// sample reads the given processes, or every process when pids is nil.
+// When keep is set, only processes whose command name it accepts are read
+// beyond their stat file. Processes that exit while being read are left
+// out.
+func (p *processSampler) sample(pids []int, keep func(name string) bool) ([]ProcessMetrics, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if pids == nil {
+		var err error
+		if pids, err = listPIDs(); err != nil {
+			return nil, err
+		}
+	}
+	if p.prev == nil {
+		p.prev = make(map[int]processSample)
+	}
+
+	processes, samples := p.read(pids, keep)
+
+	// Processes seen for the first time need a second reading for rates
+	fresh := make(map[int]bool)
+	var freshPIDs []int
+	for i, process := range processes {
+		if prev, ok := p.prev[process.PID]; !ok || prev.startTime != samples[i].startTime {
+			fresh[process.PID] = true
+			freshPIDs = append(freshPIDs, process.PID)
+			p.prev[process.PID] = samples[i]
+		}
+	}
+	if len(freshPIDs) > 0 {
+		time.Sleep(minCPUInterval)
+		reread, rereadSamples := p.read(freshPIDs, keep)
+		index := make(map[int]int, len(reread))
+		for i, process := range reread {
+			index[process.PID] = i
+		}
+
+		n := 0
+		for i, process := range processes {
+			if fresh[process.PID] {
+				j, ok := index[process.PID]
+				if !ok {
+					// Exited in the meantime
+					continue
+				}
+				processes[i], samples[i] = reread[j], rereadSamples[j]
+			}
+			processes[n], samples[n] = processes[i], samples[i]
+			n++
+		}
+		processes, samples = processes[:n], samples[:n]
+	}
+
+	for i := range processes {
+		process := &processes[i]
+		sample := samples[i]
+		prev, ok := p.prev[process.PID]
+		switch {
+		case ok && prev.startTime == sample.startTime && sample.at.Sub(prev.at) < minCPUInterval:
+			// Read again too soon to measure; report the previous rates
+			sample = prev
+		case ok && prev.startTime == sample.startTime:
+			elapsed := sample.at.Sub(prev.at).Seconds()
+			sample.cpuUsage = counterRate(prev.cpuTicks, sample.cpuTicks, elapsed) / clockTicks * 100
+			sample.readRate = counterRate(prev.io.ReadBytes, sample.io.ReadBytes, elapsed)
+			sample.writeRate = counterRate(prev.io.WriteBytes, sample.io.WriteBytes, elapsed)
+			p.prev[process.PID] = sample
+		default:
+			p.prev[process.PID] = sample
+		}
+		process.CPUUsage = sample.cpuUsage
+		process.ReadBytesPerSecond = sample.readRate
+		process.WriteBytesPerSecond = sample.writeRate
+	}
+
+	// Forget processes not seen for a while
+	for pid, prev := range p.prev {
+		if time.Since(prev.at) > 10*time.Minute {
+			delete(p.prev, pid)
+		}
+	}
+	return processes, nil
+}
+
+func (p *processSampler) read(pids []int, keep func(name string) bool) ([]ProcessMetrics, []processSample) {
+	var processes []ProcessMetrics
+	var samples []processSample
+	for _, pid := range pids {
+		stat, err := readProcessStat(pid)
+		if err != nil || (keep != nil && !keep(stat.Comm)) {
+			continue
+		}
+		process, counters := readProcess(pid, stat)
+		processes = append(processes, process)
+		samples = append(samples, processSample{
+			at:        time.Now(),
+			startTime: stat.StartTime,
+			cpuTicks:  stat.UTime + stat.STime,
+			io:        counters,
+		})
+	}
+	return processes, samples
+}
+
+func listPIDs() ([]int, error) {
+	entries, err := os.ReadDir(procPath)
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, entry := range entries {
+		if pid, err := strconv.Atoi(entry.Name()); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+// withMemoryUsage sets MemoryUsage relative to the physical memory.
+func withMemoryUsage(processes []ProcessMetrics) {
+	info, err := readMeminfo()
+	if err != nil {
+		return
+	}
+	for i := range processes {
+		processes[i].MemoryUsage = float64(processes[i].RSSBytes) / float64(info.Total) * 100
+	}
+}
+
+func (s Service) GetProcessMetrics(pid int) (*ProcessMetrics, error) {
+	processes, err := s.processes.sample([]int{pid}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read process %d: %v", pid, err)
+	}
+	if len(processes) == 0 {
+		return nil, fmt.Errorf("process %d not found", pid)
+	}
+	withMemoryUsage(processes)
+	return &processes[0], nil
+}
+
+// ServiceMetrics are the summed resource use of the processes of a managed
+// service.
+type ServiceMetrics struct {
+	// Service is nginx, php-fpm, mysql, postgresql, redis, mongodb or node.
+	Service string
+	// Instance tells apart several of a service: the PHP-FPM pool, or the
+	// site a Node process serves. Empty for the others.
+	Instance            string
+	CPUUsage            float64
+	MemoryUsage         float64
+	RSSBytes            uint64
+	OpenFDs             int
+	Threads             int
+	ReadBytes           uint64
+	WriteBytes          uint64
+	ReadBytesPerSecond  float64
+	WriteBytesPerSecond float64
+	PIDs                []int
+	// Processes holds the metrics of each process when requested
+	Processes []ProcessMetrics
+}
+
+// GetServiceMetrics accounts the running processes to the services the
+// agent manages. siteRoots maps site domains to their document roots, so
+// that Node processes are accounted to the site they run in. The process
+// details are included when withProcesses is set.
+func (s Service) GetServiceMetrics(siteRoots map[string]string, withProcesses bool) ([]ServiceMetrics, error) {
+	processes, err := s.processes.sample(nil, isManagedProcess)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read processes: %v", err)
+	}
+	withMemoryUsage(processes)
+
+	services := make(map[[2]string]*ServiceMetrics)
+	for _, process := range processes {
+		service, instance, ok := classifyProcess(process, siteRoots)
+		if !ok {
+			continue
+		}
+		key := [2]string{service, instance}
+		metrics, ok := services[key]
+		if !ok {
+			metrics = &ServiceMetrics{Service: service, Instance: instance}
+			services[key] = metrics
+		}
+		metrics.CPUUsage += process.CPUUsage
+		metrics.MemoryUsage += process.MemoryUsage
+		metrics.RSSBytes += process.RSSBytes
+		metrics.OpenFDs += process.OpenFDs
+		metrics.Threads += process.Threads
+		metrics.ReadBytes += process.ReadBytes
+		metrics.WriteBytes += process.WriteBytes
+		metrics.ReadBytesPerSecond += process.ReadBytesPerSecond
+		metrics.WriteBytesPerSecond += process.WriteBytesPerSecond
+		metrics.PIDs = append(metrics.PIDs, process.PID)
+		if withProcesses {
+			metrics.Processes = append(metrics.Processes, process)
+		}
+	}
+
+	result := make([]ServiceMetrics, 0, len(services))
+	for _, metrics := range services {
+		result = append(result, *metrics)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Service != result[j].Service {
+			return result[i].Service < result[j].Service
+		}
+		return result[i].Instance < result[j].Instance
+	})
+	return result, nil
+}
+
+// classifyProcess returns the managed service a process belongs to.
+func classifyProcess(process ProcessMetrics, siteRoots map[string]string) (string, string, bool) {
+	service, ok := processService(process.Name)
+	switch {
+	case !ok:
+		return "", "", false
+	case service == "php-fpm":
+		return service, phpFPMPool(process.Command), true
+	case service == "node":
+		return service, nodeSite(process.cwd, siteRoots), true
+	}
+	return service, "", true
+}
+
+// processService returns the managed service a process belongs to by its
+// command name alone.
+func processService(name string) (string, bool) {
+	switch {
+	case name == "nginx":
+		return "nginx", true
+	case strings.HasPrefix(name, "php-fpm"):
+		return "php-fpm", true
+	case name == "mysqld" || name == "mariadbd":
+		return "mysql", true
+	case name == "postgres" || name == "postmaster":
+		return "postgresql", true
+	case name == "redis-server":
+		return "redis", true
+	case name == "mongod":
+		return "mongodb", true
+	case name == "node" || strings.HasPrefix(name, "node "):
+		return "node", true
+	}
+	return "", false
+}
+
+func isManagedProcess(name string) bool {
+	_, ok := processService(name)
+	return ok
+}
+
+// phpFPMPool returns the pool of a PHP-FPM worker from its title, e.g.
+// "php-fpm: pool www", or "master" for the master process.
+func phpFPMPool(command string) string {
+	if _, pool, ok := strings.Cut(command, "pool "); ok {
+		return strings.TrimSpace(pool)
+	}
+	if strings.Contains(command, "master process") {
+		return "master"
+	}
+	return ""
+}
+
+// nodeSite returns the domain of the site whose document root holds cwd,
+// or cwd itself for Node processes outside every site.
+func nodeSite(cwd string, siteRoots map[string]string) string {
+	best, bestRoot := "", ""
+	for domain, root := range siteRoots {
+		root = filepath.Clean(root)
+		if pathWithin(cwd, root) && len(root) > len(bestRoot) {
+			best, bestRoot = domain, root
+		}
+	}
+	if best == "" {
+		return cwd
+	}
+	return best
+}
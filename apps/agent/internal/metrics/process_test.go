@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseProcStat(t *testing.T) {
+	capture, err := os.ReadFile(filepath.Join("testdata", "pid_stat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		input   string
+		want    procStat
+		wantErr bool
+	}{
+		{
+			// The command name itself contains ") ("
+			name:  "capture",
+			input: string(capture),
+			want:  procStat{Comm: "x) (y z", State: "S", PPID: 10530, UTime: 0, STime: 0, Threads: 1, StartTime: 681328, RSS: 358},
+		},
+		{
+			name:  "plain name",
+			input: "42 (nginx) R 1 42 42 0 -1 4194560 1000 0 0 0 150 50 0 0 20 0 3 0 98765 300000000 2048 18446744073709551615",
+			want:  procStat{Comm: "nginx", State: "R", PPID: 1, UTime: 150, STime: 50, Threads: 3, StartTime: 98765, RSS: 2048},
+		},
+		{
+			name:    "truncated",
+			input:   "42 (nginx) R 1 42",
+			wantErr: true,
+		},
+		{
+			name:    "no command name",
+			input:   "42 nginx R 1",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseProcStat([]byte(tt.input))
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("accepted %q", tt.input)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseProcIO(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "pid_io"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	got, err := parseProcIO(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (procIO{ReadBytes: 4198400, WriteBytes: 4222976}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	if _, err := parseProcIO(strings.NewReader("read_bytes: lots\n")); err == nil {
+		t.Error("invalid counter was accepted")
+	}
+}
@@ -1,31 +1,100 @@
 package metrics
 
 import (
-	"context"
 	"fmt"
-	"os"
-	"os/exec"
-	"runtime"
-	"strconv"
-	"strings"
+	"regexp"
+	"sync"
 	"time"
 )
 
 type Service struct {
 	startTime time.Time
+	tasks     *taskList
+	cpu       *cpuSampler
+	agent     *agentMetrics
+	history   *history
+	live      *liveFeed
+	disk      *ioSampler
+	paths     *pathList
+	network   *netSampler
+	processes *processSampler
+
+	interfaceExclude *regexp.Regexp
+}
+
+type Config struct {
+	// InterfaceExclude is a regular expression matching the names of
+	// network interfaces to leave out, DefaultInterfaceExclude when empty.
+	InterfaceExclude string
+}
+
+// taskList holds work that piggybacks on the collection loop, such as
+// database quota enforcement.
+type taskList struct {
+	mu    sync.Mutex
+	names []string
+	funcs []func() error
 }
 
 type SystemMetrics struct {
 	CPUUsage    float64
 	MemoryUsage float64
 	DiskUsage   float64
-	Bandwidth   int64
-	Uptime      int64
+	// Bandwidth is the current traffic in bytes per second, received and
+	// sent
+	Bandwidth int64
+	Uptime    int64
 }
 
-func NewService() Service {
+func NewService(config Config) Service {
+	pattern := config.InterfaceExclude
+	if pattern == "" {
+		pattern = DefaultInterfaceExclude
+	}
+	interfaceExclude, err := regexp.Compile(pattern)
+	if err != nil {
+		fmt.Printf("Error parsing interface exclude pattern, using the default: %v\n", err)
+		interfaceExclude = regexp.MustCompile(DefaultInterfaceExclude)
+	}
+
 	return Service{
 		startTime: time.Now(),
+		tasks:     &taskList{},
+		cpu:       &cpuSampler{},
+		agent:     newAgentMetrics(),
+		history:   newHistory(),
+		live:      newLiveFeed(),
+		disk:      &ioSampler{},
+		paths:     &pathList{},
+		network:   &netSampler{},
+		processes: &processSampler{},
+
+		interfaceExclude: interfaceExclude,
+	}
+}
+
+// AddTask registers fn to run after every metrics collection.
+func (s Service) AddTask(name string, fn func() error) {
+	s.tasks.mu.Lock()
+	defer s.tasks.mu.Unlock()
+
+	s.tasks.names = append(s.tasks.names, name)
+	s.tasks.funcs = append(s.tasks.funcs, fn)
+}
+
+func (s Service) runTasks() {
+	s.tasks.mu.Lock()
+	names := append([]string(nil), s.tasks.names...)
+	funcs := append([]func() error(nil), s.tasks.funcs...)
+	s.tasks.mu.Unlock()
+
+	for i, fn := range funcs {
+		start := time.Now()
+		err := fn()
+		s.ObserveJob(names[i], time.Since(start), err != nil)
+		if err != nil {
+			fmt.Printf("Error running %s: %v\n", names[i], err)
+		}
 	}
 }
 
@@ -62,112 +131,91 @@ func (s Service) GetSystemMetrics() (*SystemMetrics, error) {
 }
 
 func (s Service) getCPUUsage() (float64, error) {
-	// This is a simplified implementation
-	// In a real implementation, you would use more sophisticated methods
-	cmd := exec.Command("sh", "-c", "top -bn1 | grep 'Cpu(s)' | awk '{print $2}' | awk -F'%' '{print $1}'")
-	output, err := cmd.Output()
-	if err != nil {
-		// Fallback to a simple calculation
-		return float64(runtime.NumCPU()), nil
-	}
-
-	usage, err := strconv.ParseFloat(strings.TrimSpace(string(output)), 64)
-	if err != nil {
-		return 0, err
-	}
-
-	return usage, nil
+	return s.cpu.sample()
 }
 
 func (s Service) getMemoryUsage() (float64, error) {
-	// This is a simplified implementation
-	// In a real implementation, you would parse /proc/meminfo
-	cmd := exec.Command("sh", "-c", "free | grep Mem | awk '{printf \"%.2f\", $3/$2 * 100.0}'")
-	output, err := cmd.Output()
-	if err != nil {
-		// Fallback to a simple calculation
-		var m runtime.MemStats
-		runtime.ReadMemStats(&m)
-		return float64(m.Alloc) / 1024 / 1024, nil
-	}
-
-	usage, err := strconv.ParseFloat(strings.TrimSpace(string(output)), 64)
+	info, err := readMeminfo()
 	if err != nil {
 		return 0, err
 	}
-
-	return usage, nil
+	return info.usage(), nil
 }
 
 func (s Service) getDiskUsage() (float64, error) {
-	// This is a simplified implementation
-	// In a real implementation, you would use syscall.Statfs
-	cmd := exec.Command("sh", "-c", "df -h / | awk 'NR==2{print $5}' | sed 's/%//'")
-	output, err := cmd.Output()
+	stats, err := statfs("/")
 	if err != nil {
 		return 0, err
 	}
-
-	usage, err := strconv.ParseFloat(strings.TrimSpace(string(output)), 64)
-	if err != nil {
-		return 0, err
-	}
-
-	return usage, nil
+	return stats.usage(), nil
 }
 
+// getBandwidth returns the bytes per second received and sent by the
+// interfaces not excluded by Config.InterfaceExclude.
 func (s Service) getBandwidth() (int64, error) {
-	// This is a simplified implementation
-	// In a real implementation, you would read from /proc/net/dev
-	cmd := exec.Command("sh", "-c", "cat /proc/net/dev | grep eth0 | awk '{print $2+$10}'")
-	output, err := cmd.Output()
-	if err != nil {
-		return 0, nil
-	}
-
-	bandwidth, err := strconv.ParseInt(strings.TrimSpace(string(output)), 10, 64)
+	rates, err := s.network.sample(s.interfaceExclude)
 	if err != nil {
 		return 0, err
 	}
 
-	return bandwidth, nil
+	var total float64
+	for _, iface := range rates {
+		total += iface.RxBytes + iface.TxBytes
+	}
+	return int64(total), nil
 }
 
 func (s Service) Start() {
-	// Start metrics collection in background
+	// Start metrics collection in background. Samples are recorded and
+	// tasks run every 30 seconds; live subscribers may have the loop
+	// sample more often in between.
 	go func() {
-		ticker := time.NewTicker(30 * time.Second)
-		defer ticker.Stop()
+		lastCollected := time.Now()
+		lastRecorded := lastCollected
 
 		for {
+			next := lastCollected.Add(s.live.interval(historyResolution))
+			if recordAt := lastRecorded.Add(historyResolution); recordAt.Before(next) {
+				next = recordAt
+			}
+
+			timer := time.NewTimer(time.Until(next))
 			select {
-			case <-ticker.C:
-				metrics, err := s.GetSystemMetrics()
-				if err != nil {
-					fmt.Printf("Error collecting metrics: %v\n", err)
-					continue
-				}
-
-				// In a real implementation, you would send metrics to the control plane
-				fmt.Printf("Metrics: CPU=%.2f%%, Memory=%.2f%%, Disk=%.2f%%, Bandwidth=%d, Uptime=%d\n",
-					metrics.CPUUsage, metrics.MemoryUsage, metrics.DiskUsage, metrics.Bandwidth, metrics.Uptime)
+			case <-timer.C:
+			case <-s.live.changed:
+				// A faster subscriber joined
+				timer.Stop()
+				continue
 			}
-		}
-	}()
-}
 
-func (s Service) GetProcessMetrics(pid int) (*ProcessMetrics, error) {
-	// This would get metrics for a specific process
-	// For now, return a placeholder
-	return &ProcessMetrics{
-		PID:         pid,
-		CPUUsage:    0,
-		MemoryUsage: 0,
-	}, nil
-}
+			now := time.Now()
+			lastCollected = now
+			record := !now.Before(lastRecorded.Add(historyResolution))
+			if record {
+				lastRecorded = now
+			}
 
-type ProcessMetrics struct {
-	PID         int
-	CPUUsage    float64
-	MemoryUsage float64
+			metrics, err := s.GetSystemMetrics()
+			if err != nil {
+				fmt.Printf("Error collecting metrics: %v\n", err)
+				continue
+			}
+
+			sample := MetricsSample{
+				Time:        now,
+				CPUUsage:    metrics.CPUUsage,
+				MemoryUsage: metrics.MemoryUsage,
+				DiskUsage:   metrics.DiskUsage,
+				Bandwidth:   metrics.Bandwidth,
+			}
+			s.live.publish(sample)
+
+			if record {
+				// Kept for QueryMetrics, so the control plane can backfill
+				// polls it missed
+				s.history.add(sample)
+				s.runTasks()
+			}
+		}
+	}()
 }
@@ -0,0 +1,31 @@
+package metrics
+
+import "syscall"
+
+func statfs(path string) (diskStats, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return diskStats{}, err
+	}
+	size := uint64(st.Bsize)
+	return diskStats{
+		Total:      st.Blocks * size,
+		Used:       (st.Blocks - st.Bfree) * size,
+		Available:  st.Bavail * size,
+		Inodes:     st.Files,
+		InodesFree: st.Ffree,
+	}, nil
+}
+
+// deviceNumber returns the major and minor number of the device holding
+// path, as listed in /proc/diskstats.
+func deviceNumber(path string) (uint32, uint32, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return 0, 0, err
+	}
+	dev := uint64(st.Dev)
+	major := uint32((dev>>8)&0xfff | (dev>>32)&^0xfff)
+	minor := uint32(dev&0xff | (dev>>12)&^0xff)
+	return major, minor, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package metrics
+
+import "fmt"
+
+// statfs is only supported on Linux.
+func statfs(path string) (diskStats, error) {
+	return diskStats{}, fmt.Errorf("disk usage is not supported on this platform")
+}
+
+func deviceNumber(path string) (uint32, uint32, error) {
+	return 0, 0, fmt.Errorf("device numbers are not supported on this platform")
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package nginx
+
+import "os"
+
+// fileID is only supported on Linux. Elsewhere a rotated log cannot be told
+// from its successor, and only logs truncated in place are detected.
+func fileID(info os.FileInfo) (uint64, uint64) {
+	return 0, 0
+}
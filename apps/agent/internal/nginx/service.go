@@ -1,10 +1,13 @@
 package nginx
 
 import (
+	"bufio"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+	"sync"
 	"text/template"
 )
 
@@ -12,12 +15,25 @@ type Service struct {
 	configPath    string
 	sitesPath     string
 	reloadCommand string
+	logPath       string
+	observer      *reloadObserver
+	traffic       *trafficStore
+}
+
+// reloadObserver is told about every reload attempt; see ObserveReloads.
+type reloadObserver struct {
+	mu sync.RWMutex
+	fn func(err error)
 }
 
 type Config struct {
 	ConfigPath    string
 	SitesPath     string
 	ReloadCommand string
+	LogPath       string
+	// TrafficStatePath persists the totals and read offsets of site access
+	// logs.
+	TrafficStatePath string
 }
 
 type SiteConfig struct {
@@ -28,6 +44,7 @@ type SiteConfig struct {
 	SSLEnabled  bool
 	SSLCert     string
 	SSLKey      string
+	AccessLog   string
 }
 
 func NewService(config Config) Service {
@@ -35,6 +52,9 @@ func NewService(config Config) Service {
 		configPath:    config.ConfigPath,
 		sitesPath:     config.SitesPath,
 		reloadCommand: config.ReloadCommand,
+		logPath:       config.LogPath,
+		observer:      &reloadObserver{},
+		traffic:       newTrafficStore(config.TrafficStatePath),
 	}
 }
 
@@ -137,6 +157,7 @@ func (s Service) writeNginxConfig(path string, config SiteConfig) error {
     server_name {{.Domain}};
     root {{.DocumentRoot}};
     index index.html index.php;
+    access_log {{.AccessLog}} ` + accessLogFormat + `;
 
     location / {
         try_files $uri $uri/ =404;
@@ -158,6 +179,14 @@ func (s Service) writeNginxConfig(path string, config SiteConfig) error {
     {{end}}
 }`
 
+	// Every site logs to its own file for traffic accounting
+	if config.AccessLog == "" {
+		config.AccessLog = filepath.Join(s.logPath, config.Domain+".access.json")
+	}
+	if err := s.writeLogFormat(); err != nil {
+		return fmt.Errorf("failed to write log format: %v", err)
+	}
+
 	t, err := template.New("nginx").Parse(tmpl)
 	if err != nil {
 		return err
@@ -172,13 +201,104 @@ func (s Service) writeNginxConfig(path string, config SiteConfig) error {
 	return t.Execute(file, config)
 }
 
+// ListSites returns the sites in the sites directory, as written by
+// CreateSite.
+func (s Service) ListSites() ([]SiteConfig, error) {
+	entries, err := os.ReadDir(s.sitesPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sites directory: %v", err)
+	}
+
+	var sites []SiteConfig
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		config, err := s.readNginxConfig(filepath.Join(s.sitesPath, entry.Name()))
+		if err != nil {
+			continue
+		}
+		if config.Domain == "" {
+			config.Domain = entry.Name()
+		}
+		sites = append(sites, config)
+	}
+	return sites, nil
+}
+
+// SiteFiles returns the config file of a site and its sites-enabled link.
+func (s Service) SiteFiles(domain string) []string {
+	return []string{
+		filepath.Join(s.sitesPath, domain),
+		filepath.Join(s.configPath, "sites-enabled", domain),
+	}
+}
+
+// Reload reloads nginx, e.g. after its configuration was restored.
+func (s Service) Reload() error {
+	return s.reloadNginx()
+}
+
+// readNginxConfig reads back the settings writeNginxConfig put in a site's
+// config. Directives it does not write are ignored.
 func (s Service) readNginxConfig(path string) (SiteConfig, error) {
-	// This is a simplified implementation
-	// In a real implementation, you would parse the nginx config file
-	return SiteConfig{}, fmt.Errorf("not implemented")
+	file, err := os.Open(path)
+	if err != nil {
+		return SiteConfig{}, err
+	}
+	defer file.Close()
+
+	var config SiteConfig
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(strings.TrimSuffix(strings.TrimSpace(scanner.Text()), ";"))
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "server_name":
+			config.Domain = fields[1]
+		case "root":
+			config.DocumentRoot = fields[1]
+		case "ssl_certificate":
+			config.SSLEnabled = true
+			config.SSLCert = fields[1]
+		case "ssl_certificate_key":
+			config.SSLKey = fields[1]
+		case "access_log":
+			if fields[1] != "off" {
+				config.AccessLog = fields[1]
+			}
+		case "fastcgi_pass":
+			socket := filepath.Base(fields[1])
+			if strings.HasPrefix(socket, "php") && strings.HasSuffix(socket, "-fpm.sock") {
+				config.PHPVersion = strings.TrimSuffix(strings.TrimPrefix(socket, "php"), "-fpm.sock")
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return SiteConfig{}, err
+	}
+	return config, nil
+}
+
+// ObserveReloads calls fn with the outcome of every reload, e.g. to count
+// failures.
+func (s Service) ObserveReloads(fn func(err error)) {
+	s.observer.mu.Lock()
+	defer s.observer.mu.Unlock()
+	s.observer.fn = fn
 }
 
 func (s Service) reloadNginx() error {
 	cmd := exec.Command("sh", "-c", s.reloadCommand)
-	return cmd.Run()
+	err := cmd.Run()
+
+	s.observer.mu.RLock()
+	fn := s.observer.fn
+	s.observer.mu.RUnlock()
+	if fn != nil {
+		fn(err)
+	}
+	return err
 }
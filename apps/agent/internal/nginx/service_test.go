@@ -0,0 +1,90 @@
+package nginx
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadNginxConfig(t *testing.T) {
+	dir := t.TempDir()
+	s := NewService(Config{ConfigPath: dir, SitesPath: dir, LogPath: "/var/log/nginx"})
+
+	// Round trips through writeNginxConfig
+	written := []SiteConfig{
+		{Domain: "example.com", DocumentRoot: "/var/www/example.com"},
+		{Domain: "php.example.com", DocumentRoot: "/var/www/php", PHPVersion: "8.2"},
+		{
+			Domain:       "secure.example.com",
+			DocumentRoot: "/var/www/secure",
+			SSLEnabled:   true,
+			SSLCert:      "/etc/ssl/secure.pem",
+			SSLKey:       "/etc/ssl/secure.key",
+			AccessLog:    "/srv/logs/secure.json",
+		},
+	}
+	for _, config := range written {
+		path := filepath.Join(dir, config.Domain)
+		if err := s.writeNginxConfig(path, config); err != nil {
+			t.Fatal(err)
+		}
+		got, err := s.readNginxConfig(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := config
+		if want.AccessLog == "" {
+			want.AccessLog = "/var/log/nginx/" + config.Domain + ".access.json"
+		}
+		if got != want {
+			t.Errorf("read back %+v, want %+v", got, want)
+		}
+	}
+
+	// Configs written by hand or by older agents
+	tests := []struct {
+		name   string
+		config string
+		want   SiteConfig
+	}{
+		{
+			name:   "no access log",
+			config: "server {\n    listen 80;\n    server_name old.example.com;\n    root /var/www/old;\n}\n",
+			want:   SiteConfig{Domain: "old.example.com", DocumentRoot: "/var/www/old"},
+		},
+		{
+			name:   "access log off",
+			config: "server {\n    server_name quiet.example.com;\n    access_log off;\n}\n",
+			want:   SiteConfig{Domain: "quiet.example.com"},
+		},
+		{
+			name:   "fastcgi over tcp",
+			config: "server {\n    server_name tcp.example.com;\n    location ~ \\.php$ {\n        fastcgi_pass 127.0.0.1:9000;\n    }\n}\n",
+			want:   SiteConfig{Domain: "tcp.example.com"},
+		},
+		{
+			name:   "comments and unknown directives",
+			config: "server {\n    # root /var/www/commented;\n    server_name a.example.com www.a.example.com;\n    gzip on;\n    root /var/www/a;\n}\n",
+			want:   SiteConfig{Domain: "a.example.com", DocumentRoot: "/var/www/a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "site")
+			if err := os.WriteFile(path, []byte(tt.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := s.readNginxConfig(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := s.readNginxConfig(filepath.Join(dir, "missing")); err == nil {
+		t.Error("missing config was read")
+	}
+}
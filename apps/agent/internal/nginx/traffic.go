@@ -0,0 +1,542 @@
+package nginx
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessLogFormat is the log_format site access logs are written in, one
+// JSON object per request.
+const accessLogFormat = "agent_json"
+
+const logFormatConfig = `# Written by the hosting panel agent for per-site traffic accounting
+log_format ` + accessLogFormat + ` escape=json '{"time":"$time_iso8601","status":$status,"bytes_sent":$bytes_sent,"request_length":$request_length,"method":"$request_method","uri":"$uri"}';
+`
+
+// maxTrackedPaths bounds the paths counted per site. Beyond twice as many,
+// the least requested are dropped, so that a client probing random URLs
+// cannot grow the state without bound; top paths are approximate after that.
+const maxTrackedPaths = 1000
+
+// SiteTraffic is the traffic a site has served since Since, as read from its
+// access log.
+type SiteTraffic struct {
+	Domain        string
+	Requests      int64
+	BytesSent     int64
+	BytesReceived int64
+	// StatusClasses counts responses by class, e.g. "2xx"
+	StatusClasses map[string]int64
+	TopPaths      []PathTraffic
+	Since         time.Time
+	LastRequest   time.Time
+}
+
+type PathTraffic struct {
+	Path      string
+	Requests  int64
+	BytesSent int64
+}
+
+type accessLogEntry struct {
+	Time          string `json:"time"`
+	Status        int    `json:"status"`
+	BytesSent     int64  `json:"bytes_sent"`
+	RequestLength int64  `json:"request_length"`
+	Method        string `json:"method"`
+	URI           string `json:"uri"`
+}
+
+type siteCounters struct {
+	Requests      int64                   `json:"requests"`
+	BytesSent     int64                   `json:"bytes_sent"`
+	BytesReceived int64                   `json:"bytes_received"`
+	StatusClasses map[string]int64        `json:"status_classes"`
+	Paths         map[string]*pathCounter `json:"paths"`
+	Since         time.Time               `json:"since"`
+	LastRequest   time.Time               `json:"last_request"`
+}
+
+type pathCounter struct {
+	Requests  int64 `json:"requests"`
+	BytesSent int64 `json:"bytes_sent"`
+}
+
+// logPosition is how far a log file has been read. The device and inode
+// identify the file across renames, so that the rest of a rotated log is
+// read before its successor.
+type logPosition struct {
+	Device uint64 `json:"device"`
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+	// Head is the checksum of the first HeadSize bytes, which tells a log
+	// truncated in place and refilled past Offset from one that grew.
+	HeadSize int64  `json:"head_size,omitempty"`
+	Head     uint32 `json:"head,omitempty"`
+}
+
+// logHeadSize is how much of a log's beginning logPosition checksums.
+const logHeadSize = 512
+
+// readHead checksums the first n bytes of file.
+func readHead(file *os.File, n int64) (uint32, error) {
+	head := make([]byte, n)
+	if _, err := file.ReadAt(head, 0); err != nil {
+		return 0, err
+	}
+	return crc32.ChecksumIEEE(head), nil
+}
+
+// trafficStore keeps site totals and log offsets in memory and persists them
+// together as JSON, so that no request is counted twice or lost across agent
+// restarts.
+type trafficStore struct {
+	path   string
+	mu     sync.Mutex
+	loaded bool
+	sites  map[string]*siteCounters
+	logs   map[string]*logPosition
+}
+
+type trafficState struct {
+	Sites map[string]*siteCounters `json:"sites"`
+	Logs  map[string]*logPosition  `json:"logs"`
+}
+
+func newTrafficStore(path string) *trafficStore {
+	return &trafficStore{
+		path:  path,
+		sites: make(map[string]*siteCounters),
+		logs:  make(map[string]*logPosition),
+	}
+}
+
+// load reads the state file on first use. Callers must hold mu.
+func (t *trafficStore) load() error {
+	if t.loaded {
+		return nil
+	}
+
+	data, err := os.ReadFile(t.path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read traffic state: %v", err)
+	}
+	if err == nil {
+		var state trafficState
+		if err := json.Unmarshal(data, &state); err != nil {
+			return fmt.Errorf("failed to parse traffic state: %v", err)
+		}
+		for domain, site := range state.Sites {
+			t.sites[domain] = site
+		}
+		for path, pos := range state.Logs {
+			t.logs[path] = pos
+		}
+	}
+
+	t.loaded = true
+	return nil
+}
+
+// save writes state to the state file atomically. Callers must hold mu.
+func (t *trafficStore) save(state *trafficState) error {
+	if err := os.MkdirAll(filepath.Dir(t.path), 0755); err != nil {
+		return fmt.Errorf("failed to create traffic state directory: %v", err)
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := t.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write traffic state: %v", err)
+	}
+	return os.Rename(tmpPath, t.path)
+}
+
+// collect reads the access logs, by domain, from where the last call
+// stopped. It counts into a copy of the state that replaces the current one
+// only once saved, so that lines counted but not saved are counted again
+// rather than twice. The warnings name logs whose last lines could not be
+// counted.
+func (t *trafficStore) collect(logs map[string]string) ([]string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+
+	state := t.copyState()
+	changed := false
+	var warnings, failed []string
+	for domain, path := range logs {
+		read, warning, err := state.readLog(domain, path)
+		if read {
+			changed = true
+		}
+		if warning != "" {
+			warnings = append(warnings, fmt.Sprintf("%s: %s", domain, warning))
+		}
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", domain, err))
+		}
+	}
+	sort.Strings(warnings)
+
+	if changed {
+		if err := t.save(state); err != nil {
+			return nil, err
+		}
+		t.sites, t.logs = state.Sites, state.Logs
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return warnings, fmt.Errorf("failed to read access logs: %s", strings.Join(failed, "; "))
+	}
+	return warnings, nil
+}
+
+// copyState returns a deep copy of the totals and log positions. Callers
+// must hold mu.
+func (t *trafficStore) copyState() *trafficState {
+	state := &trafficState{
+		Sites: make(map[string]*siteCounters, len(t.sites)),
+		Logs:  make(map[string]*logPosition, len(t.logs)),
+	}
+	for domain, site := range t.sites {
+		copied := *site
+		copied.StatusClasses = make(map[string]int64, len(site.StatusClasses))
+		for class, count := range site.StatusClasses {
+			copied.StatusClasses[class] = count
+		}
+		copied.Paths = make(map[string]*pathCounter, len(site.Paths))
+		for path, counter := range site.Paths {
+			c := *counter
+			copied.Paths[path] = &c
+		}
+		state.Sites[domain] = &copied
+	}
+	for path, pos := range t.logs {
+		p := *pos
+		state.Logs[path] = &p
+	}
+	return state
+}
+
+// readLog counts the requests logged since the last read and reports
+// whether the state changed. A log rotated or truncated since then is
+// finished first from <path>.1, where logrotate leaves the old log or its
+// copy with delaycompress. Without it, the warning says that requests the
+// old log received after the last read may not have been counted.
+func (s *trafficState) readLog(domain, path string) (bool, string, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		// Nothing logged yet
+		return false, "", nil
+	}
+	if err != nil {
+		return false, "", err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return false, "", err
+	}
+	device, inode := fileID(info)
+
+	changed := false
+	warning := ""
+	pos, ok := s.Logs[path]
+	if !ok {
+		pos = &logPosition{Device: device, Inode: inode}
+		s.Logs[path] = pos
+		changed = true
+	}
+
+	moved := pos.Device != device || pos.Inode != inode
+	// Truncated in place, e.g. by copytruncate
+	truncated := !moved && (info.Size() < pos.Offset || !sameHead(file, pos))
+	if moved || truncated {
+		finished, err := s.finishRotated(domain, path+".1", pos, truncated)
+		if err != nil {
+			return true, "", err
+		}
+		if !finished {
+			warning = fmt.Sprintf("%s was rotated but %s.1 is missing or compressed; requests logged after offset %d may not have been counted", path, path, pos.Offset)
+		}
+		*pos = logPosition{Device: device, Inode: inode}
+		changed = true
+	}
+
+	read, err := s.read(domain, file, pos)
+	return changed || read, warning, err
+}
+
+// finishRotated reads the rest of the log pos points into from path, and
+// reports whether path still was that log. A copy is recognized by its
+// beginning rather than its inode.
+func (s *trafficState) finishRotated(domain, path string, pos *logPosition, copied bool) (bool, error) {
+	rotated, err := os.Open(path)
+	if err != nil {
+		return false, nil
+	}
+	defer rotated.Close()
+
+	info, err := rotated.Stat()
+	if err != nil {
+		return false, nil
+	}
+	if copied {
+		if pos.HeadSize == 0 || info.Size() < pos.Offset || !sameHead(rotated, pos) {
+			return false, nil
+		}
+	} else if device, inode := fileID(info); device != pos.Device || inode != pos.Inode {
+		return false, nil
+	}
+	_, err = s.read(domain, rotated, pos)
+	return true, err
+}
+
+// sameHead reports whether file still starts the way it did when pos was
+// last advanced.
+func sameHead(file *os.File, pos *logPosition) bool {
+	if pos.HeadSize == 0 {
+		return true
+	}
+	head, err := readHead(file, pos.HeadSize)
+	return err == nil && head == pos.Head
+}
+
+// read counts the complete lines of file after pos and advances pos past
+// them.
+func (s *trafficState) read(domain string, file *os.File, pos *logPosition) (bool, error) {
+	if _, err := file.Seek(pos.Offset, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	reader := bufio.NewReaderSize(file, 64*1024)
+	read := false
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// A partial line is counted once nginx finishes it
+			break
+		}
+		if err != nil {
+			return read, err
+		}
+		pos.Offset += int64(len(line))
+		read = true
+		s.count(domain, line)
+	}
+
+	if pos.HeadSize < logHeadSize && pos.Offset > pos.HeadSize {
+		size := pos.Offset
+		if size > logHeadSize {
+			size = logHeadSize
+		}
+		head, err := readHead(file, size)
+		if err != nil {
+			return read, err
+		}
+		pos.Head, pos.HeadSize = head, size
+	}
+	return read, nil
+}
+
+func (s *trafficState) count(domain string, line []byte) {
+	var entry accessLogEntry
+	if err := json.Unmarshal(line, &entry); err != nil {
+		// Not in accessLogFormat, e.g. logged before the site was rewritten
+		return
+	}
+	at, err := time.Parse(time.RFC3339, entry.Time)
+
+	site, ok := s.Sites[domain]
+	if !ok {
+		// Counting starts with the first request read, which may be well
+		// before the agent first read the log
+		since := at
+		if err != nil {
+			since = time.Now()
+		}
+		site = &siteCounters{
+			StatusClasses: make(map[string]int64),
+			Paths:         make(map[string]*pathCounter),
+			Since:         since,
+		}
+		s.Sites[domain] = site
+	}
+
+	site.Requests++
+	site.BytesSent += entry.BytesSent
+	site.BytesReceived += entry.RequestLength
+	if entry.Status >= 100 && entry.Status < 600 {
+		site.StatusClasses[strconv.Itoa(entry.Status/100)+"xx"]++
+	}
+	if err == nil && at.After(site.LastRequest) {
+		site.LastRequest = at
+	}
+
+	path, ok := site.Paths[entry.URI]
+	if !ok {
+		path = &pathCounter{}
+		site.Paths[entry.URI] = path
+	}
+	path.Requests++
+	path.BytesSent += entry.BytesSent
+	if len(site.Paths) > 2*maxTrackedPaths {
+		site.Paths = topPathCounters(site.Paths, maxTrackedPaths)
+	}
+}
+
+func topPathCounters(paths map[string]*pathCounter, n int) map[string]*pathCounter {
+	top := make(map[string]*pathCounter, n)
+	for _, path := range sortedPaths(paths, n) {
+		top[path.Path] = paths[path.Path]
+	}
+	return top
+}
+
+// sortedPaths returns the n most requested paths, all when n is negative.
+func sortedPaths(paths map[string]*pathCounter, n int) []PathTraffic {
+	sorted := make([]PathTraffic, 0, len(paths))
+	for path, counter := range paths {
+		sorted = append(sorted, PathTraffic{Path: path, Requests: counter.Requests, BytesSent: counter.BytesSent})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Requests != sorted[j].Requests {
+			return sorted[i].Requests > sorted[j].Requests
+		}
+		return sorted[i].Path < sorted[j].Path
+	})
+	if n >= 0 && len(sorted) > n {
+		sorted = sorted[:n]
+	}
+	return sorted
+}
+
+// totals returns copies of the totals of the domains, sorted by domain.
+// Domains without traffic have zero totals.
+func (t *trafficStore) totals(domains []string, topPaths int) []SiteTraffic {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	sort.Strings(domains)
+	var result []SiteTraffic
+	for _, domain := range domains {
+		traffic := SiteTraffic{Domain: domain, StatusClasses: make(map[string]int64)}
+		if site, ok := t.sites[domain]; ok {
+			traffic.Requests = site.Requests
+			traffic.BytesSent = site.BytesSent
+			traffic.BytesReceived = site.BytesReceived
+			for class, count := range site.StatusClasses {
+				traffic.StatusClasses[class] = count
+			}
+			traffic.TopPaths = sortedPaths(site.Paths, topPaths)
+			traffic.Since = site.Since
+			traffic.LastRequest = site.LastRequest
+		}
+		result = append(result, traffic)
+	}
+	return result
+}
+
+// domains returns the domains with recorded traffic.
+func (t *trafficStore) domains() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var domains []string
+	for domain := range t.sites {
+		domains = append(domains, domain)
+	}
+	return domains
+}
+
+// writeLogFormat defines accessLogFormat in conf.d, which nginx includes in
+// its http block.
+func (s Service) writeLogFormat() error {
+	path := filepath.Join(s.configPath, "conf.d", "agent-log-format.conf")
+	if current, err := os.ReadFile(path); err == nil && string(current) == logFormatConfig {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(logFormatConfig), 0644)
+}
+
+// CollectTraffic reads what the sites have logged since the last call into
+// their traffic totals. Requests that could not be counted are reported as
+// an error, after the rest was.
+func (s Service) CollectTraffic() error {
+	_, warnings, err := s.collectTraffic()
+	if err == nil && len(warnings) > 0 {
+		err = fmt.Errorf("some requests were not counted: %s", strings.Join(warnings, "; "))
+	}
+	return err
+}
+
+func (s Service) collectTraffic() ([]SiteConfig, []string, error) {
+	sites, err := s.ListSites()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	logs := make(map[string]string)
+	for _, site := range sites {
+		if site.AccessLog != "" {
+			logs[site.Domain] = site.AccessLog
+		}
+	}
+	warnings, err := s.traffic.collect(logs)
+	return sites, warnings, err
+}
+
+// SiteTraffic returns the traffic totals of a site, or of every site when
+// domain is empty, with up to topPaths of its most requested paths. Totals
+// accumulate from the first request counted, across log rotation and agent
+// restarts; those of deleted sites are kept. The warnings name logs whose
+// last requests could not be counted.
+func (s Service) SiteTraffic(domain string, topPaths int) ([]SiteTraffic, []string, error) {
+	sites, warnings, err := s.collectTraffic()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	known := make(map[string]bool)
+	for _, site := range sites {
+		known[site.Domain] = true
+	}
+	for _, d := range s.traffic.domains() {
+		known[d] = true
+	}
+
+	var domains []string
+	if domain != "" {
+		if !known[domain] {
+			return nil, nil, fmt.Errorf("site %s not found", domain)
+		}
+		domains = []string{domain}
+	} else {
+		for d := range known {
+			domains = append(domains, d)
+		}
+	}
+	return s.traffic.totals(domains, topPaths), warnings, nil
+}
@@ -0,0 +1,230 @@
+package nginx
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testLog writes access log lines for a site. Every request sends as many
+// bytes as its number, so totals show requests counted twice or lost.
+type testLog struct {
+	t    *testing.T
+	path string
+	next int64
+}
+
+func newTestLog(t *testing.T) *testLog {
+	return &testLog{t: t, path: filepath.Join(t.TempDir(), "example.com.access.json"), next: 1}
+}
+
+func (l *testLog) line() string {
+	line := fmt.Sprintf(`{"time":"2026-03-04T12:00:%02d+00:00","status":200,"bytes_sent":%d,"request_length":10,"method":"GET","uri":"/page/%d"}`+"\n", l.next%60, l.next, l.next)
+	l.next++
+	return line
+}
+
+func (l *testLog) write(s string) {
+	l.t.Helper()
+	file, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		l.t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(s); err != nil {
+		l.t.Fatal(err)
+	}
+}
+
+func (l *testLog) add(n int) {
+	l.t.Helper()
+	for i := 0; i < n; i++ {
+		l.write(l.line())
+	}
+}
+
+func (l *testLog) rename(to string) {
+	l.t.Helper()
+	if err := os.Rename(l.path, to); err != nil {
+		l.t.Fatal(err)
+	}
+}
+
+// checkTraffic collects the log and checks that requests 1 to n were each
+// counted once.
+func checkTraffic(t *testing.T, store *trafficStore, log *testLog, n int64, wantWarning bool) {
+	t.Helper()
+	warnings, err := store.collect(map[string]string{"example.com": log.path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wantWarning != (len(warnings) > 0) {
+		t.Errorf("warnings: %q", warnings)
+	}
+
+	traffic := store.totals([]string{"example.com"}, -1)[0]
+	if traffic.Requests != n || traffic.BytesSent != n*(n+1)/2 {
+		t.Errorf("counted %d requests with %d bytes, want %d with %d", traffic.Requests, traffic.BytesSent, n, n*(n+1)/2)
+	}
+}
+
+func TestTrafficRotation(t *testing.T) {
+	log := newTestLog(t)
+	store := newTrafficStore(filepath.Join(t.TempDir(), "traffic.json"))
+
+	log.add(3)
+	checkTraffic(t, store, log, 3, false)
+
+	// Lines written before the rotation are read from <path>.1
+	log.add(2)
+	log.rename(log.path + ".1")
+	log.add(1)
+	checkTraffic(t, store, log, 6, false)
+
+	// A second rotation shifts the first log to .2 before compressing it
+	log.add(2)
+	if err := os.Rename(log.path+".1", log.path+".2"); err != nil {
+		t.Fatal(err)
+	}
+	log.rename(log.path + ".1")
+	log.add(2)
+	checkTraffic(t, store, log, 10, false)
+	checkTraffic(t, store, log, 10, false)
+}
+
+func TestTrafficRotatedLogGone(t *testing.T) {
+	tests := []struct {
+		name   string
+		rotate func(log *testLog)
+	}{
+		{
+			name:   "compressed",
+			rotate: func(log *testLog) { log.rename(log.path + ".1.gz") },
+		},
+		{
+			name: "deleted",
+			rotate: func(log *testLog) {
+				if err := os.Remove(log.path); err != nil {
+					log.t.Fatal(err)
+				}
+			},
+		},
+		{
+			// .1 holds a later log than the one that was being read
+			name: "rotated twice",
+			rotate: func(log *testLog) {
+				log.rename(log.path + ".1")
+				log.add(1)
+				log.rename(log.path + ".1")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log := newTestLog(t)
+			store := newTrafficStore(filepath.Join(t.TempDir(), "traffic.json"))
+
+			log.add(3)
+			checkTraffic(t, store, log, 3, false)
+
+			// Requests logged before the rotation are lost with the old log
+			log.add(2)
+			tt.rotate(log)
+			log.add(2)
+
+			warnings, err := store.collect(map[string]string{"example.com": log.path})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(warnings) != 1 || !strings.Contains(warnings[0], log.path+".1") {
+				t.Errorf("warnings: %q", warnings)
+			}
+			traffic := store.totals([]string{"example.com"}, -1)[0]
+			if traffic.Requests != 5 {
+				t.Errorf("counted %d requests, want 5", traffic.Requests)
+			}
+		})
+	}
+}
+
+func TestTrafficCopyTruncate(t *testing.T) {
+	log := newTestLog(t)
+	store := newTrafficStore(filepath.Join(t.TempDir(), "traffic.json"))
+	copyTruncate := func() {
+		data, err := os.ReadFile(log.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(log.path+".1", data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Truncate(log.path, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	log.add(3)
+	checkTraffic(t, store, log, 3, false)
+
+	// The unread lines are read from the copy
+	log.add(2)
+	copyTruncate()
+	log.add(1)
+	checkTraffic(t, store, log, 6, false)
+
+	// Refilled past what was read before
+	log.add(1)
+	copyTruncate()
+	log.add(5)
+	checkTraffic(t, store, log, 12, false)
+
+	// Without the copy nothing tells whether lines were missed
+	if err := os.Remove(log.path + ".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(log.path, 0); err != nil {
+		t.Fatal(err)
+	}
+	log.add(1)
+	checkTraffic(t, store, log, 13, true)
+}
+
+func TestTrafficPartialLine(t *testing.T) {
+	log := newTestLog(t)
+	store := newTrafficStore(filepath.Join(t.TempDir(), "traffic.json"))
+
+	log.add(1)
+	line := log.line()
+	log.write(line[:20])
+	checkTraffic(t, store, log, 1, false)
+
+	log.write(line[20:])
+	checkTraffic(t, store, log, 2, false)
+}
+
+func TestTrafficRestart(t *testing.T) {
+	log := newTestLog(t)
+	statePath := filepath.Join(t.TempDir(), "traffic.json")
+
+	store := newTrafficStore(statePath)
+	log.add(3)
+	checkTraffic(t, store, log, 3, false)
+	since := store.totals([]string{"example.com"}, -1)[0].Since
+
+	// A new agent continues where the last one stopped
+	store = newTrafficStore(statePath)
+	log.add(2)
+	checkTraffic(t, store, log, 5, false)
+	if got := store.totals([]string{"example.com"}, -1)[0].Since; !got.Equal(since) {
+		t.Errorf("since %v after restart, was %v", got, since)
+	}
+
+	// Including across a rotation while it was stopped
+	store = newTrafficStore(statePath)
+	log.add(1)
+	log.rename(log.path + ".1")
+	log.add(1)
+	checkTraffic(t, store, log, 7, false)
+}
@@ -72,6 +72,33 @@ func (s Service) DisableSSL(domain string) error {
 func (s Service) GetCertificateInfo(domain string) (*CertificateInfo, error) {
 	certFile := filepath.Join(s.certPath, fmt.Sprintf("%s.crt", domain))
 	
+	cert, err := readCertificate(certFile)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	info := &CertificateInfo{
+		Domain:    domain,
+		ExpiresAt: cert.NotAfter,
+		IsValid:   cert.NotAfter.After(now),
+		IsExpired: cert.NotAfter.Before(now),
+	}
+
+	return info, nil
+}
+
+// CertificateExpiry returns when the certificate in certFile expires. For a
+// chain, that is the expiry of its first certificate.
+func (s Service) CertificateExpiry(certFile string) (time.Time, error) {
+	cert, err := readCertificate(certFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return cert.NotAfter, nil
+}
+
+func readCertificate(certFile string) (*x509.Certificate, error) {
 	data, err := os.ReadFile(certFile)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read certificate: %v", err)
@@ -86,16 +113,7 @@ func (s Service) GetCertificateInfo(domain string) (*CertificateInfo, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse certificate: %v", err)
 	}
-
-	now := time.Now()
-	info := &CertificateInfo{
-		Domain:    domain,
-		ExpiresAt: cert.NotAfter,
-		IsValid:   cert.NotAfter.After(now),
-		IsExpired: cert.NotAfter.Before(now),
-	}
-
-	return info, nil
+	return cert, nil
 }
 
 func (s Service) RequestLetsEncryptCertificate(domain string) error {
@@ -110,6 +128,13 @@ func (s Service) RenewCertificate(domain string) error {
 	return fmt.Errorf("certificate renewal not implemented")
 }
 
+// CertificateFiles returns where the certificate and key of a domain are
+// stored.
+func (s Service) CertificateFiles(domain string) (string, string) {
+	return filepath.Join(s.certPath, fmt.Sprintf("%s.crt", domain)),
+		filepath.Join(s.keyPath, fmt.Sprintf("%s.key", domain))
+}
+
 func (s Service) ValidateCertificate(cert, key string) error {
 	// Validate that the certificate and key match
 	_, err := tls.X509KeyPair([]byte(cert), []byte(key))
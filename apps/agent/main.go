@@ -12,7 +12,7 @@ import (
 	"time"
 
 	"hosting-panel-agent/internal/config"
-	"hosting-panel-agent/internal/grpc"
+	agentgrpc "hosting-panel-agent/internal/grpc"
 	"hosting-panel-agent/internal/http"
 	"hosting-panel-agent/internal/nginx"
 	"hosting-panel-agent/internal/ssl"
@@ -40,22 +40,24 @@ func main() {
 	sslService := ssl.NewService(cfg.SSL)
 	dbService := database.NewService(cfg.Database)
 	backupService := backup.NewService(cfg.Backup)
-	metricsService := metrics.NewService()
+	metricsService := metrics.NewService(metrics.Config{InterfaceExclude: cfg.Metrics.InterfaceExclude})
 
-	// Create gRPC server
-	var grpcServer *grpc.Server
+	// Create gRPC server, counting calls for /metrics
+	serverOptions := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(agentgrpc.UnaryMetricsInterceptor(metricsService)),
+		grpc.ChainStreamInterceptor(agentgrpc.StreamMetricsInterceptor(metricsService)),
+	}
 	if cfg.GRPC.TLS.Enabled {
 		creds, err := credentials.NewServerTLSFromFile(cfg.GRPC.TLS.CertFile, cfg.GRPC.TLS.KeyFile)
 		if err != nil {
 			log.Fatalf("Failed to load TLS credentials: %v", err)
 		}
-		grpcServer = grpc.NewServer(grpc.Creds(creds))
-	} else {
-		grpcServer = grpc.NewServer()
+		serverOptions = append(serverOptions, grpc.Creds(creds))
 	}
+	grpcServer := grpc.NewServer(serverOptions...)
 
 	// Register gRPC services
-	agentServer := grpc.NewAgentServer(nginxService, sslService, dbService, backupService, metricsService)
+	agentServer := agentgrpc.NewAgentServer(nginxService, sslService, dbService, backupService, metricsService)
 	agentServer.Register(grpcServer)
 	reflection.Register(grpcServer)
 
@@ -81,9 +83,21 @@ func main() {
 		}
 	}()
 
-	// Start metrics collection
+	// Report the filesystems holding configured paths
+	metricsService.AddPath("backup_storage", cfg.Backup.StoragePath)
+	metricsService.AddPath("nginx_sites", cfg.Nginx.SitesPath)
+	metricsService.AddPath("ssl_certificates", cfg.SSL.CertPath)
+	metricsService.AddPath("sqlite_databases", cfg.Database.SQLite.Path)
+
+	// Start metrics collection, enforcing database quotas and counting site
+	// traffic on each pass
+	metricsService.AddTask("database quota enforcement", dbService.EnforceQuotas)
+	metricsService.AddTask("site traffic", nginxService.CollectTraffic)
 	go metricsService.Start()
 
+	// Run agent-side backup schedules
+	go backupService.RunScheduler()
+
 	// Wait for interrupt signal
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)